@@ -0,0 +1,105 @@
+package auditchain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// HashField is the document field holding an event's hash
+const HashField = "hash"
+
+// VersionField is the document field holding the version of the hash an event was sealed with.
+// Events sealed before it was introduced have none and are hashed as version 1.
+const VersionField = "hash_version"
+
+// SaltField is the document field holding the random salt an event's redactable values are digested with
+const SaltField = "salt"
+
+// Version is the hash version events are sealed with. Version 2 hashes the values of redactable
+// fields one by one, so that they can be redacted without changing the hash. Version 3 digests them
+// together with a random salt held by the event, so that a redacted value cannot be found by hashing
+// guesses offline, and makes the IP address and user agent redactable too.
+const Version = 3
+
+// Hash returns the hash of a stored event document. It covers every field except the hash itself,
+// including the previous event's hash, so editing any stored event or removing one from the middle
+// of a chain changes every hash after it. Version 1 covers the raw bytes of each field; later
+// versions cover the values of redactable fields by their digests, see Redact.
+func Hash(doc bson.Raw) (string, error) {
+	elements, err := doc.Elements()
+	if err != nil {
+		return "", err
+	}
+	v, salt := version(doc), saltOf(doc)
+
+	h := sha256.New()
+	for _, element := range elements {
+		if element.Key() == HashField {
+			continue
+		}
+		if redactable(v, element.Key()) {
+			h.Write(element[:len(element.Key())+2]) // type and key
+			h.Write(digest(element.Value(), salt))
+			continue
+		}
+		h.Write(element)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// NewSalt returns a random salt for the digests of an event
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// version returns the hash version of a stored event document
+func version(doc bson.Raw) int32 {
+	value, err := doc.LookupErr(VersionField)
+	if err != nil {
+		return 1
+	}
+	v, ok := value.Int32OK()
+	if !ok {
+		return 1
+	}
+	return v
+}
+
+// saltOf returns the salt of a stored event document, or nil if it has none
+func saltOf(doc bson.Raw) []byte {
+	value, err := doc.LookupErr(SaltField)
+	if err != nil {
+		return nil
+	}
+	_, salt, ok := value.BinaryOK()
+	if !ok {
+		return nil
+	}
+	return salt
+}
+
+// Seal appends the hash field to an encoded event, returning the document to store and its hash
+func Seal(doc bson.Raw) (bson.Raw, string, error) {
+	hash, err := Hash(doc)
+	if err != nil {
+		return nil, "", err
+	}
+
+	index, sealed := bsoncore.AppendDocumentStart(nil)
+	sealed = append(sealed, doc[4:len(doc)-1]...)
+	sealed = bsoncore.AppendStringElement(sealed, HashField, hash)
+	sealed, err = bsoncore.AppendDocumentEnd(sealed, index)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return bson.Raw(sealed), hash, nil
+}
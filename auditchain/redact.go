@@ -0,0 +1,176 @@
+package auditchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// ErrNotRedactable is returned for events holding values to redact that stay readable or can be
+// recovered after redaction, because the event was sealed with a hash that does not allow it
+var ErrNotRedactable = errors.New("audit event holds values that cannot be redacted irreversibly")
+
+// RedactedPrefix starts the value left in place of a redacted value, followed by the value's digest
+const RedactedPrefix = "redacted:sha256:"
+
+// redactable reports whether the values of an event field can be redacted without breaking the chain
+// of an event sealed with the hash version
+func redactable(v int32, key string) bool {
+	switch key {
+	case "changes", "details":
+		return v >= 2
+	case "ip", "user_agent":
+		return v >= 3
+	}
+	return false
+}
+
+// Redact replaces every value beneath the named keys of the fields of an event with its salted digest,
+// e.g. {"changes": {"email"}} redacts both the old and the new email of a change; a field listed
+// without keys, e.g. {"ip": nil}, is redacted as a whole. The event's hash stays the same, so the
+// chain still verifies. It returns the document and whether it changed.
+//
+// Values that cannot be redacted irreversibly make it return ErrNotRedactable along with the document
+// redacted as far as possible: those of events sealed before redaction was supported are left in
+// place, and those of events sealed without a salt are replaced by digests that could be reversed
+// by hashing guesses. Events without a hash have no chain to keep, so their values are digested with
+// a salt that is thrown away.
+func Redact(doc bson.Raw, keys map[string][]string) (bson.Raw, bool, error) {
+	v, salt := version(doc), saltOf(doc)
+	if _, err := doc.LookupErr(HashField); err != nil {
+		v = Version
+		if salt, err = NewSalt(); err != nil {
+			return nil, false, err
+		}
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return nil, false, err
+	}
+
+	r := redaction{version: v, salt: salt}
+	index, redacted := bsoncore.AppendDocumentStart(nil)
+	for _, element := range elements {
+		names, listed := keys[element.Key()]
+		value := element.Value()
+		if !listed {
+			redacted = append(redacted, element...)
+			continue
+		}
+		if len(names) == 0 || value.Type != bsontype.EmbeddedDocument {
+			redacted = r.element(redacted, element.Key(), element)
+			continue
+		}
+
+		fields, err := value.Document().Elements()
+		if err != nil {
+			return nil, false, err
+		}
+		fieldIndex, field := bsoncore.AppendDocumentElementStart(redacted, element.Key())
+		for _, child := range fields {
+			if !contains(names, child.Key()) {
+				field = append(field, child...)
+				continue
+			}
+			field = r.element(field, element.Key(), child)
+		}
+		redacted, err = bsoncore.AppendDocumentEnd(field, fieldIndex)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	redacted, err = bsoncore.AppendDocumentEnd(redacted, index)
+	if err != nil {
+		return nil, false, err
+	}
+	if r.kept {
+		return bson.Raw(redacted), r.changed, ErrNotRedactable
+	}
+	return bson.Raw(redacted), r.changed, nil
+}
+
+// redaction tracks the redaction of one event
+type redaction struct {
+	version int32
+	salt    []byte
+	changed bool // a value was replaced
+	kept    bool // a value stays readable or can be recovered
+}
+
+// element appends an element beneath the event field, redacted if the field allows it
+func (r *redaction) element(dst []byte, field string, element bson.RawElement) []byte {
+	value := element.Value()
+	if value.Type == bsontype.Null {
+		return append(dst, element...)
+	}
+	if !redactable(r.version, field) {
+		r.kept = true
+		return append(dst, element...)
+	}
+
+	before := len(dst)
+	dst = redactValue(dst, element.Key(), value, r.salt)
+	r.changed = r.changed || string(dst[before:]) != string(element)
+	r.kept = r.kept || len(r.salt) == 0
+	return dst
+}
+
+// redactValue appends the value under key with every value in it but nulls replaced by its digest
+func redactValue(dst []byte, key string, value bson.RawValue, salt []byte) []byte {
+	if value.Type == bsontype.Null {
+		return bsoncore.AppendNullElement(dst, key)
+	}
+	if value.Type != bsontype.EmbeddedDocument && value.Type != bsontype.Array {
+		return bsoncore.AppendStringElement(dst, key, RedactedPrefix+hex.EncodeToString(digest(value, salt)))
+	}
+
+	elements, _ := bson.Raw(value.Value).Elements()
+	dst = bsoncore.AppendHeader(dst, value.Type, key)
+	index, dst := bsoncore.ReserveLength(dst)
+	for _, element := range elements {
+		dst = redactValue(dst, element.Key(), element.Value(), salt)
+	}
+	dst = append(dst, 0)
+	return bsoncore.UpdateLength(dst, index, int32(len(dst[index:])))
+}
+
+// digest returns the digest of a value: for documents and arrays that of their keys and the digests
+// of their values, for redacted values the digest they hold, and otherwise that of the salt, type and bytes
+func digest(value bson.RawValue, salt []byte) []byte {
+	h := sha256.New()
+	switch value.Type {
+	case bsontype.EmbeddedDocument, bsontype.Array:
+		elements, _ := bson.Raw(value.Value).Elements()
+		h.Write([]byte{byte(value.Type)})
+		for _, element := range elements {
+			h.Write([]byte(element.Key()))
+			h.Write([]byte{0})
+			h.Write(digest(element.Value(), salt))
+		}
+	case bsontype.String:
+		text := value.StringValue()
+		if sum, err := hex.DecodeString(strings.TrimPrefix(text, RedactedPrefix)); err == nil && strings.HasPrefix(text, RedactedPrefix) && len(sum) == sha256.Size {
+			return sum
+		}
+		fallthrough
+	default:
+		h.Write(salt)
+		h.Write([]byte{byte(value.Type)})
+		h.Write(value.Value)
+	}
+	return h.Sum(nil)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package auditchain
+
+import (
+	"fmt"
+
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Report is the result of verifying a tenant's audit chain
+type Report struct {
+	Tenant      string `json:"tenant"`
+	Valid       bool   `json:"valid"`
+	Events      int64  `json:"events"`      // events verified before the first break
+	Checkpoints int    `json:"checkpoints"` // checkpoints verified before the first break
+	Head        string `json:"head,omitempty"`
+	Break       *Break `json:"break,omitempty"`
+}
+
+// Break describes the first point at which a chain fails verification
+type Break struct {
+	Sequence int64  `json:"sequence"`
+	EventID  string `json:"event_id,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// Verifier walks a tenant's chain in sequence order and stops at the first break
+type Verifier struct {
+	keys        KeySet
+	checkpoints []models.AuditCheckpoint
+	next        int64
+	report      Report
+}
+
+// NewVerifier creates a Verifier for the tenant's chain; checkpoints must be sorted by sequence
+func NewVerifier(tenant string, keys KeySet, checkpoints []models.AuditCheckpoint) *Verifier {
+	return &Verifier{
+		keys:        keys,
+		checkpoints: checkpoints,
+		next:        1,
+		report:      Report{Tenant: tenant, Valid: true},
+	}
+}
+
+// Next verifies the next stored event and reports whether the walk should continue
+func (v *Verifier) Next(doc bson.Raw) bool {
+	if !v.report.Valid {
+		return false
+	}
+
+	var event models.AuditEvent
+	if err := bson.Unmarshal(doc, &event); err != nil {
+		return v.fail(v.next, "", fmt.Sprintf("event cannot be decoded: %v", err))
+	}
+	eventID := event.ID.Hex()
+
+	if event.Sequence != v.next {
+		return v.fail(v.next, eventID, fmt.Sprintf("expected sequence %d, found %d", v.next, event.Sequence))
+	}
+	if event.PrevHash != v.report.Head {
+		return v.fail(event.Sequence, eventID, "previous hash does not match the preceding event")
+	}
+	hash, err := Hash(doc)
+	if err != nil || hash != event.Hash {
+		return v.fail(event.Sequence, eventID, "event contents do not match its hash")
+	}
+
+	for len(v.checkpoints) > 0 && v.checkpoints[0].Sequence == event.Sequence {
+		if !v.checkCheckpoint(&v.checkpoints[0]) {
+			return false
+		}
+		if v.checkpoints[0].Hash != event.Hash {
+			return v.fail(event.Sequence, eventID, "event does not match the signed checkpoint")
+		}
+		v.checkpoints = v.checkpoints[1:]
+		v.report.Checkpoints++
+	}
+
+	v.report.Events++
+	v.report.Head = event.Hash
+	v.next++
+	return true
+}
+
+// Finish completes the walk, checking that no signed checkpoint lies beyond the end of the chain
+func (v *Verifier) Finish() *Report {
+	if v.report.Valid && len(v.checkpoints) > 0 {
+		checkpoint := &v.checkpoints[0]
+		if v.checkCheckpoint(checkpoint) {
+			v.fail(checkpoint.Sequence, "", fmt.Sprintf("chain ends at sequence %d but a checkpoint was signed at sequence %d", v.next-1, checkpoint.Sequence))
+		}
+	}
+	return &v.report
+}
+
+func (v *Verifier) checkCheckpoint(checkpoint *models.AuditCheckpoint) bool {
+	if err := v.keys.Verify(checkpoint); err != nil {
+		return v.fail(checkpoint.Sequence, "", "checkpoint "+err.Error())
+	}
+	return true
+}
+
+func (v *Verifier) fail(sequence int64, eventID, reason string) bool {
+	v.report.Valid = false
+	v.report.Break = &Break{Sequence: sequence, EventID: eventID, Reason: reason}
+	return false
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	models "iam_backend/models"
+)
+
+// SourceLocal names the local password store
+const SourceLocal = models.LocalAuthSource
+
+// ErrInvalidCredentials is returned when a username or password is wrong
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity is a user as described by the password store that authenticated them
+type Identity struct {
+	Username string
+	Email    string
+}
+
+// Authenticator verifies passwords against one password store
+type Authenticator interface {
+	// Name identifies the password store in routing rules and user records
+	Name() string
+	// Authenticate checks the password for login. user is the matching local account, or nil
+	// if there is none yet. It returns ErrInvalidCredentials if the password is wrong.
+	Authenticate(ctx context.Context, login string, user *models.User, password string) (*Identity, error)
+}
+
+// LocalAuthenticator checks passwords against the hashes stored with local users
+type LocalAuthenticator struct{}
+
+// Name returns SourceLocal
+func (LocalAuthenticator) Name() string {
+	return SourceLocal
+}
+
+// Authenticate checks the password against the user's hash, upgrading the hash in place
+// if the hashing policy has changed since it was created
+func (LocalAuthenticator) Authenticate(ctx context.Context, login string, user *models.User, password string) (*Identity, error) {
+	if user == nil || !user.CheckPasswordHash(password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if user.PasswordNeedsRehash() {
+		if err := user.HashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Identity{Username: user.Username, Email: user.Email}, nil
+}
+
+// AuthenticatorRouter picks the password store for a login: the store recorded on the user, or for
+// logins without a local account, the store configured for the email domain, then the default store
+type AuthenticatorRouter struct {
+	authenticators map[string]Authenticator
+	domains        map[string]string
+	defaultSource  string
+}
+
+// NewAuthenticatorRouter creates a router over the given authenticators, which always include the local store
+func NewAuthenticatorRouter(authenticators ...Authenticator) *AuthenticatorRouter {
+	r := &AuthenticatorRouter{
+		authenticators: map[string]Authenticator{SourceLocal: LocalAuthenticator{}},
+		domains:        map[string]string{},
+		defaultSource:  SourceLocal,
+	}
+	for _, a := range authenticators {
+		r.authenticators[a.Name()] = a
+	}
+	return r
+}
+
+// RouteDomain sends logins with emails in domain to the named store
+func (r *AuthenticatorRouter) RouteDomain(domain, source string) error {
+	if _, ok := r.authenticators[source]; !ok {
+		return fmt.Errorf("unknown authentication source %q", source)
+	}
+	r.domains[strings.ToLower(domain)] = source
+	return nil
+}
+
+// SetDefault sends logins matched by no other rule to the named store
+func (r *AuthenticatorRouter) SetDefault(source string) error {
+	if _, ok := r.authenticators[source]; !ok {
+		return fmt.Errorf("unknown authentication source %q", source)
+	}
+	r.defaultSource = source
+	return nil
+}
+
+// Has reports whether a store with this name is configured
+func (r *AuthenticatorRouter) Has(source string) bool {
+	_, ok := r.authenticators[source]
+	return ok
+}
+
+// Route returns the authenticator for login; user is the matching local account, or nil.
+// Existing users always log in through their own store, local unless recorded otherwise; the
+// domain rules and the default store only decide where logins without an account go.
+func (r *AuthenticatorRouter) Route(login string, user *models.User) (Authenticator, error) {
+	var source string
+	switch {
+	case user != nil && user.AuthSource != "":
+		source = user.AuthSource
+	case user != nil:
+		source = SourceLocal
+	default:
+		source = r.defaultSource
+		if domainSource, ok := r.domains[emailDomain(login)]; ok {
+			source = domainSource
+		}
+	}
+
+	authenticator, ok := r.authenticators[source]
+	if !ok {
+		return nil, fmt.Errorf("authentication source %q is not configured", source)
+	}
+	return authenticator, nil
+}
+
+// SameIdentity reports whether the identity a store authenticated is the local user,
+// comparing usernames and emails without regard to case
+func SameIdentity(identity *Identity, user *models.User) bool {
+	if identity == nil || user == nil {
+		return false
+	}
+	return identity.Username != "" && strings.EqualFold(identity.Username, user.Username) ||
+		identity.Email != "" && strings.EqualFold(identity.Email, user.Email)
+}
+
+// ParseDomainRoutes parses rules written as "example.com:ldap,other.example:local"
+func ParseDomainRoutes(spec string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		domain, source, ok := strings.Cut(entry, ":")
+		if !ok || domain == "" || source == "" {
+			return nil, fmt.Errorf("invalid domain route %q, expected domain:source", entry)
+		}
+		routes[strings.ToLower(domain)] = source
+	}
+	return routes, nil
+}
+
+func emailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(email[i+1:])
+}
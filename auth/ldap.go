@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	models "iam_backend/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// SourceLDAP names the LDAP directory
+const SourceLDAP = "ldap"
+
+// LDAPConfig describes how to find and bind users in an LDAP directory.
+// Users are located either directly through UserDNTemplate, or by searching BaseDN with
+// UserFilter, binding as BindDN first if it is set.
+type LDAPConfig struct {
+	URL               string // ldap:// or ldaps:// URL of the server
+	StartTLS          bool   // upgrade ldap:// connections with StartTLS
+	BindDN            string // service account used to search for users, if any
+	BindPassword      string
+	UserDNTemplate    string // e.g. "uid=%s,ou=people,dc=example,dc=com"; %s is the escaped login
+	BaseDN            string // where to search for users
+	UserFilter        string // e.g. "(|(uid=%s)(mail=%s))"; every %s is the escaped login
+	UsernameAttribute string // attribute holding the username, "uid" by default
+	EmailAttribute    string // attribute holding the email address, "mail" by default
+	Timeout           time.Duration
+}
+
+// LDAPAuthenticator verifies passwords with an LDAP simple bind as the user
+type LDAPAuthenticator struct {
+	config LDAPConfig
+}
+
+// NewLDAPAuthenticator creates a new instance of LDAPAuthenticator
+func NewLDAPAuthenticator(config LDAPConfig) (*LDAPAuthenticator, error) {
+	if config.URL == "" {
+		return nil, errors.New("an LDAP URL is required")
+	}
+	if config.UserDNTemplate == "" && (config.BaseDN == "" || config.UserFilter == "") {
+		return nil, errors.New("either a user DN template or a base DN and user filter are required")
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &LDAPAuthenticator{config: config}, nil
+}
+
+// Name returns SourceLDAP
+func (a *LDAPAuthenticator) Name() string {
+	return SourceLDAP
+}
+
+// Authenticate binds as the user with the password and reads their username and email from the directory
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, login string, user *models.User, password string) (*Identity, error) {
+	// An empty password would be an unauthenticated bind, which many servers accept
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the directory: %w", err)
+	}
+	defer conn.Close()
+
+	var userDN string
+	var entry *ldap.Entry
+	if a.config.UserDNTemplate != "" {
+		userDN = fmt.Sprintf(a.config.UserDNTemplate, ldap.EscapeDN(login))
+	} else {
+		if a.config.BindDN != "" {
+			if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+				return nil, fmt.Errorf("binding as the service account: %w", err)
+			}
+		}
+		entry, err = a.search(conn, a.config.BaseDN, ldap.ScopeWholeSubtree, a.userFilter(login))
+		if err != nil {
+			return nil, err
+		}
+		userDN = entry.DN
+	}
+
+	err = conn.Bind(userDN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("binding as the user: %w", err)
+	}
+
+	// With a DN template the user's attributes are read after binding, with their own rights
+	if entry == nil {
+		entry, err = a.search(conn, userDN, ldap.ScopeBaseObject, "(objectClass=*)")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	identity := &Identity{
+		Username: entry.GetAttributeValue(a.config.UsernameAttribute),
+		Email:    entry.GetAttributeValue(a.config.EmailAttribute),
+	}
+	if identity.Username == "" {
+		identity.Username = login
+	}
+	return identity, nil
+}
+
+func (a *LDAPAuthenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	deadline := time.Now().Add(a.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithDialer(&net.Dialer{Deadline: deadline}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Until(deadline))
+
+	if a.config.StartTLS {
+		host := strings.TrimPrefix(a.config.URL, "ldap://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// search returns the single entry matching filter; no match means the user does not exist
+func (a *LDAPAuthenticator) search(conn *ldap.Conn, baseDN string, scope int, filter string) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(
+		baseDN, scope, ldap.NeverDerefAliases, 2, int(a.config.Timeout.Seconds()), false,
+		filter, []string{a.config.UsernameAttribute, a.config.EmailAttribute}, nil,
+	)
+
+	result, err := conn.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("searching the directory: %w", err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrInvalidCredentials
+	case 1:
+		return result.Entries[0], nil
+	}
+	return nil, fmt.Errorf("the directory has several entries for %q", filter)
+}
+
+func (a *LDAPAuthenticator) userFilter(login string) string {
+	return strings.ReplaceAll(a.config.UserFilter, "%s", ldap.EscapeFilter(login))
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -51,3 +52,32 @@ func (db *Database) Disconnect() error {
 
 	return db.Client.Disconnect(ctx)
 }
+
+// SupportsTransactions reports whether the server is a replica set member or a mongos router, the
+// deployments that support transactions. A standalone server does not.
+func (db *Database) SupportsTransactions(ctx context.Context) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := db.Client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, err
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
+// WithTransaction runs fn in a transaction, committing if it returns nil. Operations that use
+// the context passed to fn take part in the transaction. Transactions need a replica set.
+func (db *Database) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := db.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionCtx)
+	})
+	return err
+}
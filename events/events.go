@@ -0,0 +1,118 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types emitted by the identity service
+const (
+	UserRegistered      = "user.registered"
+	UserImported        = "user.imported"
+	UserProvisioned     = "user.provisioned"
+	UserUpdated         = "user.updated"
+	UserDeleted         = "user.deleted"
+	UserRolesUpdated    = "user.roles_updated"
+	UserDeactivated     = "user.deactivated"
+	UserReactivated     = "user.reactivated"
+	UserPasswordChanged = "user.password_changed"
+	UserEmailRequested  = "user.email_verification_requested"
+	UserLocked          = "user.locked"
+	UserUnlocked        = "user.unlocked"
+	UserErased          = "user.erased"
+	UserStateChanged    = "user.state_changed"
+	UserDeprovisioned   = "user.deprovisioned"
+
+	ServiceAccountCreated          = "service_account.created"
+	ServiceAccountOwnerTransferred = "service_account.owner_transferred"
+)
+
+// Confidential reports whether events of the type carry a secret, such as the token verifying an email
+// address. Only subscribers that name the type receive them, not those to every event.
+func Confidential(eventType string) bool {
+	return eventType == UserEmailRequested
+}
+
+// Event describes something that happened to a user account
+type Event struct {
+	ID         string                 `bson:"id" json:"id"`
+	Type       string                 `bson:"type" json:"type"`
+	UserID     string                 `bson:"user_id" json:"user_id"`
+	ActorID    string                 `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	Data       map[string]interface{} `bson:"data,omitempty" json:"data,omitempty"`
+	OccurredAt time.Time              `bson:"occurred_at" json:"occurred_at"`
+}
+
+// New creates an event of the given type for a user
+func New(eventType, userID string, data map[string]interface{}) Event {
+	return Event{
+		ID:         newID(),
+		Type:       eventType,
+		UserID:     userID,
+		Data:       data,
+		OccurredAt: time.Now(),
+	}
+}
+
+// newID returns a random event ID that consumers can use to discard duplicates
+func newID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Publisher publishes identity events
+type Publisher interface {
+	Publish(ctx context.Context, event Event)
+}
+
+// Handler receives published events
+type Handler func(ctx context.Context, event Event)
+
+// Bus is an in-process publisher that fans events out to subscribed handlers
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewBus creates a new instance of Bus
+func NewBus() *Bus {
+	return &Bus{
+		handlers: make(map[string][]Handler),
+	}
+}
+
+// Subscribe registers a handler for an event type, or for all events but confidential ones when eventType is "*"
+func (b *Bus) Subscribe(eventType string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[eventType] = append(b.handlers[eventType], handler)
+}
+
+// Publish delivers the event to every matching handler
+func (b *Bus) Publish(ctx context.Context, event Event) {
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+
+	b.mu.RLock()
+	handlers := append([]Handler{}, b.handlers[event.Type]...)
+	if !Confidential(event.Type) {
+		handlers = append(handlers, b.handlers["*"]...)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(ctx, event)
+	}
+}
+
+// LogHandler writes every event to the standard logger
+func LogHandler(ctx context.Context, event Event) {
+	log.Printf("event %s user=%s actor=%s data=%v", event.Type, event.UserID, event.ActorID, event.Data)
+}
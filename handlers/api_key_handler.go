@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateAPIKeyHandler creates an API key for the authenticated user.
+// The key is only returned in this response.
+func CreateAPIKeyHandler(apiKeyController *controllers.APIKeyController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name      string     `json:"name" binding:"required"`
+			Scopes    []string   `json:"scopes" binding:"required"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		apiKey, key, err := apiKeyController.CreateKey(c.Request.Context(), middleware.CurrentClaims(c).Subject, req.Name, req.Scopes, req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "API key created successfully",
+			"api_key": apiKey,
+			"key":     key,
+		})
+	}
+}
+
+// ListAPIKeysHandler lists the authenticated user's API keys
+func ListAPIKeysHandler(apiKeyController *controllers.APIKeyController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := apiKeyController.ListKeys(c.Request.Context(), middleware.CurrentClaims(c).Subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+	}
+}
+
+// RevokeAPIKeyHandler revokes one of the authenticated user's API keys
+func RevokeAPIKeyHandler(apiKeyController *controllers.APIKeyController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := apiKeyController.RevokeKey(c.Request.Context(), middleware.CurrentClaims(c).Subject, c.Param("key_id"))
+		if errors.Is(err, controllers.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "API key revoked successfully",
+		})
+	}
+}
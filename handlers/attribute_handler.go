@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetAttributeSchemaHandler returns a tenant's custom attribute schema
+func GetAttributeSchemaHandler(attributeController *controllers.AttributeController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schema, err := attributeController.GetSchema(c.Request.Context(), c.Param("tenant"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"schema": schema})
+	}
+}
+
+// SaveAttributeSchemaHandler replaces a tenant's custom attribute schema
+func SaveAttributeSchemaHandler(attributeController *controllers.AttributeController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Attributes []models.AttributeDefinition `json:"attributes" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		schema, err := attributeController.SaveSchema(c.Request.Context(), c.Param("tenant"), req.Attributes)
+		if errors.Is(err, models.ErrInvalidAttribute) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, controllers.ErrAttributeTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Attribute schema saved successfully",
+			"schema":  schema,
+		})
+	}
+}
+
+// SetUserAttributesHandler replaces a user's custom attributes
+func SetUserAttributesHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Attributes map[string]interface{} `json:"attributes" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := userController.SetAttributes(c.Request.Context(), c.Param("id"), req.Attributes)
+		switch {
+		case errors.Is(err, models.ErrInvalidAttribute):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, controllers.ErrAttributeTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err == mongo.ErrNoDocuments || errors.Is(err, primitive.ErrInvalidHex):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "User attributes updated successfully",
+		})
+	}
+}
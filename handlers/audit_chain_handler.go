@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VerifyAuditChainHandler walks a tenant's audit chain and reports the first break
+func VerifyAuditChainHandler(auditChain *controllers.AuditChain) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant := c.DefaultQuery("tenant", models.DefaultTenant)
+
+		report, err := auditChain.Verify(c.Request.Context(), tenant)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	controllers "iam_backend/jwork"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Page sizes for paginated listings
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// ListAuditEventsHandler returns audit events, newest first, filtered by the query parameters.
+// Pass next_cursor from a response as cursor to fetch the following page.
+func ListAuditEventsHandler(auditLog *controllers.AuditLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := auditFilterFromQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if cursor := c.Query("cursor"); cursor != "" {
+			filter.Before, err = primitive.ObjectIDFromHex(cursor)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+				return
+			}
+		}
+
+		limit := defaultPageSize
+		if value := c.Query("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxPageSize {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+				return
+			}
+		}
+
+		events, err := auditLog.QueryEvents(c.Request.Context(), filter, int64(limit))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		response := gin.H{"events": events}
+		if len(events) == limit {
+			response["next_cursor"] = events[len(events)-1].ID.Hex()
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// auditFilterFromQuery reads the audit event filters shared by listing and export
+func auditFilterFromQuery(c *gin.Context) (repository.AuditFilter, error) {
+	filter := repository.AuditFilter{
+		Action:   c.Query("action"),
+		ActorID:  c.Query("actor_id"),
+		TargetID: c.Query("target_id"),
+		Outcome:  c.Query("outcome"),
+	}
+
+	var err error
+	filter.From, filter.To, err = timeRangeFromQuery(c)
+	return filter, err
+}
+
+// timeRangeFromQuery reads the optional RFC 3339 from and to query parameters
+func timeRangeFromQuery(c *gin.Context) (from, to time.Time, err error) {
+	from, err = timeFromQuery(c, "from")
+	if err != nil {
+		return from, to, err
+	}
+	to, err = timeFromQuery(c, "to")
+	return from, to, err
+}
+
+// timeFromQuery reads an optional RFC 3339 query parameter
+func timeFromQuery(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return parsed, errors.New(name + " must be an RFC 3339 timestamp")
+	}
+	return parsed, nil
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	controllers "iam_backend/jwork"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListDeprovisioningJobsHandler returns the jobs that revoked a user's access when they were deactivated
+// or deleted, newest first, showing which steps completed and why a pending job last failed
+func ListDeprovisioningJobsHandler(deprovisioner *controllers.Deprovisioner) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobs, err := deprovisioner.ListJobs(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, controllers.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+	}
+}
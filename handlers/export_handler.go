@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// exportFlushEvery is the number of records written between flushes of the response
+const exportFlushEvery = 100
+
+// exportStatusTrailer is sent after the body, "complete" or "incomplete", so clients can tell a finished export from a truncated one
+const exportStatusTrailer = "Export-Status"
+
+var userCSVHeader = []string{"id", "username", "email", "roles", "active", "state", "must_change_password", "last_login", "created_at", "updated_at"}
+
+var auditCSVHeader = []string{"id", "tenant", "sequence", "occurred_at", "action", "actor_id", "target_id", "outcome", "error", "ip", "user_agent", "request_id", "changes", "details"}
+
+// ExportUsersHandler streams the users matching the query parameters as NDJSON or CSV.
+// To resume an interrupted export, repeat the request with cursor set to the last id received.
+func ExportUsersHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var filter repository.UserFilter
+		var err error
+		filter.CreatedFrom, filter.CreatedTo, err = timeRangeFromQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if role := c.Query("role"); role != "" {
+			filter.Roles = []string{role}
+		}
+		if value := c.Query("active"); value != "" {
+			active, err := strconv.ParseBool(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "active must be true or false"})
+				return
+			}
+			filter.Active = &active
+		}
+
+		export, ok := newExport(c, "users", userCSVHeader, &filter.After)
+		if !ok {
+			return
+		}
+
+		err = userController.ExportUsers(c.Request.Context(), filter, func(user *models.User) error {
+			return export.write(user, userCSVRow(user))
+		})
+		export.finish(err)
+	}
+}
+
+// ExportAuditEventsHandler streams the audit events matching the query parameters, oldest first, as NDJSON or CSV.
+// To resume an interrupted export, repeat the request with cursor set to the last id received.
+func ExportAuditEventsHandler(auditLog *controllers.AuditLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := auditFilterFromQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		export, ok := newExport(c, "audit-events", auditCSVHeader, &filter.After)
+		if !ok {
+			return
+		}
+
+		err = auditLog.ExportEvents(c.Request.Context(), filter, func(event *models.AuditEvent) error {
+			return export.write(event, auditCSVRow(event))
+		})
+		export.finish(err)
+	}
+}
+
+// export writes records to the response as they are read, in the requested format
+type export struct {
+	c         *gin.Context
+	name      string
+	format    string
+	csvHeader []string
+	csv       *csv.Writer
+	json      *json.Encoder
+	started   bool
+	written   int
+}
+
+// newExport reads the format and resume cursor from the query, responding with an error if either is invalid
+func newExport(c *gin.Context, name string, csvHeader []string, after *primitive.ObjectID) (*export, bool) {
+	format := c.DefaultQuery("format", "ndjson")
+	if format != "ndjson" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be ndjson or csv"})
+		return nil, false
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		id, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return nil, false
+		}
+		*after = id
+	}
+
+	return &export{c: c, name: name, format: format, csvHeader: csvHeader}, true
+}
+
+// start writes the response headers. It is deferred until the first record so that
+// a failing query can still be reported with an error status.
+func (e *export) start() error {
+	e.started = true
+
+	contentType := "application/x-ndjson"
+	if e.format == "csv" {
+		contentType = "text/csv; charset=utf-8"
+	}
+	header := e.c.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", `attachment; filename="`+e.name+"."+e.format+`"`)
+	header.Set("Cache-Control", "no-store")
+	header.Set("Trailer", exportStatusTrailer)
+	e.c.Status(http.StatusOK)
+
+	if e.format == "csv" {
+		e.csv = csv.NewWriter(e.c.Writer)
+		return e.csv.Write(e.csvHeader)
+	}
+	e.json = json.NewEncoder(e.c.Writer)
+	return nil
+}
+
+func (e *export) write(record interface{}, row []string) error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if e.csv != nil {
+		err = e.csv.Write(row)
+	} else {
+		err = e.json.Encode(record)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.written++
+	if e.written%exportFlushEvery == 0 {
+		e.flush()
+	}
+	return nil
+}
+
+func (e *export) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	e.c.Writer.Flush()
+}
+
+// finish completes the response. Once records have been sent the status can no longer change,
+// so a failure part way through only ends the stream early; the client resumes from the last id it received.
+func (e *export) finish(err error) {
+	if err != nil && !e.started {
+		e.c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Export of %s stopped after %d records: %v", e.name, e.written, err)
+		e.flush()
+		e.c.Writer.Header().Set(exportStatusTrailer, "incomplete")
+		return
+	}
+
+	if !e.started {
+		if err := e.start(); err != nil {
+			log.Printf("Export of %s failed: %v", e.name, err)
+			return
+		}
+	}
+	e.flush()
+	e.c.Writer.Header().Set(exportStatusTrailer, "complete")
+}
+
+func userCSVRow(user *models.User) []string {
+	return csvRow(
+		user.ID.Hex(),
+		user.Username,
+		user.Email,
+		strings.Join(user.Roles, ";"),
+		strconv.FormatBool(user.IsActive()),
+		user.State,
+		strconv.FormatBool(user.MustChangePassword),
+		csvTime(user.LastLogin),
+		csvTime(&user.CreatedAt),
+		csvTime(&user.UpdatedAt),
+	)
+}
+
+func auditCSVRow(event *models.AuditEvent) []string {
+	return csvRow(
+		event.ID.Hex(),
+		event.Tenant,
+		strconv.FormatInt(event.Sequence, 10),
+		csvTime(&event.OccurredAt),
+		event.Action,
+		event.ActorID,
+		event.TargetID,
+		event.Outcome,
+		event.Error,
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+		csvJSON(event.Changes),
+		csvJSON(event.Details),
+	)
+}
+
+// csvRow neutralizes values a spreadsheet would otherwise evaluate as formulas
+func csvRow(values ...string) []string {
+	for i, value := range values {
+		if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+			values[i] = "'" + value
+		}
+	}
+	return values
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func csvJSON(value interface{}) string {
+	switch m := value.(type) {
+	case map[string]models.AuditChange:
+		if len(m) == 0 {
+			return ""
+		}
+	case map[string]interface{}:
+		if len(m) == 0 {
+			return ""
+		}
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"iam_backend/auth"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListIdentityProvidersHandler lists the upstream providers users can sign in with
+func ListIdentityProvidersHandler(federationController *controllers.FederationController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"providers": federationController.Providers()})
+	}
+}
+
+// oidcBindingCookie holds the secret binding a sign-in at a provider to the browser that started it
+const oidcBindingCookie = "oidc_binding"
+
+// setOIDCBinding sets the binding cookie, sent back only to the callbacks. It must be sent along with
+// the provider's redirect to the callback, which SameSite=Lax allows.
+func setOIDCBinding(c *gin.Context, binding string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcBindingCookie,
+		Value:    binding,
+		Path:     "/api/v1/oidc",
+		MaxAge:   maxAge,
+		Secure:   c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// writeBeginLoginError responds to a sign-in that could not be started
+func writeBeginLoginError(c *gin.Context, err error) {
+	if errors.Is(err, controllers.ErrUnknownProvider) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+}
+
+// OIDCLoginHandler redirects the user to the provider to sign in
+func OIDCLoginHandler(federationController *controllers.FederationController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		redirectURL, binding, err := federationController.BeginLogin(c.Request.Context(), c.Param("provider"))
+		if err != nil {
+			writeBeginLoginError(c, err)
+			return
+		}
+
+		setOIDCBinding(c, binding, int(controllers.OIDCLoginTTL.Seconds()))
+		c.Redirect(http.StatusFound, redirectURL)
+	}
+}
+
+// LinkIdentityHandler starts a sign-in at the provider that links the provider account to the
+// authenticated user. The front-end navigates to the returned URL.
+func LinkIdentityHandler(federationController *controllers.FederationController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		redirectURL, binding, err := federationController.BeginLink(c.Request.Context(), c.Param("provider"), middleware.CurrentClaims(c).Subject)
+		if err != nil {
+			writeBeginLoginError(c, err)
+			return
+		}
+
+		setOIDCBinding(c, binding, int(controllers.OIDCLoginTTL.Seconds()))
+		c.JSON(http.StatusOK, gin.H{"url": redirectURL})
+	}
+}
+
+// OIDCCallbackHandler completes a sign-in when the provider redirects the user back, responding like a login
+func OIDCCallbackHandler(federationController *controllers.FederationController, sessionController *controllers.SessionController, tokens *auth.TokenService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if providerError := c.Query("error"); providerError != "" {
+			message := providerError
+			if description := c.Query("error_description"); description != "" {
+				message += ": " + description
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+			return
+		}
+		if c.Query("state") == "" || c.Query("code") == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "state and code are required"})
+			return
+		}
+
+		// The binding is cleared whatever the outcome; the sign-in cannot be completed twice
+		binding, _ := c.Cookie(oidcBindingCookie)
+		setOIDCBinding(c, "", -1)
+
+		result, err := federationController.CompleteLogin(c.Request.Context(), c.Param("provider"), c.Query("state"), binding, c.Query("code"))
+		if err != nil {
+			status := http.StatusBadGateway
+			switch {
+			case errors.Is(err, controllers.ErrUnknownProvider):
+				status = http.StatusNotFound
+			case errors.Is(err, controllers.ErrInvalidOIDCState):
+				status = http.StatusBadRequest
+			case errors.Is(err, auth.ErrInvalidIDToken):
+				status = http.StatusUnauthorized
+			case errors.Is(err, controllers.ErrUserInactive):
+				status = http.StatusForbidden
+			case errors.Is(err, controllers.ErrUnverifiedEmail), errors.Is(err, controllers.ErrLinkRequired),
+				errors.Is(err, controllers.ErrIdentityLinked), errors.Is(err, repository.ErrUserExists):
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		writeLoginSuccess(c, sessionController, tokens, result)
+	}
+}
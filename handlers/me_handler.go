@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"iam_backend/auth"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetMyProfileHandler returns the authenticated user's profile
+func GetMyProfileHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := userController.GetUserByID(c.Request.Context(), middleware.CurrentClaims(c).Subject)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"user": profile(user)})
+	}
+}
+
+// UpdateMyProfileHandler changes the authenticated user's username, email or user-editable attributes.
+// A new email only replaces the current one once it is verified.
+func UpdateMyProfileHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Password   string                 `json:"password"`
+			Username   *string                `json:"username" binding:"omitempty,min=3,max=50"`
+			Email      *string                `json:"email" binding:"omitempty,email"`
+			Attributes map[string]interface{} `json:"attributes"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Whoever holds a key could otherwise move the account to an address they control
+		claims := middleware.CurrentClaims(c)
+		if req.Email != nil && claims.Scope == auth.ScopeAPIKey {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Changing the email needs a signed-in session"})
+			return
+		}
+
+		subject := claims.Subject
+		err := userController.UpdateOwnProfile(c.Request.Context(), subject, req.Password, req.Username, req.Email, req.Attributes)
+		if writeLoginBlocked(c, err) {
+			return
+		}
+		if errors.Is(err, controllers.ErrIncorrectPassword) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, repository.ErrUserExists) || errors.Is(err, controllers.ErrServiceAccount) || errors.Is(err, controllers.ErrAttributeTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, models.ErrInvalidAttribute) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := userController.GetUserByID(c.Request.Context(), subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Profile updated successfully",
+			"user":    profile(user),
+		})
+	}
+}
+
+// VerifyMyEmailHandler makes the email the authenticated user changed to their email, given the token sent to it
+func VerifyMyEmailHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token string `json:"token" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		subject := middleware.CurrentClaims(c).Subject
+		err := userController.VerifyEmail(c.Request.Context(), subject, req.Token)
+		if errors.Is(err, controllers.ErrInvalidEmailToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, repository.ErrUserExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := userController.GetUserByID(c.Request.Context(), subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Email verified successfully",
+			"user":    profile(user),
+		})
+	}
+}
+
+// ListMyRolesHandler lists the roles of the authenticated user
+func ListMyRolesHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := userController.GetUserByID(c.Request.Context(), middleware.CurrentClaims(c).Subject)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"roles": user.Roles})
+	}
+}
+
+// DeactivateMyAccountHandler deactivates the authenticated user's account and ends all of their sessions.
+// Only an administrator can reactivate it.
+func DeactivateMyAccountHandler(userController *controllers.UserController, sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Password string `json:"password"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		subject := middleware.CurrentClaims(c).Subject
+		err := userController.DeactivateOwnAccount(c.Request.Context(), subject, req.Password)
+		if writeLoginBlocked(c, err) {
+			return
+		}
+		if errors.Is(err, controllers.ErrIncorrectPassword) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = sessionController.RevokeAllSessions(c.Request.Context(), subject, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Account deactivated successfully",
+		})
+	}
+}
+
+// profile describes a user to themselves
+func profile(user *models.User) gin.H {
+	return gin.H{
+		"id":                  user.ID.Hex(),
+		"username":            user.Username,
+		"email":               user.Email,
+		"pending_email":       user.PendingEmail,
+		"roles":               user.Roles,
+		"active":              user.IsActive(),
+		"state":               user.State,
+		"auth_source":         user.AuthSource,
+		"tenant":              user.TenantName(),
+		"attributes":          user.Attributes,
+		"identities":          user.Identities,
+		"password_changed_at": user.PasswordChangedAt,
+		"last_login":          user.LastLogin,
+		"created_at":          user.CreatedAt,
+		"updated_at":          user.UpdatedAt,
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportUserDataHandler returns everything held about a user as a single JSON archive
+func ExportUserDataHandler(privacyController *controllers.PrivacyController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeDataExport(c, privacyController, c.Param("id"))
+	}
+}
+
+// ExportMyDataHandler returns everything held about the authenticated user as a single JSON archive
+func ExportMyDataHandler(privacyController *controllers.PrivacyController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeDataExport(c, privacyController, middleware.CurrentClaims(c).Subject)
+	}
+}
+
+// EraseUserHandler erases a user's personal data, either deleting the user or keeping a pseudonymized record
+func EraseUserHandler(privacyController *controllers.PrivacyController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Mode string `json:"mode" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tombstone, err := privacyController.EraseUser(c.Request.Context(), c.Param("id"), req.Mode)
+		switch {
+		case errors.Is(err, controllers.ErrInvalidErasureMode):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, controllers.ErrUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		case errors.Is(err, controllers.ErrServiceAccount):
+			c.JSON(http.StatusConflict, gin.H{"error": "Service accounts are deleted, not erased"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		message := "User erased successfully"
+		if !tombstone.Complete {
+			message = "User erased, but some audit events still hold their personal data"
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":   message,
+			"tombstone": tombstone,
+		})
+	}
+}
+
+// GetErasureHandler returns the tombstone proving that a user was erased
+func GetErasureHandler(privacyController *controllers.PrivacyController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tombstone, err := privacyController.GetTombstone(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, controllers.ErrNotErased) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"tombstone": tombstone})
+	}
+}
+
+// writeDataExport responds with a user's data export as a JSON attachment
+func writeDataExport(c *gin.Context, privacyController *controllers.PrivacyController, userID string) {
+	export, err := privacyController.ExportUserData(c.Request.Context(), userID)
+	if errors.Is(err, controllers.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="user-`+userID+`.json"`)
+	c.JSON(http.StatusOK, export)
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SAMLMetadataHandler serves the identity provider's metadata
+func SAMLMetadataHandler(samlController *controllers.SAMLController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metadata, err := samlController.Metadata()
+		if err != nil {
+			samlError(c, err)
+			return
+		}
+
+		c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+	}
+}
+
+// SAMLSSOHandler receives authentication requests from service providers through the HTTP-Redirect
+// and HTTP-POST bindings and forwards the user to the sign-in page
+func SAMLSSOHandler(samlController *controllers.SAMLController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rawQuery := c.Request.URL.RawQuery
+		if c.Request.Method == http.MethodPost {
+			// The request is passed on in the query; SAMLBinding tells that it is not deflated
+			rawQuery = url.Values{
+				"SAMLRequest": {c.PostForm("SAMLRequest")},
+				"RelayState":  {c.PostForm("RelayState")},
+				"SAMLBinding": {"post"},
+			}.Encode()
+		}
+
+		redirectURL, err := samlController.LoginRedirect(rawQuery)
+		if err != nil {
+			samlError(c, err)
+			return
+		}
+
+		c.Redirect(http.StatusFound, redirectURL)
+	}
+}
+
+// CompleteSAMLRequestHandler answers a forwarded authentication request for the authenticated user.
+// The response is for the sign-in page to post to the service provider.
+func CompleteSAMLRequestHandler(samlController *controllers.SAMLController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Query string `json:"query" binding:"required"` // the query string the sign-in page was opened with
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		claims := middleware.CurrentClaims(c)
+		post, err := samlController.HandleAuthnRequest(c.Request.Context(), claims.Subject, claims.SessionID(), strings.TrimPrefix(req.Query, "?"))
+		if err != nil {
+			samlError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, post)
+	}
+}
+
+// SAMLIdPInitiatedHandler signs the authenticated user in to a service provider without a request from it
+func SAMLIdPInitiatedHandler(samlController *controllers.SAMLController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			EntityID   string `json:"entity_id" binding:"required"`
+			RelayState string `json:"relay_state"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		claims := middleware.CurrentClaims(c)
+		post, err := samlController.IdPInitiated(c.Request.Context(), claims.Subject, claims.SessionID(), req.EntityID, req.RelayState)
+		if err != nil {
+			samlError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, post)
+	}
+}
+
+// RegisterSAMLServiceProviderHandler registers a service provider from its metadata
+func RegisterSAMLServiceProviderHandler(samlController *controllers.SAMLController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Metadata          string                 `json:"metadata" binding:"required"`
+			Name              string                 `json:"name"`
+			NameIDFormat      string                 `json:"name_id_format"`
+			NameIDField       string                 `json:"name_id_field"`
+			Attributes        []models.SAMLAttribute `json:"attributes"`
+			RoleValues        map[string]string      `json:"role_values"`
+			AllowIdPInitiated bool                   `json:"allow_idp_initiated"`
+			DefaultRelayState string                 `json:"default_relay_state"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sp := &models.SAMLServiceProvider{
+			Metadata:          req.Metadata,
+			Name:              req.Name,
+			NameIDFormat:      req.NameIDFormat,
+			NameIDField:       req.NameIDField,
+			Attributes:        req.Attributes,
+			RoleValues:        req.RoleValues,
+			AllowIdPInitiated: req.AllowIdPInitiated,
+			DefaultRelayState: req.DefaultRelayState,
+		}
+		err := samlController.RegisterServiceProvider(c.Request.Context(), sp)
+		if errors.Is(err, repository.ErrServiceProviderExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":          "Service provider registered successfully",
+			"service_provider": sp,
+		})
+	}
+}
+
+// ListSAMLServiceProvidersHandler lists the registered service providers
+func ListSAMLServiceProvidersHandler(samlController *controllers.SAMLController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sps, err := samlController.ListServiceProviders(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"service_providers": sps})
+	}
+}
+
+// DeleteSAMLServiceProviderHandler removes a service provider
+func DeleteSAMLServiceProviderHandler(samlController *controllers.SAMLController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := samlController.DeleteServiceProvider(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, controllers.ErrUnknownServiceProvider) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Service provider not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Service provider deleted successfully",
+		})
+	}
+}
+
+// samlError responds with the status matching a SAML error
+func samlError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, controllers.ErrSAMLNotConfigured), errors.Is(err, controllers.ErrUnknownServiceProvider):
+		status = http.StatusNotFound
+	case errors.Is(err, controllers.ErrInvalidSAMLRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, controllers.ErrIdPInitiatedNotAllowed), errors.Is(err, controllers.ErrUserInactive):
+		status = http.StatusForbidden
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	controllers "iam_backend/jwork"
+	"iam_backend/scim"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultScimCount is the page size used when a SCIM query does not specify count
+const defaultScimCount = 100
+
+// ScimServiceProviderConfigHandler describes the SCIM features the service supports
+func ScimServiceProviderConfigHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := scim.NewServiceProviderConfig()
+		config.Meta.Location = scimBaseURL(c) + "/ServiceProviderConfig"
+		writeScim(c, http.StatusOK, config)
+	}
+}
+
+// ScimSchemasHandler lists the supported schemas
+func ScimSchemasHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schemas := scim.Schemas()
+		resources := make([]interface{}, 0, len(schemas))
+		for i := range schemas {
+			schemas[i].Meta.Location = scimBaseURL(c) + "/Schemas/" + schemas[i].ID
+			resources = append(resources, schemas[i])
+		}
+		writeScim(c, http.StatusOK, scim.NewListResponse(resources, int64(len(resources)), 1))
+	}
+}
+
+// ScimSchemaHandler returns a schema by its URN
+func ScimSchemaHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, schema := range scim.Schemas() {
+			if schema.ID == c.Param("id") {
+				schema.Meta.Location = scimBaseURL(c) + "/Schemas/" + schema.ID
+				writeScim(c, http.StatusOK, schema)
+				return
+			}
+		}
+		writeScimError(c, scim.NotFound("schema not found"))
+	}
+}
+
+// ScimResourceTypesHandler lists the supported resource types
+func ScimResourceTypesHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		resourceTypes := scim.ResourceTypes()
+		resources := make([]interface{}, 0, len(resourceTypes))
+		for i := range resourceTypes {
+			resourceTypes[i].Meta.Location = scimBaseURL(c) + "/ResourceTypes/" + resourceTypes[i].ID
+			resources = append(resources, resourceTypes[i])
+		}
+		writeScim(c, http.StatusOK, scim.NewListResponse(resources, int64(len(resources)), 1))
+	}
+}
+
+// ScimResourceTypeHandler returns a resource type by its name
+func ScimResourceTypeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, resourceType := range scim.ResourceTypes() {
+			if resourceType.ID == c.Param("id") {
+				resourceType.Meta.Location = scimBaseURL(c) + "/ResourceTypes/" + resourceType.ID
+				writeScim(c, http.StatusOK, resourceType)
+				return
+			}
+		}
+		writeScimError(c, scim.NotFound("resource type not found"))
+	}
+}
+
+// ListScimUsersHandler queries users with a SCIM filter and startIndex/count pagination
+func ListScimUsersHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		startIndex, count, err := scimPage(c)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		list, err := scimController.ListUsers(c.Request.Context(), c.Query("filter"), startIndex, count)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		for _, resource := range list.Resources {
+			setUserLocation(c, resource.(*scim.User))
+		}
+		writeScim(c, http.StatusOK, list)
+	}
+}
+
+// CreateScimUserHandler provisions a user
+func CreateScimUserHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource scim.User
+		if err := bindScim(c, &resource); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		user, err := scimController.CreateUser(c.Request.Context(), &resource)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setUserLocation(c, user)
+		c.Header("Location", user.Meta.Location)
+		writeScim(c, http.StatusCreated, user)
+	}
+}
+
+// GetScimUserHandler retrieves a user
+func GetScimUserHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := scimController.GetUser(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setUserLocation(c, user)
+		writeScim(c, http.StatusOK, user)
+	}
+}
+
+// ReplaceScimUserHandler replaces a user
+func ReplaceScimUserHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource scim.User
+		if err := bindScim(c, &resource); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		user, err := scimController.ReplaceUser(c.Request.Context(), c.Param("id"), &resource)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setUserLocation(c, user)
+		writeScim(c, http.StatusOK, user)
+	}
+}
+
+// PatchScimUserHandler applies PATCH operations to a user
+func PatchScimUserHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var patch scim.PatchRequest
+		if err := bindScim(c, &patch); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		user, err := scimController.PatchUser(c.Request.Context(), c.Param("id"), patch.Operations)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setUserLocation(c, user)
+		writeScim(c, http.StatusOK, user)
+	}
+}
+
+// DeleteScimUserHandler deletes a user
+func DeleteScimUserHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := scimController.DeleteUser(c.Request.Context(), c.Param("id")); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// ListScimGroupsHandler queries groups with a SCIM filter and startIndex/count pagination
+func ListScimGroupsHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		startIndex, count, err := scimPage(c)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		list, err := scimController.ListGroups(c.Request.Context(), c.Query("filter"), startIndex, count)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		for _, resource := range list.Resources {
+			setGroupLocation(c, resource.(*scim.Group))
+		}
+		writeScim(c, http.StatusOK, list)
+	}
+}
+
+// CreateScimGroupHandler creates a group
+func CreateScimGroupHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource scim.Group
+		if err := bindScim(c, &resource); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		group, err := scimController.CreateGroup(c.Request.Context(), &resource)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setGroupLocation(c, group)
+		c.Header("Location", group.Meta.Location)
+		writeScim(c, http.StatusCreated, group)
+	}
+}
+
+// GetScimGroupHandler retrieves a group
+func GetScimGroupHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group, err := scimController.GetGroup(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setGroupLocation(c, group)
+		writeScim(c, http.StatusOK, group)
+	}
+}
+
+// ReplaceScimGroupHandler replaces a group
+func ReplaceScimGroupHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource scim.Group
+		if err := bindScim(c, &resource); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		group, err := scimController.ReplaceGroup(c.Request.Context(), c.Param("id"), &resource)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setGroupLocation(c, group)
+		writeScim(c, http.StatusOK, group)
+	}
+}
+
+// PatchScimGroupHandler applies PATCH operations to a group
+func PatchScimGroupHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var patch scim.PatchRequest
+		if err := bindScim(c, &patch); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		group, err := scimController.PatchGroup(c.Request.Context(), c.Param("id"), patch.Operations)
+		if err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		setGroupLocation(c, group)
+		writeScim(c, http.StatusOK, group)
+	}
+}
+
+// DeleteScimGroupHandler deletes a group
+func DeleteScimGroupHandler(scimController *controllers.ScimController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := scimController.DeleteGroup(c.Request.Context(), c.Param("id")); err != nil {
+			writeScimError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// writeScim writes a SCIM response body
+func writeScim(c *gin.Context, status int, body interface{}) {
+	c.Header("Content-Type", scim.ContentType)
+	c.JSON(status, body)
+}
+
+// writeScimError writes err as a SCIM error response; errors that are not *scim.Error are internal errors
+func writeScimError(c *gin.Context, err error) {
+	var scimErr *scim.Error
+	if !errors.As(err, &scimErr) {
+		scimErr = scim.NewError(http.StatusInternalServerError, "", err.Error())
+	}
+	writeScim(c, scimErr.Status, scimErr)
+}
+
+// bindScim decodes a SCIM request body
+func bindScim(c *gin.Context, v interface{}) error {
+	if err := json.NewDecoder(c.Request.Body).Decode(v); err != nil {
+		return scim.BadRequest(scim.ErrInvalidSyntax, "invalid request body: "+err.Error())
+	}
+	return nil
+}
+
+// scimPage reads the 1-based startIndex and the count of a query, clamping them to valid values
+func scimPage(c *gin.Context) (int, int, error) {
+	startIndex, count := 1, defaultScimCount
+	if raw := c.Query("startIndex"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return 0, 0, scim.BadRequest(scim.ErrInvalidValue, "startIndex must be an integer")
+		}
+		if n > 1 {
+			startIndex = n
+		}
+	}
+	if raw := c.Query("count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return 0, 0, scim.BadRequest(scim.ErrInvalidValue, "count must be an integer")
+		}
+		count = max(0, min(n, scim.MaxResults))
+	}
+	return startIndex, count, nil
+}
+
+// scimBaseURL returns the absolute URL of the SCIM API, for resource locations
+func scimBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + "/scim/v2"
+}
+
+func setUserLocation(c *gin.Context, user *scim.User) {
+	user.Meta.Location = scimBaseURL(c) + "/Users/" + user.ID
+}
+
+func setGroupLocation(c *gin.Context, group *scim.Group) {
+	group.Meta.Location = scimBaseURL(c) + "/Groups/" + group.ID
+}
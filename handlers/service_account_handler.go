@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"iam_backend/auth"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateServiceAccountHandler creates a service account owned by the authenticated user or a group
+func CreateServiceAccountHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name        string `json:"name" binding:"required"`
+			Description string `json:"description"`
+			Owner       struct {
+				Type string `json:"type"`
+				ID   string `json:"id"`
+			} `json:"owner"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		account, err := serviceAccounts.CreateServiceAccount(c.Request.Context(), middleware.CurrentClaims(c), req.Name, req.Description, req.Owner.Type, req.Owner.ID)
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":         "Service account created successfully",
+			"service_account": account,
+		})
+	}
+}
+
+// ListServiceAccountsHandler lists the service accounts the authenticated user can manage
+func ListServiceAccountsHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		accounts, err := serviceAccounts.ListServiceAccounts(c.Request.Context(), middleware.CurrentClaims(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"service_accounts": accounts})
+	}
+}
+
+// GetServiceAccountHandler retrieves a service account
+func GetServiceAccountHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account, err := serviceAccounts.GetServiceAccount(c.Request.Context(), middleware.CurrentClaims(c), c.Param("id"))
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"service_account": account})
+	}
+}
+
+// DeleteServiceAccountHandler removes a service account
+func DeleteServiceAccountHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := serviceAccounts.DeleteServiceAccount(c.Request.Context(), middleware.CurrentClaims(c), c.Param("id"))
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Service account deleted successfully",
+		})
+	}
+}
+
+// BindServiceAccountRolesHandler replaces the roles bound to a service account
+func BindServiceAccountRolesHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Roles []string `json:"roles" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := serviceAccounts.BindRoles(c.Request.Context(), c.Param("id"), req.Roles)
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Service account roles updated successfully",
+		})
+	}
+}
+
+// RotateClientSecretHandler issues a new client secret for a service account.
+// The secret is only returned in this response.
+func RotateClientSecretHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		secret, err := serviceAccounts.RotateClientSecret(c.Request.Context(), middleware.CurrentClaims(c), id)
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "Client secret rotated successfully",
+			"client_id":     id,
+			"client_secret": secret,
+		})
+	}
+}
+
+// CreateServiceAccountKeyHandler creates an API key for a service account.
+// The key is only returned in this response.
+func CreateServiceAccountKeyHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Name      string     `json:"name" binding:"required"`
+			Scopes    []string   `json:"scopes" binding:"required"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		apiKey, key, err := serviceAccounts.CreateKey(c.Request.Context(), middleware.CurrentClaims(c), c.Param("id"), req.Name, req.Scopes, req.ExpiresAt)
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "API key created successfully",
+			"api_key": apiKey,
+			"key":     key,
+		})
+	}
+}
+
+// ListServiceAccountKeysHandler lists a service account's API keys
+func ListServiceAccountKeysHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := serviceAccounts.ListKeys(c.Request.Context(), middleware.CurrentClaims(c), c.Param("id"))
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+	}
+}
+
+// RevokeServiceAccountKeyHandler revokes one of a service account's API keys
+func RevokeServiceAccountKeyHandler(serviceAccounts *controllers.ServiceAccountController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := serviceAccounts.RevokeKey(c.Request.Context(), middleware.CurrentClaims(c), c.Param("id"), c.Param("key_id"))
+		if errors.Is(err, controllers.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		if err != nil {
+			writeServiceAccountError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "API key revoked successfully",
+		})
+	}
+}
+
+// ClientCredentialsTokenHandler exchanges a service account's client credentials for an access token,
+// following the OAuth 2.0 client credentials grant. The credentials are accepted as HTTP Basic
+// authentication or as client_id and client_secret form fields.
+func ClientCredentialsTokenHandler(serviceAccounts *controllers.ServiceAccountController, sessionController *controllers.SessionController, tokens *auth.TokenService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+
+		if grantType := c.PostForm("grant_type"); grantType != "client_credentials" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type", "error_description": "only the client_credentials grant is supported"})
+			return
+		}
+
+		clientID, clientSecret, ok := c.Request.BasicAuth()
+		if !ok {
+			clientID, clientSecret = c.PostForm("client_id"), c.PostForm("client_secret")
+		}
+		if clientID == "" || clientSecret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "client_id and client_secret are required"})
+			return
+		}
+
+		result, err := serviceAccounts.AuthenticateClient(c.Request.Context(), clientID, clientSecret)
+		if errors.Is(err, controllers.ErrInvalidClient) {
+			c.Header("WWW-Authenticate", `Basic realm="iam"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client", "error_description": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error", "error_description": err.Error()})
+			return
+		}
+
+		session, err := sessionController.StartSession(c.Request.Context(), result.User, c.GetHeader("User-Agent"), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error", "error_description": err.Error()})
+			return
+		}
+		token, claims, err := tokens.Issue(result.User, session.ID.Hex(), result.ClaimAttributes)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error", "error_description": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   int(time.Until(claims.ExpiresAt.Time).Seconds()),
+		})
+	}
+}
+
+// writeServiceAccountError maps service account errors to responses
+func writeServiceAccountError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, controllers.ErrServiceAccountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, controllers.ErrNotServiceAccountOwner):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, repository.ErrUserExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListMySessionsHandler lists the authenticated user's active sessions
+func ListMySessionsHandler(sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := middleware.CurrentClaims(c)
+
+		sessions, err := sessionController.ListSessions(c.Request.Context(), claims.Subject)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": sessionList(sessions, claims.SessionID())})
+	}
+}
+
+// RevokeMySessionHandler ends one of the authenticated user's sessions
+func RevokeMySessionHandler(sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revokeSession(c, sessionController, middleware.CurrentClaims(c).Subject, c.Param("session_id"))
+	}
+}
+
+// RevokeMyOtherSessionsHandler ends all of the authenticated user's sessions except the current one
+func RevokeMyOtherSessionsHandler(sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := middleware.CurrentClaims(c)
+
+		revoked, err := sessionController.RevokeAllSessions(c.Request.Context(), claims.Subject, claims.SessionID())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Other sessions revoked successfully",
+			"revoked": revoked,
+		})
+	}
+}
+
+// ListUserSessionsHandler lists any user's active sessions
+func ListUserSessionsHandler(sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessions, err := sessionController.ListSessions(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": sessionList(sessions, "")})
+	}
+}
+
+// RevokeUserSessionHandler ends one of any user's sessions
+func RevokeUserSessionHandler(sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revokeSession(c, sessionController, c.Param("id"), c.Param("session_id"))
+	}
+}
+
+// RevokeUserSessionsHandler ends all of any user's sessions
+func RevokeUserSessionsHandler(sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revoked, err := sessionController.RevokeAllSessions(c.Request.Context(), c.Param("id"), "")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Sessions revoked successfully",
+			"revoked": revoked,
+		})
+	}
+}
+
+func revokeSession(c *gin.Context, sessionController *controllers.SessionController, userID, sessionID string) {
+	err := sessionController.RevokeSession(c.Request.Context(), userID, sessionID)
+	if errors.Is(err, controllers.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Session revoked successfully",
+	})
+}
+
+// sessionList renders sessions, flagging the one the request was made with
+func sessionList(sessions []models.Session, currentID string) []gin.H {
+	list := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, gin.H{
+			"id":           s.ID.Hex(),
+			"device":       s.Device,
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.ID.Hex() == currentID,
+		})
+	}
+	return list
+}
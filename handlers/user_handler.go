@@ -1,11 +1,23 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"iam_backend/auth"
 	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	"iam_backend/password"
+	repository "iam_backend/repo"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // RegisterHandler handles user registration
@@ -14,7 +26,7 @@ func RegisterHandler(userController *controllers.UserController) gin.HandlerFunc
 		var registrationRequest struct {
 			Username string `json:"username" binding:"required"`
 			Email    string `json:"email" binding:"required,email"`
-			Password string `json:"password" binding:"required,min=6"`
+			Password string `json:"password" binding:"required"`
 		}
 
 		if err := c.ShouldBindJSON(&registrationRequest); err != nil {
@@ -28,6 +40,17 @@ func RegisterHandler(userController *controllers.UserController) gin.HandlerFunc
 			registrationRequest.Email,
 			registrationRequest.Password,
 		)
+		if writePolicyError(c, err) {
+			return
+		}
+		if errors.Is(err, repository.ErrUserExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, models.ErrInvalidAttribute) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -41,7 +64,7 @@ func RegisterHandler(userController *controllers.UserController) gin.HandlerFunc
 }
 
 // LoginHandler handles user authentication
-func LoginHandler(userController *controllers.UserController) gin.HandlerFunc {
+func LoginHandler(userController *controllers.UserController, sessionController *controllers.SessionController, tokens *auth.TokenService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var loginRequest struct {
 			Username string `json:"username" binding:"required"`
@@ -53,28 +76,81 @@ func LoginHandler(userController *controllers.UserController) gin.HandlerFunc {
 			return
 		}
 
-		user, err := userController.AuthenticateUser(
+		result, err := userController.AuthenticateUser(
 			c.Request.Context(),
 			loginRequest.Username,
 			loginRequest.Password,
 		)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			if writeLoginBlocked(c, err) {
+				return
+			}
+			if errors.Is(err, controllers.ErrUserInactive) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, models.ErrInvalidAttribute) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, controllers.ErrInvalidCredentials) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Login failed"})
 			return
 		}
 
-		// Here you would normally generate a JWT token
-		// For simplicity, just returning user information
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Login successful",
-			"user": gin.H{
-				"id":       user.ID.Hex(),
-				"username": user.Username,
-				"email":    user.Email,
-				"roles":    user.Roles,
-			},
-		})
+		user := result.User
+
+		// Only allow a password change until the user picks a new password
+		if result.PasswordChangeRequired {
+			token, claims, err := tokens.IssuePasswordChange(user)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"message":                  "Password change required",
+				"password_change_required": true,
+				"token":                    token,
+				"expires_at":               claims.ExpiresAt.Time,
+			})
+			return
+		}
+
+		writeLoginSuccess(c, sessionController, tokens, result)
+	}
+}
+
+// writeLoginSuccess starts a session for the authenticated user and responds with its access token
+func writeLoginSuccess(c *gin.Context, sessionController *controllers.SessionController, tokens *auth.TokenService, result *controllers.AuthResult) {
+	user := result.User
+	session, err := sessionController.StartSession(c.Request.Context(), user, c.GetHeader("User-Agent"), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, claims, err := tokens.Issue(user, session.ID.Hex(), result.ClaimAttributes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Login successful",
+		"token":      token,
+		"expires_at": claims.ExpiresAt.Time,
+		"session_id": session.ID.Hex(),
+		"user": gin.H{
+			"id":       user.ID.Hex(),
+			"username": user.Username,
+			"email":    user.Email,
+			"roles":    user.Roles,
+		},
+	})
 }
 
 // GetUserHandler retrieves user information
@@ -98,7 +174,8 @@ func GetUserHandler(userController *controllers.UserController) gin.HandlerFunc
 				"username":  user.Username,
 				"email":     user.Email,
 				"roles":     user.Roles,
-				"active":    user.Active,
+				"active":    user.IsActive(),
+				"state":     user.State,
 				"lastLogin": user.LastLogin,
 				"createdAt": user.CreatedAt,
 				"updatedAt": user.UpdatedAt,
@@ -107,6 +184,92 @@ func GetUserHandler(userController *controllers.UserController) gin.HandlerFunc
 	}
 }
 
+// ListUsersHandler returns a page of users filtered, searched and sorted by the query parameters.
+// Pass next_cursor from a response as cursor, with the same sort, to fetch the following page.
+func ListUsersHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := repository.UserFilter{
+			Search: c.Query("q"),
+			Tenant: c.Query("tenant"),
+		}
+		for _, value := range c.QueryArray("role") {
+			for _, role := range strings.Split(value, ",") {
+				if role != "" {
+					filter.Roles = append(filter.Roles, role)
+				}
+			}
+		}
+		if value := c.Query("active"); value != "" {
+			active, err := strconv.ParseBool(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "active must be true or false"})
+				return
+			}
+			filter.Active = &active
+		}
+		for _, value := range c.QueryArray("state") {
+			for _, state := range strings.Split(value, ",") {
+				if state == "" {
+					continue
+				}
+				if !models.ValidState(state) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown state " + state})
+					return
+				}
+				filter.States = append(filter.States, state)
+			}
+		}
+
+		var err error
+		for name, bound := range map[string]*time.Time{
+			"created_from":    &filter.CreatedFrom,
+			"created_to":      &filter.CreatedTo,
+			"last_login_from": &filter.LastLoginFrom,
+			"last_login_to":   &filter.LastLoginTo,
+		} {
+			*bound, err = timeFromQuery(c, name)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		sort := repository.DefaultUserSort
+		if value := c.Query("sort"); value != "" {
+			sort, err = repository.ParseUserSort(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		limit := defaultPageSize
+		if value := c.Query("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxPageSize {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+				return
+			}
+		}
+
+		users, next, err := userController.ListUsers(c.Request.Context(), filter, sort, c.Query("cursor"), int64(limit))
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		response := gin.H{"users": users}
+		if next != "" {
+			response["next_cursor"] = next
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
 // UpdateUserRolesHandler updates roles for a user
 func UpdateUserRolesHandler(userController *controllers.UserController) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -139,15 +302,17 @@ func UpdateUserRolesHandler(userController *controllers.UserController) gin.Hand
 // DeactivateUserHandler deactivates a user account
 func DeactivateUserHandler(userController *controllers.UserController) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Param("id")
-		if userID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+		var req struct {
+			Reason string `json:"reason" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		err := userController.DeactivateUser(c.Request.Context(), userID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		err := userController.DeactivateUser(c.Request.Context(), c.Param("id"), req.Reason)
+		if writeStateError(c, err) {
 			return
 		}
 
@@ -160,15 +325,17 @@ func DeactivateUserHandler(userController *controllers.UserController) gin.Handl
 // ReactivateUserHandler reactivates a user account
 func ReactivateUserHandler(userController *controllers.UserController) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Param("id")
-		if userID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+		var req struct {
+			Reason string `json:"reason" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		err := userController.ReactivateUser(c.Request.Context(), userID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		err := userController.ReactivateUser(c.Request.Context(), c.Param("id"), req.Reason)
+		if writeStateError(c, err) {
 			return
 		}
 
@@ -178,13 +345,56 @@ func ReactivateUserHandler(userController *controllers.UserController) gin.Handl
 	}
 }
 
-// ChangePasswordHandler handles password changes
+// ChangeUserStateHandler moves a user to another lifecycle state
+func ChangeUserStateHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			State  string `json:"state" binding:"required"`
+			Reason string `json:"reason" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !models.ValidState(req.State) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown state " + req.State})
+			return
+		}
+
+		err := userController.ChangeState(c.Request.Context(), c.Param("id"), req.State, req.Reason)
+		if writeStateError(c, err) {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "User state changed successfully",
+		})
+	}
+}
+
+// writeStateError responds to a failed lifecycle transition and reports whether there was an error
+func writeStateError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, controllers.ErrInvalidTransition):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err == mongo.ErrNoDocuments || errors.Is(err, primitive.ErrInvalidHex):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return true
+}
+
+// ChangePasswordHandler handles password changes for the authenticated user
 func ChangePasswordHandler(userController *controllers.UserController) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var passwordRequest struct {
-			UserID      string `json:"user_id" binding:"required"`
+			UserID      string `json:"user_id"`
 			OldPassword string `json:"old_password" binding:"required"`
-			NewPassword string `json:"new_password" binding:"required,min=6"`
+			NewPassword string `json:"new_password" binding:"required"`
 		}
 
 		if err := c.ShouldBindJSON(&passwordRequest); err != nil {
@@ -192,19 +402,205 @@ func ChangePasswordHandler(userController *controllers.UserController) gin.Handl
 			return
 		}
 
+		// Users may only change their own password
+		subject := middleware.CurrentClaims(c).Subject
+		if passwordRequest.UserID != "" && passwordRequest.UserID != subject {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change another user's password"})
+			return
+		}
+
 		err := userController.ChangePassword(
 			c.Request.Context(),
-			passwordRequest.UserID,
+			subject,
 			passwordRequest.OldPassword,
 			passwordRequest.NewPassword,
 		)
-		if err != nil {
+		if writePolicyError(c, err) || writeLoginBlocked(c, err) {
+			return
+		}
+		if errors.Is(err, controllers.ErrExternalPassword) || errors.Is(err, controllers.ErrServiceAccount) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, controllers.ErrIncorrectPassword) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Password changed successfully",
 		})
 	}
 }
+
+// UnlockUserHandler lifts a lockout caused by repeated failed logins
+func UnlockUserHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.Param("id")
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+			return
+		}
+
+		err := userController.UnlockUser(c.Request.Context(), userID, middleware.CurrentClaims(c).Subject)
+		if writeStateError(c, err) {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "User account unlocked successfully",
+		})
+	}
+}
+
+// SetTemporaryPasswordHandler issues a temporary password that must be changed at next login, ending the
+// user's sessions so that whoever knew the old password is signed out
+func SetTemporaryPasswordHandler(userController *controllers.UserController, sessionController *controllers.SessionController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.Param("id")
+		if userID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+			return
+		}
+
+		temporary, err := userController.SetTemporaryPassword(c.Request.Context(), userID)
+		switch {
+		case errors.Is(err, controllers.ErrExternalPassword) || errors.Is(err, controllers.ErrServiceAccount):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err == mongo.ErrNoDocuments || errors.Is(err, primitive.ErrInvalidHex):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = sessionController.RevokeAllSessions(c.Request.Context(), userID, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":            "Temporary password set, the user must change it at next login",
+			"temporary_password": temporary,
+		})
+	}
+}
+
+// SetAuthSourceHandler routes a user's logins to a password store such as "local" or "ldap"
+func SetAuthSourceHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Source string `json:"source" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := userController.SetAuthSource(c.Request.Context(), c.Param("id"), req.Source)
+		if errors.Is(err, controllers.ErrUnknownAuthSource) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, controllers.ErrServiceAccount) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Authentication source updated successfully",
+		})
+	}
+}
+
+// PepperKeyUsageHandler reports how many password hashes use each pepper key
+func PepperKeyUsageHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		usage, err := userController.PepperKeyUsage(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"keys": usage})
+	}
+}
+
+// ImportUsersHandler imports users from another system along with their existing password hashes
+func ImportUsersHandler(userController *controllers.UserController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var importRequest struct {
+			Users []struct {
+				Username     string   `json:"username" binding:"required"`
+				Email        string   `json:"email" binding:"required,email"`
+				PasswordHash string   `json:"password_hash" binding:"required"`
+				Roles        []string `json:"roles"`
+			} `json:"users" binding:"required,dive"`
+		}
+
+		if err := c.ShouldBindJSON(&importRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		results := make([]gin.H, 0, len(importRequest.Users))
+		imported := 0
+		for _, u := range importRequest.Users {
+			user, err := userController.ImportUser(c.Request.Context(), u.Username, u.Email, u.PasswordHash, u.Roles)
+			if err != nil {
+				results = append(results, gin.H{"username": u.Username, "error": err.Error()})
+				continue
+			}
+			imported++
+			results = append(results, gin.H{"username": u.Username, "user_id": user.ID.Hex()})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"imported": imported,
+			"failed":   len(importRequest.Users) - imported,
+			"results":  results,
+		})
+	}
+}
+
+// writePolicyError responds with the violated rules if err is a password policy error
+func writePolicyError(c *gin.Context, err error) bool {
+	var policyErr *password.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":      "Password does not meet policy",
+		"violations": policyErr.Violations,
+	})
+	return true
+}
+
+// writeLoginBlocked responds with the lockout or delay if err is a LoginBlockedError
+func writeLoginBlocked(c *gin.Context, err error) bool {
+	var blocked *controllers.LoginBlockedError
+	if !errors.As(err, &blocked) {
+		return false
+	}
+
+	status := http.StatusTooManyRequests
+	if blocked.Locked {
+		status = http.StatusLocked
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(blocked.RetryAfter.Seconds()))))
+	c.JSON(status, gin.H{"error": blocked.Error()})
+	return true
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	controllers "iam_backend/jwork"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateWebhookHandler subscribes an endpoint to identity events.
+// The signing secret is only returned in this response.
+func CreateWebhookHandler(dispatcher *controllers.WebhookDispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			URL         string   `json:"url" binding:"required"`
+			EventTypes  []string `json:"event_types" binding:"required"`
+			Description string   `json:"description"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		subscription, err := dispatcher.CreateSubscription(c.Request.Context(), req.URL, req.EventTypes, req.Description)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message":      "Webhook created successfully",
+			"subscription": subscription,
+			"secret":       subscription.Secret,
+		})
+	}
+}
+
+// ListWebhooksHandler lists webhook subscriptions
+func ListWebhooksHandler(dispatcher *controllers.WebhookDispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subscriptions, err := dispatcher.ListSubscriptions(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"subscriptions": subscriptions})
+	}
+}
+
+// DeleteWebhookHandler removes a webhook subscription
+func DeleteWebhookHandler(dispatcher *controllers.WebhookDispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := dispatcher.DeleteSubscription(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, controllers.ErrWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Webhook deleted successfully",
+		})
+	}
+}
+
+// ListWebhookDeliveriesHandler lists deliveries, newest first; status=dead lists the dead-letter queue
+func ListWebhookDeliveriesHandler(dispatcher *controllers.WebhookDispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := repository.DeliveryFilter{Status: c.Query("status")}
+
+		var err error
+		if id := c.Query("subscription_id"); id != "" {
+			filter.SubscriptionID, err = primitive.ObjectIDFromHex(id)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription_id"})
+				return
+			}
+		}
+		if cursor := c.Query("cursor"); cursor != "" {
+			filter.Before, err = primitive.ObjectIDFromHex(cursor)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+				return
+			}
+		}
+
+		limit := defaultPageSize
+		if value := c.Query("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxPageSize {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+				return
+			}
+		}
+
+		deliveries, err := dispatcher.ListDeliveries(c.Request.Context(), filter, int64(limit))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		response := gin.H{"deliveries": deliveries}
+		if len(deliveries) == limit {
+			response["next_cursor"] = deliveries[len(deliveries)-1].ID.Hex()
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// GetWebhookDeliveryHandler returns a delivery with its attempts
+func GetWebhookDeliveryHandler(dispatcher *controllers.WebhookDispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		delivery, err := dispatcher.GetDelivery(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, controllers.ErrDeliveryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, delivery)
+	}
+}
+
+// RedeliverWebhookHandler queues a delivery to be sent again
+func RedeliverWebhookHandler(dispatcher *controllers.WebhookDispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := dispatcher.Redeliver(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, controllers.ErrDeliveryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "Delivery queued for redelivery",
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package hashing
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id hashes passwords with argon2id, encoded in the PHC string format
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type Argon2id struct {
+	Memory      uint32 // memory in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id returns the parameters recommended by RFC 9106 for memory-constrained environments
+func DefaultArgon2id() Argon2id {
+	return Argon2id{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 4,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// Bounds on the parameters of argon2id hashes. Hashes are decoded from stored and imported data, so their
+// parameters must not be able to make verification panic or exhaust memory.
+const (
+	maxArgon2Memory      = 1024 * 1024 // 1 GiB in KiB
+	maxArgon2Iterations  = 64
+	maxArgon2Parallelism = 64
+	minArgon2SaltLength  = 8
+	minArgon2KeyLength   = 16
+	maxArgon2Length      = 1024 // salt and key
+)
+
+// Validate returns an error if the parameters are outside the supported bounds
+func (a Argon2id) Validate() error {
+	switch {
+	case a.Parallelism < 1 || a.Parallelism > maxArgon2Parallelism:
+		return fmt.Errorf("argon2id parallelism must be between 1 and %d", maxArgon2Parallelism)
+	case a.Iterations < 1 || a.Iterations > maxArgon2Iterations:
+		return fmt.Errorf("argon2id iterations must be between 1 and %d", maxArgon2Iterations)
+	case a.Memory < 8*uint32(a.Parallelism) || a.Memory > maxArgon2Memory:
+		return fmt.Errorf("argon2id memory must be between 8 KiB per lane and %d KiB", maxArgon2Memory)
+	case a.SaltLength < minArgon2SaltLength || a.SaltLength > maxArgon2Length:
+		return fmt.Errorf("argon2id salt length must be between %d and %d bytes", minArgon2SaltLength, maxArgon2Length)
+	case a.KeyLength < minArgon2KeyLength || a.KeyLength > maxArgon2Length:
+		return fmt.Errorf("argon2id key length must be between %d and %d bytes", minArgon2KeyLength, maxArgon2Length)
+	}
+	return nil
+}
+
+type argon2Hash struct {
+	params Argon2id
+	salt   []byte
+	key    []byte
+}
+
+// Matches reports whether the encoded hash is an argon2id hash with parameters within the supported bounds
+func (a Argon2id) Matches(encoded string) bool {
+	_, err := decodeArgon2id(encoded)
+	return err == nil
+}
+
+// Hash returns the argon2id hash of the password
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether the password matches the argon2id hash, using the parameters stored in it
+func (a Argon2id) Verify(password, encoded string) bool {
+	h, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), h.salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// NeedsRehash reports whether the hash was produced with different parameters
+func (a Argon2id) NeedsRehash(encoded string) bool {
+	h, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return h.params.Memory != a.Memory ||
+		h.params.Iterations != a.Iterations ||
+		h.params.Parallelism != a.Parallelism ||
+		uint32(len(h.salt)) != a.SaltLength ||
+		uint32(len(h.key)) != a.KeyLength
+}
+
+func decodeArgon2id(encoded string) (*argon2Hash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2id version")
+	}
+
+	h := &argon2Hash{}
+	var memory, iterations, parallelism uint64
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return nil, errors.New("invalid argon2id parameters")
+	}
+	if memory > maxArgon2Memory || iterations > maxArgon2Iterations || parallelism > maxArgon2Parallelism {
+		return nil, errors.New("argon2id parameters out of range")
+	}
+	h.params.Memory, h.params.Iterations, h.params.Parallelism = uint32(memory), uint32(iterations), uint8(parallelism)
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	h.params.SaltLength = uint32(len(h.salt))
+	h.params.KeyLength = uint32(len(h.key))
+	if err := h.params.Validate(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
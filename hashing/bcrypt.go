@@ -0,0 +1,37 @@
+package hashing
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt hashes passwords with bcrypt at a configurable cost
+type Bcrypt struct {
+	Cost int
+}
+
+// Matches reports whether the encoded hash is a bcrypt hash
+func (b Bcrypt) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// Hash returns the bcrypt hash of the password
+func (b Bcrypt) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// Verify reports whether the password matches the bcrypt hash
+func (b Bcrypt) Verify(password, encoded string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+// NeedsRehash reports whether the hash was produced with a different cost
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
@@ -0,0 +1,106 @@
+package hashing
+
+// Scheme hashes and verifies passwords in one self-describing encoded format
+type Scheme interface {
+	// Matches reports whether the encoded hash was produced by this scheme
+	Matches(encoded string) bool
+	// Hash returns the encoded hash of the password
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash
+	Verify(password, encoded string) bool
+	// NeedsRehash reports whether the encoded hash uses parameters other than the configured ones
+	NeedsRehash(encoded string) bool
+}
+
+// Hasher hashes new passwords with the current scheme and verifies hashes from any known scheme
+type Hasher struct {
+	current Scheme
+	schemes []Scheme
+	pepper  *Pepper
+}
+
+// NewHasher creates a new instance of Hasher; additional schemes are only used for verification
+func NewHasher(current Scheme, others ...Scheme) *Hasher {
+	return &Hasher{
+		current: current,
+		schemes: append([]Scheme{current}, others...),
+	}
+}
+
+// UsePepper makes the hasher pepper new passwords; hashes made without a pepper keep verifying
+func (h *Hasher) UsePepper(pepper *Pepper) {
+	h.pepper = pepper
+}
+
+// Pepper returns the configured pepper, or nil if passwords are not peppered
+func (h *Hasher) Pepper() *Pepper {
+	return h.pepper
+}
+
+// Hash hashes the password with the current scheme, peppered with the current key if configured
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.pepper == nil {
+		return h.current.Hash(password)
+	}
+
+	keyID := h.pepper.CurrentID()
+	peppered, _ := h.pepper.apply(keyID, password)
+	inner, err := h.current.Hash(peppered)
+	if err != nil {
+		return "", err
+	}
+	return PepperPrefix(keyID) + inner, nil
+}
+
+// Verify checks the password against an encoded hash from any known scheme
+func (h *Hasher) Verify(password, encoded string) bool {
+	if keyID, inner, ok := splitPeppered(encoded); ok {
+		if h.pepper == nil {
+			return false
+		}
+		peppered, known := h.pepper.apply(keyID, password)
+		if !known {
+			return false
+		}
+		password, encoded = peppered, inner
+	}
+
+	scheme := h.schemeFor(encoded)
+	if scheme == nil {
+		return false
+	}
+	return scheme.Verify(password, encoded)
+}
+
+// Recognizes reports whether the encoded hash belongs to any known scheme
+func (h *Hasher) Recognizes(encoded string) bool {
+	if _, inner, ok := splitPeppered(encoded); ok {
+		encoded = inner
+	}
+	return h.schemeFor(encoded) != nil
+}
+
+// NeedsRehash reports whether the encoded hash should be replaced by one from the current scheme and pepper key
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	keyID, inner, peppered := splitPeppered(encoded)
+	if h.pepper == nil && peppered || h.pepper != nil && (!peppered || keyID != h.pepper.CurrentID()) {
+		return true
+	}
+	if peppered {
+		encoded = inner
+	}
+
+	if !h.current.Matches(encoded) {
+		return true
+	}
+	return h.current.NeedsRehash(encoded)
+}
+
+func (h *Hasher) schemeFor(encoded string) Scheme {
+	for _, scheme := range h.schemes {
+		if scheme.Matches(encoded) {
+			return scheme
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package hashing
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// LegacySchemes returns the schemes used to verify password hashes imported from other systems
+func LegacySchemes() []Scheme {
+	return []Scheme{
+		DjangoPBKDF2{Iterations: 870000},
+		SaltedSHA1{},
+		MD5Crypt{},
+	}
+}
+
+// maxDjangoIterations bounds the iteration count taken from a hash, so an imported hash cannot make
+// every login attempt for its user burn CPU. Django itself uses 1,200,000 since version 5.1.
+const maxDjangoIterations = 2000000
+
+// DjangoPBKDF2 verifies Django PBKDF2-SHA256 hashes: pbkdf2_sha256$<iterations>$<salt>$<base64 hash>
+type DjangoPBKDF2 struct {
+	Iterations int
+}
+
+// Matches reports whether the encoded hash is a Django PBKDF2-SHA256 hash with a supported iteration count
+func (d DjangoPBKDF2) Matches(encoded string) bool {
+	_, ok := djangoIterations(encoded)
+	return ok
+}
+
+// Hash returns the Django PBKDF2-SHA256 hash of the password
+func (d DjangoPBKDF2) Hash(password string) (string, error) {
+	salt, err := randomSalt(12)
+	if err != nil {
+		return "", err
+	}
+	return d.encode(password, salt, d.Iterations), nil
+}
+
+// Verify reports whether the password matches the Django PBKDF2-SHA256 hash
+func (d DjangoPBKDF2) Verify(password, encoded string) bool {
+	iterations, ok := djangoIterations(encoded)
+	if !ok {
+		return false
+	}
+
+	salt := strings.Split(encoded, "$")[2]
+	return subtle.ConstantTimeCompare([]byte(d.encode(password, salt, iterations)), []byte(encoded)) == 1
+}
+
+// djangoIterations returns the iteration count of a Django PBKDF2-SHA256 hash, and false if the hash
+// is malformed or its iteration count is out of range
+func djangoIterations(encoded string) (int, bool) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2_sha256" || parts[2] == "" {
+		return 0, false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 || iterations > maxDjangoIterations {
+		return 0, false
+	}
+	if key, err := base64.StdEncoding.DecodeString(parts[3]); err != nil || len(key) != sha256.Size {
+		return 0, false
+	}
+	return iterations, true
+}
+
+// NeedsRehash reports whether the hash was produced with a different iteration count
+func (d DjangoPBKDF2) NeedsRehash(encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	return len(parts) != 4 || parts[1] != strconv.Itoa(d.Iterations)
+}
+
+func (d DjangoPBKDF2) encode(password, salt string, iterations int) string {
+	key := pbkdf2.Key([]byte(password), []byte(salt), iterations, sha256.Size, sha256.New)
+	return fmt.Sprintf("pbkdf2_sha256$%d$%s$%s", iterations, salt, base64.StdEncoding.EncodeToString(key))
+}
+
+// SaltedSHA1 verifies salted SHA-1 hashes: sha1$<salt>$<hex of sha1(salt + password)>.
+// It exists only to verify imported hashes and must never be the current scheme.
+type SaltedSHA1 struct{}
+
+// Matches reports whether the encoded hash is a salted SHA-1 hash
+func (s SaltedSHA1) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "sha1$")
+}
+
+// Hash returns the salted SHA-1 hash of the password
+func (s SaltedSHA1) Hash(password string) (string, error) {
+	salt, err := randomSalt(8)
+	if err != nil {
+		return "", err
+	}
+	return s.encode(password, salt), nil
+}
+
+// Verify reports whether the password matches the salted SHA-1 hash
+func (s SaltedSHA1) Verify(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 {
+		return false
+	}
+	normalized := "sha1$" + parts[1] + "$" + strings.ToLower(parts[2])
+	return subtle.ConstantTimeCompare([]byte(s.encode(password, parts[1])), []byte(normalized)) == 1
+}
+
+// NeedsRehash always reports true, as SHA-1 is too weak to keep
+func (s SaltedSHA1) NeedsRehash(encoded string) bool {
+	return true
+}
+
+func (s SaltedSHA1) encode(password, salt string) string {
+	sum := sha1.Sum([]byte(salt + password))
+	return "sha1$" + salt + "$" + hex.EncodeToString(sum[:])
+}
+
+// MD5Crypt verifies FreeBSD MD5-crypt hashes as produced by PHP crypt(): $1$<salt>$<hash>.
+// It exists only to verify imported hashes and must never be the current scheme.
+type MD5Crypt struct{}
+
+const md5CryptMagic = "$1$"
+
+// Matches reports whether the encoded hash is an MD5-crypt hash
+func (m MD5Crypt) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, md5CryptMagic)
+}
+
+// Hash returns the MD5-crypt hash of the password
+func (m MD5Crypt) Hash(password string) (string, error) {
+	salt, err := randomSalt(6)
+	if err != nil {
+		return "", err
+	}
+	return md5Crypt([]byte(password), []byte(salt)), nil
+}
+
+// Verify reports whether the password matches the MD5-crypt hash
+func (m MD5Crypt) Verify(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(md5Crypt([]byte(password), []byte(parts[2]))), []byte(encoded)) == 1
+}
+
+// NeedsRehash always reports true, as MD5-crypt is too weak to keep
+func (m MD5Crypt) NeedsRehash(encoded string) bool {
+	return true
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// md5Crypt implements the FreeBSD MD5-crypt algorithm
+func md5Crypt(password, salt []byte) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.New()
+	alternate.Write(password)
+	alternate.Write(salt)
+	alternate.Write(password)
+	mixin := alternate.Sum(nil)
+
+	digest := md5.New()
+	digest.Write(password)
+	digest.Write([]byte(md5CryptMagic))
+	digest.Write(salt)
+	for i := len(password); i > 0; i -= md5.Size {
+		digest.Write(mixin[:min(i, md5.Size)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write(password[:1])
+		}
+	}
+	final := digest.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(password)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write(salt)
+		}
+		if i%7 != 0 {
+			round.Write(password)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(password)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(md5CryptMagic)
+	out.Write(salt)
+	out.WriteByte('$')
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		v := uint(final[group[0]])<<16 | uint(final[group[1]])<<8 | uint(final[group[2]])
+		writeCrypt64(&out, v, 4)
+	}
+	writeCrypt64(&out, uint(final[11]), 2)
+
+	return out.String()
+}
+
+func writeCrypt64(out *strings.Builder, v uint, n int) {
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+}
+
+// randomSalt returns n random characters from the crypt alphabet
+func randomSalt(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i := range buf {
+		buf[i] = cryptAlphabet[buf[i]&0x3f]
+	}
+	return string(buf), nil
+}
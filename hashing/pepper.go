@@ -0,0 +1,80 @@
+package hashing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// pepperPrefix marks a hash of a peppered password: $pepper$<key id><inner hash>
+const pepperPrefix = "$pepper$"
+
+// Pepper holds the secret keys used to HMAC passwords before they are hashed.
+// Every hash records the ID of the key it was made with, so keys can be rotated.
+type Pepper struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// NewPepper creates a new instance of Pepper; new hashes use the key named by currentID
+func NewPepper(currentID string, keys map[string][]byte) (*Pepper, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, errors.New("current pepper key is not configured")
+	}
+	for id := range keys {
+		if id == "" || strings.Contains(id, "$") {
+			return nil, errors.New("pepper key IDs must be non-empty and must not contain '$'")
+		}
+	}
+
+	return &Pepper{currentID: currentID, keys: keys}, nil
+}
+
+// CurrentID returns the ID of the key used for new hashes
+func (p *Pepper) CurrentID() string {
+	return p.currentID
+}
+
+// KeyIDs returns the IDs of all configured keys in sorted order
+func (p *Pepper) KeyIDs() []string {
+	ids := make([]string, 0, len(p.keys))
+	for id := range p.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// PepperPrefix returns the prefix of every hash made with the given key
+func PepperPrefix(keyID string) string {
+	return pepperPrefix + keyID
+}
+
+// apply returns the HMAC of the password under the given key
+func (p *Pepper) apply(keyID, password string) (string, bool) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return "", false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), true
+}
+
+// splitPeppered splits a peppered hash into its key ID and inner hash
+func splitPeppered(encoded string) (keyID, inner string, ok bool) {
+	if !strings.HasPrefix(encoded, pepperPrefix) {
+		return "", "", false
+	}
+
+	rest := encoded[len(pepperPrefix):]
+	i := strings.IndexByte(rest, '$')
+	if i <= 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i:], true
+}
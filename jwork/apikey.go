@@ -0,0 +1,177 @@
+package jwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"iam_backend/auth"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// API key errors
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidAPIKey  = errors.New("invalid, revoked or expired API key")
+)
+
+// maxAPIKeysPerUser bounds how many active keys a user can hold
+const maxAPIKeysPerUser = 50
+
+// APIKeyController handles business logic for users' API keys
+type APIKeyController struct {
+	apiKeyRepo *repository.APIKeyRepository
+	userRepo   *repository.UserRepository
+	auditLog   *AuditLogger
+}
+
+// NewAPIKeyController creates a new instance of APIKeyController
+func NewAPIKeyController(apiKeyRepo *repository.APIKeyRepository, userRepo *repository.UserRepository, auditLog *AuditLogger) *APIKeyController {
+	return &APIKeyController{
+		apiKeyRepo: apiKeyRepo,
+		userRepo:   userRepo,
+		auditLog:   auditLog,
+	}
+}
+
+// CreateKey creates a named key with the given scopes for the user. The key is only returned here;
+// it is stored as a hash.
+func (c *APIKeyController) CreateKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (apiKey *models.APIKey, key string, err error) {
+	entry := AuditEntry{Action: AuditAPIKeyCreated, TargetID: userID, Details: map[string]interface{}{"name": name, "scopes": scopes}}
+	defer func() {
+		entry.Err = err
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if name == "" {
+		return nil, "", errors.New("a name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !auth.ValidAPIKeyScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, "", errors.New("expires_at must be in the future")
+	}
+
+	existing, err := c.apiKeyRepo.FindByUser(ctx, userObjectID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(existing) >= maxAPIKeysPerUser {
+		return nil, "", fmt.Errorf("a user can have at most %d API keys", maxAPIKeysPerUser)
+	}
+
+	key, prefix, err := auth.NewAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	apiKey = &models.APIKey{
+		UserID:    userObjectID,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   auth.HashAPIKey(key),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	err = c.apiKeyRepo.Create(ctx, apiKey)
+	if err != nil {
+		return nil, "", err
+	}
+	entry.Details["key_id"] = apiKey.ID.Hex()
+
+	return apiKey, key, nil
+}
+
+// ListKeys returns the user's keys that are not revoked, newest first
+func (c *APIKeyController) ListKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.apiKeyRepo.FindByUser(ctx, objectID)
+}
+
+// RevokeKey revokes one of the user's keys
+func (c *APIKeyController) RevokeKey(ctx context.Context, userID, keyID string) (err error) {
+	defer func() {
+		c.auditLog.Record(ctx, AuditEntry{Action: AuditAPIKeyRevoked, TargetID: userID, Err: err, Details: map[string]interface{}{"key_id": keyID}})
+	}()
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrAPIKeyNotFound
+	}
+	keyObjectID, err := primitive.ObjectIDFromHex(keyID)
+	if err != nil {
+		return ErrAPIKeyNotFound
+	}
+
+	revoked, err := c.apiKeyRepo.Revoke(ctx, userObjectID, keyObjectID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// ValidateAPIKey checks a key and returns claims for its user, restricted to the key's scopes,
+// and records that the key was used
+func (c *APIKeyController) ValidateAPIKey(ctx context.Context, key string) (*auth.Claims, error) {
+	prefix, ok := auth.APIKeyPrefix(key)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	apiKey, err := c.apiKeyRepo.FindByPrefix(ctx, prefix)
+	if err != nil || !auth.APIKeyMatches(key, apiKey.KeyHash) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	if !apiKey.IsActive(now) {
+		return nil, ErrInvalidAPIKey
+	}
+	user, err := c.userRepo.FindByID(ctx, apiKey.UserID.Hex())
+	if err != nil || !user.IsActive() {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= touchInterval {
+		if err := c.apiKeyRepo.Touch(ctx, apiKey.ID, now); err != nil {
+			return nil, err
+		}
+	}
+
+	claims := &auth.Claims{
+		Username:  user.Username,
+		Roles:     user.Roles,
+		Scope:     auth.ScopeAPIKey,
+		KeyScopes: apiKey.Scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       apiKey.ID.Hex(),
+			Subject:  user.ID.Hex(),
+			IssuedAt: jwt.NewNumericDate(apiKey.CreatedAt),
+		},
+	}
+	if apiKey.ExpiresAt != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*apiKey.ExpiresAt)
+	}
+	return claims, nil
+}
@@ -0,0 +1,107 @@
+package jwork
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+)
+
+// AttributeController manages the schemas that define each tenant's custom user attributes
+type AttributeController struct {
+	schemaRepo *repository.AttributeSchemaRepository
+	userRepo   *repository.UserRepository
+	auditLog   *AuditLogger
+}
+
+// NewAttributeController creates a new instance of AttributeController
+func NewAttributeController(schemaRepo *repository.AttributeSchemaRepository, userRepo *repository.UserRepository, auditLog *AuditLogger) *AttributeController {
+	return &AttributeController{
+		schemaRepo: schemaRepo,
+		userRepo:   userRepo,
+		auditLog:   auditLog,
+	}
+}
+
+// EnsureIndexes creates the unique index of every unique attribute of every tenant's schema, replacing
+// indexes created before they were unique, and drops the indexes of attributes that are no longer unique.
+// Attributes whose values users already share are reported together in an error wrapping
+// ErrAttributeTaken, after the other indexes are created.
+func (c *AttributeController) EnsureIndexes(ctx context.Context) error {
+	schemas, err := c.schemaRepo.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	var shared []error
+	for _, schema := range schemas {
+		for _, name := range uniqueAttributes(schema.Attributes) {
+			err := c.userRepo.EnsureAttributeIndex(ctx, schema.Tenant, name)
+			if errors.Is(err, ErrAttributeTaken) {
+				shared = append(shared, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := c.userRepo.DropAttributeIndexes(ctx, schema.Tenant, uniqueAttributes(schema.Attributes)); err != nil {
+			return err
+		}
+	}
+	if err := c.userRepo.DropLegacyAttributeIndexes(ctx); err != nil {
+		return err
+	}
+	return errors.Join(shared...)
+}
+
+// GetSchema returns a tenant's attribute schema, which is empty if none was saved
+func (c *AttributeController) GetSchema(ctx context.Context, tenant string) (*models.AttributeSchema, error) {
+	return c.schemaRepo.FindByTenant(ctx, tenant)
+}
+
+// SaveSchema replaces a tenant's attribute schema. Stored values are not revalidated; each user's
+// attributes are checked against the new schema the next time they change.
+func (c *AttributeController) SaveSchema(ctx context.Context, tenant string, attributes []models.AttributeDefinition) (schema *models.AttributeSchema, err error) {
+	defer func() {
+		c.auditLog.Record(ctx, AuditEntry{Action: AuditAttributeSchemaSaved, Err: err, Details: map[string]interface{}{"tenant": tenant, "attributes": attributes}})
+	}()
+
+	schema = &models.AttributeSchema{Tenant: tenant, Attributes: attributes, UpdatedAt: time.Now()}
+	if err := schema.Check(); err != nil {
+		return nil, err
+	}
+
+	// Uniqueness is checked with a query on every write, and enforced by a unique index against
+	// concurrent writes
+	unique := uniqueAttributes(attributes)
+	for _, name := range unique {
+		if err := c.userRepo.EnsureAttributeIndex(ctx, tenant, name); err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.schemaRepo.Save(ctx, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attributes that were unique before must stop rejecting shared values
+	if err := c.userRepo.DropAttributeIndexes(ctx, tenant, unique); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// uniqueAttributes returns the names of the unique attributes among the definitions
+func uniqueAttributes(attributes []models.AttributeDefinition) []string {
+	var names []string
+	for _, def := range attributes {
+		if def.Unique {
+			names = append(names, def.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,175 @@
+package jwork
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"time"
+
+	"iam_backend/events"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+	"iam_backend/reqctx"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Audit actions
+const (
+	AuditUserRegistered        = events.UserRegistered
+	AuditUserImported          = events.UserImported
+	AuditLogin                 = "auth.login"
+	AuditRolesUpdated          = events.UserRolesUpdated
+	AuditUserDeactivated       = events.UserDeactivated
+	AuditUserReactivated       = events.UserReactivated
+	AuditStateChanged          = events.UserStateChanged
+	AuditPasswordChanged       = events.UserPasswordChanged
+	AuditTemporaryPasswordSet  = "user.temporary_password_set"
+	AuditUserUnlocked          = events.UserUnlocked
+	AuditUserProvisioned       = events.UserProvisioned
+	AuditProfileUpdated        = events.UserUpdated
+	AuditUserReplaced          = "user.replaced"
+	AuditPasswordSet           = "user.password_set"
+	AuditUserDeleted           = events.UserDeleted
+	AuditAuthSourceChanged     = "user.auth_source_changed"
+	AuditIdentityLinked        = "user.identity_linked"
+	AuditEmailVerified         = "user.email_verified"
+	AuditSAMLAssertionIssued   = "saml.assertion_issued"
+	AuditAPIKeyCreated         = "api_key.created"
+	AuditAPIKeyRevoked         = "api_key.revoked"
+	AuditServiceAccountCreated = events.ServiceAccountCreated
+	AuditClientSecretRotated   = "service_account.client_secret_rotated"
+	AuditClientCredentials     = "auth.client_credentials"
+	AuditAttributesUpdated     = "user.attributes_updated"
+	AuditAttributeSchemaSaved  = "attribute_schema.saved"
+	AuditUserDataExported      = "user.data_exported"
+	AuditUserErased            = events.UserErased
+	AuditUserDeprovisioned     = events.UserDeprovisioned
+	AuditOwnerTransferred      = events.ServiceAccountOwnerTransferred
+	AuditGroupCreated          = "group.created"
+	AuditGroupUpdated          = "group.updated"
+	AuditGroupDeleted          = "group.deleted"
+)
+
+// redacted replaces the values of sensitive fields in audit diffs
+const redacted = "[redacted]"
+
+// auditIgnoredFields change on every write and would only add noise to diffs
+var auditIgnoredFields = map[string]bool{"updated_at": true}
+
+// auditSensitiveFields are reported as changed without their values
+var auditSensitiveFields = map[string]bool{"password_hash": true, "password_history": true}
+
+// AuditEntry describes an operation to be recorded
+type AuditEntry struct {
+	Action   string
+	ActorID  string // overrides the actor taken from the context, e.g. for logins
+	TargetID string
+	Before   *models.User // state before the operation, if any
+	After    *models.User // state after the operation, if it changed the user
+	Err      error        // error the operation failed with, if any
+	Details  map[string]interface{}
+}
+
+// AuditLogger records identity operations in the append-only audit log
+type AuditLogger struct {
+	auditRepo *repository.AuditRepository
+}
+
+// NewAuditLogger creates a new instance of AuditLogger
+func NewAuditLogger(auditRepo *repository.AuditRepository) *AuditLogger {
+	return &AuditLogger{
+		auditRepo: auditRepo,
+	}
+}
+
+// Record writes an audit event for the entry, taking the actor, IP and request ID from the context.
+// Failures to write are logged rather than failing the audited operation.
+func (l *AuditLogger) Record(ctx context.Context, entry AuditEntry) {
+	info := reqctx.From(ctx)
+	if entry.ActorID != "" {
+		info.ActorID = entry.ActorID
+	}
+	event := &models.AuditEvent{
+		Action:     entry.Action,
+		ActorID:    info.ActorID,
+		TargetID:   entry.TargetID,
+		Outcome:    models.AuditSuccess,
+		Details:    entry.Details,
+		IP:         info.IP,
+		UserAgent:  info.UserAgent,
+		RequestID:  info.RequestID,
+		OccurredAt: time.Now(),
+	}
+	if entry.Err != nil {
+		event.Outcome = models.AuditFailure
+		event.Error = entry.Err.Error()
+	}
+	if entry.After != nil {
+		event.Changes = diffUsers(entry.Before, entry.After)
+	}
+
+	// Audit writes must not be cut short by a client disconnecting
+	if err := l.auditRepo.Insert(context.WithoutCancel(ctx), event); err != nil {
+		log.Printf("Failed to write audit event %s for %s: %v", event.Action, event.TargetID, err)
+	}
+}
+
+// QueryEvents returns up to limit audit events matching the filter, newest first
+func (l *AuditLogger) QueryEvents(ctx context.Context, filter repository.AuditFilter, limit int64) ([]models.AuditEvent, error) {
+	return l.auditRepo.Find(ctx, filter, limit)
+}
+
+// ExportEvents passes the audit events matching the filter to fn, oldest first
+func (l *AuditLogger) ExportEvents(ctx context.Context, filter repository.AuditFilter, fn func(event *models.AuditEvent) error) error {
+	return l.auditRepo.Stream(ctx, filter, fn)
+}
+
+// diffUsers returns the fields that differ between two user states
+func diffUsers(before, after *models.User) map[string]models.AuditChange {
+	beforeFields := userFields(before)
+	afterFields := userFields(after)
+
+	changes := map[string]models.AuditChange{}
+	for _, fields := range []bson.M{beforeFields, afterFields} {
+		for key := range fields {
+			if _, seen := changes[key]; seen || auditIgnoredFields[key] {
+				continue
+			}
+			if reflect.DeepEqual(beforeFields[key], afterFields[key]) {
+				continue
+			}
+			if auditSensitiveFields[key] {
+				changes[key] = models.AuditChange{Before: redacted, After: redacted}
+				continue
+			}
+			changes[key] = models.AuditChange{Before: beforeFields[key], After: afterFields[key]}
+		}
+	}
+	return changes
+}
+
+// userFields flattens a user into its stored fields
+func userFields(user *models.User) bson.M {
+	fields := bson.M{}
+	if user == nil {
+		return fields
+	}
+
+	// Client secrets are nested in the service account, so they are redacted before flattening;
+	// rotations still show up through the secret's creation time
+	if user.ServiceAccount != nil && user.ServiceAccount.ClientSecretHash != "" {
+		account := *user.ServiceAccount
+		account.ClientSecretHash = redacted
+		copied := *user
+		copied.ServiceAccount = &account
+		user = &copied
+	}
+
+	data, err := bson.Marshal(user)
+	if err != nil {
+		return fields
+	}
+	bson.Unmarshal(data, &fields)
+	return fields
+}
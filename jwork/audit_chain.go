@@ -0,0 +1,128 @@
+package jwork
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"iam_backend/auditchain"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrNoSigningKey is returned when checkpoints are requested without a signing key
+var ErrNoSigningKey = errors.New("no audit signing key is configured")
+
+// AuditChain signs checkpoints of the hash-chained audit log and verifies it
+type AuditChain struct {
+	auditRepo      *repository.AuditRepository
+	checkpointRepo *repository.AuditCheckpointRepository
+	signer         *auditchain.Signer // nil when checkpoints are not signed
+	keys           auditchain.KeySet
+}
+
+// NewAuditChain creates a new instance of AuditChain
+func NewAuditChain(auditRepo *repository.AuditRepository, checkpointRepo *repository.AuditCheckpointRepository, signer *auditchain.Signer, keys auditchain.KeySet) *AuditChain {
+	return &AuditChain{
+		auditRepo:      auditRepo,
+		checkpointRepo: checkpointRepo,
+		signer:         signer,
+		keys:           keys,
+	}
+}
+
+// Checkpoint signs the head of every tenant's chain that has grown since its last checkpoint
+func (c *AuditChain) Checkpoint(ctx context.Context) error {
+	if c.signer == nil {
+		return ErrNoSigningKey
+	}
+
+	tenants, err := c.auditRepo.Tenants(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		head, err := c.auditRepo.Head(ctx, tenant)
+		if err != nil {
+			return err
+		}
+		latest, err := c.checkpointRepo.Latest(ctx, tenant)
+		if err != nil {
+			return err
+		}
+		if head == nil || (latest != nil && latest.Sequence >= head.Sequence) {
+			continue
+		}
+
+		checkpoint := &models.AuditCheckpoint{
+			Tenant:   tenant,
+			Sequence: head.Sequence,
+			Hash:     head.Hash,
+			SignedAt: time.Now().UTC(),
+		}
+		c.signer.Sign(checkpoint)
+		err = c.checkpointRepo.Insert(ctx, checkpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunCheckpoints signs checkpoints every interval until ctx is cancelled
+func (c *AuditChain) RunCheckpoints(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Checkpoint(ctx); err != nil {
+				log.Printf("Failed to checkpoint audit chains: %v", err)
+			}
+		}
+	}
+}
+
+// Verify walks the tenant's chain and reports the first break, if any
+func (c *AuditChain) Verify(ctx context.Context, tenant string) (*auditchain.Report, error) {
+	checkpoints, err := c.checkpointRepo.FindByTenant(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := auditchain.NewVerifier(tenant, c.keys, checkpoints)
+	err = c.auditRepo.Walk(ctx, tenant, func(doc bson.Raw) bool {
+		return verifier.Next(doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return verifier.Finish(), nil
+}
+
+// VerifyAll verifies the chain of every tenant
+func (c *AuditChain) VerifyAll(ctx context.Context) ([]*auditchain.Report, error) {
+	tenants, err := c.auditRepo.Tenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*auditchain.Report, 0, len(tenants))
+	for _, tenant := range tenants {
+		report, err := c.Verify(ctx, tenant)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
@@ -0,0 +1,431 @@
+package jwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"iam_backend/events"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+	"iam_backend/reqctx"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DeprovisionPolicy configures the deprovisioning worker
+type DeprovisionPolicy struct {
+	FallbackOwner string        // user who takes over service accounts when the actor cannot, empty for none
+	BatchSize     int64         // due jobs read per pass
+	PollInterval  time.Duration // wait between passes when there is nothing to do
+	Lease         time.Duration // how long a worker holds a job while running it
+	BaseDelay     time.Duration // retry delay after the first failure, doubled after each further failure
+	MaxDelay      time.Duration // upper bound for the retry delay
+}
+
+// DefaultDeprovisionPolicy returns the deprovisioning policy used when none is configured
+func DefaultDeprovisionPolicy() DeprovisionPolicy {
+	return DeprovisionPolicy{
+		BatchSize:    50,
+		PollInterval: 5 * time.Second,
+		Lease:        time.Minute,
+		BaseDelay:    5 * time.Second,
+		MaxDelay:     10 * time.Minute,
+	}
+}
+
+// Deprovisioner removes the access of deactivated and deleted users: it revokes their sessions and API keys,
+// suspends or removes their group memberships, hands their service accounts to another owner and emits
+// a user.deprovisioned event. Jobs are enqueued with the change that triggers them and run step by step;
+// an interrupted job is retried by the worker and resumes at the first step it did not complete.
+type Deprovisioner struct {
+	jobRepo     *repository.DeprovisioningRepository
+	userRepo    *repository.UserRepository
+	sessionRepo *repository.SessionRepository
+	apiKeyRepo  *repository.APIKeyRepository
+	groupRepo   *repository.GroupRepository
+	outbox      *Outbox
+	tx          Transactor
+	auditLog    *AuditLogger
+	policy      DeprovisionPolicy
+}
+
+// NewDeprovisioner creates a new instance of Deprovisioner
+func NewDeprovisioner(jobRepo *repository.DeprovisioningRepository, userRepo *repository.UserRepository, sessionRepo *repository.SessionRepository, apiKeyRepo *repository.APIKeyRepository, groupRepo *repository.GroupRepository, outbox *Outbox, tx Transactor, auditLog *AuditLogger, policy DeprovisionPolicy) *Deprovisioner {
+	return &Deprovisioner{
+		jobRepo:     jobRepo,
+		userRepo:    userRepo,
+		sessionRepo: sessionRepo,
+		apiKeyRepo:  apiKeyRepo,
+		groupRepo:   groupRepo,
+		outbox:      outbox,
+		tx:          tx,
+		auditLog:    auditLog,
+		policy:      policy,
+	}
+}
+
+// Enqueue records a deprovisioning job for a user. Call it with the transaction's context of the change
+// that triggers it, so the job exists if and only if the change commits. Deleting a user supersedes
+// any deactivation job still pending for them.
+func (d *Deprovisioner) Enqueue(ctx context.Context, userID primitive.ObjectID, trigger, actorID string) (*models.DeprovisioningJob, error) {
+	if trigger == models.DeprovisionDeleted {
+		if err := d.jobRepo.CancelDeactivations(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	job := models.NewDeprovisioningJob(userID, trigger, actorID)
+	if err := d.jobRepo.Create(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Restore undoes what can be undone for a reactivated user: pending deactivation jobs are cancelled and
+// suspended group memberships restored. Revoked sessions and API keys stay revoked.
+func (d *Deprovisioner) Restore(ctx context.Context, userID primitive.ObjectID) error {
+	if err := d.jobRepo.CancelDeactivations(ctx, userID); err != nil {
+		return err
+	}
+	_, err := d.groupRepo.RestoreMember(ctx, userID)
+	return err
+}
+
+// ListJobs returns a user's deprovisioning jobs, newest first
+func (d *Deprovisioner) ListJobs(ctx context.Context, userID string) ([]models.DeprovisioningJob, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+	return d.jobRepo.FindByUser(ctx, id)
+}
+
+// Run processes due jobs until ctx is cancelled
+func (d *Deprovisioner) Run(ctx context.Context) {
+	for {
+		processed, err := d.RunOnce(ctx)
+		if err != nil {
+			log.Printf("Deprovisioning worker failed: %v", err)
+		}
+		if processed > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.policy.PollInterval):
+		}
+	}
+}
+
+// RunOnce makes one pass over the due jobs and returns how many it finished. Failed jobs are scheduled for a retry.
+func (d *Deprovisioner) RunOnce(ctx context.Context) (int, error) {
+	jobs, err := d.jobRepo.FindDue(ctx, time.Now(), d.policy.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	for i := range jobs {
+		job := &jobs[i]
+		if err := d.Process(ctx, job); err != nil {
+			log.Printf("Deprovisioning job %s for user %s failed: %v", job.ID.Hex(), job.UserID.Hex(), err)
+			continue
+		}
+		processed++
+	}
+
+	return processed, nil
+}
+
+// Process claims a job and runs its remaining steps. If a step fails the job is scheduled for a retry
+// and the error returned; a job held by another worker is left alone, and a worker that loses its hold
+// on a job, because it was cancelled or its lease ran out, stops without changing it further.
+func (d *Deprovisioner) Process(ctx context.Context, job *models.DeprovisioningJob) error {
+	now := time.Now()
+	claimed, err := d.jobRepo.Claim(ctx, job, now, now.Add(d.policy.Lease))
+	if err != nil || !claimed {
+		return err
+	}
+
+	err = d.process(reqctx.WithActor(ctx, job.ActorID), job)
+	if errors.Is(err, repository.ErrJobNotHeld) {
+		return nil
+	}
+	if err != nil {
+		job.Failures++
+		next := time.Now().Add(d.retryDelay(job.Failures))
+		markErr := d.jobRepo.MarkFailed(ctx, job, job.Failures, err.Error(), next)
+		if errors.Is(markErr, repository.ErrJobNotHeld) {
+			return nil
+		}
+		if markErr != nil {
+			return markErr
+		}
+		return err
+	}
+	return nil
+}
+
+// process runs the steps of a claimed job that have not completed yet, checking before each step
+// that the job still applies
+func (d *Deprovisioner) process(ctx context.Context, job *models.DeprovisioningJob) error {
+	for _, step := range models.DeprovisioningSteps {
+		if job.StepDone(step) {
+			continue
+		}
+		if err := d.check(ctx, job); err != nil {
+			return err
+		}
+		if err := d.runStep(ctx, job, step); err != nil {
+			return fmt.Errorf("%s: %w", step, err)
+		}
+	}
+
+	err := d.jobRepo.MarkCompleted(ctx, job, time.Now())
+	if err != nil {
+		return err
+	}
+	d.auditLog.Record(ctx, AuditEntry{
+		Action:   AuditUserDeprovisioned,
+		ActorID:  job.ActorID,
+		TargetID: job.UserID.Hex(),
+		Details:  map[string]interface{}{"job_id": job.ID.Hex(), "trigger": job.Trigger, "results": job.Results},
+	})
+	return nil
+}
+
+// check returns ErrJobNotHeld if the job is no longer pending under the worker's claim, and cancels
+// a deactivation job whose user was reactivated after it was enqueued
+func (d *Deprovisioner) check(ctx context.Context, job *models.DeprovisioningJob) error {
+	stored, err := d.jobRepo.FindByID(ctx, job.ID)
+	if err == mongo.ErrNoDocuments {
+		return repository.ErrJobNotHeld
+	}
+	if err != nil {
+		return err
+	}
+	if stored.Status != models.JobPending || stored.ClaimID != job.ClaimID {
+		return repository.ErrJobNotHeld
+	}
+
+	if job.Trigger != models.DeprovisionDeactivated {
+		return nil
+	}
+	user, err := d.userRepo.FindByID(ctx, job.UserID.Hex())
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.IsActive() {
+		if err := d.jobRepo.MarkCancelled(ctx, job, time.Now()); err != nil {
+			return err
+		}
+		return repository.ErrJobNotHeld
+	}
+	return nil
+}
+
+// runStep runs one step of a job and records it as completed. Every step can be repeated safely.
+func (d *Deprovisioner) runStep(ctx context.Context, job *models.DeprovisioningJob, step string) error {
+	var changed int64
+	var err error
+	switch step {
+	case models.StepRevokeSessions:
+		changed, err = d.sessionRepo.RevokeAllByUser(ctx, job.UserID, primitive.NilObjectID)
+	case models.StepRevokeAPIKeys:
+		changed, err = d.apiKeyRepo.RevokeAllByUser(ctx, job.UserID)
+	case models.StepGroupMemberships:
+		if job.Trigger == models.DeprovisionDeleted {
+			changed, err = d.groupRepo.RemoveMember(ctx, job.UserID)
+		} else {
+			changed, err = d.groupRepo.SuspendMember(ctx, job.UserID)
+		}
+	case models.StepServiceAccounts:
+		changed, err = d.transferServiceAccounts(ctx, job)
+	case models.StepEmitEvent:
+		// The event and the step's completion commit together, so the event is emitted once. The step is
+		// completed first: only the worker holding the job can complete it, so no other worker stages the event.
+		return d.tx.WithTransaction(ctx, func(ctx context.Context) error {
+			if err := d.jobRepo.CompleteStep(ctx, job, step, 1); err != nil {
+				return err
+			}
+			return d.outbox.Stage(ctx, deprovisionedEvent(job))
+		})
+	default:
+		return fmt.Errorf("unknown step %q", step)
+	}
+	if err != nil {
+		return err
+	}
+	return d.jobRepo.CompleteStep(ctx, job, step, changed)
+}
+
+// transferServiceAccounts hands the service accounts owned by the job's user to a new owner and returns
+// how many were transferred. Without a possible owner the accounts are suspended instead.
+func (d *Deprovisioner) transferServiceAccounts(ctx context.Context, job *models.DeprovisioningJob) (int64, error) {
+	accounts, err := d.userRepo.FindServiceAccounts(ctx, []primitive.ObjectID{job.UserID})
+	if err != nil || len(accounts) == 0 {
+		return 0, err
+	}
+
+	owner, err := d.newOwner(ctx, job)
+	if err != nil {
+		return 0, err
+	}
+
+	var transferred int64
+	for i := range accounts {
+		account := &accounts[i]
+		if account.ServiceAccount.OwnerType != models.OwnerTypeUser {
+			continue
+		}
+		// The user may have been reactivated since the previous account
+		if err := d.check(ctx, job); err != nil {
+			return transferred, err
+		}
+
+		var applied bool
+		if owner.IsZero() {
+			if !account.IsActive() {
+				continue
+			}
+			from := account.State
+			applied, err = d.updateAccount(ctx, job, account, AuditStateChanged, events.UserStateChanged, func(ctx context.Context, account *models.User) (bool, error) {
+				now := time.Now()
+				if err := account.Transition(models.StateSuspended, "owner deprovisioned without a new owner", now); err != nil {
+					return false, err
+				}
+				account.UpdatedAt = now
+				return d.userRepo.UpdateServiceAccountState(ctx, account, job.UserID, from)
+			})
+		} else {
+			applied, err = d.updateAccount(ctx, job, account, AuditOwnerTransferred, events.ServiceAccountOwnerTransferred, func(ctx context.Context, account *models.User) (bool, error) {
+				return d.userRepo.TransferServiceAccount(ctx, account.ID, job.UserID, owner, time.Now())
+			})
+		}
+		if err != nil {
+			return transferred, err
+		}
+		if applied && !owner.IsZero() {
+			transferred++
+		}
+	}
+
+	return transferred, nil
+}
+
+// newOwner picks who takes over the job's service accounts: the actor who triggered the job, unless that
+// is the user themself, or else the policy's fallback owner. Either must be an active person.
+// It returns a zero ID if neither is.
+func (d *Deprovisioner) newOwner(ctx context.Context, job *models.DeprovisioningJob) (primitive.ObjectID, error) {
+	if job.NewOwnerID != "" {
+		return primitive.ObjectIDFromHex(job.NewOwnerID)
+	}
+
+	for _, candidate := range []string{job.ActorID, d.policy.FallbackOwner} {
+		if candidate == "" || candidate == job.UserID.Hex() {
+			continue
+		}
+		user, err := d.userRepo.FindByID(ctx, candidate)
+		if err == mongo.ErrNoDocuments || err == primitive.ErrInvalidHex {
+			continue
+		}
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		if !user.IsActive() || user.IsServiceAccount() {
+			continue
+		}
+
+		if err := d.jobRepo.SetNewOwner(ctx, job, candidate); err != nil {
+			return primitive.NilObjectID, err
+		}
+		job.NewOwnerID = candidate
+		return user.ID, nil
+	}
+
+	return primitive.NilObjectID, nil
+}
+
+// updateAccount changes a service account owned by the job's user with write and stages eventType in the
+// outbox, recording the change in the audit log. write updates only the fields it changes, and reports false
+// without writing if the account no longer belongs to the job's user or changed state meanwhile; the account
+// is then left alone. The write renews the worker's hold on the job in the same transaction, so it does not
+// happen once the job was cancelled, e.g. because the user was reactivated.
+func (d *Deprovisioner) updateAccount(ctx context.Context, job *models.DeprovisioningJob, account *models.User, action, eventType string, write func(ctx context.Context, account *models.User) (bool, error)) (applied bool, err error) {
+	before := *account
+	entry := AuditEntry{
+		Action:   action,
+		ActorID:  job.ActorID,
+		TargetID: account.ID.Hex(),
+		Before:   &before,
+		Details:  map[string]interface{}{"deprovisioned_owner_id": job.UserID.Hex()},
+	}
+	defer func() {
+		if applied || (err != nil && !errors.Is(err, repository.ErrJobNotHeld)) {
+			entry.Err = err
+			d.auditLog.Record(ctx, entry)
+		}
+	}()
+
+	var after *models.User
+	err = d.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		applied = false
+		if err := d.jobRepo.Renew(ctx, job, time.Now().Add(d.policy.Lease)); err != nil {
+			return err
+		}
+		ok, err := write(ctx, account)
+		if err != nil || !ok {
+			return err
+		}
+		after, err = d.userRepo.FindByID(ctx, account.ID.Hex())
+		if err != nil {
+			return err
+		}
+		applied = true
+		return d.outbox.Stage(ctx, userEvent(ctx, eventType, after))
+	})
+	if err != nil {
+		applied = false
+		return false, err
+	}
+	entry.After = after
+
+	return applied, nil
+}
+
+func (d *Deprovisioner) retryDelay(failures int) time.Duration {
+	delay := d.policy.BaseDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if d.policy.MaxDelay > 0 && delay >= d.policy.MaxDelay {
+			return d.policy.MaxDelay
+		}
+	}
+	return delay
+}
+
+// deprovisionedEvent describes a finished deprovisioning. It names only the user ID, as the user may be erased.
+func deprovisionedEvent(job *models.DeprovisioningJob) events.Event {
+	data := map[string]interface{}{"trigger": job.Trigger}
+	for _, step := range models.DeprovisioningSteps {
+		if step != models.StepEmitEvent {
+			data[step] = job.Results[step]
+		}
+	}
+	if job.NewOwnerID != "" {
+		data["new_owner_id"] = job.NewOwnerID
+	}
+
+	event := events.New(events.UserDeprovisioned, job.UserID.Hex(), data)
+	event.ActorID = job.ActorID
+	return event
+}
@@ -0,0 +1,262 @@
+package jwork
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/events"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Federation errors
+var (
+	ErrUnknownProvider  = errors.New("unknown identity provider")
+	ErrInvalidOIDCState = errors.New("the sign-in has expired or was already completed")
+	ErrUnverifiedEmail  = errors.New("the identity provider has not verified the email address")
+	ErrLinkRequired     = errors.New("a user with this email already exists; sign in and link the provider account from the user")
+	ErrIdentityLinked   = errors.New("the provider account is linked to another user")
+)
+
+// OIDCLoginTTL is how long a user has to complete a sign-in at the provider
+const OIDCLoginTTL = 10 * time.Minute
+
+// FederationController signs users in through upstream OpenID Connect providers
+type FederationController struct {
+	users     *UserController
+	loginRepo *repository.OIDCLoginRepository
+	providers map[string]*auth.OIDCProvider
+}
+
+// NewFederationController creates a new instance of FederationController
+func NewFederationController(users *UserController, loginRepo *repository.OIDCLoginRepository, providers ...*auth.OIDCProvider) *FederationController {
+	c := &FederationController{
+		users:     users,
+		loginRepo: loginRepo,
+		providers: map[string]*auth.OIDCProvider{},
+	}
+	for _, provider := range providers {
+		c.providers[provider.Name()] = provider
+	}
+	return c
+}
+
+// Providers lists the names of the configured providers
+func (c *FederationController) Providers() []string {
+	names := make([]string, 0, len(c.providers))
+	for name := range c.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BeginLogin starts a sign-in at the provider. It returns the URL to redirect the user to and a
+// binding the browser must present with the callback, so that a callback cannot be completed in
+// a browser other than the one that started the sign-in.
+func (c *FederationController) BeginLogin(ctx context.Context, providerName string) (redirectURL, binding string, err error) {
+	return c.begin(ctx, providerName, "")
+}
+
+// BeginLink starts a sign-in at the provider that links the provider account to the signed-in user
+// when it completes. It returns the same as BeginLogin.
+func (c *FederationController) BeginLink(ctx context.Context, providerName, userID string) (redirectURL, binding string, err error) {
+	return c.begin(ctx, providerName, userID)
+}
+
+func (c *FederationController) begin(ctx context.Context, providerName, linkUserID string) (string, string, error) {
+	provider, ok := c.providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	values := make([]string, 4)
+	for i := range values {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return "", "", err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(secret)
+	}
+
+	now := time.Now()
+	login := &models.OIDCLogin{
+		State:        values[0],
+		Provider:     providerName,
+		Nonce:        values[1],
+		CodeVerifier: values[2],
+		BindingHash:  auth.HashAPIKey(values[3]),
+		LinkUserID:   linkUserID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(OIDCLoginTTL),
+	}
+	redirectURL, err := provider.AuthCodeURL(ctx, login.State, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = c.loginRepo.Create(ctx, login)
+	if err != nil {
+		return "", "", err
+	}
+
+	return redirectURL, values[3], nil
+}
+
+// CompleteLogin handles the provider's callback: it checks the state against the browser's binding,
+// redeems the code, validates the ID token and returns the user the upstream account is linked to.
+// A sign-in started by BeginLink links the account to the user who started it. Otherwise an account
+// that is not linked yet gets a new user, unless a user already has its email: that user has to sign
+// in and link the account, since nothing shows that they own it.
+func (c *FederationController) CompleteLogin(ctx context.Context, providerName, state, binding, code string) (result *AuthResult, err error) {
+	provider, ok := c.providers[providerName]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	entry := AuditEntry{Action: AuditLogin, Details: map[string]interface{}{"source": providerName}}
+	defer func() {
+		entry.Err = err
+		if err == nil {
+			entry.ActorID = entry.TargetID
+			entry.After = result.User
+		}
+		c.users.auditLog.Record(ctx, entry)
+	}()
+
+	// The state is consumed first, so a replayed callback fails even if the code is still valid
+	login, err := c.loginRepo.Consume(ctx, state)
+	if err != nil || login.Provider != providerName || time.Now().After(login.ExpiresAt) || !auth.APIKeyMatches(binding, login.BindingHash) {
+		return nil, ErrInvalidOIDCState
+	}
+
+	identity, err := provider.Exchange(ctx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	entry.Details["subject"] = identity.Subject
+	entry.Details["email"] = identity.Email
+
+	var user *models.User
+	if login.LinkUserID != "" {
+		entry.Details["link"] = true
+		user, err = c.linkToUser(ctx, login.LinkUserID, identity)
+	} else {
+		user, err = c.resolveUser(ctx, identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+	before := *user
+	entry.TargetID = user.ID.Hex()
+	entry.Before = &before
+	if err := user.CheckActive(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user.LastLogin = &now
+	err = c.users.userRepo.UpdateLastLogin(ctx, user.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	claimAttributes, err := c.users.ClaimAttributes(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResult{User: user, ClaimAttributes: claimAttributes}, nil
+}
+
+// resolveUser finds the user linked to the upstream account, linking or provisioning one if needed
+func (c *FederationController) resolveUser(ctx context.Context, identity *auth.OIDCIdentity) (*models.User, error) {
+	user, err := c.users.userRepo.FindByIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	// Matching by email would let anyone who can register an unverified address at the provider take over the account
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, ErrUnverifiedEmail
+	}
+
+	// Nothing shows that the owner of the provider account is the user with the same email, so the
+	// user has to confirm the link by signing in
+	_, err = c.users.userRepo.FindByEmail(ctx, identity.Email)
+	if err == nil {
+		return nil, ErrLinkRequired
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	username, err := c.availableUsername(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+	user, err = c.users.provisionExternalUser(ctx, &auth.Identity{Username: username, Email: identity.Email}, auth.OIDCSource(identity.Provider))
+	if err != nil {
+		return nil, err
+	}
+	return c.linkIdentity(ctx, user.ID.Hex(), identity)
+}
+
+// linkToUser links the upstream account to the user who started the sign-in, unless another user has it
+func (c *FederationController) linkToUser(ctx context.Context, userID string, identity *auth.OIDCIdentity) (*models.User, error) {
+	linked, err := c.users.userRepo.FindByIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil && linked.ID.Hex() != userID {
+		return nil, ErrIdentityLinked
+	}
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	return c.linkIdentity(ctx, userID, identity)
+}
+
+// linkIdentity records the upstream account on the user
+func (c *FederationController) linkIdentity(ctx context.Context, userID string, identity *auth.OIDCIdentity) (*models.User, error) {
+	var linked *models.User
+	err := c.users.mutateUser(ctx, AuditIdentityLinked, events.UserUpdated, userID, func(user *models.User) error {
+		user.LinkIdentity(identity.Provider, identity.Subject, identity.Email)
+		linked = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return linked, nil
+}
+
+// availableUsername picks the first free username among the provider's preferred username,
+// the local part of the email and the email itself
+func (c *FederationController) availableUsername(ctx context.Context, identity *auth.OIDCIdentity) (string, error) {
+	localPart, _, _ := strings.Cut(identity.Email, "@")
+	for _, candidate := range []string{identity.PreferredUsername, localPart, identity.Email} {
+		if candidate == "" || strings.HasPrefix(strings.ToLower(candidate), models.ServiceAccountPrefix) {
+			continue
+		}
+		taken, err := c.users.userRepo.IsTaken(ctx, candidate, identity.Email, primitive.NilObjectID)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+	return "", repository.ErrUserExists
+}
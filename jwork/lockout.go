@@ -0,0 +1,187 @@
+package jwork
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"iam_backend/events"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LockoutPolicy configures login throttling and temporary account lockout
+type LockoutPolicy struct {
+	MaxFailedAttempts int           // failures within Window that trigger a lockout
+	Window            time.Duration // period over which failures are counted
+	LockoutDuration   time.Duration // how long a locked account stays locked
+	BaseDelay         time.Duration // delay after the first failure, doubled after each further failure
+	MaxDelay          time.Duration // upper bound for the progressive delay
+}
+
+// DefaultLockoutPolicy returns the lockout policy used when none is configured
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxFailedAttempts: 5,
+		Window:            15 * time.Minute,
+		LockoutDuration:   15 * time.Minute,
+		BaseDelay:         time.Second,
+		MaxDelay:          30 * time.Second,
+	}
+}
+
+// DelayAfter returns the delay imposed after the given number of failures in the current window
+func (p LockoutPolicy) DelayAfter(failures int) time.Duration {
+	if failures <= 0 || p.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+
+	return delay
+}
+
+// LoginBlockedError is returned when a login is refused because of lockout or throttling
+type LoginBlockedError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("account is locked, retry in %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// LoginGuard enforces the lockout policy using counters shared through the database
+type LoginGuard struct {
+	attempts *repository.LoginAttemptRepository
+	policy   LockoutPolicy
+	events   events.Publisher
+}
+
+// NewLoginGuard creates a new instance of LoginGuard
+func NewLoginGuard(attempts *repository.LoginAttemptRepository, policy LockoutPolicy, publisher events.Publisher) *LoginGuard {
+	return &LoginGuard{
+		attempts: attempts,
+		policy:   policy,
+		events:   publisher,
+	}
+}
+
+// Begin counts a login attempt before the password is checked, returning a LoginBlockedError if the user may
+// not attempt to log in right now. The attempt counts as failed until RecordSuccess clears it, so no more than
+// MaxFailedAttempts passwords are tried per window however many guesses arrive at once.
+func (g *LoginGuard) Begin(ctx context.Context, user *models.User) error {
+	return g.begin(ctx, user.ID)
+}
+
+// BeginExternal is Begin for a login without a local account, which an external store may still accept.
+// Its attempts are counted per login name.
+func (g *LoginGuard) BeginExternal(ctx context.Context, login string) error {
+	return g.begin(ctx, externalLoginKey(login))
+}
+
+func (g *LoginGuard) begin(ctx context.Context, key primitive.ObjectID) error {
+	attempt, admitted, err := g.attempts.RecordAttempt(ctx, key, g.policy.Window, g.policy.MaxFailedAttempts)
+	if err != nil || admitted {
+		return err
+	}
+
+	now := time.Now()
+	switch {
+	case attempt.IsLocked(now):
+		return &LoginBlockedError{Locked: true, RetryAfter: attempt.LockedUntil.Sub(now)}
+	case attempt.NextAttemptAt != nil && now.Before(*attempt.NextAttemptAt):
+		return &LoginBlockedError{RetryAfter: attempt.NextAttemptAt.Sub(now)}
+	}
+	// The limit is reached by attempts still in progress; the last of them to fail locks the account
+	return &LoginBlockedError{RetryAfter: g.policy.BaseDelay}
+}
+
+// RecordFailure applies a delay or lockout as required after an attempt counted by Begin failed
+func (g *LoginGuard) RecordFailure(ctx context.Context, user *models.User) error {
+	attempt, err := g.recordFailure(ctx, user.ID)
+	if err != nil || attempt == nil {
+		return err
+	}
+
+	g.events.Publish(ctx, events.New(events.UserLocked, user.ID.Hex(), map[string]interface{}{
+		"failed_attempts": attempt.FailedCount,
+		"locked_until":    *attempt.LockedUntil,
+	}))
+	return nil
+}
+
+// RecordExternalFailure is RecordFailure for an attempt counted by BeginExternal
+func (g *LoginGuard) RecordExternalFailure(ctx context.Context, login string) error {
+	_, err := g.recordFailure(ctx, externalLoginKey(login))
+	return err
+}
+
+// recordFailure returns the counter with the lockout it applied, or nil if it applied none
+func (g *LoginGuard) recordFailure(ctx context.Context, key primitive.ObjectID) (*models.LoginAttempt, error) {
+	attempt, err := g.attempts.FindByUserID(ctx, key)
+	if err != nil || attempt == nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if g.policy.MaxFailedAttempts > 0 && attempt.FailedCount >= g.policy.MaxFailedAttempts {
+		until := now.Add(g.policy.LockoutDuration)
+		locked, err := g.attempts.Lock(ctx, key, until)
+		if err != nil || !locked {
+			return nil, err
+		}
+		attempt.LockedUntil = &until
+		return attempt, nil
+	}
+
+	if delay := g.policy.DelayAfter(attempt.FailedCount); delay > 0 {
+		return nil, g.attempts.SetNextAttemptAt(ctx, key, now.Add(delay))
+	}
+
+	return nil, nil
+}
+
+// RecordSuccess clears the failure counter after a successful login
+func (g *LoginGuard) RecordSuccess(ctx context.Context, user *models.User) error {
+	return g.attempts.Reset(ctx, user.ID)
+}
+
+// RecordExternalSuccess is RecordSuccess for an attempt counted by BeginExternal
+func (g *LoginGuard) RecordExternalSuccess(ctx context.Context, login string) error {
+	return g.attempts.Reset(ctx, externalLoginKey(login))
+}
+
+// externalLoginKey derives the key counting the attempts of a login name from the name, so that the
+// counters share the collection and code of those of users
+func externalLoginKey(login string) primitive.ObjectID {
+	sum := sha256.Sum256([]byte("login:" + strings.ToLower(strings.TrimSpace(login))))
+	var key primitive.ObjectID
+	copy(key[:], sum[:])
+	return key
+}
+
+// Unlock clears any lockout for the user on behalf of an administrator
+func (g *LoginGuard) Unlock(ctx context.Context, userID primitive.ObjectID, actorID string) error {
+	if err := g.attempts.Reset(ctx, userID); err != nil {
+		return err
+	}
+
+	event := events.New(events.UserUnlocked, userID.Hex(), nil)
+	event.ActorID = actorID
+	g.events.Publish(ctx, event)
+	return nil
+}
@@ -0,0 +1,199 @@
+package jwork
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"iam_backend/events"
+	models "iam_backend/models"
+	"iam_backend/outbox"
+	repository "iam_backend/repo"
+)
+
+// Transactor runs a function atomically; writes that use the context passed to fn take part in the transaction
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// NoTransactor runs functions without a transaction, for MongoDB deployments that do not support them.
+// A crash between a change and its outbox write then loses the event.
+type NoTransactor struct{}
+
+// WithTransaction calls fn directly
+func (NoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// Outbox stages events in the outbox collection, from where the OutboxRelay publishes them
+type Outbox struct {
+	outboxRepo *repository.OutboxRepository
+}
+
+// NewOutbox creates a new instance of Outbox
+func NewOutbox(outboxRepo *repository.OutboxRepository) *Outbox {
+	return &Outbox{
+		outboxRepo: outboxRepo,
+	}
+}
+
+// Stage writes the event to the outbox. Call it with a transaction's context so the event
+// is only published if the transaction commits.
+func (o *Outbox) Stage(ctx context.Context, event events.Event) error {
+	now := time.Now()
+	return o.outboxRepo.Insert(ctx, &models.OutboxMessage{
+		Key:           event.UserID,
+		Event:         event,
+		Status:        models.OutboxPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
+
+// Publish stages an event that is not tied to a transaction, making Outbox an events.Publisher
+func (o *Outbox) Publish(ctx context.Context, event events.Event) {
+	if err := o.Stage(context.WithoutCancel(ctx), event); err != nil {
+		log.Printf("Failed to stage event %s (%s) in the outbox: %v", event.ID, event.Type, err)
+	}
+}
+
+// OutboxPolicy configures the outbox relay
+type OutboxPolicy struct {
+	BatchSize    int64         // pending messages read per pass
+	PollInterval time.Duration // wait between passes when there is nothing to publish
+	Lease        time.Duration // how long a relay holds a message while publishing it
+	BaseDelay    time.Duration // retry delay after the first failure, doubled after each further failure
+	MaxDelay     time.Duration // upper bound for the retry delay
+}
+
+// DefaultOutboxPolicy returns the outbox policy used when none is configured
+func DefaultOutboxPolicy() OutboxPolicy {
+	return OutboxPolicy{
+		BatchSize:    200,
+		PollInterval: time.Second,
+		Lease:        time.Minute,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+	}
+}
+
+// OutboxRelay publishes outbox messages to every sink, at least once and in order per user.
+// Messages are retried until all sinks accept them; a failing message holds back later
+// messages for the same user but not for others. Several relays may run concurrently.
+type OutboxRelay struct {
+	outboxRepo *repository.OutboxRepository
+	sinks      []outbox.Sink
+	policy     OutboxPolicy
+}
+
+// NewOutboxRelay creates a new instance of OutboxRelay
+func NewOutboxRelay(outboxRepo *repository.OutboxRepository, sinks []outbox.Sink, policy OutboxPolicy) *OutboxRelay {
+	return &OutboxRelay{
+		outboxRepo: outboxRepo,
+		sinks:      sinks,
+		policy:     policy,
+	}
+}
+
+// Run relays messages until ctx is cancelled
+func (r *OutboxRelay) Run(ctx context.Context) {
+	for {
+		published, err := r.RelayOnce(ctx)
+		if err != nil {
+			log.Printf("Outbox relay failed: %v", err)
+		}
+		if published > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.policy.PollInterval):
+		}
+	}
+}
+
+// RelayOnce makes one pass over the due messages, publishing at most one per user,
+// and returns how many were published
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	now := time.Now()
+	messages, err := r.outboxRepo.FindPending(ctx, now, r.policy.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only the oldest pending message of each user may be published, so skip users whose oldest
+	// message is waiting for a retry or being published by another relay
+	var keys []string
+	for _, message := range messages {
+		keys = append(keys, message.Key)
+	}
+	blocked, err := r.outboxRepo.BlockedKeys(ctx, keys, now)
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	seen := map[string]bool{}
+	for i := range messages {
+		message := &messages[i]
+		if seen[message.Key] || blocked[message.Key] {
+			continue
+		}
+		seen[message.Key] = true
+
+		claimed, err := r.outboxRepo.Claim(ctx, message.ID, now, now.Add(r.policy.Lease))
+		if err != nil {
+			return published, err
+		}
+		if !claimed {
+			continue
+		}
+
+		err = r.publish(ctx, message.Event)
+		if err != nil {
+			failures := message.Failures + 1
+			next := time.Now().Add(r.retryDelay(failures))
+			if err := r.outboxRepo.MarkFailed(ctx, message.ID, failures, err.Error(), next); err != nil {
+				return published, err
+			}
+			continue
+		}
+
+		if err := r.outboxRepo.MarkPublished(ctx, message.ID, time.Now()); err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	return published, nil
+}
+
+// publish hands the event to every sink; sinks that already accepted it on an earlier attempt receive it again
+func (r *OutboxRelay) publish(ctx context.Context, event events.Event) error {
+	var failed []string
+	for _, sink := range r.sinks {
+		if err := sink.Publish(ctx, event); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", sink.Name(), err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("publishing %s failed: %s", event.ID, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (r *OutboxRelay) retryDelay(failures int) time.Duration {
+	delay := r.policy.BaseDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if r.policy.MaxDelay > 0 && delay >= r.policy.MaxDelay {
+			return r.policy.MaxDelay
+		}
+	}
+	return delay
+}
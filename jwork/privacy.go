@@ -0,0 +1,240 @@
+package jwork
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"iam_backend/events"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+	"iam_backend/reqctx"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Privacy errors
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidErasureMode = errors.New("erasure mode must be delete or pseudonymize")
+	ErrNotErased          = errors.New("user has not been erased")
+)
+
+// The audit event fields redacted when erasing a user, from the events about the user and from those
+// the user performed
+var (
+	erasedTargetAuditData = map[string][]string{"changes": models.PersonalUserFields, "details": models.PersonalEventData}
+	erasedActorAuditData  = map[string][]string{"details": models.PersonalEventData, "ip": nil, "user_agent": nil}
+)
+
+// PrivacyController handles data subject requests: exporting everything held about a user and erasing it
+type PrivacyController struct {
+	users            *UserController
+	sessionRepo      *repository.SessionRepository
+	apiKeyRepo       *repository.APIKeyRepository
+	loginAttemptRepo *repository.LoginAttemptRepository
+	groupRepo        *repository.GroupRepository
+	outboxRepo       *repository.OutboxRepository
+	webhookRepo      *repository.WebhookRepository
+	erasureRepo      *repository.ErasureRepository
+}
+
+// NewPrivacyController creates a new instance of PrivacyController
+func NewPrivacyController(users *UserController, sessionRepo *repository.SessionRepository, apiKeyRepo *repository.APIKeyRepository, loginAttemptRepo *repository.LoginAttemptRepository, groupRepo *repository.GroupRepository, outboxRepo *repository.OutboxRepository, webhookRepo *repository.WebhookRepository, erasureRepo *repository.ErasureRepository) *PrivacyController {
+	return &PrivacyController{
+		users:            users,
+		sessionRepo:      sessionRepo,
+		apiKeyRepo:       apiKeyRepo,
+		loginAttemptRepo: loginAttemptRepo,
+		groupRepo:        groupRepo,
+		outboxRepo:       outboxRepo,
+		webhookRepo:      webhookRepo,
+		erasureRepo:      erasureRepo,
+	}
+}
+
+// ExportUserData gathers the profile, linked identities, sessions, API keys, group memberships and
+// the audit events about a user into one archive
+func (c *PrivacyController) ExportUserData(ctx context.Context, userID string) (export *models.DataExport, err error) {
+	defer func() {
+		c.users.auditLog.Record(ctx, AuditEntry{Action: AuditUserDataExported, TargetID: userID, Err: err})
+	}()
+
+	user, err := c.find(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export = &models.DataExport{
+		GeneratedAt: time.Now(),
+		Profile:     user,
+		Identities:  user.Identities,
+		AuditEvents: []models.AuditEvent{},
+	}
+	if export.Identities == nil {
+		export.Identities = []models.LinkedIdentity{}
+	}
+	if export.Sessions, err = c.sessionRepo.FindByUser(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	if export.APIKeys, err = c.apiKeyRepo.FindAllByUser(ctx, user.ID); err != nil {
+		return nil, err
+	}
+	if export.Groups, err = c.groupRepo.FindByMember(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	err = c.users.auditLog.ExportEvents(ctx, repository.AuditFilter{TargetID: userID}, func(event *models.AuditEvent) error {
+		export.AuditEvents = append(export.AuditEvents, *event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// EraseUser removes a user's personal data from every collection and leaves a tombstone recording the erasure.
+// In delete mode the user document is removed; in pseudonymize mode it is kept under a pseudonym so that
+// records referring to the user still resolve. Erasing an erased user returns the existing tombstone.
+// Records that are kept, such as audit events, webhook deliveries and events still to be published,
+// have the user's personal data redacted. Audit events whose values cannot be redacted irreversibly are
+// listed in the tombstone, which then does not report the erasure as complete.
+func (c *PrivacyController) EraseUser(ctx context.Context, userID, mode string) (tombstone *models.ErasureTombstone, err error) {
+	defer func() {
+		details := map[string]interface{}{"mode": mode}
+		if tombstone != nil && !tombstone.Complete {
+			details["retained_audit_events"] = len(tombstone.RetainedAuditEvents)
+		}
+		c.users.auditLog.Record(ctx, AuditEntry{Action: AuditUserErased, TargetID: userID, Err: err, Details: details})
+	}()
+
+	if mode != models.ErasureDelete && mode != models.ErasurePseudonymize {
+		return nil, ErrInvalidErasureMode
+	}
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+	tombstone, err = c.erasureRepo.FindByUser(ctx, id)
+	if err == nil {
+		return tombstone, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	user, err := c.find(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsServiceAccount() {
+		return nil, ErrServiceAccount
+	}
+
+	tombstone = &models.ErasureTombstone{
+		UserID:      user.ID,
+		Tenant:      user.TenantName(),
+		Mode:        mode,
+		RequestedBy: reqctx.From(ctx).ActorID,
+		ErasedAt:    time.Now(),
+	}
+	var job *models.DeprovisioningJob
+	err = c.users.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		// Audit values are replaced by their salted digests, so the audit chain still verifies. The user's
+		// own IP addresses and user agents are redacted from the events they performed.
+		retained, err := c.users.auditLog.auditRepo.RedactUser(ctx, userID, erasedTargetAuditData, erasedActorAuditData)
+		if err != nil {
+			return err
+		}
+		tombstone.RetainedAuditEvents = retained
+		tombstone.Complete = len(retained) == 0
+
+		if err := c.erasureRepo.Create(ctx, tombstone); err != nil {
+			return err
+		}
+		if err := c.sessionRepo.DeleteByUser(ctx, user.ID); err != nil {
+			return err
+		}
+		if err := c.apiKeyRepo.DeleteByUser(ctx, user.ID); err != nil {
+			return err
+		}
+		if err := c.loginAttemptRepo.Reset(ctx, user.ID); err != nil {
+			return err
+		}
+		if _, err := c.groupRepo.RemoveMember(ctx, user.ID); err != nil {
+			return err
+		}
+		if err := c.outboxRepo.DeletePublishedByUser(ctx, userID); err != nil {
+			return err
+		}
+		if err := c.outboxRepo.RedactPendingByUser(ctx, userID, models.PersonalEventData, models.ErasedValue); err != nil {
+			return err
+		}
+		if err := c.webhookRepo.RedactByUser(ctx, userID, models.PersonalEventData, models.ErasedValue); err != nil {
+			return err
+		}
+		if mode == models.ErasureDelete {
+			err = c.users.userRepo.Delete(ctx, userID)
+		} else {
+			user.Pseudonymize()
+			err = c.users.userRepo.Replace(ctx, user)
+		}
+		if err != nil {
+			return err
+		}
+
+		// The event names only the user ID, so subscribers can erase their copies without receiving personal data
+		event := events.New(events.UserErased, userID, map[string]interface{}{"mode": mode})
+		event.ActorID = tombstone.RequestedBy
+		if err := c.users.outbox.Stage(ctx, event); err != nil {
+			return err
+		}
+
+		// Deprovisioning hands over the user's service accounts, which erasure leaves alone
+		job, err = c.users.enqueueDeprovisioning(ctx, user.ID, models.DeprovisionDeleted)
+		return err
+	})
+	if errors.Is(err, repository.ErrAlreadyErased) {
+		// A concurrent request erased the user first
+		return c.erasureRepo.FindByUser(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.users.deprovision(ctx, job)
+
+	return tombstone, nil
+}
+
+// GetTombstone returns the tombstone left by erasing a user
+func (c *PrivacyController) GetTombstone(ctx context.Context, userID string) (*models.ErasureTombstone, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrNotErased
+	}
+
+	tombstone, err := c.erasureRepo.FindByUser(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotErased
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tombstone, nil
+}
+
+// find retrieves a user by ID
+func (c *PrivacyController) find(ctx context.Context, userID string) (*models.User, error) {
+	user, err := c.users.userRepo.FindByID(ctx, userID)
+	if err == mongo.ErrNoDocuments || errors.Is(err, primitive.ErrInvalidHex) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,376 @@
+package jwork
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+	"iam_backend/saml"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SAML errors
+var (
+	ErrSAMLNotConfigured      = errors.New("SAML sign-on is not configured")
+	ErrUnknownServiceProvider = errors.New("unknown service provider")
+	ErrInvalidSAMLRequest     = errors.New("invalid SAML authentication request")
+	ErrIdPInitiatedNotAllowed = errors.New("the service provider does not accept unsolicited sign-ins")
+)
+
+// SAMLPost is a response for the browser to post to a service provider's assertion consumer service
+type SAMLPost struct {
+	URL          string `json:"url"`
+	SAMLResponse string `json:"saml_response"` // base64-encoded Response document
+	RelayState   string `json:"relay_state,omitempty"`
+}
+
+// SAMLController issues SAML assertions to registered service providers for signed-in users
+type SAMLController struct {
+	users     *UserController
+	groupRepo *repository.GroupRepository
+	spRepo    *repository.SAMLServiceProviderRepository
+	idp       *saml.IdentityProvider // nil when SAML is not configured
+	loginURL  string                 // front-end page that signs the user in and completes the request
+}
+
+// NewSAMLController creates a new instance of SAMLController
+func NewSAMLController(users *UserController, groupRepo *repository.GroupRepository, spRepo *repository.SAMLServiceProviderRepository, idp *saml.IdentityProvider, loginURL string) *SAMLController {
+	return &SAMLController{
+		users:     users,
+		groupRepo: groupRepo,
+		spRepo:    spRepo,
+		idp:       idp,
+		loginURL:  loginURL,
+	}
+}
+
+// Metadata returns the identity provider's metadata document
+func (c *SAMLController) Metadata() ([]byte, error) {
+	if c.idp == nil {
+		return nil, ErrSAMLNotConfigured
+	}
+	return c.idp.Metadata()
+}
+
+// LoginRedirect returns the URL of the sign-in page that an authentication request received at the
+// SSO endpoint is forwarded to. The page signs the user in and then submits the query for an assertion.
+// The query is passed on unchanged, as re-encoding it would break a redirect binding signature.
+func (c *SAMLController) LoginRedirect(rawQuery string) (string, error) {
+	if c.idp == nil {
+		return "", ErrSAMLNotConfigured
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil || query.Get("SAMLRequest") == "" {
+		return "", fmt.Errorf("%w: SAMLRequest is required", ErrInvalidSAMLRequest)
+	}
+
+	target, err := url.Parse(c.loginURL)
+	if err != nil {
+		return "", err
+	}
+	target.RawQuery = rawQuery
+	return target.String(), nil
+}
+
+// RegisterServiceProvider registers a service provider from its metadata. Attributes default to the
+// username, email and roles; the name ID defaults to the email address.
+func (c *SAMLController) RegisterServiceProvider(ctx context.Context, sp *models.SAMLServiceProvider) error {
+	parsed, err := saml.ParseServiceProviderMetadata([]byte(sp.Metadata))
+	if err != nil {
+		return err
+	}
+	sp.EntityID = parsed.EntityID
+
+	if sp.NameIDFormat == "" {
+		sp.NameIDFormat = saml.NameIDFormatEmail
+	}
+	if sp.NameIDField == "" {
+		sp.NameIDField = models.SAMLFieldEmail
+	}
+	if sp.Attributes == nil {
+		sp.Attributes = []models.SAMLAttribute{
+			{Name: "username", Field: models.SAMLFieldUsername},
+			{Name: "email", Field: models.SAMLFieldEmail},
+			{Name: "roles", Field: models.SAMLFieldRoles},
+		}
+	}
+	if !samlNameIDFormats[sp.NameIDFormat] {
+		return fmt.Errorf("unsupported name ID format %q", sp.NameIDFormat)
+	}
+	if !samlFields[sp.NameIDField] || sp.NameIDField == models.SAMLFieldRoles || sp.NameIDField == models.SAMLFieldGroups {
+		return fmt.Errorf("name_id_field must be one of id, username, email or external_id")
+	}
+	for _, attribute := range sp.Attributes {
+		if attribute.Name == "" || !samlFields[attribute.Field] {
+			return fmt.Errorf("attribute %q must have a name and map one of the fields id, username, email, external_id, roles or groups", attribute.Name)
+		}
+	}
+	if sp.DefaultRelayState != "" {
+		if _, err := url.Parse(sp.DefaultRelayState); err != nil {
+			return fmt.Errorf("invalid default_relay_state: %w", err)
+		}
+	}
+
+	sp.CreatedAt = time.Now()
+	return c.spRepo.Create(ctx, sp)
+}
+
+// ListServiceProviders returns the registered service providers
+func (c *SAMLController) ListServiceProviders(ctx context.Context) ([]models.SAMLServiceProvider, error) {
+	return c.spRepo.FindAll(ctx)
+}
+
+// DeleteServiceProvider removes a service provider; users can no longer sign in to it
+func (c *SAMLController) DeleteServiceProvider(ctx context.Context, id string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrUnknownServiceProvider
+	}
+
+	deleted, err := c.spRepo.Delete(ctx, objectID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrUnknownServiceProvider
+	}
+	return nil
+}
+
+// HandleAuthnRequest answers a service provider's authentication request for the signed-in user.
+// The request is passed as the query string it arrived with, so that redirect signatures can be checked.
+func (c *SAMLController) HandleAuthnRequest(ctx context.Context, userID, sessionID, rawQuery string) (*SAMLPost, error) {
+	if c.idp == nil {
+		return nil, ErrSAMLNotConfigured
+	}
+
+	received, err := saml.ParseRequestQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLRequest, err)
+	}
+	sp, parsed, err := c.serviceProvider(ctx, received.Request.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// An unsigned request is accepted unless the service provider declared that it signs them, but a
+	// signature that is present has to verify
+	if parsed.AuthnRequestsSigned || received.Signed() {
+		if err := received.VerifySignature(parsed.Certificates); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLRequest, err)
+		}
+	}
+	request := received.Request
+	if request.Destination != "" && request.Destination != c.idp.SSOURL {
+		return nil, fmt.Errorf("%w: the request is addressed to %s", ErrInvalidSAMLRequest, request.Destination)
+	}
+	if request.ProtocolBinding != "" && request.ProtocolBinding != saml.HTTPPostBinding {
+		return nil, fmt.Errorf("%w: only the HTTP-POST binding is supported for responses", ErrInvalidSAMLRequest)
+	}
+	acs, err := parsed.AssertionConsumerService(request.AssertionConsumerServiceURL, request.AssertionConsumerServiceIndex)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLRequest, err)
+	}
+
+	return c.issue(ctx, userID, sessionID, sp, acs, request.ID, request.NameIDFormat(), received.RelayState)
+}
+
+// IdPInitiated signs the user in to a service provider without a request from it, if the service provider allows it
+func (c *SAMLController) IdPInitiated(ctx context.Context, userID, sessionID, entityID, relayState string) (*SAMLPost, error) {
+	if c.idp == nil {
+		return nil, ErrSAMLNotConfigured
+	}
+
+	sp, parsed, err := c.serviceProvider(ctx, entityID)
+	if err != nil {
+		return nil, err
+	}
+	if !sp.AllowIdPInitiated {
+		return nil, ErrIdPInitiatedNotAllowed
+	}
+	acs, err := parsed.AssertionConsumerService("", nil)
+	if err != nil {
+		return nil, err
+	}
+	if relayState == "" {
+		relayState = sp.DefaultRelayState
+	}
+
+	return c.issue(ctx, userID, sessionID, sp, acs, "", "", relayState)
+}
+
+// serviceProvider loads a registered service provider together with its parsed metadata
+func (c *SAMLController) serviceProvider(ctx context.Context, entityID string) (*models.SAMLServiceProvider, *saml.ServiceProvider, error) {
+	if entityID == "" {
+		return nil, nil, ErrUnknownServiceProvider
+	}
+	sp, err := c.spRepo.FindByEntityID(ctx, entityID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil, ErrUnknownServiceProvider
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, err := saml.ParseServiceProviderMetadata([]byte(sp.Metadata))
+	if err != nil {
+		return nil, nil, err
+	}
+	return sp, parsed, nil
+}
+
+// issue builds the signed response asserting the user's identity to the service provider
+func (c *SAMLController) issue(ctx context.Context, userID, sessionID string, sp *models.SAMLServiceProvider, acs, inResponseTo, requestedFormat, relayState string) (post *SAMLPost, err error) {
+	entry := AuditEntry{Action: AuditSAMLAssertionIssued, TargetID: userID, Details: map[string]interface{}{
+		"service_provider": sp.EntityID,
+		"idp_initiated":    inResponseTo == "",
+	}}
+	defer func() {
+		entry.Err = err
+		c.users.auditLog.Record(ctx, entry)
+	}()
+
+	user, err := c.users.userRepo.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.CheckActive(); err != nil {
+		return nil, err
+	}
+	var groups []models.Group
+	if samlReleasesGroups(sp) {
+		groups, err = c.groupRepo.FindByMember(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	format := sp.NameIDFormat
+	if requestedFormat != "" && requestedFormat != saml.NameIDFormatUnspecified {
+		if !samlNameIDFormats[requestedFormat] {
+			return nil, fmt.Errorf("%w: unsupported name ID format %q", ErrInvalidSAMLRequest, requestedFormat)
+		}
+		format = requestedFormat
+	}
+	nameID := SAMLFieldValues(sp, user, groups, sp.NameIDField)
+	switch format {
+	case saml.NameIDFormatPersistent:
+		// A persistent identifier must never be reassigned, which only the user ID guarantees
+		nameID = []string{user.ID.Hex()}
+	case saml.NameIDFormatEmail:
+		nameID = []string{user.Email}
+	}
+	if len(nameID) == 0 || nameID[0] == "" {
+		return nil, fmt.Errorf("the user has no %s to use as the name ID", sp.NameIDField)
+	}
+
+	response, err := c.idp.NewResponse(saml.Assertion{
+		Destination:  acs,
+		Audience:     sp.EntityID,
+		InResponseTo: inResponseTo,
+		NameID:       nameID[0],
+		NameIDFormat: format,
+		SessionIndex: sessionID,
+		Attributes:   SAMLAttributes(sp, user, groups),
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry.Details["name_id"] = nameID[0]
+
+	return &SAMLPost{
+		URL:          acs,
+		SAMLResponse: base64.StdEncoding.EncodeToString(response),
+		RelayState:   relayState,
+	}, nil
+}
+
+// samlNameIDFormats are the name ID formats assertions can be issued with
+var samlNameIDFormats = map[string]bool{
+	saml.NameIDFormatUnspecified: true,
+	saml.NameIDFormatEmail:       true,
+	saml.NameIDFormatPersistent:  true,
+}
+
+// samlFields are the user fields attributes can map
+var samlFields = map[string]bool{
+	models.SAMLFieldID:         true,
+	models.SAMLFieldUsername:   true,
+	models.SAMLFieldEmail:      true,
+	models.SAMLFieldExternalID: true,
+	models.SAMLFieldRoles:      true,
+	models.SAMLFieldGroups:     true,
+}
+
+func samlReleasesGroups(sp *models.SAMLServiceProvider) bool {
+	for _, attribute := range sp.Attributes {
+		if attribute.Field == models.SAMLFieldGroups {
+			return true
+		}
+	}
+	return false
+}
+
+// SAMLAttributes maps the user's fields to the attribute statements configured for the service provider.
+// Attributes without a value are left out.
+func SAMLAttributes(sp *models.SAMLServiceProvider, user *models.User, groups []models.Group) []saml.Attribute {
+	var attributes []saml.Attribute
+	for _, attribute := range sp.Attributes {
+		values := SAMLFieldValues(sp, user, groups, attribute.Field)
+		if len(values) == 0 {
+			continue
+		}
+		attributes = append(attributes, saml.Attribute{Name: attribute.Name, NameFormat: attribute.NameFormat, Values: values})
+	}
+	return attributes
+}
+
+// SAMLFieldValues returns the values of a user field as released to the service provider.
+// Roles are renamed through the service provider's role values.
+func SAMLFieldValues(sp *models.SAMLServiceProvider, user *models.User, groups []models.Group, field string) []string {
+	var value string
+	switch field {
+	case models.SAMLFieldID:
+		value = user.ID.Hex()
+	case models.SAMLFieldUsername:
+		value = user.Username
+	case models.SAMLFieldEmail:
+		value = user.Email
+	case models.SAMLFieldExternalID:
+		value = user.ExternalID
+	case models.SAMLFieldRoles:
+		values := make([]string, 0, len(user.Roles))
+		seen := map[string]bool{}
+		for _, role := range user.Roles {
+			if mapped, ok := sp.RoleValues[role]; ok {
+				role = mapped
+			}
+			if role != "" && !seen[role] {
+				seen[role] = true
+				values = append(values, role)
+			}
+		}
+		sort.Strings(values)
+		return values
+	case models.SAMLFieldGroups:
+		values := make([]string, 0, len(groups))
+		for _, group := range groups {
+			values = append(values, group.DisplayName)
+		}
+		return values
+	}
+
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return []string{value}
+}
@@ -0,0 +1,574 @@
+package jwork
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	models "iam_backend/models"
+	"iam_backend/password"
+	repository "iam_backend/repo"
+	"iam_backend/scim"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ScimController maps SCIM users and groups onto the user and group repositories.
+// Errors meant for the client are returned as *scim.Error.
+type ScimController struct {
+	users     *UserController
+	userRepo  *repository.UserRepository
+	groupRepo *repository.GroupRepository
+	auditLog  *AuditLogger
+}
+
+// NewScimController creates a new instance of ScimController
+func NewScimController(users *UserController, userRepo *repository.UserRepository, groupRepo *repository.GroupRepository, auditLog *AuditLogger) *ScimController {
+	return &ScimController{
+		users:     users,
+		userRepo:  userRepo,
+		groupRepo: groupRepo,
+		auditLog:  auditLog,
+	}
+}
+
+// CreateUser provisions a user; users are active unless the resource says otherwise
+func (c *ScimController) CreateUser(ctx context.Context, resource *scim.User) (*scim.User, error) {
+	if err := validateScimUser(resource); err != nil {
+		return nil, err
+	}
+
+	active := resource.Active == nil || *resource.Active
+	user, err := c.users.ProvisionUser(ctx, resource.UserName, resource.PrimaryEmail(), resource.Password, resource.ExternalID, scimRoles(resource.Roles), active)
+	if err != nil {
+		return nil, scimUserError(err)
+	}
+
+	return c.scimUser(ctx, user)
+}
+
+// GetUser retrieves a user
+func (c *ScimController) GetUser(ctx context.Context, id string) (*scim.User, error) {
+	user, err := c.findUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scimUser(ctx, user)
+}
+
+// ListUsers returns a page of the users matching filter, starting at the 1-based startIndex
+func (c *ScimController) ListUsers(ctx context.Context, filter string, startIndex, count int) (*scim.ListResponse, error) {
+	expr, err := parseScimFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	users, total, err := c.userRepo.FindByScimFilter(ctx, expr, int64(startIndex-1), int64(count))
+	if err != nil {
+		return nil, scimFilterError(err)
+	}
+
+	resources := make([]interface{}, 0, len(users))
+	for i := range users {
+		resource, err := c.scimUser(ctx, &users[i])
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, resource)
+	}
+
+	return scim.NewListResponse(resources, total, startIndex), nil
+}
+
+// ReplaceUser updates a user to match the resource in one change, which is saved in full or not at all.
+// Roles are only replaced when the resource has the roles attribute, and an empty list removes them all.
+// active=false deactivates an active user; active=true reactivates a deactivated user, and is refused
+// with 409 for users an administrator locked or suspended.
+func (c *ScimController) ReplaceUser(ctx context.Context, id string, resource *scim.User) (*scim.User, error) {
+	if err := validateScimUser(resource); err != nil {
+		return nil, err
+	}
+
+	user, err := c.findUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := ProvisionedChanges{
+		Username:   resource.UserName,
+		Email:      resource.PrimaryEmail(),
+		ExternalID: resource.ExternalID,
+		Password:   resource.Password,
+		Active:     resource.Active,
+	}
+	if resource.Roles != nil {
+		changes.Roles = scimRoles(resource.Roles)
+	}
+	if err := c.users.ReplaceProvisionedUser(ctx, user.ID.Hex(), changes); err != nil {
+		return nil, scimUserError(err)
+	}
+
+	return c.GetUser(ctx, id)
+}
+
+// PatchUser applies PATCH operations to a user
+func (c *ScimController) PatchUser(ctx context.Context, id string, operations []scim.PatchOperation) (*scim.User, error) {
+	current, err := c.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched scim.User
+	if err := patchResource(current, operations, &patched); err != nil {
+		return nil, err
+	}
+	if current.Roles != nil && patched.Roles == nil {
+		// The operations removed every role
+		patched.Roles = []scim.MultiValued{}
+	}
+
+	return c.ReplaceUser(ctx, id, &patched)
+}
+
+// DeleteUser deletes a user. Their deprovisioning removes them from all groups.
+func (c *ScimController) DeleteUser(ctx context.Context, id string) error {
+	if _, err := c.findUser(ctx, id); err != nil {
+		return err
+	}
+
+	return c.users.DeleteUser(ctx, id)
+}
+
+// CreateGroup creates a group
+func (c *ScimController) CreateGroup(ctx context.Context, resource *scim.Group) (*scim.Group, error) {
+	group, err := c.createGroup(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scimGroup(ctx, group)
+}
+
+func (c *ScimController) createGroup(ctx context.Context, resource *scim.Group) (group *models.Group, err error) {
+	defer func() {
+		entry := AuditEntry{Action: AuditGroupCreated, Err: err, Details: map[string]interface{}{"display_name": resource.DisplayName}}
+		if err == nil {
+			entry.TargetID = group.ID.Hex()
+			entry.Details["members_added"] = objectIDHexes(group.Members)
+		}
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	if resource.DisplayName == "" {
+		return nil, scim.BadRequest(scim.ErrInvalidValue, "displayName is required")
+	}
+	members, err := c.memberIDs(ctx, resource.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	group = &models.Group{
+		DisplayName: resource.DisplayName,
+		ExternalID:  resource.ExternalID,
+		Members:     members,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	err = c.groupRepo.Create(ctx, group)
+	if err != nil {
+		return nil, scimGroupError(err)
+	}
+
+	return group, nil
+}
+
+// GetGroup retrieves a group
+func (c *ScimController) GetGroup(ctx context.Context, id string) (*scim.Group, error) {
+	group, err := c.findGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scimGroup(ctx, group)
+}
+
+func (c *ScimController) findGroup(ctx context.Context, id string) (*models.Group, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, scim.NotFound("group not found")
+	}
+
+	group, err := c.groupRepo.FindByID(ctx, objectID)
+	if err == mongo.ErrNoDocuments {
+		return nil, scim.NotFound("group not found")
+	}
+	return group, err
+}
+
+// scimGroup converts a group to its SCIM representation, with the user names of its members. Suspended
+// members are listed as members, as the provisioning client still considers them part of the group.
+func (c *ScimController) scimGroup(ctx context.Context, group *models.Group) (*scim.Group, error) {
+	all := allMembers(group)
+	users, err := c.userRepo.FindByIDs(ctx, all)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make(map[primitive.ObjectID]string, len(users))
+	for _, user := range users {
+		usernames[user.ID] = user.Username
+	}
+
+	members := make([]scim.Reference, 0, len(all))
+	for _, member := range all {
+		members = append(members, scim.Reference{Value: member.Hex(), Display: usernames[member], Type: "User"})
+	}
+
+	return &scim.Group{
+		Schemas:     []string{scim.GroupSchema},
+		ID:          group.ID.Hex(),
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members:     members,
+		Meta:        scimMeta("Group", group.CreatedAt, group.UpdatedAt),
+	}, nil
+}
+
+// ListGroups returns a page of the groups matching filter, starting at the 1-based startIndex
+func (c *ScimController) ListGroups(ctx context.Context, filter string, startIndex, count int) (*scim.ListResponse, error) {
+	expr, err := parseScimFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, total, err := c.groupRepo.FindByScimFilter(ctx, expr, int64(startIndex-1), int64(count))
+	if err != nil {
+		return nil, scimFilterError(err)
+	}
+
+	resources := make([]interface{}, 0, len(groups))
+	for i := range groups {
+		resource, err := c.scimGroup(ctx, &groups[i])
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, resource)
+	}
+
+	return scim.NewListResponse(resources, total, startIndex), nil
+}
+
+// ReplaceGroup updates a group to match the resource
+func (c *ScimController) ReplaceGroup(ctx context.Context, id string, resource *scim.Group) (*scim.Group, error) {
+	group, err := c.replaceGroup(ctx, id, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scimGroup(ctx, group)
+}
+
+func (c *ScimController) replaceGroup(ctx context.Context, id string, resource *scim.Group) (group *models.Group, err error) {
+	entry := AuditEntry{Action: AuditGroupUpdated, TargetID: id, Details: map[string]interface{}{"display_name": resource.DisplayName}}
+	defer func() {
+		entry.Err = err
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	if resource.DisplayName == "" {
+		return nil, scim.BadRequest(scim.ErrInvalidValue, "displayName is required")
+	}
+	group, err = c.findGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	members, err := c.memberIDs(ctx, resource.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	current := allMembers(group)
+	entry.Details["members_added"] = objectIDHexes(missingIDs(members, current))
+	entry.Details["members_removed"] = objectIDHexes(missingIDs(current, members))
+	if group.DisplayName != resource.DisplayName {
+		entry.Details["previous_display_name"] = group.DisplayName
+	}
+
+	// Members who stay in the group keep their suspension; those left out lose both kinds of membership
+	suspended := make(map[primitive.ObjectID]bool, len(group.SuspendedMembers))
+	for _, id := range group.SuspendedMembers {
+		suspended[id] = true
+	}
+	group.DisplayName = resource.DisplayName
+	group.ExternalID = resource.ExternalID
+	group.Members = []primitive.ObjectID{}
+	group.SuspendedMembers = []primitive.ObjectID{}
+	for _, id := range members {
+		if suspended[id] {
+			group.SuspendedMembers = append(group.SuspendedMembers, id)
+		} else {
+			group.Members = append(group.Members, id)
+		}
+	}
+	err = c.groupRepo.Replace(ctx, group)
+	if err != nil {
+		return nil, scimGroupError(err)
+	}
+
+	return group, nil
+}
+
+// PatchGroup applies PATCH operations to a group, such as adding or removing members
+func (c *ScimController) PatchGroup(ctx context.Context, id string, operations []scim.PatchOperation) (*scim.Group, error) {
+	current, err := c.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched scim.Group
+	if err := patchResource(current, operations, &patched); err != nil {
+		return nil, err
+	}
+
+	return c.ReplaceGroup(ctx, id, &patched)
+}
+
+// DeleteGroup deletes a group; its members are not affected
+func (c *ScimController) DeleteGroup(ctx context.Context, id string) (err error) {
+	defer func() {
+		c.auditLog.Record(ctx, AuditEntry{Action: AuditGroupDeleted, TargetID: id, Err: err})
+	}()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return scim.NotFound("group not found")
+	}
+
+	deleted, err := c.groupRepo.Delete(ctx, objectID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return scim.NotFound("group not found")
+	}
+	return nil
+}
+
+func (c *ScimController) findUser(ctx context.Context, id string) (*models.User, error) {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return nil, scim.NotFound("user not found")
+	}
+
+	user, err := c.userRepo.FindByID(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return nil, scim.NotFound("user not found")
+	}
+	return user, err
+}
+
+// scimUser converts a user to its SCIM representation, with the groups they belong to
+func (c *ScimController) scimUser(ctx context.Context, user *models.User) (*scim.User, error) {
+	groups, err := c.groupRepo.FindByMember(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	active := user.IsActive()
+	resource := &scim.User{
+		Schemas:    []string{scim.UserSchema},
+		ID:         user.ID.Hex(),
+		ExternalID: user.ExternalID,
+		UserName:   user.Username,
+		Emails:     []scim.MultiValued{{Value: user.Email, Type: "work", Primary: true}},
+		Active:     &active,
+		Meta:       scimMeta("User", user.CreatedAt, user.UpdatedAt),
+	}
+	for _, role := range user.Roles {
+		resource.Roles = append(resource.Roles, scim.MultiValued{Value: role})
+	}
+	for _, group := range groups {
+		resource.Groups = append(resource.Groups, scim.Reference{Value: group.ID.Hex(), Display: group.DisplayName})
+	}
+	return resource, nil
+}
+
+// memberIDs converts member references to user IDs, rejecting references to unknown users
+func (c *ScimController) memberIDs(ctx context.Context, members []scim.Reference) ([]primitive.ObjectID, error) {
+	ids := []primitive.ObjectID{}
+	seen := map[primitive.ObjectID]bool{}
+	for _, member := range members {
+		id, err := primitive.ObjectIDFromHex(member.Value)
+		if err != nil {
+			return nil, scim.BadRequest(scim.ErrInvalidValue, fmt.Sprintf("member %q is not a user", member.Value))
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	users, err := c.userRepo.FindByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != len(ids) {
+		found := make([]primitive.ObjectID, 0, len(users))
+		for _, user := range users {
+			found = append(found, user.ID)
+		}
+		missing := missingIDs(ids, found)
+		return nil, scim.BadRequest(scim.ErrInvalidValue, fmt.Sprintf("member %q is not a user", missing[0].Hex()))
+	}
+	return ids, nil
+}
+
+// patchResource applies operations to the JSON form of current and decodes the result into patched
+func patchResource(current interface{}, operations []scim.PatchOperation, patched interface{}) error {
+	encoded, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var resource map[string]interface{}
+	if err := json.Unmarshal(encoded, &resource); err != nil {
+		return err
+	}
+
+	if err := scim.ApplyPatch(resource, operations); err != nil {
+		return err
+	}
+
+	encoded, err = json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(encoded, patched); err != nil {
+		return scim.BadRequest(scim.ErrInvalidValue, err.Error())
+	}
+	return nil
+}
+
+func parseScimFilter(filter string) (scim.Expr, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+
+	expr, err := scim.ParseFilter(filter)
+	if err != nil {
+		return nil, scim.BadRequest(scim.ErrInvalidFilter, err.Error())
+	}
+	return expr, nil
+}
+
+func validateScimUser(resource *scim.User) error {
+	if resource.UserName == "" {
+		return scim.BadRequest(scim.ErrInvalidValue, "userName is required")
+	}
+	if resource.PrimaryEmail() == "" {
+		return scim.BadRequest(scim.ErrInvalidValue, "an email address is required")
+	}
+	return nil
+}
+
+// scimUserError converts errors of user operations that the client can act on
+func scimUserError(err error) error {
+	var policyErr *password.PolicyError
+	switch {
+	case errors.Is(err, repository.ErrUserExists), errors.Is(err, ErrAttributeTaken):
+		return scim.NewError(http.StatusConflict, scim.ErrUniqueness, err.Error())
+	case errors.Is(err, models.ErrInvalidAttribute):
+		return scim.BadRequest(scim.ErrInvalidValue, err.Error())
+	case errors.As(err, &policyErr):
+		return scim.BadRequest(scim.ErrInvalidValue, err.Error())
+	case errors.Is(err, ErrExternalPassword), errors.Is(err, ErrServiceAccount):
+		return scim.BadRequest(scim.ErrMutability, err.Error())
+	case errors.Is(err, ErrNotReactivatable):
+		return scim.NewError(http.StatusConflict, "", err.Error())
+	}
+	return err
+}
+
+func scimGroupError(err error) error {
+	if errors.Is(err, repository.ErrGroupExists) {
+		return scim.NewError(http.StatusConflict, scim.ErrUniqueness, err.Error())
+	}
+	if err == mongo.ErrNoDocuments {
+		return scim.NotFound("group not found")
+	}
+	return err
+}
+
+func scimFilterError(err error) error {
+	if errors.Is(err, repository.ErrUnsupportedFilter) {
+		return scim.BadRequest(scim.ErrInvalidFilter, err.Error())
+	}
+	return err
+}
+
+func scimMeta(resourceType string, created, lastModified time.Time) *scim.Meta {
+	return &scim.Meta{
+		ResourceType: resourceType,
+		Created:      created,
+		LastModified: lastModified,
+		Version:      `W/"` + strconv.FormatInt(lastModified.UnixNano(), 36) + `"`,
+	}
+}
+
+func scimRoles(values []scim.MultiValued) []string {
+	roles := []string{}
+	for _, value := range values {
+		if value.Value != "" {
+			roles = append(roles, value.Value)
+		}
+	}
+	return roles
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// missingIDs returns the IDs in a that are not in b
+func missingIDs(a, b []primitive.ObjectID) []primitive.ObjectID {
+	present := make(map[primitive.ObjectID]bool, len(b))
+	for _, id := range b {
+		present[id] = true
+	}
+
+	missing := []primitive.ObjectID{}
+	for _, id := range a {
+		if !present[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// allMembers returns a group's members followed by its suspended members
+func allMembers(group *models.Group) []primitive.ObjectID {
+	all := make([]primitive.ObjectID, 0, len(group.Members)+len(group.SuspendedMembers))
+	all = append(all, group.Members...)
+	return append(all, group.SuspendedMembers...)
+}
+
+func objectIDHexes(ids []primitive.ObjectID) []string {
+	hexes := make([]string, 0, len(ids))
+	for _, id := range ids {
+		hexes = append(hexes, id.Hex())
+	}
+	return hexes
+}
@@ -0,0 +1,272 @@
+package jwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/events"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Service account errors
+var (
+	ErrServiceAccountNotFound = errors.New("service account not found")
+	ErrNotServiceAccountOwner = errors.New("only an owner of the service account or an administrator can manage it")
+	ErrInvalidOwner           = errors.New("the owner must be an existing user or group")
+	ErrInvalidClient          = errors.New("invalid client credentials")
+)
+
+// ServiceAccountController handles service accounts: principals owned by a user or group that are used by
+// software, authenticate with API keys or client credentials, and never sign in with a password
+type ServiceAccountController struct {
+	users     *UserController
+	groupRepo *repository.GroupRepository
+	apiKeys   *APIKeyController
+	sessions  *SessionController
+}
+
+// NewServiceAccountController creates a new instance of ServiceAccountController
+func NewServiceAccountController(users *UserController, groupRepo *repository.GroupRepository, apiKeys *APIKeyController, sessions *SessionController) *ServiceAccountController {
+	return &ServiceAccountController{
+		users:     users,
+		groupRepo: groupRepo,
+		apiKeys:   apiKeys,
+		sessions:  sessions,
+	}
+}
+
+// CreateServiceAccount creates a service account owned by a user or group. Without an owner the actor owns it;
+// only administrators can assign accounts to users other than themselves or to groups they are not in.
+func (c *ServiceAccountController) CreateServiceAccount(ctx context.Context, actor *auth.Claims, name, description, ownerType, ownerID string) (account *models.User, err error) {
+	defer func() {
+		entry := AuditEntry{Action: AuditServiceAccountCreated, Err: err, Details: map[string]interface{}{"name": name, "owner_type": ownerType, "owner_id": ownerID}}
+		if err == nil {
+			entry.TargetID = account.ID.Hex()
+			entry.After = account
+		}
+		c.users.auditLog.Record(ctx, entry)
+	}()
+
+	if ownerType == "" && ownerID == "" {
+		ownerType, ownerID = models.OwnerTypeUser, actor.Subject
+	}
+	owner, err := primitive.ObjectIDFromHex(ownerID)
+	if err != nil {
+		return nil, ErrInvalidOwner
+	}
+	if err := c.checkOwner(ctx, ownerType, owner); err != nil {
+		return nil, err
+	}
+	if !actor.HasRole("admin") {
+		owns, err := c.ownedBy(ctx, actor.Subject, ownerType, owner)
+		if err != nil {
+			return nil, err
+		}
+		if !owns {
+			return nil, ErrNotServiceAccountOwner
+		}
+	}
+
+	account = models.NewServiceAccount(name, description, ownerType, owner)
+	err = c.users.createUser(ctx, account, events.ServiceAccountCreated)
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// ListServiceAccounts returns the service accounts the actor can manage: all of them for administrators,
+// otherwise those owned by the actor or one of their groups
+func (c *ServiceAccountController) ListServiceAccounts(ctx context.Context, actor *auth.Claims) ([]models.User, error) {
+	if actor.HasRole("admin") {
+		return c.users.userRepo.FindServiceAccounts(ctx, nil)
+	}
+
+	actorID, err := primitive.ObjectIDFromHex(actor.Subject)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := c.groupRepo.FindByMember(ctx, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := []primitive.ObjectID{actorID}
+	for _, group := range groups {
+		owners = append(owners, group.ID)
+	}
+	return c.users.userRepo.FindServiceAccounts(ctx, owners)
+}
+
+// GetServiceAccount returns a service account the actor can manage
+func (c *ServiceAccountController) GetServiceAccount(ctx context.Context, actor *auth.Claims, id string) (*models.User, error) {
+	account, err := c.find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if actor.HasRole("admin") {
+		return account, nil
+	}
+
+	owns, err := c.ownedBy(ctx, actor.Subject, account.ServiceAccount.OwnerType, account.ServiceAccount.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	if !owns {
+		return nil, ErrNotServiceAccountOwner
+	}
+	return account, nil
+}
+
+// DeleteServiceAccount removes a service account the actor can manage
+func (c *ServiceAccountController) DeleteServiceAccount(ctx context.Context, actor *auth.Claims, id string) error {
+	if _, err := c.GetServiceAccount(ctx, actor, id); err != nil {
+		return err
+	}
+	return c.users.DeleteUser(ctx, id)
+}
+
+// BindRoles replaces the roles bound to a service account
+func (c *ServiceAccountController) BindRoles(ctx context.Context, id string, roles []string) error {
+	if _, err := c.find(ctx, id); err != nil {
+		return err
+	}
+	return c.users.UpdateUserRoles(ctx, id, roles)
+}
+
+// RotateClientSecret replaces the client secret of a service account the actor can manage. The secret is
+// only returned here; it is stored as a hash, and the previous secret stops working immediately. The sessions
+// started with the previous secret are revoked, so that tokens obtained with a leaked secret stop working too.
+func (c *ServiceAccountController) RotateClientSecret(ctx context.Context, actor *auth.Claims, id string) (string, error) {
+	if _, err := c.GetServiceAccount(ctx, actor, id); err != nil {
+		return "", err
+	}
+
+	secret, err := auth.NewClientSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = c.users.mutateUser(ctx, AuditClientSecretRotated, "", id, func(user *models.User) error {
+		now := time.Now()
+		user.ServiceAccount.ClientSecretHash = auth.HashAPIKey(secret)
+		user.ServiceAccount.ClientSecretCreatedAt = &now
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := c.sessions.RevokeAllSessions(ctx, id, ""); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// CreateKey creates an API key for a service account the actor can manage
+func (c *ServiceAccountController) CreateKey(ctx context.Context, actor *auth.Claims, id, name string, scopes []string, expiresAt *time.Time) (*models.APIKey, string, error) {
+	if _, err := c.GetServiceAccount(ctx, actor, id); err != nil {
+		return nil, "", err
+	}
+	return c.apiKeys.CreateKey(ctx, id, name, scopes, expiresAt)
+}
+
+// ListKeys lists the API keys of a service account the actor can manage
+func (c *ServiceAccountController) ListKeys(ctx context.Context, actor *auth.Claims, id string) ([]models.APIKey, error) {
+	if _, err := c.GetServiceAccount(ctx, actor, id); err != nil {
+		return nil, err
+	}
+	return c.apiKeys.ListKeys(ctx, id)
+}
+
+// RevokeKey revokes an API key of a service account the actor can manage
+func (c *ServiceAccountController) RevokeKey(ctx context.Context, actor *auth.Claims, id, keyID string) error {
+	if _, err := c.GetServiceAccount(ctx, actor, id); err != nil {
+		return err
+	}
+	return c.apiKeys.RevokeKey(ctx, id, keyID)
+}
+
+// AuthenticateClient checks the client credentials of a service account, whose ID is the client ID
+func (c *ServiceAccountController) AuthenticateClient(ctx context.Context, clientID, clientSecret string) (result *AuthResult, err error) {
+	entry := AuditEntry{Action: AuditClientCredentials, TargetID: clientID, ActorID: clientID}
+	defer func() {
+		entry.Err = err
+		c.users.auditLog.Record(ctx, entry)
+	}()
+
+	account, err := c.find(ctx, clientID)
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+	hash := account.ServiceAccount.ClientSecretHash
+	if hash == "" || !auth.APIKeyMatches(clientSecret, hash) || !account.IsActive() {
+		return nil, ErrInvalidClient
+	}
+
+	claimAttributes, err := c.users.ClaimAttributes(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResult{User: account, ClaimAttributes: claimAttributes}, nil
+}
+
+// find retrieves a service account by ID
+func (c *ServiceAccountController) find(ctx context.Context, id string) (*models.User, error) {
+	account, err := c.users.userRepo.FindByID(ctx, id)
+	if err == mongo.ErrNoDocuments || errors.Is(err, primitive.ErrInvalidHex) || (err == nil && !account.IsServiceAccount()) {
+		return nil, ErrServiceAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// checkOwner verifies that the owner of a new service account exists and is a person or a group
+func (c *ServiceAccountController) checkOwner(ctx context.Context, ownerType string, ownerID primitive.ObjectID) error {
+	switch ownerType {
+	case models.OwnerTypeUser:
+		user, err := c.users.userRepo.FindByID(ctx, ownerID.Hex())
+		if err == mongo.ErrNoDocuments || (err == nil && user.IsServiceAccount()) {
+			return ErrInvalidOwner
+		}
+		return err
+	case models.OwnerTypeGroup:
+		_, err := c.groupRepo.FindByID(ctx, ownerID)
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidOwner
+		}
+		return err
+	}
+	return fmt.Errorf("%w: unknown owner type %q", ErrInvalidOwner, ownerType)
+}
+
+// ownedBy reports whether a user is the owner or a member of the owning group
+func (c *ServiceAccountController) ownedBy(ctx context.Context, userID, ownerType string, ownerID primitive.ObjectID) (bool, error) {
+	if ownerType == models.OwnerTypeUser {
+		return ownerID.Hex() == userID, nil
+	}
+
+	group, err := c.groupRepo.FindByID(ctx, ownerID)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, member := range group.Members {
+		if member.Hex() == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
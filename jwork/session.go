@@ -0,0 +1,169 @@
+package jwork
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrSessionNotFound is returned when a session does not exist or belongs to another user
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionExpired is returned when a session was revoked, timed out or reached its absolute lifetime
+var ErrSessionExpired = errors.New("session has expired")
+
+// touchInterval limits how often a session's last-seen time is written
+const touchInterval = time.Minute
+
+// SessionPolicy configures session timeouts
+type SessionPolicy struct {
+	IdleTimeout     time.Duration // sessions unused for this long end; zero disables the idle timeout
+	AbsoluteTimeout time.Duration // sessions end this long after login regardless of activity
+}
+
+// DefaultSessionPolicy returns the session policy used when none is configured
+func DefaultSessionPolicy() SessionPolicy {
+	return SessionPolicy{
+		IdleTimeout:     30 * time.Minute,
+		AbsoluteTimeout: 12 * time.Hour,
+	}
+}
+
+// SessionController handles business logic for login sessions
+type SessionController struct {
+	sessionRepo *repository.SessionRepository
+	policy      SessionPolicy
+}
+
+// NewSessionController creates a new instance of SessionController
+func NewSessionController(sessionRepo *repository.SessionRepository, policy SessionPolicy) *SessionController {
+	return &SessionController{
+		sessionRepo: sessionRepo,
+		policy:      policy,
+	}
+}
+
+// StartSession records a new login for the user from the given client
+func (c *SessionController) StartSession(ctx context.Context, user *models.User, userAgent, ip string) (*models.Session, error) {
+	session := models.NewSession(user.ID, userAgent, describeDevice(userAgent), ip, c.policy.AbsoluteTimeout)
+
+	err := c.sessionRepo.Create(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ValidateSession checks that the session belongs to the user and is still active, and records the activity
+func (c *SessionController) ValidateSession(ctx context.Context, sessionID, userID string) error {
+	session, err := c.sessionRepo.FindByID(ctx, sessionID)
+	if err != nil || session.UserID.Hex() != userID {
+		return ErrSessionExpired
+	}
+
+	now := time.Now()
+	if !session.IsActive(now, c.policy.IdleTimeout) {
+		return ErrSessionExpired
+	}
+
+	if now.Sub(session.LastSeenAt) >= touchInterval {
+		return c.sessionRepo.Touch(ctx, session.ID, now)
+	}
+	return nil
+}
+
+// ListSessions returns the user's active sessions, most recently used first
+func (c *SessionController) ListSessions(ctx context.Context, userID string) ([]models.Session, error) {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	idleCutoff := time.Time{}
+	if c.policy.IdleTimeout > 0 {
+		idleCutoff = time.Now().Add(-c.policy.IdleTimeout)
+	}
+	return c.sessionRepo.FindActiveByUser(ctx, objectID, idleCutoff)
+}
+
+// RevokeSession ends one of the user's sessions
+func (c *SessionController) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+	sessionObjectID, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	revoked, err := c.sessionRepo.Revoke(ctx, userObjectID, sessionObjectID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessions ends all of the user's sessions except exceptSessionID, which may be empty
+func (c *SessionController) RevokeAllSessions(ctx context.Context, userID, exceptSessionID string) (int64, error) {
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var exceptID primitive.ObjectID
+	if exceptSessionID != "" {
+		exceptID, _ = primitive.ObjectIDFromHex(exceptSessionID)
+	}
+
+	return c.sessionRepo.RevokeAllByUser(ctx, userObjectID, exceptID)
+}
+
+// describeDevice derives a short "Browser on OS" label from a user agent
+func describeDevice(userAgent string) string {
+	browser := firstMatch(userAgent, [][2]string{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	})
+	platform := firstMatch(userAgent, [][2]string{
+		{"Windows", "Windows"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	})
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	return "Unknown device"
+}
+
+func firstMatch(userAgent string, patterns [][2]string) string {
+	for _, p := range patterns {
+		if strings.Contains(userAgent, p[0]) {
+			return p[1]
+		}
+	}
+	return ""
+}
@@ -3,34 +3,134 @@ package jwork
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
 	"time"
 
+	"iam_backend/auth"
+	"iam_backend/events"
+	"iam_backend/hashing"
 	models "iam_backend/models"
+	"iam_backend/password"
 	repository "iam_backend/repo"
+	"iam_backend/reqctx"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// User errors
+var (
+	ErrInvalidCredentials = auth.ErrInvalidCredentials
+	ErrUnknownAuthSource  = errors.New("unknown authentication source")
+	ErrExternalPassword   = errors.New("the password of this user is managed by an external directory")
+	ErrIncorrectPassword  = errors.New("incorrect password")
+	ErrAttributeTaken     = repository.ErrAttributeTaken
+	ErrServiceAccount     = errors.New("service accounts have no password and authenticate with keys or client credentials")
+	ErrUserInactive       = models.ErrUserInactive
+	ErrInvalidTransition  = models.ErrInvalidTransition
+	ErrInvalidEmailToken  = errors.New("the email verification token is invalid or has expired")
+	ErrNotReactivatable   = errors.New("provisioning clients can only make deactivated users active; locked, suspended and unverified users are reactivated by an administrator")
+	ErrReservedUsername   = fmt.Errorf("%w: usernames starting with %q are reserved for service accounts", repository.ErrUserExists, models.ServiceAccountPrefix)
 )
 
+// temporaryPasswordLength is the length of admin-issued temporary passwords
+const temporaryPasswordLength = 16
+
+// emailVerificationTTL is how long a user has to verify an email address they changed to
+const emailVerificationTTL = 24 * time.Hour
+
+// errUnchanged is returned by changes that leave the user as they were, which are neither saved nor audited
+var errUnchanged = errors.New("user unchanged")
+
+// AuthResult is the outcome of a successful authentication
+type AuthResult struct {
+	User *models.User
+	// ClaimAttributes are the custom attributes the tenant's schema includes in access tokens
+	ClaimAttributes map[string]interface{}
+	// PasswordChangeRequired is set when the user must change their password before doing anything else
+	PasswordChangeRequired bool
+}
+
 // UserController handles business logic for user operations
 type UserController struct {
-	userRepo *repository.UserRepository
+	userRepo       *repository.UserRepository
+	loginGuard     *LoginGuard
+	passwordPolicy *password.Policy
+	auditLog       *AuditLogger
+	outbox         *Outbox
+	tx             Transactor
+	authenticators *auth.AuthenticatorRouter
+	attributeRepo  *repository.AttributeSchemaRepository
+	deprovisioner  *Deprovisioner // nil leaves the access of deactivated and deleted users in place
 }
 
 // NewUserController creates a new instance of UserController
-func NewUserController(userRepo *repository.UserRepository) *UserController {
+func NewUserController(userRepo *repository.UserRepository, loginGuard *LoginGuard, passwordPolicy *password.Policy, auditLog *AuditLogger, outbox *Outbox, tx Transactor, authenticators *auth.AuthenticatorRouter, attributeRepo *repository.AttributeSchemaRepository, deprovisioner *Deprovisioner) *UserController {
 	return &UserController{
-		userRepo: userRepo,
+		userRepo:       userRepo,
+		loginGuard:     loginGuard,
+		passwordPolicy: passwordPolicy,
+		auditLog:       auditLog,
+		outbox:         outbox,
+		tx:             tx,
+		authenticators: authenticators,
+		attributeRepo:  attributeRepo,
+		deprovisioner:  deprovisioner,
 	}
 }
 
 // RegisterUser handles user registration
-func (c *UserController) RegisterUser(ctx context.Context, username, email, password string) (*models.User, error) {
+func (c *UserController) RegisterUser(ctx context.Context, username, email, password string) (user *models.User, err error) {
+	defer func() {
+		entry := AuditEntry{Action: AuditUserRegistered, Err: err, Details: map[string]interface{}{"username": username, "email": email}}
+		if err == nil {
+			entry.TargetID = user.ID.Hex()
+			entry.After = user
+		}
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	// Enforce the password policy
+	err = c.passwordPolicy.Validate(password, &models.User{Username: username, Email: email})
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a new user
-	user, err := models.NewUser(username, email, password)
+	user, err = models.NewUser(username, email, password)
 	if err != nil {
 		return nil, err
 	}
 
 	// Save the user to the database
-	err = c.userRepo.Create(ctx, user)
+	err = c.createUser(ctx, user, events.UserRegistered)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ImportUser creates a user migrated from another system, keeping its existing password hash
+func (c *UserController) ImportUser(ctx context.Context, username, email, passwordHash string, roles []string) (user *models.User, err error) {
+	defer func() {
+		entry := AuditEntry{Action: AuditUserImported, Err: err, Details: map[string]interface{}{"username": username, "email": email}}
+		if err == nil {
+			entry.TargetID = user.ID.Hex()
+			entry.After = user
+		}
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	user, err = models.NewImportedUser(username, email, passwordHash, roles)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.createUser(ctx, user, events.UserImported)
 	if err != nil {
 		return nil, err
 	}
@@ -38,39 +138,327 @@ func (c *UserController) RegisterUser(ctx context.Context, username, email, pass
 	return user, nil
 }
 
-// AuthenticateUser handles user login
-func (c *UserController) AuthenticateUser(ctx context.Context, username, password string) (*models.User, error) {
-	// Find the user by username
+// ProvisionUser creates a user pushed by a provisioning client. Without a password the account gets a
+// random one, so the user can only log in after a password is set.
+func (c *UserController) ProvisionUser(ctx context.Context, username, email, initialPassword, externalID string, roles []string, active bool) (user *models.User, err error) {
+	defer func() {
+		entry := AuditEntry{Action: AuditUserProvisioned, Err: err, Details: map[string]interface{}{"username": username, "email": email}}
+		if err == nil {
+			entry.TargetID = user.ID.Hex()
+			entry.After = user
+		}
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	if initialPassword == "" {
+		initialPassword, err = password.Generate(temporaryPasswordLength)
+	} else {
+		err = c.passwordPolicy.Validate(initialPassword, &models.User{Username: username, Email: email})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err = models.NewUser(username, email, initialPassword)
+	if err != nil {
+		return nil, err
+	}
+	user.ExternalID = externalID
+	if !active {
+		user.State = models.StateDeactivated
+		user.StateReason = "provisioned inactive"
+	}
+	if len(roles) > 0 {
+		user.Roles = roles
+	}
+
+	err = c.createUser(ctx, user, events.UserProvisioned)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ProvisionedChanges is a provisioning client's replacement of a user's profile, password, roles and status
+type ProvisionedChanges struct {
+	Username   string
+	Email      string
+	ExternalID string
+	Password   string   // empty leaves the password as it is
+	Roles      []string // nil leaves the roles as they are
+	Active     *bool    // nil leaves the state as it is
+}
+
+// ReplaceProvisionedUser applies a provisioning client's replacement of a user as one change, so that it is
+// saved in full or not at all, staging an event for each part that changed. Active only moves users between
+// the active and deactivated states: marking a user who is not active inactive changes nothing, and making a
+// locked, suspended or unverified user active fails with ErrNotReactivatable.
+func (c *UserController) ReplaceProvisionedUser(ctx context.Context, userID string, changes ProvisionedChanges) error {
+	var from string
+	var profileChanged, passwordChanged, rolesChanged bool
+	var job *models.DeprovisioningJob
+	err := c.mutateUserWith(ctx, AuditUserReplaced, "", userID, func(user *models.User) error {
+		from = user.State
+
+		profileChanged = changes.Username != user.Username || changes.Email != user.Email || changes.ExternalID != user.ExternalID
+		if profileChanged {
+			taken, err := c.userRepo.IsTaken(ctx, changes.Username, changes.Email, user.ID)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return repository.ErrUserExists
+			}
+			user.Username = changes.Username
+			user.Email = changes.Email
+			user.ExternalID = changes.ExternalID
+			if !user.HasValidUsername() {
+				return ErrReservedUsername
+			}
+		}
+
+		passwordChanged = changes.Password != ""
+		if passwordChanged {
+			if user.IsServiceAccount() {
+				return ErrServiceAccount
+			}
+			if !user.HasLocalPassword() {
+				return ErrExternalPassword
+			}
+			if err := c.passwordPolicy.Validate(changes.Password, user); err != nil {
+				return err
+			}
+			if err := user.ReplacePassword(changes.Password, c.passwordPolicy.HistorySize); err != nil {
+				return err
+			}
+		}
+
+		rolesChanged = changes.Roles != nil && !sameStrings(changes.Roles, user.Roles)
+		if rolesChanged {
+			user.Roles = changes.Roles
+		}
+
+		if changes.Active != nil && *changes.Active != user.IsActive() {
+			switch {
+			case !*changes.Active:
+				if err := user.Transition(models.StateDeactivated, "set inactive by the provisioning client", time.Now()); err != nil {
+					return err
+				}
+			case user.State == models.StateDeactivated:
+				if err := user.Transition(models.StateActive, "set active by the provisioning client", time.Now()); err != nil {
+					return err
+				}
+			default:
+				return ErrNotReactivatable
+			}
+		}
+
+		if !profileChanged && !passwordChanged && !rolesChanged && user.State == from {
+			return errUnchanged
+		}
+		return nil
+	}, func(ctx context.Context, user *models.User) (err error) {
+		var eventTypes []string
+		if profileChanged {
+			eventTypes = append(eventTypes, events.UserUpdated)
+		}
+		if passwordChanged {
+			eventTypes = append(eventTypes, events.UserPasswordChanged)
+		}
+		if rolesChanged {
+			eventTypes = append(eventTypes, events.UserRolesUpdated)
+		}
+		switch {
+		case user.State == from:
+		case user.State == models.StateActive:
+			eventTypes = append(eventTypes, events.UserReactivated)
+		default:
+			eventTypes = append(eventTypes, events.UserDeactivated)
+		}
+		for _, eventType := range eventTypes {
+			if err := c.outbox.Stage(ctx, userEvent(ctx, eventType, user)); err != nil {
+				return err
+			}
+		}
+
+		job, err = c.stateChanged(ctx, from, user)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.deprovision(ctx, job)
+
+	return nil
+}
+
+// AuthenticateUser handles user login, checking the password against the store the user is routed to.
+// Users authenticated by an external store get a local account on their first login.
+func (c *UserController) AuthenticateUser(ctx context.Context, username, password string) (result *AuthResult, err error) {
+	entry := AuditEntry{Action: AuditLogin, Details: map[string]interface{}{"username": username}}
+	defer func() {
+		entry.Err = err
+		if err == nil {
+			entry.ActorID = entry.TargetID
+			entry.After = result.User
+		}
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	// Find the user by username; users of external stores may not have an account yet
 	user, err := c.userRepo.FindByUsernameOrEmail(ctx, username, username)
+	if err == mongo.ErrNoDocuments {
+		user = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if user != nil && user.IsServiceAccount() {
+		return nil, ErrInvalidCredentials
+	}
+
+	authenticator, err := c.authenticators.Route(username, user)
 	if err != nil {
 		return nil, err
 	}
+	entry.Details["source"] = authenticator.Name()
+	if user == nil && authenticator.Name() == auth.SourceLocal {
+		return nil, ErrInvalidCredentials
+	}
 
-	// Check password
-	if !user.CheckPasswordHash(password) {
+	if user != nil {
+		before := *user
+		entry.TargetID = user.ID.Hex()
+		entry.Before = &before
+
+		// Refuse attempts while the account is locked or throttled, counting this one otherwise
+		if err := c.loginGuard.Begin(ctx, user); err != nil {
+			return nil, err
+		}
+	} else if err := c.loginGuard.BeginExternal(ctx, username); err != nil {
+		// Guesses at logins without an account are throttled per login name
+		return nil, err
+	}
+
+	// Check password; the local store may upgrade the hash in place
+	var storedHash string
+	if user != nil {
+		storedHash = user.PasswordHash
+	}
+	identity, err := authenticator.Authenticate(ctx, username, user, password)
+	if err == nil && user != nil && !auth.SameIdentity(identity, user) {
+		// The store accepted the password of someone else, e.g. a directory entry found by the login
+		err = auth.ErrInvalidCredentials
+	}
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		if user != nil {
+			err = c.loginGuard.RecordFailure(ctx, user)
+		} else {
+			err = c.loginGuard.RecordExternalFailure(ctx, username)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	// Update last login
+	if user == nil {
+		err = c.loginGuard.RecordExternalSuccess(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		user, err = c.provisionExternalUser(ctx, identity, authenticator.Name())
+		if err != nil {
+			return nil, err
+		}
+		entry.TargetID = user.ID.Hex()
+	} else {
+		// Clear failed attempts
+		err = c.loginGuard.RecordSuccess(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only active users may sign in; the state is revealed only once the password is known to be right
+	if err := user.CheckActive(); err != nil {
+		return nil, err
+	}
+
+	// Record the login, writing only what it changed so that changes made since the user was read are kept
+	if user.PasswordHash != storedHash && storedHash != "" {
+		err = c.userRepo.UpgradePasswordHash(ctx, user.ID, storedHash, user.PasswordHash)
+		if err != nil {
+			return nil, err
+		}
+	}
 	now := time.Now()
 	user.LastLogin = &now
-	err = c.userRepo.Update(ctx, user)
+	err = c.userRepo.UpdateLastLogin(ctx, user.ID, now)
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	claimAttributes, err := c.ClaimAttributes(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResult{
+		User:                   user,
+		ClaimAttributes:        claimAttributes,
+		PasswordChangeRequired: user.HasLocalPassword() && (user.MustChangePassword || user.PasswordExpired(c.passwordPolicy.MaxAge)),
+	}, nil
 }
 
-// UpdateUserRoles updates roles for a user
-func (c *UserController) UpdateUserRoles(ctx context.Context, userID string, roles []string) error {
-	user, err := c.userRepo.FindByID(ctx, userID)
+// provisionExternalUser creates the local account of a user authenticated by an external store
+func (c *UserController) provisionExternalUser(ctx context.Context, identity *auth.Identity, source string) (user *models.User, err error) {
+	defer func() {
+		entry := AuditEntry{Action: AuditUserProvisioned, Err: err, Details: map[string]interface{}{"username": identity.Username, "email": identity.Email, "source": source}}
+		if err == nil {
+			entry.TargetID = user.ID.Hex()
+			entry.After = user
+		}
+		c.auditLog.Record(ctx, entry)
+	}()
+
+	if identity.Email == "" {
+		return nil, fmt.Errorf("%s returned no email address for %s", source, identity.Username)
+	}
+
+	user = models.NewExternalUser(identity.Username, identity.Email, source)
+	err = c.createUser(ctx, user, events.UserProvisioned)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	user.Roles = roles
-	return c.userRepo.Update(ctx, user)
+	return user, nil
+}
+
+// SetAuthSource routes a user's logins to the named password store
+func (c *UserController) SetAuthSource(ctx context.Context, userID, source string) error {
+	if !c.authenticators.Has(source) {
+		return fmt.Errorf("%w: %q", ErrUnknownAuthSource, source)
+	}
+
+	return c.mutateUser(ctx, AuditAuthSourceChanged, events.UserUpdated, userID, func(user *models.User) error {
+		if user.IsServiceAccount() {
+			return ErrServiceAccount
+		}
+		user.AuthSource = source
+		return nil
+	})
+}
+
+// UpdateUserRoles updates roles for a user
+func (c *UserController) UpdateUserRoles(ctx context.Context, userID string, roles []string) error {
+	return c.mutateUser(ctx, AuditRolesUpdated, events.UserRolesUpdated, userID, func(user *models.User) error {
+		user.Roles = roles
+		return nil
+	})
 }
 
 // GetUserByID retrieves a user by their ID
@@ -90,45 +478,573 @@ func (c *UserController) GetUserByID(ctx context.Context, userID string) (*model
 }
 
 // DeactivateUser deactivates a user account
-func (c *UserController) DeactivateUser(ctx context.Context, userID string) error {
+func (c *UserController) DeactivateUser(ctx context.Context, userID, reason string) error {
+	return c.ChangeState(ctx, userID, models.StateDeactivated, reason)
+}
+
+// DeactivateOwnAccount deactivates the user's own account. Users whose password is kept here confirm it.
+func (c *UserController) DeactivateOwnAccount(ctx context.Context, userID, password string) error {
+	return c.changeState(ctx, AuditUserDeactivated, events.UserDeactivated, userID, func(user *models.User) error {
+		if user.HasLocalPassword() && !user.IsServiceAccount() {
+			if err := c.confirmPassword(ctx, user, password); err != nil {
+				return err
+			}
+		}
+		return user.Transition(models.StateDeactivated, "deactivated by the user", time.Now())
+	})
+}
+
+// ReactivateUser makes a user account active again, e.g. after deactivation, suspension or a lock
+func (c *UserController) ReactivateUser(ctx context.Context, userID, reason string) error {
+	return c.ChangeState(ctx, userID, models.StateActive, reason)
+}
+
+// ChangeState moves a user to another lifecycle state, recording the reason. Moves between states
+// that are not allowed fail with ErrInvalidTransition. Deactivating a user deprovisions them. Moving
+// a user to their current state changes nothing and is not audited.
+func (c *UserController) ChangeState(ctx context.Context, userID, state, reason string) error {
+	action, eventType := AuditStateChanged, events.UserStateChanged
+	switch state {
+	case models.StateActive:
+		action, eventType = AuditUserReactivated, events.UserReactivated
+	case models.StateDeactivated:
+		action, eventType = AuditUserDeactivated, events.UserDeactivated
+	}
+
+	return c.changeState(ctx, action, eventType, userID, func(user *models.User) error {
+		return user.Transition(state, reason, time.Now())
+	})
+}
+
+// ValidateUser checks that a user exists and is active, for requests authenticated by a token
+func (c *UserController) ValidateUser(ctx context.Context, userID string) error {
+	user, err := c.userRepo.FindByID(ctx, userID)
+	if err != nil {
+		return ErrInvalidCredentials
+	}
+	return user.CheckActive()
+}
+
+// ChangePassword handles password changes
+func (c *UserController) ChangePassword(ctx context.Context, userID, oldPassword, newPassword string) error {
+	return c.mutateUser(ctx, AuditPasswordChanged, events.UserPasswordChanged, userID, func(user *models.User) error {
+		if user.IsServiceAccount() {
+			return ErrServiceAccount
+		}
+		if !user.HasLocalPassword() {
+			return ErrExternalPassword
+		}
+
+		// Verify old password
+		if err := c.confirmPassword(ctx, user, oldPassword); err != nil {
+			return err
+		}
+
+		// Enforce the password policy
+		err := c.passwordPolicy.Validate(newPassword, user)
+		if err != nil {
+			return err
+		}
+
+		return user.ReplacePassword(newPassword, c.passwordPolicy.HistorySize)
+	})
+}
+
+// confirmPassword checks the password a user entered to confirm a change to their account. Each check counts
+// as a login attempt, so guesses are throttled and locked out as at login, failing with a LoginBlockedError.
+func (c *UserController) confirmPassword(ctx context.Context, user *models.User, password string) error {
+	if err := c.loginGuard.Begin(ctx, user); err != nil {
+		return err
+	}
+	if !user.CheckPasswordHash(password) {
+		if err := c.loginGuard.RecordFailure(ctx, user); err != nil {
+			return err
+		}
+		return ErrIncorrectPassword
+	}
+	return c.loginGuard.RecordSuccess(ctx, user)
+}
+
+// SetTemporaryPassword replaces the user's password with a generated one that must be changed at next login
+func (c *UserController) SetTemporaryPassword(ctx context.Context, userID string) (string, error) {
+	temporary, err := password.Generate(temporaryPasswordLength)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.mutateUser(ctx, AuditTemporaryPasswordSet, "", userID, func(user *models.User) error {
+		if user.IsServiceAccount() {
+			return ErrServiceAccount
+		}
+		if !user.HasLocalPassword() {
+			return ErrExternalPassword
+		}
+
+		err := user.ReplacePassword(temporary, c.passwordPolicy.HistorySize)
+		if err != nil {
+			return err
+		}
+		user.MustChangePassword = true
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return temporary, nil
+}
+
+// UpdateProfile changes a user's username, email and external ID
+func (c *UserController) UpdateProfile(ctx context.Context, userID, username, email, externalID string) error {
+	return c.mutateUser(ctx, AuditProfileUpdated, events.UserUpdated, userID, func(user *models.User) error {
+		taken, err := c.userRepo.IsTaken(ctx, username, email, user.ID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return repository.ErrUserExists
+		}
+
+		user.Username = username
+		user.Email = email
+		user.ExternalID = externalID
+		if !user.HasValidUsername() {
+			return ErrReservedUsername
+		}
+		return nil
+	})
+}
+
+// UpdateOwnProfile changes the username, email and custom attributes of the user themselves; nil values
+// are left unchanged, and attributes set to nil are removed. Users whose password is kept here confirm it.
+// Users can only change attributes the schema marks as user-editable. A new email is kept as pending, and a
+// token to verify it with is sent in a user.email_verification_requested event; VerifyEmail then makes it
+// the user's email. The external ID belongs to provisioning clients, so users cannot change it.
+func (c *UserController) UpdateOwnProfile(ctx context.Context, userID, password string, username, email *string, attributes map[string]interface{}) error {
+	var token string
+	return c.mutateUserWith(ctx, AuditProfileUpdated, events.UserUpdated, userID, func(user *models.User) error {
+		if user.HasLocalPassword() && !user.IsServiceAccount() {
+			if err := c.confirmPassword(ctx, user, password); err != nil {
+				return err
+			}
+		}
+		if len(attributes) > 0 {
+			schema, err := c.attributeRepo.FindByTenant(ctx, user.TenantName())
+			if err != nil {
+				return err
+			}
+			for name := range attributes {
+				if def := schema.Definition(name); def != nil && !def.UserEditable {
+					return fmt.Errorf("%w: %s cannot be changed by the user", models.ErrInvalidAttribute, name)
+				}
+			}
+			user.Attributes = mergeAttributes(user.Attributes, attributes)
+		}
+		if username != nil {
+			user.Username = *username
+			if !user.HasValidUsername() {
+				return ErrReservedUsername
+			}
+		}
+		if email != nil && *email != user.Email {
+			if user.IsServiceAccount() {
+				return ErrServiceAccount
+			}
+			var err error
+			token, err = auth.NewClientSecret()
+			if err != nil {
+				return err
+			}
+			user.PendingEmail = &models.EmailChange{
+				Email:     *email,
+				TokenHash: auth.HashAPIKey(token),
+				ExpiresAt: time.Now().Add(emailVerificationTTL),
+			}
+		}
+
+		pendingEmail := ""
+		if user.PendingEmail != nil {
+			pendingEmail = user.PendingEmail.Email
+		}
+		taken, err := c.userRepo.IsTaken(ctx, user.Username, pendingEmail, user.ID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return repository.ErrUserExists
+		}
+		return nil
+	}, func(ctx context.Context, user *models.User) error {
+		if token == "" {
+			return nil
+		}
+		event := events.New(events.UserEmailRequested, user.ID.Hex(), map[string]interface{}{
+			"email":      user.PendingEmail.Email,
+			"token":      token,
+			"expires_at": user.PendingEmail.ExpiresAt,
+		})
+		event.ActorID = reqctx.From(ctx).ActorID
+		return c.outbox.Stage(ctx, event)
+	})
+}
+
+// VerifyEmail makes the email the user changed to their email, given the token sent to the new address
+func (c *UserController) VerifyEmail(ctx context.Context, userID, token string) error {
+	return c.mutateUser(ctx, AuditEmailVerified, events.UserUpdated, userID, func(user *models.User) error {
+		pending := user.PendingEmail
+		if pending == nil || time.Now().After(pending.ExpiresAt) || !auth.APIKeyMatches(token, pending.TokenHash) {
+			return ErrInvalidEmailToken
+		}
+
+		// Another user may have taken the address since it was requested
+		taken, err := c.userRepo.IsTaken(ctx, "", pending.Email, user.ID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return repository.ErrUserExists
+		}
+
+		user.Email = pending.Email
+		user.PendingEmail = nil
+		return nil
+	})
+}
+
+// SetAttributes replaces a user's custom attributes
+func (c *UserController) SetAttributes(ctx context.Context, userID string, attributes map[string]interface{}) error {
+	return c.mutateUser(ctx, AuditAttributesUpdated, events.UserUpdated, userID, func(user *models.User) error {
+		user.Attributes = attributes
+		return nil
+	})
+}
+
+// ClaimAttributes returns the user's custom attributes that the tenant's schema includes in access tokens
+func (c *UserController) ClaimAttributes(ctx context.Context, user *models.User) (map[string]interface{}, error) {
+	if len(user.Attributes) == 0 {
+		return nil, nil
+	}
+	schema, err := c.attributeRepo.FindByTenant(ctx, user.TenantName())
+	if err != nil {
+		return nil, err
+	}
+	return schema.ClaimAttributes(user.Attributes), nil
+}
+
+// SetPassword replaces the user's password without requiring the current one, e.g. for provisioning clients
+func (c *UserController) SetPassword(ctx context.Context, userID, newPassword string) error {
+	return c.mutateUser(ctx, AuditPasswordSet, events.UserPasswordChanged, userID, func(user *models.User) error {
+		if user.IsServiceAccount() {
+			return ErrServiceAccount
+		}
+		if !user.HasLocalPassword() {
+			return ErrExternalPassword
+		}
+
+		err := c.passwordPolicy.Validate(newPassword, user)
+		if err != nil {
+			return err
+		}
+
+		return user.ReplacePassword(newPassword, c.passwordPolicy.HistorySize)
+	})
+}
+
+// DeleteUser removes a user account and deprovisions the user
+func (c *UserController) DeleteUser(ctx context.Context, userID string) (err error) {
+	entry := AuditEntry{Action: AuditUserDeleted, TargetID: userID}
+	defer func() {
+		entry.Err = err
+		c.auditLog.Record(ctx, entry)
+	}()
+
 	user, err := c.userRepo.FindByID(ctx, userID)
 	if err != nil {
 		return err
 	}
+	entry.Before = user
 
-	user.Active = false
-	return c.userRepo.Update(ctx, user)
+	var job *models.DeprovisioningJob
+	err = c.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		err := c.userRepo.Delete(ctx, userID)
+		if err != nil {
+			return err
+		}
+		err = c.outbox.Stage(ctx, userEvent(ctx, events.UserDeleted, user))
+		if err != nil {
+			return err
+		}
+		job, err = c.enqueueDeprovisioning(ctx, user.ID, models.DeprovisionDeleted)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.deprovision(ctx, job)
+
+	return nil
+}
+
+// ListUsers returns a page of the users matching the filter and the cursor of the next page
+func (c *UserController) ListUsers(ctx context.Context, filter repository.UserFilter, sort repository.UserSort, cursor string, limit int64) ([]models.User, string, error) {
+	return c.userRepo.List(ctx, filter, sort, cursor, limit)
 }
 
-// ReactivateUser reactivates a deactivated user account
-func (c *UserController) ReactivateUser(ctx context.Context, userID string) error {
+// ExportUsers passes the users matching the filter to fn in ID order
+func (c *UserController) ExportUsers(ctx context.Context, filter repository.UserFilter, fn func(user *models.User) error) error {
+	return c.userRepo.Stream(ctx, filter, fn)
+}
+
+// PepperKeyUsage counts users per pepper key, so operators know when a rotated-out key can be removed.
+// Hashes move to the current key as users log in; users without a pepper are counted under "none".
+func (c *UserController) PepperKeyUsage(ctx context.Context) (map[string]int64, error) {
+	total, err := c.userRepo.Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]int64{}
+	if pepper := models.PasswordPepper(); pepper != nil {
+		for _, keyID := range pepper.KeyIDs() {
+			count, err := c.userRepo.CountByPasswordHashPrefix(ctx, hashing.PepperPrefix(keyID)+"$")
+			if err != nil {
+				return nil, err
+			}
+			usage[keyID] = count
+			total -= count
+		}
+	}
+	usage["none"] = total
+
+	return usage, nil
+}
+
+// UnlockUser clears a lockout caused by repeated failed logins
+func (c *UserController) UnlockUser(ctx context.Context, userID, actorID string) (err error) {
+	defer func() {
+		c.auditLog.Record(ctx, AuditEntry{Action: AuditUserUnlocked, TargetID: userID, Err: err})
+	}()
+
 	user, err := c.userRepo.FindByID(ctx, userID)
 	if err != nil {
 		return err
 	}
 
-	user.Active = true
-	return c.userRepo.Update(ctx, user)
+	err = c.loginGuard.Unlock(ctx, user.ID, actorID)
+	if err != nil || user.State != models.StateLocked {
+		return err
+	}
+	return c.ChangeState(ctx, userID, models.StateActive, "unlocked")
 }
 
-// ChangePassword handles password changes
-func (c *UserController) ChangePassword(ctx context.Context, userID, oldPassword, newPassword string) error {
-	// Get the user
+// mutateUser loads a user, applies change and saves the result, recording the operation in the audit log
+// and staging eventType, if set, in the outbox in the same transaction
+func (c *UserController) mutateUser(ctx context.Context, action, eventType, userID string, change func(user *models.User) error) error {
+	return c.mutateUserWith(ctx, action, eventType, userID, change, nil)
+}
+
+// changeState is mutateUser for changes of the user's lifecycle state; changes that leave the state as it
+// was are skipped. A user entering the deactivated state is deprovisioned; one becoming active again gets
+// back what deprovisioning suspended, and a locked user loses the lockout of their failed logins.
+func (c *UserController) changeState(ctx context.Context, action, eventType, userID string, change func(user *models.User) error) error {
+	var from string
+	var job *models.DeprovisioningJob
+	err := c.mutateUserWith(ctx, action, eventType, userID, func(user *models.User) error {
+		from = user.State
+		if err := change(user); err != nil {
+			return err
+		}
+		if user.State == from {
+			return errUnchanged
+		}
+		return nil
+	}, func(ctx context.Context, user *models.User) (err error) {
+		job, err = c.stateChanged(ctx, from, user)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.deprovision(ctx, job)
+
+	return nil
+}
+
+// stateChanged follows up, in ctx's transaction, on the user's move from the state from to their current
+// state, returning the deprovisioning job it enqueued, if any. Users staying in their state are left alone.
+func (c *UserController) stateChanged(ctx context.Context, from string, user *models.User) (job *models.DeprovisioningJob, err error) {
+	if user.State == from {
+		return nil, nil
+	}
+	if from == models.StateLocked && user.State == models.StateActive {
+		if err := c.loginGuard.attempts.Reset(ctx, user.ID); err != nil {
+			return nil, err
+		}
+	}
+	if c.deprovisioner == nil {
+		return nil, nil
+	}
+	switch user.State {
+	case models.StateDeactivated:
+		job, err = c.enqueueDeprovisioning(ctx, user.ID, models.DeprovisionDeactivated)
+	case models.StateActive:
+		err = c.deprovisioner.Restore(ctx, user.ID)
+	}
+	return job, err
+}
+
+// enqueueDeprovisioning records a deprovisioning job for the user in ctx's transaction.
+// It does nothing without a deprovisioner.
+func (c *UserController) enqueueDeprovisioning(ctx context.Context, userID primitive.ObjectID, trigger string) (*models.DeprovisioningJob, error) {
+	if c.deprovisioner == nil {
+		return nil, nil
+	}
+	return c.deprovisioner.Enqueue(ctx, userID, trigger, reqctx.From(ctx).ActorID)
+}
+
+// deprovision runs a job enqueued by a committed change right away. Failures are only logged,
+// as the change stands and the deprovisioning worker retries the job.
+func (c *UserController) deprovision(ctx context.Context, job *models.DeprovisioningJob) {
+	if job == nil {
+		return
+	}
+	if err := c.deprovisioner.Process(context.WithoutCancel(ctx), job); err != nil {
+		log.Printf("Deprovisioning user %s failed, the worker will retry: %v", job.UserID.Hex(), err)
+	}
+}
+
+// mutateUserWith is mutateUser that also calls inTx, if set, with the changed user inside the transaction
+func (c *UserController) mutateUserWith(ctx context.Context, action, eventType, userID string, change func(user *models.User) error, inTx func(ctx context.Context, user *models.User) error) (err error) {
+	entry := AuditEntry{Action: action, TargetID: userID}
+	defer func() {
+		if errors.Is(err, errUnchanged) {
+			err = nil
+			return
+		}
+		entry.Err = err
+		c.auditLog.Record(ctx, entry)
+	}()
+
 	user, err := c.userRepo.FindByID(ctx, userID)
 	if err != nil {
 		return err
 	}
+	before := *user
+	before.Attributes = maps.Clone(user.Attributes)
+	entry.Before = &before
 
-	// Verify old password
-	if !user.CheckPasswordHash(oldPassword) {
-		return errors.New("incorrect password")
+	err = change(user)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(before.Attributes, user.Attributes) {
+		err = c.checkAttributes(ctx, user)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Update with new password
-	err = user.HashPassword(newPassword)
+	err = c.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		// Replaced rather than updated, so that fields the change cleared are removed
+		err := c.userRepo.Replace(ctx, user)
+		if err != nil {
+			return err
+		}
+		if eventType != "" {
+			err = c.outbox.Stage(ctx, userEvent(ctx, eventType, user))
+			if err != nil {
+				return err
+			}
+		}
+		if inTx != nil {
+			return inTx(ctx, user)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	entry.After = user
+
+	return nil
+}
+
+// createUser inserts a new user and stages eventType in the outbox in the same transaction
+func (c *UserController) createUser(ctx context.Context, user *models.User, eventType string) error {
+	if !user.HasValidUsername() {
+		return ErrReservedUsername
+	}
+	if err := c.checkAttributes(ctx, user); err != nil {
+		return err
+	}
+
+	return c.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		err := c.userRepo.Create(ctx, user)
+		if err != nil {
+			return err
+		}
+		return c.outbox.Stage(ctx, userEvent(ctx, eventType, user))
+	})
+}
+
+// checkAttributes validates the user's custom attributes against their tenant's schema, including uniqueness,
+// and normalizes them to their stored types
+func (c *UserController) checkAttributes(ctx context.Context, user *models.User) error {
+	schema, err := c.attributeRepo.FindByTenant(ctx, user.TenantName())
+	if err != nil {
+		return err
+	}
+	values, err := schema.Validate(user.Attributes)
+	if err != nil {
+		return err
+	}
+
+	for _, def := range schema.Attributes {
+		value, ok := values[def.Name]
+		if !ok || !def.Unique {
+			continue
+		}
+		taken, err := c.userRepo.AttributeTaken(ctx, user.TenantName(), def.Name, value, user.ID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return fmt.Errorf("%w: %s", ErrAttributeTaken, def.Name)
+		}
+	}
+
+	if len(values) == 0 {
+		values = nil
+	}
+	user.Attributes = values
+	return nil
+}
+
+// mergeAttributes applies changes to a copy of attributes, removing those changed to nil
+func mergeAttributes(attributes, changes map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for name, value := range attributes {
+		merged[name] = value
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(merged, name)
+			continue
+		}
+		merged[name] = value
+	}
+	return merged
+}
 
-	return c.userRepo.Update(ctx, user)
+// userEvent creates an event describing the user's current state
+func userEvent(ctx context.Context, eventType string, user *models.User) events.Event {
+	event := events.New(eventType, user.ID.Hex(), map[string]interface{}{
+		"username": user.Username,
+		"email":    user.Email,
+		"roles":    user.Roles,
+		"active":   user.IsActive(),
+		"state":    user.State,
+	})
+	event.ActorID = reqctx.From(ctx).ActorID
+	return event
 }
@@ -0,0 +1,328 @@
+package jwork
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"iam_backend/events"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+	"iam_backend/webhook"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Webhook errors
+var (
+	ErrWebhookNotFound  = errors.New("webhook subscription not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// WebhookPolicy configures webhook delivery and retries
+type WebhookPolicy struct {
+	MaxAttempts int           // attempts before a delivery is dead-lettered
+	BaseDelay   time.Duration // delay after the first failure, doubled after each further failure
+	MaxDelay    time.Duration // upper bound for the retry delay
+	Timeout     time.Duration // timeout of each request
+	Workers     int           // deliveries sent concurrently
+}
+
+// DefaultWebhookPolicy returns the webhook policy used when none is configured
+func DefaultWebhookPolicy() WebhookPolicy {
+	return WebhookPolicy{
+		MaxAttempts: 8,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    2 * time.Hour,
+		Timeout:     10 * time.Second,
+		Workers:     4,
+	}
+}
+
+// RetryDelay returns the delay before the next attempt after the given number of failures
+func (p WebhookPolicy) RetryDelay(failures int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+// WebhookSender signs and sends individual webhook requests
+type WebhookSender struct {
+	client *http.Client
+}
+
+// NewWebhookSender creates a WebhookSender whose requests time out after timeout. Redirects are not followed.
+func NewWebhookSender(timeout time.Duration) *WebhookSender {
+	return &WebhookSender{
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Send posts the delivery's payload to the subscription and reports the outcome
+func (s *WebhookSender) Send(ctx context.Context, subscription *models.WebhookSubscription, delivery *models.WebhookDelivery) models.WebhookAttempt {
+	start := time.Now()
+	attempt := models.WebhookAttempt{At: start}
+
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "iam_backend-webhooks")
+	req.Header.Set(webhook.EventIDHeader, delivery.EventID)
+	req.Header.Set(webhook.EventTypeHeader, delivery.EventType)
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(subscription.Secret, start, payload))
+
+	resp, err := s.client.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// WebhookDispatcher queues identity events for subscribed endpoints and delivers them with retries
+type WebhookDispatcher struct {
+	webhookRepo *repository.WebhookRepository
+	sender      *WebhookSender
+	policy      WebhookPolicy
+}
+
+// NewWebhookDispatcher creates a new instance of WebhookDispatcher
+func NewWebhookDispatcher(webhookRepo *repository.WebhookRepository, policy WebhookPolicy) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		webhookRepo: webhookRepo,
+		sender:      NewWebhookSender(policy.Timeout),
+		policy:      policy,
+	}
+}
+
+// CreateSubscription registers an endpoint for the given event types and returns it with its signing secret
+func (d *WebhookDispatcher) CreateSubscription(ctx context.Context, endpoint string, eventTypes []string, description string) (*models.WebhookSubscription, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return nil, errors.New("url must be an absolute http or https URL")
+	}
+	if len(eventTypes) == 0 {
+		return nil, errors.New("at least one event type is required")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	subscription := &models.WebhookSubscription{
+		URL:         endpoint,
+		EventTypes:  eventTypes,
+		Description: description,
+		Secret:      "whsec_" + base64.RawURLEncoding.EncodeToString(secret),
+		Active:      true,
+		CreatedAt:   time.Now(),
+	}
+	err = d.webhookRepo.CreateSubscription(ctx, subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// ListSubscriptions returns all subscriptions
+func (d *WebhookDispatcher) ListSubscriptions(ctx context.Context) ([]models.WebhookSubscription, error) {
+	return d.webhookRepo.FindSubscriptions(ctx)
+}
+
+// DeleteSubscription removes a subscription; its queued deliveries are dead-lettered when next attempted
+func (d *WebhookDispatcher) DeleteSubscription(ctx context.Context, id string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrWebhookNotFound
+	}
+
+	deleted, err := d.webhookRepo.DeleteSubscription(ctx, objectID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// ListDeliveries returns up to limit deliveries matching the filter, newest first
+func (d *WebhookDispatcher) ListDeliveries(ctx context.Context, filter repository.DeliveryFilter, limit int64) ([]models.WebhookDelivery, error) {
+	return d.webhookRepo.FindDeliveries(ctx, filter, limit)
+}
+
+// GetDelivery retrieves a delivery with its attempts
+func (d *WebhookDispatcher) GetDelivery(ctx context.Context, id string) (*models.WebhookDelivery, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrDeliveryNotFound
+	}
+
+	delivery, err := d.webhookRepo.FindDelivery(ctx, objectID)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrDeliveryNotFound
+	}
+	return delivery, err
+}
+
+// Redeliver queues a delivery to be sent again right away, with a fresh retry budget
+func (d *WebhookDispatcher) Redeliver(ctx context.Context, id string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrDeliveryNotFound
+	}
+
+	found, err := d.webhookRepo.Requeue(ctx, objectID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// Name identifies the dispatcher as an outbox sink
+func (d *WebhookDispatcher) Name() string {
+	return "webhook"
+}
+
+// Publish queues the event for every subscription to its type, making the dispatcher an outbox sink.
+// Queuing the same event again does not create duplicate deliveries.
+func (d *WebhookDispatcher) Publish(ctx context.Context, event events.Event) error {
+	subscriptions, err := d.webhookRepo.FindSubscriptionsForEvent(ctx, event.Type)
+	if err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, subscription := range subscriptions {
+		delivery := &models.WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			UserID:         event.UserID,
+			Payload:        string(payload),
+			Status:         models.DeliveryPending,
+			Attempts:       []models.WebhookAttempt{},
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		}
+		err := d.webhookRepo.CreateDelivery(ctx, delivery)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run delivers due webhooks until ctx is cancelled, checking for new work every pollInterval
+func (d *WebhookDispatcher) Run(ctx context.Context, pollInterval time.Duration) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.policy.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx, pollInterval)
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *WebhookDispatcher) work(ctx context.Context, pollInterval time.Duration) {
+	for {
+		delivered, err := d.deliverNext(ctx)
+		if err != nil {
+			log.Printf("Failed to deliver webhook: %v", err)
+		}
+		if delivered && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// deliverNext attempts one due delivery, reporting whether there was one
+func (d *WebhookDispatcher) deliverNext(ctx context.Context) (bool, error) {
+	now := time.Now()
+	// The lease outlasts the request, so an attempt interrupted by a crash is retried afterwards
+	delivery, err := d.webhookRepo.ClaimDueDelivery(ctx, now, now.Add(2*d.policy.Timeout+time.Minute))
+	if err != nil || delivery == nil {
+		return false, err
+	}
+
+	var attempt models.WebhookAttempt
+	subscription, err := d.webhookRepo.FindSubscription(ctx, delivery.SubscriptionID)
+	switch {
+	case err == mongo.ErrNoDocuments || (err == nil && !subscription.Active):
+		attempt = models.WebhookAttempt{At: now, Error: "subscription was removed or disabled"}
+		delivery.Failures = d.policy.MaxAttempts
+	case err != nil:
+		return true, err
+	default:
+		attempt = d.sender.Send(ctx, subscription, delivery)
+	}
+
+	if attempt.Error == "" {
+		delivered := time.Now()
+		delivery.Status = models.DeliverySucceeded
+		delivery.DeliveredAt = &delivered
+	} else {
+		delivery.Failures++
+		if delivery.Failures >= d.policy.MaxAttempts {
+			delivery.Status = models.DeliveryDead
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(d.policy.RetryDelay(delivery.Failures))
+		}
+	}
+
+	return true, d.webhookRepo.RecordAttempt(ctx, delivery, attempt)
+}
@@ -1,13 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"iam_backend/auditchain"
+	"iam_backend/auth"
 	database "iam_backend/db"
+	"iam_backend/events"
+	"iam_backend/hashing"
 	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	"iam_backend/outbox"
+	"iam_backend/password"
+	"iam_backend/ratelimit"
 	repository "iam_backend/repo"
 	"iam_backend/router"
+	"iam_backend/saml"
 )
 
 func main() {
@@ -20,6 +38,156 @@ func main() {
 	if dbName == "" {
 		dbName = "iam_database"
 	}
+	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
+	if len(jwtSecret) == 0 {
+		log.Println("JWT_SECRET is not set, using a random secret; tokens will not survive a restart")
+		jwtSecret = make([]byte, 32)
+		if _, err := rand.Read(jwtSecret); err != nil {
+			log.Fatalf("Failed to generate JWT secret: %v", err)
+		}
+	}
+
+	lockoutPolicy := controllers.DefaultLockoutPolicy()
+	lockoutPolicy.MaxFailedAttempts = envInt("LOCKOUT_MAX_ATTEMPTS", lockoutPolicy.MaxFailedAttempts)
+	lockoutPolicy.Window = envDuration("LOCKOUT_WINDOW", lockoutPolicy.Window)
+	lockoutPolicy.LockoutDuration = envDuration("LOCKOUT_DURATION", lockoutPolicy.LockoutDuration)
+	lockoutPolicy.BaseDelay = envDuration("LOCKOUT_BASE_DELAY", lockoutPolicy.BaseDelay)
+	lockoutPolicy.MaxDelay = envDuration("LOCKOUT_MAX_DELAY", lockoutPolicy.MaxDelay)
+
+	argon2Scheme := hashing.DefaultArgon2id()
+	argon2Scheme.Memory = uint32(envInt("ARGON2_MEMORY_KIB", int(argon2Scheme.Memory)))
+	argon2Scheme.Iterations = uint32(envInt("ARGON2_ITERATIONS", int(argon2Scheme.Iterations)))
+	argon2Scheme.Parallelism = uint8(envInt("ARGON2_PARALLELISM", int(argon2Scheme.Parallelism)))
+	if err := argon2Scheme.Validate(); err != nil {
+		log.Fatalf("Invalid Argon2id configuration: %v", err)
+	}
+	bcryptScheme := hashing.Bcrypt{Cost: envInt("BCRYPT_COST", 12)}
+	legacySchemes := hashing.LegacySchemes()
+	var hasher *hashing.Hasher
+	switch os.Getenv("PASSWORD_HASH_ALGORITHM") {
+	case "", "argon2id":
+		hasher = hashing.NewHasher(argon2Scheme, append([]hashing.Scheme{bcryptScheme}, legacySchemes...)...)
+	case "bcrypt":
+		hasher = hashing.NewHasher(bcryptScheme, append([]hashing.Scheme{argon2Scheme}, legacySchemes...)...)
+	default:
+		log.Fatalf("Unsupported PASSWORD_HASH_ALGORITHM %q", os.Getenv("PASSWORD_HASH_ALGORITHM"))
+	}
+	if keys := os.Getenv("PASSWORD_PEPPER_KEYS"); keys != "" {
+		pepper, err := parsePepper(keys, os.Getenv("PASSWORD_PEPPER_CURRENT"))
+		if err != nil {
+			log.Fatalf("Invalid password pepper configuration: %v", err)
+		}
+		hasher.UsePepper(pepper)
+	}
+	models.SetPasswordHasher(hasher)
+
+	passwordPolicy := password.DefaultPolicy()
+	passwordPolicy.MinLength = envInt("PASSWORD_MIN_LENGTH", passwordPolicy.MinLength)
+	passwordPolicy.RequireUppercase = envBool("PASSWORD_REQUIRE_UPPERCASE", passwordPolicy.RequireUppercase)
+	passwordPolicy.RequireLowercase = envBool("PASSWORD_REQUIRE_LOWERCASE", passwordPolicy.RequireLowercase)
+	passwordPolicy.RequireDigit = envBool("PASSWORD_REQUIRE_DIGIT", passwordPolicy.RequireDigit)
+	passwordPolicy.RequireSymbol = envBool("PASSWORD_REQUIRE_SYMBOL", passwordPolicy.RequireSymbol)
+	passwordPolicy.DisallowUserInfo = envBool("PASSWORD_DISALLOW_USER_INFO", passwordPolicy.DisallowUserInfo)
+	passwordPolicy.HistorySize = envInt("PASSWORD_HISTORY", passwordPolicy.HistorySize)
+	passwordPolicy.MaxAge = envDuration("PASSWORD_MAX_AGE", passwordPolicy.MaxAge)
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		breached, err := password.OpenBreachedList(path)
+		if err != nil {
+			log.Fatalf("Failed to open breached password list: %v", err)
+		}
+		defer breached.Close()
+		passwordPolicy.Breached = breached
+	}
+
+	var auditSigner *auditchain.Signer
+	if key := os.Getenv("AUDIT_SIGNING_KEY"); key != "" {
+		seed, err := base64.StdEncoding.DecodeString(key)
+		if err == nil {
+			auditSigner, err = auditchain.NewSigner(seed)
+		}
+		if err != nil {
+			log.Fatalf("Invalid AUDIT_SIGNING_KEY: %v", err)
+		}
+	} else {
+		log.Println("AUDIT_SIGNING_KEY is not set, audit checkpoints will not be signed")
+	}
+	trustedAuditKeys, err := auditchain.ParsePublicKeys(os.Getenv("AUDIT_TRUSTED_KEYS"))
+	if err != nil {
+		log.Fatalf("Invalid AUDIT_TRUSTED_KEYS: %v", err)
+	}
+	if auditSigner != nil {
+		trustedAuditKeys = append(trustedAuditKeys, auditSigner.PublicKey())
+	}
+
+	webhookPolicy := controllers.DefaultWebhookPolicy()
+	webhookPolicy.MaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", webhookPolicy.MaxAttempts)
+	webhookPolicy.BaseDelay = envDuration("WEBHOOK_BASE_DELAY", webhookPolicy.BaseDelay)
+	webhookPolicy.MaxDelay = envDuration("WEBHOOK_MAX_DELAY", webhookPolicy.MaxDelay)
+	webhookPolicy.Timeout = envDuration("WEBHOOK_TIMEOUT", webhookPolicy.Timeout)
+	webhookPolicy.Workers = envInt("WEBHOOK_WORKERS", webhookPolicy.Workers)
+
+	var authenticators []auth.Authenticator
+	if ldapURL := os.Getenv("LDAP_URL"); ldapURL != "" {
+		ldapAuthenticator, err := auth.NewLDAPAuthenticator(auth.LDAPConfig{
+			URL:               ldapURL,
+			StartTLS:          envBool("LDAP_START_TLS", false),
+			BindDN:            os.Getenv("LDAP_BIND_DN"),
+			BindPassword:      os.Getenv("LDAP_BIND_PASSWORD"),
+			UserDNTemplate:    os.Getenv("LDAP_USER_DN_TEMPLATE"),
+			BaseDN:            os.Getenv("LDAP_BASE_DN"),
+			UserFilter:        os.Getenv("LDAP_USER_FILTER"),
+			UsernameAttribute: os.Getenv("LDAP_USERNAME_ATTRIBUTE"),
+			EmailAttribute:    os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+			Timeout:           envDuration("LDAP_TIMEOUT", 5*time.Second),
+		})
+		if err != nil {
+			log.Fatalf("Invalid LDAP configuration: %v", err)
+		}
+		authenticators = append(authenticators, ldapAuthenticator)
+	}
+	authRouter := auth.NewAuthenticatorRouter(authenticators...)
+	domainRoutes, err := auth.ParseDomainRoutes(os.Getenv("AUTH_DOMAIN_ROUTES"))
+	if err != nil {
+		log.Fatalf("Invalid AUTH_DOMAIN_ROUTES: %v", err)
+	}
+	for domain, source := range domainRoutes {
+		if err := authRouter.RouteDomain(domain, source); err != nil {
+			log.Fatalf("Invalid AUTH_DOMAIN_ROUTES: %v", err)
+		}
+	}
+	if source := os.Getenv("AUTH_DEFAULT_SOURCE"); source != "" {
+		if err := authRouter.SetDefault(source); err != nil {
+			log.Fatalf("Invalid AUTH_DEFAULT_SOURCE: %v", err)
+		}
+	}
+
+	identityProviders := oidcProviders()
+	samlIdP := samlIdentityProvider()
+
+	var scimTokens []string
+	for _, token := range strings.Split(os.Getenv("SCIM_BEARER_TOKENS"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			scimTokens = append(scimTokens, token)
+		}
+	}
+	if len(scimTokens) == 0 {
+		log.Println("SCIM_BEARER_TOKENS is not set, SCIM requests will be rejected")
+	}
+
+	sessionPolicy := controllers.DefaultSessionPolicy()
+	sessionPolicy.IdleTimeout = envDuration("SESSION_IDLE_TIMEOUT", sessionPolicy.IdleTimeout)
+	sessionPolicy.AbsoluteTimeout = envDuration("SESSION_ABSOLUTE_TIMEOUT", sessionPolicy.AbsoluteTimeout)
+
+	routeLimits := map[string]middleware.RouteLimit{
+		"register": {
+			PerIP:       envLimit("RATE_LIMIT_REGISTER_IP", "10/1h"),
+			PerUsername: envLimit("RATE_LIMIT_REGISTER_USERNAME", "3/1h"),
+		},
+		"login": {
+			PerIP:       envLimit("RATE_LIMIT_LOGIN_IP", "30/1m"),
+			PerUsername: envLimit("RATE_LIMIT_LOGIN_USERNAME", "10/1m"),
+		},
+	}
 
 	// Establish database connection
 	db, err := database.NewMongoConnection(mongoURI, dbName)
@@ -28,14 +196,176 @@ func main() {
 	}
 	defer db.Disconnect()
 
+	// Initialize event bus
+	bus := events.NewBus()
+	bus.Subscribe("*", events.LogHandler)
+
 	// Initialize repositories
 	userRepo := repository.NewUserRepository(db)
+	if err := userRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create user indexes: %v", err)
+	}
+	if err := userRepo.MigrateLifecycleStates(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate user lifecycle states: %v", err)
+	}
+	if err := userRepo.MigrateServiceAccountUsernames(context.Background(), models.ServiceAccountPrefix); err != nil {
+		log.Fatalf("Failed to migrate service account usernames: %v", err)
+	}
+	loginAttemptRepo := repository.NewLoginAttemptRepository(db)
+	sessionRepo := repository.NewSessionRepository(db)
+	if err := sessionRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create session indexes: %v", err)
+	}
+	auditRepo := repository.NewAuditRepository(db)
+	if err := auditRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create audit indexes: %v", err)
+	}
+	auditCheckpointRepo := repository.NewAuditCheckpointRepository(db)
+	if err := auditCheckpointRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create audit checkpoint indexes: %v", err)
+	}
+	outboxRepo := repository.NewOutboxRepository(db)
+	if err := outboxRepo.EnsureIndexes(context.Background(), envDuration("OUTBOX_RETENTION", 7*24*time.Hour)); err != nil {
+		log.Fatalf("Failed to create outbox indexes: %v", err)
+	}
+	webhookRepo := repository.NewWebhookRepository(db)
+	if err := webhookRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create webhook indexes: %v", err)
+	}
+	if err := webhookRepo.MigrateDeliveryUsers(context.Background()); err != nil {
+		log.Fatalf("Failed to migrate webhook deliveries: %v", err)
+	}
+	groupRepo := repository.NewGroupRepository(db)
+	if err := groupRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create group indexes: %v", err)
+	}
+	oidcLoginRepo := repository.NewOIDCLoginRepository(db)
+	if err := oidcLoginRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create OIDC login indexes: %v", err)
+	}
+	apiKeyRepo := repository.NewAPIKeyRepository(db)
+	if err := apiKeyRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create API key indexes: %v", err)
+	}
+	attributeSchemaRepo := repository.NewAttributeSchemaRepository(db)
+	if err := attributeSchemaRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create attribute schema indexes: %v", err)
+	}
+	erasureRepo := repository.NewErasureRepository(db)
+	if err := erasureRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create erasure tombstone indexes: %v", err)
+	}
+	deprovisioningRepo := repository.NewDeprovisioningRepository(db)
+	if err := deprovisioningRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create deprovisioning job indexes: %v", err)
+	}
+	samlSPRepo := repository.NewSAMLServiceProviderRepository(db)
+	if err := samlSPRepo.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to create SAML service provider indexes: %v", err)
+	}
+	auditChain := controllers.NewAuditChain(auditRepo, auditCheckpointRepo, auditSigner, auditchain.NewKeySet(trustedAuditKeys...))
+
+	// "verify-audit" checks the audit chains and exits instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAudit(auditChain))
+	}
+
+	// Initialize rate limit store
+	var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if os.Getenv("RATE_LIMIT_STORE") == "mongo" {
+		rateLimitRepo := repository.NewRateLimitRepository(db)
+		if err := rateLimitRepo.EnsureIndexes(context.Background()); err != nil {
+			log.Fatalf("Failed to create rate limit indexes: %v", err)
+		}
+		rateLimitStore = rateLimitRepo
+	}
+	limiter := middleware.NewRateLimiter(rateLimitStore, routeLimits)
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := limiter.TrustProxies(trustedProxies...); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// Initialize services
+	tokens := auth.NewTokenService(jwtSecret, "iam_backend", envDuration("TOKEN_TTL", time.Hour))
+	eventOutbox := controllers.NewOutbox(outboxRepo)
+	loginGuard := controllers.NewLoginGuard(loginAttemptRepo, lockoutPolicy, eventOutbox)
+	auditLog := controllers.NewAuditLogger(auditRepo)
+	webhooks := controllers.NewWebhookDispatcher(webhookRepo, webhookPolicy)
+	go webhooks.Run(context.Background(), time.Second)
+
+	// Relay events from the outbox to the configured sinks
+	// Transactions need a replica set; unless MONGO_TRANSACTIONS says otherwise they are used when the server supports them
+	supported, err := db.SupportsTransactions(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to check MongoDB transaction support: %v", err)
+	}
+	useTransactions := envBool("MONGO_TRANSACTIONS", supported)
+	if useTransactions && !supported {
+		log.Fatalf("MONGO_TRANSACTIONS is enabled but MongoDB is not a replica set, which transactions require")
+	}
+	var transactor controllers.Transactor = db
+	if !useTransactions {
+		log.Println("MongoDB transactions are disabled, events may be lost if the process stops right after a change")
+		transactor = controllers.NoTransactor{}
+	}
+	sinks, closeSinks := outboxSinks(bus, webhooks)
+	defer closeSinks()
+	go controllers.NewOutboxRelay(outboxRepo, sinks, controllers.DefaultOutboxPolicy()).Run(context.Background())
+
+	// Revoke the access of deactivated and deleted users, retrying interrupted jobs in the background
+	deprovisionPolicy := controllers.DefaultDeprovisionPolicy()
+	deprovisionPolicy.FallbackOwner = os.Getenv("DEPROVISION_FALLBACK_OWNER")
+	deprovisionPolicy.MaxDelay = envDuration("DEPROVISION_MAX_DELAY", deprovisionPolicy.MaxDelay)
+	deprovisioner := controllers.NewDeprovisioner(deprovisioningRepo, userRepo, sessionRepo, apiKeyRepo, groupRepo, eventOutbox, transactor, auditLog, deprovisionPolicy)
+	go deprovisioner.Run(context.Background())
 
 	// Initialize controllers
-	userController := controllers.NewUserController(userRepo)
+	userController := controllers.NewUserController(userRepo, loginGuard, passwordPolicy, auditLog, eventOutbox, transactor, authRouter, attributeSchemaRepo, deprovisioner)
+	sessionController := controllers.NewSessionController(sessionRepo, sessionPolicy)
+	apiKeyController := controllers.NewAPIKeyController(apiKeyRepo, userRepo, auditLog)
+	attributeController := controllers.NewAttributeController(attributeSchemaRepo, userRepo, auditLog)
+	err = attributeController.EnsureIndexes(context.Background())
+	if errors.Is(err, controllers.ErrAttributeTaken) {
+		log.Printf("Unique attributes are shared by users and checked by query only until fixed: %v", err)
+	} else if err != nil {
+		log.Fatalf("Failed to create unique attribute indexes: %v", err)
+	}
+	privacyController := controllers.NewPrivacyController(userController, sessionRepo, apiKeyRepo, loginAttemptRepo, groupRepo, outboxRepo, webhookRepo, erasureRepo)
+	serviceAccountController := controllers.NewServiceAccountController(userController, groupRepo, apiKeyController, sessionController)
+	scimController := controllers.NewScimController(userController, userRepo, groupRepo, auditLog)
+	federationController := controllers.NewFederationController(userController, oidcLoginRepo, identityProviders...)
+	samlController := controllers.NewSAMLController(userController, groupRepo, samlSPRepo, samlIdP, os.Getenv("SAML_LOGIN_URL"))
+
+	// Sign audit checkpoints in the background
+	if auditSigner != nil {
+		go auditChain.RunCheckpoints(context.Background(), envDuration("AUDIT_CHECKPOINT_INTERVAL", time.Hour))
+	}
 
 	// Setup router
-	r := router.SetupRouter(userController)
+	r := router.SetupRouter(router.Dependencies{
+		Users:         userController,
+		Sessions:      sessionController,
+		Tokens:        tokens,
+		APIKeys:       apiKeyController,
+		Services:      serviceAccountController,
+		Attributes:    attributeController,
+		Privacy:       privacyController,
+		Deprovisioner: deprovisioner,
+		Authenticator: middleware.NewAuthenticator(tokens, sessionController, apiKeyController, userController),
+		Limiter:       limiter,
+		Audit:         auditLog,
+		AuditChain:    auditChain,
+		Webhooks:      webhooks,
+		Scim:          scimController,
+		ScimAuth:      middleware.NewScimAuthenticator(scimTokens),
+		Federation:    federationController,
+		SAML:          samlController,
+	})
 
 	// Start the server
 	port := os.Getenv("PORT")
@@ -45,3 +375,212 @@ func main() {
 	log.Printf("Starting server on :%s", port)
 	log.Fatal(r.Run(":" + port))
 }
+
+// outboxSinks builds the sinks listed in OUTBOX_SINKS, returning them with a function that closes them
+func outboxSinks(bus *events.Bus, webhooks *controllers.WebhookDispatcher) ([]outbox.Sink, func()) {
+	names := os.Getenv("OUTBOX_SINKS")
+	if names == "" {
+		names = "log,webhook"
+	}
+
+	var sinks []outbox.Sink
+	var closers []func() error
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "log":
+			sinks = append(sinks, outbox.NewPublisherSink("log", bus))
+		case "webhook":
+			sinks = append(sinks, webhooks)
+		case "nats":
+			prefix := os.Getenv("NATS_SUBJECT_PREFIX")
+			if prefix == "" {
+				prefix = "iam"
+			}
+			sink, err := outbox.NewNATSSink(os.Getenv("NATS_URL"), prefix, envDuration("NATS_TIMEOUT", 5*time.Second))
+			if err != nil {
+				log.Fatalf("Invalid NATS sink configuration: %v", err)
+			}
+			sinks = append(sinks, sink)
+			closers = append(closers, sink.Close)
+		case "file":
+			sink, err := outbox.NewFileSink(os.Getenv("OUTBOX_FILE"))
+			if err != nil {
+				log.Fatalf("Failed to open OUTBOX_FILE: %v", err)
+			}
+			sinks = append(sinks, sink)
+			closers = append(closers, sink.Close)
+		default:
+			log.Fatalf("Unknown outbox sink %q", name)
+		}
+	}
+
+	return sinks, func() {
+		for _, closer := range closers {
+			closer()
+		}
+	}
+}
+
+// oidcProviders builds the upstream OpenID Connect connections listed in OIDC_PROVIDERS. Each is configured
+// through OIDC_<NAME>_* variables; google, gitlab and microsoft have a default issuer.
+func oidcProviders() []*auth.OIDCProvider {
+	var providers []*auth.OIDCProvider
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+
+		issuer := os.Getenv(prefix + "ISSUER")
+		if issuer == "" {
+			switch name {
+			case "google":
+				issuer = "https://accounts.google.com"
+			case "gitlab":
+				issuer = "https://gitlab.com"
+			case "microsoft":
+				tenant := os.Getenv(prefix + "TENANT")
+				if tenant == "" {
+					log.Fatalf("%sTENANT is required for Microsoft sign-in", prefix)
+				}
+				issuer = "https://login.microsoftonline.com/" + tenant + "/v2.0"
+			}
+		}
+		redirectURL := os.Getenv(prefix + "REDIRECT_URL")
+		if redirectURL == "" && os.Getenv("OIDC_REDIRECT_BASE_URL") != "" {
+			redirectURL = strings.TrimSuffix(os.Getenv("OIDC_REDIRECT_BASE_URL"), "/") + "/api/v1/oidc/" + name + "/callback"
+		}
+
+		provider, err := auth.NewOIDCProvider(auth.OIDCProviderConfig{
+			Name:         name,
+			Issuer:       issuer,
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  redirectURL,
+			Scopes:       strings.Fields(strings.ReplaceAll(os.Getenv(prefix+"SCOPES"), ",", " ")),
+			TrustEmail:   envBool(prefix+"TRUST_EMAIL", false),
+			Timeout:      envDuration("OIDC_TIMEOUT", 10*time.Second),
+		})
+		if err != nil {
+			log.Fatalf("Invalid configuration of OIDC provider %q: %v", name, err)
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+// samlIdentityProvider loads the SAML signing certificate and key named by SAML_CERTIFICATE and
+// SAML_PRIVATE_KEY. It returns nil, disabling SAML, when they are not set.
+func samlIdentityProvider() *saml.IdentityProvider {
+	certFile, keyFile := os.Getenv("SAML_CERTIFICATE"), os.Getenv("SAML_PRIVATE_KEY")
+	if certFile == "" || keyFile == "" {
+		log.Println("SAML_CERTIFICATE and SAML_PRIVATE_KEY are not set, SAML sign-on is disabled")
+		return nil
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		log.Fatalf("Failed to read SAML_CERTIFICATE: %v", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Fatalf("Failed to read SAML_PRIVATE_KEY: %v", err)
+	}
+
+	baseURL := strings.TrimSuffix(os.Getenv("SAML_BASE_URL"), "/")
+	if baseURL == "" || os.Getenv("SAML_LOGIN_URL") == "" {
+		log.Fatalf("SAML_BASE_URL and SAML_LOGIN_URL are required for SAML sign-on")
+	}
+	entityID := os.Getenv("SAML_ENTITY_ID")
+	if entityID == "" {
+		entityID = baseURL + "/saml/metadata"
+	}
+
+	idp, err := saml.NewIdentityProvider(entityID, baseURL+"/saml/sso", certPEM, keyPEM, envDuration("SAML_ASSERTION_TTL", 5*time.Minute))
+	if err != nil {
+		log.Fatalf("Invalid SAML configuration: %v", err)
+	}
+	return idp
+}
+
+// envInt reads an integer environment variable, falling back to def when unset or invalid
+func envInt(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envBool reads a boolean environment variable such as "true", falling back to def when unset or invalid
+func envBool(key string, def bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envDuration reads a duration environment variable such as "15m", falling back to def when unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envLimit reads a rate limit such as "10/1m"; "off" disables the limit
+func envLimit(key, def string) ratelimit.Limit {
+	spec := os.Getenv(key)
+	if spec == "" {
+		spec = def
+	}
+	if spec == "off" {
+		return ratelimit.Limit{}
+	}
+
+	limit, err := ratelimit.ParseLimit(spec)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return limit
+}
+
+// parsePepper parses pepper keys written as "id:base64secret,id:base64secret"
+func parsePepper(spec, currentID string) (*hashing.Pepper, error) {
+	keys := map[string][]byte{}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("pepper keys must look like id:base64secret")
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		keys[parts[0]] = secret
+	}
+
+	return hashing.NewPepper(currentID, keys)
+}
+
+// verifyAudit verifies every tenant's audit chain, printing one JSON report per tenant.
+// It returns the process exit code: 0 when all chains are intact, 1 otherwise.
+func verifyAudit(auditChain *controllers.AuditChain) int {
+	reports, err := auditChain.VerifyAll(context.Background())
+	if err != nil {
+		log.Printf("Failed to verify audit chains: %v", err)
+		return 1
+	}
+
+	code := 0
+	encoder := json.NewEncoder(os.Stdout)
+	for _, report := range reports {
+		encoder.Encode(report)
+		if !report.Valid {
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"iam_backend/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RouteLimit holds the limits applied to a single route
+type RouteLimit struct {
+	PerIP       ratelimit.Limit
+	PerUsername ratelimit.Limit
+}
+
+// maxPeekBody is the largest request body searched for a username; larger bodies are passed on unread
+const maxPeekBody = 64 << 10
+
+// RateLimiter applies per-route token bucket limits keyed by client IP and submitted username
+type RateLimiter struct {
+	store   ratelimit.Store
+	routes  map[string]RouteLimit
+	proxies []*net.IPNet // proxies trusted to report the client address in X-Forwarded-For
+}
+
+// NewRateLimiter creates a new instance of RateLimiter
+func NewRateLimiter(store ratelimit.Store, routes map[string]RouteLimit) *RateLimiter {
+	return &RateLimiter{
+		store:  store,
+		routes: routes,
+	}
+}
+
+// TrustProxies trusts proxies at the given addresses or CIDR ranges to report the client address in
+// X-Forwarded-For. Without trusted proxies requests are limited by the address of the connection.
+func (l *RateLimiter) TrustProxies(proxies ...string) error {
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid proxy address %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			proxy = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy range %q", proxy)
+		}
+		l.proxies = append(l.proxies, network)
+	}
+	return nil
+}
+
+// Limit returns middleware enforcing the limits configured for the named route
+func (l *RateLimiter) Limit(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limits := l.routes[route]
+
+		var results []ratelimit.Result
+		if limits.PerIP.Enabled() {
+			results = l.take(c, route+":ip:"+l.clientIP(c.Request), limits.PerIP, results)
+		}
+		if limits.PerUsername.Enabled() {
+			if username := peekUsername(c); username != "" {
+				results = l.take(c, route+":username:"+username, limits.PerUsername, results)
+			}
+		}
+		if len(results) == 0 {
+			c.Next()
+			return
+		}
+
+		// Report the most restrictive bucket
+		result := results[0]
+		for _, r := range results[1:] {
+			if moreRestrictive(r, result) {
+				result = r
+			}
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(result.Reset))
+		if !result.Allowed {
+			c.Header("Retry-After", ceilSeconds(result.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// take consumes a token for key, failing open if the store is unavailable
+func (l *RateLimiter) take(c *gin.Context, key string, limit ratelimit.Limit, results []ratelimit.Result) []ratelimit.Result {
+	result, err := l.store.Take(c.Request.Context(), key, limit)
+	if err != nil {
+		log.Printf("rate limit store error for %s: %v", key, err)
+		return results
+	}
+	return append(results, result)
+}
+
+// clientIP returns the address of the connection, or when it comes from a trusted proxy, the nearest
+// address in X-Forwarded-For that is not a trusted proxy
+func (l *RateLimiter) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(req.RemoteAddr))
+	if err != nil {
+		ip = strings.TrimSpace(req.RemoteAddr)
+	}
+	if !l.trusted(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (l *RateLimiter) trusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peekUsername reads the username field from a JSON body without consuming it
+func peekUsername(c *gin.Context) string {
+	if c.Request.Body == nil {
+		return ""
+	}
+
+	original := c.Request.Body
+	body, err := io.ReadAll(io.LimitReader(original, maxPeekBody+1))
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), original), original}
+	if err != nil || len(body) > maxPeekBody {
+		return ""
+	}
+
+	var payload struct {
+		Username string `json:"username"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(payload.Username))
+}
+
+// moreRestrictive reports whether result a should be reported instead of b
+func moreRestrictive(a, b ratelimit.Result) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Remaining < b.Remaining
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
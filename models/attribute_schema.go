@@ -0,0 +1,221 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidAttribute is returned for attribute values or schemas that break the rules of the schema
+var ErrInvalidAttribute = errors.New("invalid attribute")
+
+// Attribute types
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeInteger = "integer"
+	AttributeBoolean = "boolean"
+	AttributeDate    = "date" // calendar date in the form 2006-01-02
+)
+
+// attributeNamePattern restricts attribute names to identifiers that are safe as stored field names
+var attributeNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,63}$`)
+
+// attributePatterns caches compiled attribute patterns by their source, so each is compiled once
+var attributePatterns sync.Map
+
+// compilePattern returns the compiled form of an attribute pattern
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if compiled, ok := attributePatterns.Load(pattern); ok {
+		return compiled.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	attributePatterns.Store(pattern, compiled)
+	return compiled, nil
+}
+
+// AttributeSchema defines the custom attributes users of a tenant can have
+type AttributeSchema struct {
+	ID         primitive.ObjectID    `bson:"_id,omitempty" json:"-"`
+	Tenant     string                `bson:"tenant" json:"tenant"`
+	Attributes []AttributeDefinition `bson:"attributes" json:"attributes"`
+	UpdatedAt  time.Time             `bson:"updated_at" json:"updated_at"`
+}
+
+// AttributeDefinition describes one custom attribute
+type AttributeDefinition struct {
+	Name         string   `bson:"name" json:"name"`
+	Type         string   `bson:"type" json:"type"`
+	Required     bool     `bson:"required" json:"required"`
+	Enum         []string `bson:"enum,omitempty" json:"enum,omitempty"`       // allowed values of a string attribute
+	Pattern      string   `bson:"pattern,omitempty" json:"pattern,omitempty"` // regular expression a string attribute must match
+	Unique       bool     `bson:"unique" json:"unique"`                       // no two users of the tenant share a value
+	InToken      bool     `bson:"in_token" json:"in_token"`                   // included in access token claims
+	UserEditable bool     `bson:"user_editable" json:"user_editable"`         // users may change it themselves
+}
+
+// Definition returns the definition of the named attribute, or nil if the schema has none
+func (s *AttributeSchema) Definition(name string) *AttributeDefinition {
+	for i := range s.Attributes {
+		if s.Attributes[i].Name == name {
+			return &s.Attributes[i]
+		}
+	}
+	return nil
+}
+
+// Check reports whether the schema itself is valid
+func (s *AttributeSchema) Check() error {
+	seen := map[string]bool{}
+	for _, def := range s.Attributes {
+		if !attributeNamePattern.MatchString(def.Name) {
+			return fmt.Errorf("%w: %q is not a valid attribute name", ErrInvalidAttribute, def.Name)
+		}
+		if seen[def.Name] {
+			return fmt.Errorf("%w: %s is defined twice", ErrInvalidAttribute, def.Name)
+		}
+		seen[def.Name] = true
+
+		switch def.Type {
+		case AttributeString:
+		case AttributeNumber, AttributeInteger, AttributeBoolean, AttributeDate:
+			if len(def.Enum) > 0 || def.Pattern != "" {
+				return fmt.Errorf("%w: %s: enum and pattern only apply to strings", ErrInvalidAttribute, def.Name)
+			}
+		default:
+			return fmt.Errorf("%w: %s has unknown type %q", ErrInvalidAttribute, def.Name, def.Type)
+		}
+		if def.Pattern != "" {
+			if _, err := compilePattern(def.Pattern); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidAttribute, def.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks attribute values against the schema and returns them normalized to their stored types.
+// Unknown attributes are rejected, and required attributes must have a value.
+func (s *AttributeSchema) Validate(values map[string]interface{}) (map[string]interface{}, error) {
+	for name := range values {
+		if s.Definition(name) == nil {
+			return nil, fmt.Errorf("%w: %s is not defined", ErrInvalidAttribute, name)
+		}
+	}
+
+	normalized := map[string]interface{}{}
+	for _, def := range s.Attributes {
+		value, ok := values[def.Name]
+		if !ok || value == nil || value == "" {
+			if def.Required {
+				return nil, fmt.Errorf("%w: %s is required", ErrInvalidAttribute, def.Name)
+			}
+			continue
+		}
+
+		value, err := def.normalize(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s %v", ErrInvalidAttribute, def.Name, err)
+		}
+		normalized[def.Name] = value
+	}
+	return normalized, nil
+}
+
+// ClaimAttributes returns the values that the schema includes in access tokens
+func (s *AttributeSchema) ClaimAttributes(values map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for _, def := range s.Attributes {
+		if value, ok := values[def.Name]; ok && def.InToken {
+			claims[def.Name] = value
+		}
+	}
+	if len(claims) == 0 {
+		return nil
+	}
+	return claims
+}
+
+// normalize converts a value to the attribute's stored type, or explains why it does not fit
+func (d *AttributeDefinition) normalize(value interface{}) (interface{}, error) {
+	switch d.Type {
+	case AttributeString:
+		text, ok := value.(string)
+		if !ok {
+			return nil, errors.New("must be a string")
+		}
+		if len(d.Enum) > 0 && !contains(d.Enum, text) {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(d.Enum, ", "))
+		}
+		if d.Pattern != "" {
+			pattern, err := compilePattern(d.Pattern)
+			if err != nil || !pattern.MatchString(text) {
+				return nil, fmt.Errorf("must match %s", d.Pattern)
+			}
+		}
+		return text, nil
+	case AttributeNumber:
+		number, ok := toFloat(value)
+		if !ok {
+			return nil, errors.New("must be a number")
+		}
+		return number, nil
+	case AttributeInteger:
+		number, ok := toFloat(value)
+		if !ok || number != math.Trunc(number) || math.Abs(number) > 1<<53 {
+			return nil, errors.New("must be an integer")
+		}
+		return int64(number), nil
+	case AttributeBoolean:
+		flag, ok := value.(bool)
+		if !ok {
+			return nil, errors.New("must be true or false")
+		}
+		return flag, nil
+	case AttributeDate:
+		text, ok := value.(string)
+		if !ok {
+			return nil, errors.New("must be a date such as 2006-01-02")
+		}
+		if _, err := time.Parse("2006-01-02", text); err != nil {
+			return nil, errors.New("must be a date such as 2006-01-02")
+		}
+		return text, nil
+	}
+	return nil, fmt.Errorf("has unknown type %q", d.Type)
+}
+
+// toFloat converts the numeric types JSON and BSON decode to
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
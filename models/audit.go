@@ -0,0 +1,59 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DefaultTenant owns the audit chain of events not attributed to another tenant
+const DefaultTenant = "default"
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditChange records the value of a field before and after a change
+type AuditChange struct {
+	Before interface{} `bson:"before" json:"before"`
+	After  interface{} `bson:"after" json:"after"`
+}
+
+// AuditEvent is an immutable record of an identity operation
+type AuditEvent struct {
+	ID         primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Tenant     string                 `bson:"tenant" json:"tenant"`
+	Sequence   int64                  `bson:"sequence" json:"sequence"`
+	PrevHash   string                 `bson:"prev_hash" json:"prev_hash"`
+	Action     string                 `bson:"action" json:"action"`
+	ActorID    string                 `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	TargetID   string                 `bson:"target_id,omitempty" json:"target_id,omitempty"`
+	Outcome    string                 `bson:"outcome" json:"outcome"`
+	Error      string                 `bson:"error,omitempty" json:"error,omitempty"`
+	Changes    map[string]AuditChange `bson:"changes,omitempty" json:"changes,omitempty"`
+	Details    map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	IP         string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent  string                 `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	RequestID  string                 `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	OccurredAt time.Time              `bson:"occurred_at" json:"occurred_at"`
+	// Salt is digested with the values of redactable fields, see auditchain.Redact. It is kept out of
+	// responses so that redacted values cannot be checked against guesses.
+	Salt []byte `bson:"salt,omitempty" json:"-"`
+	// HashVersion is the version of the hash the event was sealed with, see auditchain.Hash
+	HashVersion int32 `bson:"hash_version,omitempty" json:"hash_version,omitempty"`
+	// Hash covers every other field and must stay last, see auditchain.Seal
+	Hash string `bson:"hash,omitempty" json:"hash"`
+}
+
+// AuditCheckpoint is a signed statement of the head of a tenant's audit chain
+type AuditCheckpoint struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Tenant    string             `bson:"tenant" json:"tenant"`
+	Sequence  int64              `bson:"sequence" json:"sequence"`
+	Hash      string             `bson:"hash" json:"hash"`
+	SignedAt  time.Time          `bson:"signed_at" json:"signed_at"`
+	KeyID     string             `bson:"key_id" json:"key_id"`
+	Signature string             `bson:"signature" json:"signature"`
+}
@@ -0,0 +1,77 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Deprovisioning triggers
+const (
+	DeprovisionDeactivated = "deactivated"
+	DeprovisionDeleted     = "deleted"
+)
+
+// Deprovisioning steps
+const (
+	StepRevokeSessions   = "revoke_sessions"
+	StepRevokeAPIKeys    = "revoke_api_keys"
+	StepGroupMemberships = "group_memberships" // suspended on deactivation, removed on deletion
+	StepServiceAccounts  = "service_accounts"  // ownership transferred to another user
+	StepEmitEvent        = "emit_event"
+)
+
+// DeprovisioningSteps lists the steps of a deprovisioning job in the order they run
+var DeprovisioningSteps = []string{StepRevokeSessions, StepRevokeAPIKeys, StepGroupMemberships, StepServiceAccounts, StepEmitEvent}
+
+// Deprovisioning job statuses
+const (
+	JobPending   = "pending"
+	JobCompleted = "completed"
+	JobCancelled = "cancelled" // the user was reactivated before the job finished
+)
+
+// DeprovisioningJob tracks the cascade that removes a deactivated or deleted user's access. Every step is
+// safe to repeat, and completed steps are recorded, so an interrupted job resumes where it stopped.
+type DeprovisioningJob struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID         primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Trigger        string             `bson:"trigger" json:"trigger"`
+	ActorID        string             `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	Status         string             `bson:"status" json:"status"`
+	CompletedSteps []string           `bson:"completed_steps" json:"completed_steps"`
+	Results        map[string]int64   `bson:"results,omitempty" json:"results,omitempty"` // what each completed step changed
+	NewOwnerID     string             `bson:"new_owner_id,omitempty" json:"new_owner_id,omitempty"`
+	Failures       int                `bson:"failures" json:"failures"`
+	LastError      string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	NextAttemptAt  time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil    time.Time          `bson:"locked_until" json:"-"`
+	ClaimID        primitive.ObjectID `bson:"claim_id,omitempty" json:"-"` // set by each claim, so a worker whose lease ran out cannot change the job
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	CompletedAt    *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// NewDeprovisioningJob creates a pending job for a user
+func NewDeprovisioningJob(userID primitive.ObjectID, trigger, actorID string) *DeprovisioningJob {
+	now := time.Now()
+	return &DeprovisioningJob{
+		UserID:         userID,
+		Trigger:        trigger,
+		ActorID:        actorID,
+		Status:         JobPending,
+		CompletedSteps: []string{},
+		Results:        map[string]int64{},
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+	}
+}
+
+// StepDone reports whether a step of the job has completed
+func (j *DeprovisioningJob) StepDone(step string) bool {
+	for _, done := range j.CompletedSteps {
+		if done == step {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Erasure modes
+const (
+	ErasureDelete       = "delete"       // the user document is removed
+	ErasurePseudonymize = "pseudonymize" // the user document stays under a pseudonym, stripped of personal data
+)
+
+// ErasedValue replaces personal data in the records kept about an erased user
+const ErasedValue = "[erased]"
+
+// PersonalUserFields are the stored user fields that hold personal data
+var PersonalUserFields = []string{"username", "email", "pending_email", "external_id", "identities", "attributes"}
+
+// PersonalEventData are the keys of event data, and of audit event details, that hold personal data
+var PersonalEventData = []string{"username", "email"}
+
+// DataExport gathers everything held about a user, for answering a data access request
+type DataExport struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Profile     *User            `json:"profile"`
+	Identities  []LinkedIdentity `json:"identities"`
+	Sessions    []Session        `json:"sessions"`
+	APIKeys     []APIKey         `json:"api_keys"`
+	Groups      []Group          `json:"groups"`
+	AuditEvents []AuditEvent     `json:"audit_events"` // events whose target is the user
+}
+
+// ErasureTombstone proves that a user was erased. It holds no personal data.
+type ErasureTombstone struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID      primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Tenant      string             `bson:"tenant" json:"tenant"`
+	Mode        string             `bson:"mode" json:"mode"`
+	RequestedBy string             `bson:"requested_by,omitempty" json:"requested_by,omitempty"`
+	ErasedAt    time.Time          `bson:"erased_at" json:"erased_at"`
+	// Complete is false when records still hold personal data of the user that could not be erased
+	Complete bool `bson:"complete" json:"complete"`
+	// RetainedAuditEvents are the audit events whose personal data of the user could not be redacted
+	// irreversibly, because they were sealed before that was supported
+	RetainedAuditEvents []primitive.ObjectID `bson:"retained_audit_events,omitempty" json:"retained_audit_events,omitempty"`
+}
+
+// Pseudonymize strips the user of personal data and credentials, leaving the ID, tenant and timestamps
+// so that records referring to the user still resolve. The user is left deactivated.
+func (u *User) Pseudonymize() {
+	now := time.Now()
+	*u = User{
+		ID:             u.ID,
+		Username:       "erased-" + u.ID.Hex(),
+		Tenant:         u.Tenant,
+		Roles:          []string{},
+		State:          StateDeactivated,
+		StateReason:    "erased",
+		StateChangedAt: &now,
+		CreatedAt:      u.CreatedAt,
+		UpdatedAt:      now,
+	}
+}
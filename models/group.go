@@ -0,0 +1,19 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Group is a named set of users, managed through SCIM
+type Group struct {
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	DisplayName string               `bson:"display_name" json:"display_name"`
+	ExternalID  string               `bson:"external_id" json:"external_id,omitempty"`
+	Members     []primitive.ObjectID `bson:"members" json:"members"`
+	// SuspendedMembers are members whose account is deactivated; they regain membership when reactivated
+	SuspendedMembers []primitive.ObjectID `bson:"suspended_members,omitempty" json:"suspended_members,omitempty"`
+	CreatedAt        time.Time            `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time            `bson:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,81 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lifecycle states of a user account. Only active users can sign in or use their tokens and keys.
+const (
+	StatePendingVerification = "pending_verification" // created but not yet confirmed
+	StateActive              = "active"
+	StateSuspended           = "suspended"        // blocked for a while, e.g. during an investigation
+	StateLocked              = "locked"           // blocked for security reasons until unlocked
+	StateDeactivated         = "deactivated"      // blocked until reactivated, e.g. after leaving
+	StatePendingDeletion     = "pending_deletion" // blocked and scheduled for deletion
+)
+
+// Lifecycle errors
+var (
+	ErrUserInactive      = errors.New("user account is inactive")
+	ErrInvalidTransition = errors.New("invalid lifecycle transition")
+)
+
+// stateTransitions lists the states each state can move to
+var stateTransitions = map[string][]string{
+	StatePendingVerification: {StateActive, StateDeactivated, StatePendingDeletion},
+	StateActive:              {StateSuspended, StateLocked, StateDeactivated, StatePendingDeletion},
+	StateSuspended:           {StateActive, StateDeactivated, StatePendingDeletion},
+	StateLocked:              {StateActive, StateSuspended, StateDeactivated, StatePendingDeletion},
+	StateDeactivated:         {StateActive, StatePendingDeletion},
+	StatePendingDeletion:     {StateActive, StateDeactivated},
+}
+
+// ValidState reports whether state is a lifecycle state
+func ValidState(state string) bool {
+	_, ok := stateTransitions[state]
+	return ok
+}
+
+// IsActive reports whether the user is in the active state
+func (u *User) IsActive() bool {
+	return u.State == StateActive
+}
+
+// CheckActive returns an error wrapping ErrUserInactive that names the user's state, unless the user is active
+func (u *User) CheckActive() error {
+	if u.IsActive() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUserInactive, strings.ReplaceAll(u.State, "_", " "))
+}
+
+// CanTransition reports whether the user can move from their current state to state
+func (u *User) CanTransition(state string) bool {
+	for _, allowed := range stateTransitions[u.State] {
+		if allowed == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the user to state, recording the reason and time. Moving to the current state is a no-op.
+func (u *User) Transition(state, reason string, at time.Time) error {
+	if !ValidState(state) {
+		return fmt.Errorf("%w: unknown state %q", ErrInvalidTransition, state)
+	}
+	if u.State == state {
+		return nil
+	}
+	if !u.CanTransition(state) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, u.State, state)
+	}
+
+	u.State = state
+	u.StateReason = reason
+	u.StateChangedAt = &at
+	return nil
+}
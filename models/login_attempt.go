@@ -0,0 +1,22 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LoginAttempt tracks failed login attempts for a single user account
+type LoginAttempt struct {
+	UserID        primitive.ObjectID `bson:"_id" json:"user_id"`
+	FailedCount   int                `bson:"failed_count" json:"failed_count"`
+	WindowStart   time.Time          `bson:"window_start" json:"window_start"`
+	LastFailedAt  time.Time          `bson:"last_failed_at" json:"last_failed_at"`
+	NextAttemptAt *time.Time         `bson:"next_attempt_at,omitempty" json:"next_attempt_at,omitempty"`
+	LockedUntil   *time.Time         `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+}
+
+// IsLocked reports whether the account is locked at the given time
+func (a *LoginAttempt) IsLocked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
@@ -0,0 +1,20 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OIDCLogin is a sign-in started at an upstream OpenID Connect provider, waiting for its callback
+type OIDCLogin struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	State        string             `bson:"state"`
+	Provider     string             `bson:"provider"`
+	Nonce        string             `bson:"nonce"`
+	CodeVerifier string             `bson:"code_verifier"`
+	BindingHash  string             `bson:"binding_hash"`           // hash of the secret the browser that started the sign-in holds
+	LinkUserID   string             `bson:"link_user_id,omitempty"` // the user to link the provider account to, for a sign-in started by a user
+	CreatedAt    time.Time          `bson:"created_at"`
+	ExpiresAt    time.Time          `bson:"expires_at"`
+}
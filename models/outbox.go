@@ -0,0 +1,30 @@
+package users
+
+import (
+	"time"
+
+	"iam_backend/events"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Outbox message statuses
+const (
+	OutboxPending   = "pending"
+	OutboxPublished = "published"
+)
+
+// OutboxMessage is an event written together with the change that raised it, waiting to be published
+type OutboxMessage struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	// Key orders publishing: messages with the same key, such as a user ID, are published in ID order
+	Key           string       `bson:"key" json:"key"`
+	Event         events.Event `bson:"event" json:"event"`
+	Status        string       `bson:"status" json:"status"`
+	Failures      int          `bson:"failures" json:"failures"`
+	LastError     string       `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	NextAttemptAt time.Time    `bson:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil   time.Time    `bson:"locked_until" json:"locked_until"`
+	CreatedAt     time.Time    `bson:"created_at" json:"created_at"`
+	PublishedAt   *time.Time   `bson:"published_at,omitempty" json:"published_at,omitempty"`
+}
@@ -0,0 +1,43 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// User fields that can be released to SAML service providers
+const (
+	SAMLFieldID         = "id"
+	SAMLFieldUsername   = "username"
+	SAMLFieldEmail      = "email"
+	SAMLFieldExternalID = "external_id"
+	SAMLFieldRoles      = "roles"
+	SAMLFieldGroups     = "groups"
+)
+
+// SAMLServiceProvider is a service provider that users can sign in to with assertions issued by this service
+type SAMLServiceProvider struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	EntityID string             `bson:"entity_id" json:"entity_id"`
+	Name     string             `bson:"name,omitempty" json:"name,omitempty"`
+	Metadata string             `bson:"metadata" json:"-"` // the service provider's metadata document as registered
+	// NameIDFormat is used unless the request names another supported format. The email and persistent
+	// formats identify the user by email address and user ID; NameIDField is used with the unspecified format.
+	NameIDFormat string          `bson:"name_id_format" json:"name_id_format"`
+	NameIDField  string          `bson:"name_id_field" json:"name_id_field"`
+	Attributes   []SAMLAttribute `bson:"attributes" json:"attributes"`
+	// RoleValues renames roles in the roles attribute; roles without an entry are released unchanged
+	// and roles mapped to an empty value are withheld
+	RoleValues        map[string]string `bson:"role_values,omitempty" json:"role_values,omitempty"`
+	AllowIdPInitiated bool              `bson:"allow_idp_initiated" json:"allow_idp_initiated"`
+	DefaultRelayState string            `bson:"default_relay_state,omitempty" json:"default_relay_state,omitempty"`
+	CreatedAt         time.Time         `bson:"created_at" json:"created_at"`
+}
+
+// SAMLAttribute releases a user field as an attribute statement
+type SAMLAttribute struct {
+	Name       string `bson:"name" json:"name"`
+	NameFormat string `bson:"name_format,omitempty" json:"name_format,omitempty"`
+	Field      string `bson:"field" json:"field"`
+}
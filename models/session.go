@@ -0,0 +1,42 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session represents a signed-in device for a user
+type Session struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	UserAgent  string             `bson:"user_agent" json:"user_agent"`
+	Device     string             `bson:"device" json:"device"`
+	IP         string             `bson:"ip" json:"ip"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	LastSeenAt time.Time          `bson:"last_seen_at" json:"last_seen_at"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// NewSession creates a session for a user that ends at the absolute timeout
+func NewSession(userID primitive.ObjectID, userAgent, device, ip string, absoluteTimeout time.Duration) *Session {
+	now := time.Now()
+	return &Session{
+		UserID:     userID,
+		UserAgent:  userAgent,
+		Device:     device,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(absoluteTimeout),
+	}
+}
+
+// IsActive reports whether the session is neither revoked, expired nor idle for longer than idleTimeout
+func (s *Session) IsActive(now time.Time, idleTimeout time.Duration) bool {
+	if s.RevokedAt != nil || !now.Before(s.ExpiresAt) {
+		return false
+	}
+	return idleTimeout <= 0 || now.Sub(s.LastSeenAt) < idleTimeout
+}
@@ -1,51 +1,213 @@
 package users
 
 import (
+	"errors"
+	"strings"
 	"time"
 
+	"iam_backend/hashing"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// passwordHasher hashes new passwords and verifies stored ones
+var passwordHasher = hashing.NewHasher(hashing.DefaultArgon2id(), append([]hashing.Scheme{hashing.Bcrypt{Cost: 14}}, hashing.LegacySchemes()...)...)
+
+// SetPasswordHasher replaces the hasher used for all user passwords
+func SetPasswordHasher(hasher *hashing.Hasher) {
+	passwordHasher = hasher
+}
+
+// PasswordHasher returns the hasher used for all user passwords
+func PasswordHasher() *hashing.Hasher {
+	return passwordHasher
+}
+
+// PasswordPepper returns the pepper applied to new password hashes, or nil if there is none
+func PasswordPepper() *hashing.Pepper {
+	return passwordHasher.Pepper()
+}
+
 // User represents the user model
 type User struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Username     string             `bson:"username" json:"username" validate:"required,min=3,max=50"`
-	Email        string             `bson:"email" json:"email" validate:"required,email"`
-	PasswordHash string             `bson:"password_hash" json:"-"`
-	Roles        []string           `bson:"roles" json:"roles"`
-	Active       bool               `bson:"active" json:"active"`
-	LastLogin    *time.Time         `bson:"last_login" json:"last_login"`
-	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
-}
-
-// HashPassword generates a bcrypt hash of the password
+	ID                 primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Username           string                 `bson:"username" json:"username" validate:"required,min=3,max=50"`
+	Email              string                 `bson:"email" json:"email" validate:"required,email"`
+	PendingEmail       *EmailChange           `bson:"pending_email,omitempty" json:"pending_email,omitempty"` // address the user asked to change to, until verified
+	ExternalID         string                 `bson:"external_id" json:"external_id,omitempty"`               // identifier in a provisioning client
+	PasswordHash       string                 `bson:"password_hash" json:"-"`
+	PasswordHistory    []string               `bson:"password_history,omitempty" json:"-"`
+	PasswordChangedAt  time.Time              `bson:"password_changed_at" json:"password_changed_at"`
+	MustChangePassword bool                   `bson:"must_change_password" json:"must_change_password"`
+	AuthSource         string                 `bson:"auth_source,omitempty" json:"auth_source,omitempty"`         // password store; empty means local
+	Identities         []LinkedIdentity       `bson:"identities,omitempty" json:"identities,omitempty"`           // upstream provider accounts that sign in as the user
+	ServiceAccount     *ServiceAccount        `bson:"service_account,omitempty" json:"service_account,omitempty"` // set when the principal is not a person
+	Tenant             string                 `bson:"tenant,omitempty" json:"tenant,omitempty"`                   // empty means the default tenant
+	Attributes         map[string]interface{} `bson:"attributes,omitempty" json:"attributes,omitempty"`           // custom attributes defined by the tenant's schema
+	Roles              []string               `bson:"roles" json:"roles"`
+	State              string                 `bson:"state" json:"state"`                                           // lifecycle state, see StateActive
+	StateReason        string                 `bson:"state_reason,omitempty" json:"state_reason,omitempty"`         // why the user entered the state
+	StateChangedAt     *time.Time             `bson:"state_changed_at,omitempty" json:"state_changed_at,omitempty"` // when the user entered the state
+	LastLogin          *time.Time             `bson:"last_login" json:"last_login"`
+	CreatedAt          time.Time              `bson:"created_at" json:"created_at"`
+	UpdatedAt          time.Time              `bson:"updated_at" json:"updated_at"`
+}
+
+// EmailChange is an address a user asked to change their email to. It replaces the email once the user
+// presents the token sent to it, which proves that they receive mail there.
+type EmailChange struct {
+	Email     string    `bson:"email" json:"email"`
+	TokenHash string    `bson:"token_hash" json:"-"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// TenantName returns the user's tenant, which is the default tenant when unset
+func (u *User) TenantName() string {
+	if u.Tenant == "" {
+		return DefaultTenant
+	}
+	return u.Tenant
+}
+
+// LocalAuthSource names the local password store in AuthSource
+const LocalAuthSource = "local"
+
+// Service account owner types
+const (
+	OwnerTypeUser  = "user"
+	OwnerTypeGroup = "group"
+)
+
+// ServiceAccount describes a principal used by software rather than a person. It has no password;
+// it authenticates with API keys or its client secret, and is owned by a user or a group.
+type ServiceAccount struct {
+	OwnerType             string             `bson:"owner_type" json:"owner_type"`
+	OwnerID               primitive.ObjectID `bson:"owner_id" json:"owner_id"`
+	Description           string             `bson:"description,omitempty" json:"description,omitempty"`
+	ClientSecretHash      string             `bson:"client_secret_hash,omitempty" json:"-"`
+	ClientSecretCreatedAt *time.Time         `bson:"client_secret_created_at,omitempty" json:"client_secret_created_at,omitempty"`
+}
+
+// ServiceAccountPrefix starts the username of every service account and of no one else. Service accounts share
+// the username namespace with people, so without it an account could take the name a person signs in with.
+const ServiceAccountPrefix = "svc:"
+
+// HasValidUsername reports whether the username fits the kind of user: a service account's starts with
+// ServiceAccountPrefix, and no one else's does
+func (u *User) HasValidUsername() bool {
+	return strings.HasPrefix(strings.ToLower(u.Username), ServiceAccountPrefix) == u.IsServiceAccount()
+}
+
+// IsServiceAccount reports whether the user is a service account rather than a person.
+// Service accounts are left out of flows meant for people, such as password login and password changes.
+func (u *User) IsServiceAccount() bool {
+	return u.ServiceAccount != nil
+}
+
+// LinkedIdentity is an account at an upstream identity provider that can sign in as the user
+type LinkedIdentity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+// LinkIdentity records an upstream account as able to sign in as the user; linking it again is a no-op
+func (u *User) LinkIdentity(provider, subject, email string) {
+	for _, identity := range u.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return
+		}
+	}
+	u.Identities = append(u.Identities, LinkedIdentity{Provider: provider, Subject: subject, Email: email, LinkedAt: time.Now()})
+}
+
+// HasLocalPassword reports whether the user's password is kept by this service rather than an external store
+func (u *User) HasLocalPassword() bool {
+	return u.AuthSource == "" || u.AuthSource == LocalAuthSource
+}
+
+// HashPassword generates a hash of the password with the configured hasher
 func (u *User) HashPassword(password string) error {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	hash, err := passwordHasher.Hash(password)
 	if err != nil {
 		return err
 	}
-	u.PasswordHash = string(bytes)
+	u.PasswordHash = hash
 	return nil
 }
 
 // CheckPasswordHash checks if the provided password matches the stored hash
 func (u *User) CheckPasswordHash(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
-	return err == nil
+	return passwordHasher.Verify(password, u.PasswordHash)
+}
+
+// PasswordNeedsRehash reports whether the stored hash differs from the configured algorithm or parameters
+func (u *User) PasswordNeedsRehash() bool {
+	return passwordHasher.NeedsRehash(u.PasswordHash)
+}
+
+// ReplacePassword hashes a new password and keeps up to historySize previous hashes.
+// It clears any pending forced password change.
+func (u *User) ReplacePassword(password string, historySize int) error {
+	previous := u.PasswordHash
+	if err := u.HashPassword(password); err != nil {
+		return err
+	}
+	u.PasswordChangedAt = time.Now()
+	u.MustChangePassword = false
+
+	if historySize > 0 && previous != "" {
+		u.PasswordHistory = append([]string{previous}, u.PasswordHistory...)
+		if len(u.PasswordHistory) > historySize {
+			u.PasswordHistory = u.PasswordHistory[:historySize]
+		}
+	}
+	return nil
+}
+
+// PasswordExpired reports whether the password is older than maxAge; a zero maxAge never expires
+func (u *User) PasswordExpired(maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+
+	// Users created before passwords were timestamped count from account creation
+	changedAt := u.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = u.CreatedAt
+	}
+	return time.Since(changedAt) > maxAge
+}
+
+// MatchesRecentPassword checks the password against the current hash and the last n previous hashes
+func (u *User) MatchesRecentPassword(password string, n int) bool {
+	if u.PasswordHash != "" && u.CheckPasswordHash(password) {
+		return true
+	}
+
+	for i, hash := range u.PasswordHistory {
+		if i >= n {
+			break
+		}
+		if passwordHasher.Verify(password, hash) {
+			return true
+		}
+	}
+	return false
 }
 
 // NewUser creates a new user with default values
 func NewUser(username, email, password string) (*User, error) {
 	now := time.Now()
 	user := &User{
-		Username:  username,
-		Email:     email,
-		Active:    true,
-		Roles:     []string{"user"},
-		CreatedAt: now,
-		UpdatedAt: now,
+		Username:          username,
+		Email:             email,
+		State:             StateActive,
+		Roles:             []string{"user"},
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		PasswordChangedAt: now,
 	}
 
 	if err := user.HashPassword(password); err != nil {
@@ -54,3 +216,58 @@ func NewUser(username, email, password string) (*User, error) {
 
 	return user, nil
 }
+
+// NewExternalUser creates a user whose password is verified by an external store such as a directory.
+// The user has no local password.
+func NewExternalUser(username, email, authSource string) *User {
+	now := time.Now()
+	return &User{
+		Username:   username,
+		Email:      email,
+		AuthSource: authSource,
+		State:      StateActive,
+		Roles:      []string{"user"},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+}
+
+// NewServiceAccount creates a service account owned by a user or group. It has no roles until some are bound to it.
+func NewServiceAccount(name, description, ownerType string, ownerID primitive.ObjectID) *User {
+	now := time.Now()
+	return &User{
+		Username: ServiceAccountPrefix + strings.TrimPrefix(name, ServiceAccountPrefix),
+		ServiceAccount: &ServiceAccount{
+			OwnerType:   ownerType,
+			OwnerID:     ownerID,
+			Description: description,
+		},
+		State:     StateActive,
+		Roles:     []string{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// NewImportedUser creates a user migrated from another system with an existing password hash.
+// The hash must be in a format the configured hasher can verify; it is upgraded on first login.
+func NewImportedUser(username, email, passwordHash string, roles []string) (*User, error) {
+	if !passwordHasher.Recognizes(passwordHash) {
+		return nil, errors.New("unsupported password hash format")
+	}
+	if len(roles) == 0 {
+		roles = []string{"user"}
+	}
+
+	now := time.Now()
+	return &User{
+		Username:          username,
+		Email:             email,
+		PasswordHash:      passwordHash,
+		State:             StateActive,
+		Roles:             roles,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		PasswordChangedAt: now,
+	}, nil
+}
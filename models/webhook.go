@@ -0,0 +1,49 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"   // waiting for its first or next attempt
+	DeliverySucceeded = "succeeded" // acknowledged with a 2xx response
+	DeliveryDead      = "dead"      // gave up after the last attempt; can be redelivered manually
+)
+
+// WebhookSubscription sends events of the subscribed types to a URL
+type WebhookSubscription struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URL         string             `bson:"url" json:"url"`
+	EventTypes  []string           `bson:"event_types" json:"event_types"` // "*" subscribes to every event
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	Secret      string             `bson:"secret" json:"-"`
+	Active      bool               `bson:"active" json:"active"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// WebhookAttempt records one attempt to deliver a webhook
+type WebhookAttempt struct {
+	At         time.Time     `bson:"at" json:"at"`
+	StatusCode int           `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+	Duration   time.Duration `bson:"duration" json:"duration"`
+}
+
+// WebhookDelivery is an event queued for delivery to one subscription
+type WebhookDelivery struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SubscriptionID primitive.ObjectID `bson:"subscription_id" json:"subscription_id"`
+	EventID        string             `bson:"event_id" json:"event_id"`
+	EventType      string             `bson:"event_type" json:"event_type"`
+	UserID         string             `bson:"user_id,omitempty" json:"user_id,omitempty"` // user the event is about
+	Payload        string             `bson:"payload" json:"payload"`                     // exact body that is signed and sent
+	Status         string             `bson:"status" json:"status"`
+	Attempts       []WebhookAttempt   `bson:"attempts" json:"attempts"`
+	Failures       int                `bson:"failures" json:"failures"` // failed attempts since queued or redelivered
+	NextAttemptAt  time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
@@ -0,0 +1,84 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"iam_backend/events"
+)
+
+// Sink receives events relayed from the outbox. Publish must only return nil once the event
+// has been durably handed over; events may be delivered more than once.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, event events.Event) error
+}
+
+// PublisherSink relays events to an in-process publisher such as the event bus
+type PublisherSink struct {
+	name      string
+	publisher events.Publisher
+}
+
+// NewPublisherSink creates a new instance of PublisherSink
+func NewPublisherSink(name string, publisher events.Publisher) *PublisherSink {
+	return &PublisherSink{
+		name:      name,
+		publisher: publisher,
+	}
+}
+
+// Name returns the name the sink was created with
+func (s *PublisherSink) Name() string {
+	return s.name
+}
+
+// Publish hands the event to the publisher
+func (s *PublisherSink) Publish(ctx context.Context, event events.Event) error {
+	s.publisher.Publish(ctx, event)
+	return nil
+}
+
+// FileSink appends events to a file as newline-delimited JSON
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens path for appending, creating it if needed
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+// Name returns "file"
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+// Publish appends the event and syncs the file
+func (s *FileSink) Publish(ctx context.Context, event events.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
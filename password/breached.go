@@ -0,0 +1,126 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxLineLength bounds a single line of the breached password list
+const maxLineLength = 256
+
+// BreachedList looks up passwords in a local list of SHA-1 hashes sorted in ascending order,
+// one per line and optionally followed by ":count", as in the HIBP "ordered by hash" download.
+// Lookups binary search the file, so it never has to fit in memory.
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// OpenBreachedList opens a sorted SHA-1 breached password list
+func OpenBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &BreachedList{file: file, size: info.Size()}, nil
+}
+
+// Close closes the underlying file
+func (l *BreachedList) Close() error {
+	return l.file.Close()
+}
+
+// Contains reports whether the password's SHA-1 hash appears in the list
+func (l *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// Search over byte offsets; lo is always the start of a line
+	lo, hi := int64(0), l.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, err := l.lineStart(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		line, next, err := l.readLine(start)
+		if err != nil {
+			return false, err
+		}
+
+		switch cmp := strings.Compare(lineHash(line), target); {
+		case cmp == 0:
+			return true, nil
+		case cmp < 0:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+// lineStart returns the offset of the first line starting at or after offset
+func (l *BreachedList) lineStart(offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+
+	buf := make([]byte, maxLineLength)
+	pos := offset - 1
+	for pos < l.size {
+		n, err := l.file.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		pos += int64(n)
+	}
+
+	return l.size, nil
+}
+
+// readLine returns the line starting at offset and the offset of the following line
+func (l *BreachedList) readLine(offset int64) (string, int64, error) {
+	buf := make([]byte, maxLineLength)
+	n, err := l.file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+
+	if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+		return string(buf[:i]), offset + int64(i) + 1, nil
+	}
+	return string(buf[:n]), offset + int64(n), nil
+}
+
+// lineHash extracts the upper-case hash from a "HASH[:count]" line
+func lineHash(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(strings.TrimSpace(line))
+}
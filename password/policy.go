@@ -0,0 +1,142 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	models "iam_backend/models"
+)
+
+// Rule identifiers reported in violations
+const (
+	RuleMinLength = "min_length"
+	RuleUppercase = "uppercase"
+	RuleLowercase = "lowercase"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleUserInfo  = "user_info"
+	RuleHistory   = "history"
+	RuleBreached  = "breached"
+)
+
+// Violation describes a single password rule that was not satisfied
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError is returned when a password violates one or more rules
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password does not meet policy: " + strings.Join(messages, "; ")
+}
+
+// Policy defines the rules a new password must satisfy
+type Policy struct {
+	MinLength        int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	DisallowUserInfo bool          // reject passwords containing the username or email
+	HistorySize      int           // number of previous passwords that may not be reused
+	MaxAge           time.Duration // passwords older than this must be changed at login; zero never expires
+	Breached         *BreachedList // optional list of known breached passwords
+}
+
+// DefaultPolicy returns the password policy used when none is configured
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:        8,
+		DisallowUserInfo: true,
+		HistorySize:      5,
+	}
+}
+
+// Validate checks a candidate password for the user and returns a PolicyError listing every violation
+func (p *Policy) Validate(password string, user *models.User) error {
+	var violations []Violation
+	add := func(rule, message string) {
+		violations = append(violations, Violation{Rule: rule, Message: message})
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		add(RuleMinLength, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUppercase && !upper {
+		add(RuleUppercase, "must contain an uppercase letter")
+	}
+	if p.RequireLowercase && !lower {
+		add(RuleLowercase, "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add(RuleDigit, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add(RuleSymbol, "must contain a symbol")
+	}
+
+	if p.DisallowUserInfo && containsUserInfo(password, user) {
+		add(RuleUserInfo, "must not contain your username or email")
+	}
+
+	if p.HistorySize > 0 && user.MatchesRecentPassword(password, p.HistorySize) {
+		add(RuleHistory, fmt.Sprintf("must not match any of your last %d passwords", p.HistorySize))
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			add(RuleBreached, "has appeared in a known data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// containsUserInfo reports whether the password contains the username, email or email local part
+func containsUserInfo(password string, user *models.User) bool {
+	lowered := strings.ToLower(password)
+
+	candidates := []string{user.Username, user.Email}
+	if at := strings.Index(user.Email, "@"); at > 0 {
+		candidates = append(candidates, user.Email[:at])
+	}
+
+	for _, candidate := range candidates {
+		// Very short fragments would reject too many unrelated passwords
+		if len(candidate) >= 3 && strings.Contains(lowered, strings.ToLower(candidate)) {
+			return true
+		}
+	}
+	return false
+}
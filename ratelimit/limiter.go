@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket: Burst tokens that refill at Rate tokens per second
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled reports whether the limit should be enforced
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// ParseLimit parses a limit such as "10/1m", meaning a burst of 10 requests refilled over one minute.
+// An empty string yields a disabled limit.
+func ParseLimit(spec string) (Limit, error) {
+	if spec == "" {
+		return Limit{}, nil
+	}
+
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, errors.New("rate limit must look like 10/1m")
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return Limit{}, errors.New("rate limit count must be a positive integer")
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return Limit{}, errors.New("rate limit period must be a positive duration")
+	}
+
+	return Limit{Rate: float64(count) / period.Seconds(), Burst: count}, nil
+}
+
+// Result is the outcome of taking a token from a bucket
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // time until a token is available, zero when allowed
+	Reset      time.Duration // time until the bucket is full again
+}
+
+// ResultFor builds a Result from the tokens left in the bucket after a take
+func (l Limit) ResultFor(tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:   allowed,
+		Limit:     l.Burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(l.Burst) - tokens) / l.Rate),
+	}
+	if !allowed {
+		result.RetryAfter = seconds((1 - tokens) / l.Rate)
+	}
+	return result
+}
+
+// refill returns the tokens in a bucket after elapsed time, capped at the burst size
+func (l Limit) refill(tokens float64, elapsed time.Duration) float64 {
+	return math.Min(float64(l.Burst), tokens+elapsed.Seconds()*l.Rate)
+}
+
+func seconds(s float64) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+// Store keeps token buckets keyed by an arbitrary string
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	limit     Limit
+}
+
+// maxIdleBuckets is the bucket count above which full buckets are swept from a MemoryStore
+const maxIdleBuckets = 10000
+
+// MemoryStore keeps token buckets in process memory
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewMemoryStore creates a new instance of MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take removes a token from the bucket for key if one is available
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if len(s.buckets) > maxIdleBuckets {
+		s.sweep(now)
+	}
+
+	b, exists := s.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		s.buckets[key] = b
+	}
+	b.tokens = limit.refill(b.tokens, now.Sub(b.updatedAt))
+	b.updatedAt = now
+	b.limit = limit
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	return limit.ResultFor(b.tokens, allowed), nil
+}
+
+// sweep drops buckets that have refilled completely and so carry no state
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if b.limit.refill(b.tokens, now.Sub(b.updatedAt)) >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
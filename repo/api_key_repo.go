@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeyRepository handles database operations for API keys
+type APIKeyRepository struct {
+	collection *mongo.Collection
+}
+
+// NewAPIKeyRepository creates a new instance of APIKeyRepository
+func NewAPIKeyRepository(db *database.Database) *APIKeyRepository {
+	return &APIKeyRepository{
+		collection: db.Database.Collection("api_keys"),
+	}
+}
+
+// EnsureIndexes creates the unique index keys are looked up by and the index listing a user's keys
+func (r *APIKeyRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "prefix", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+// Create inserts a new API key
+func (r *APIKeyRepository) Create(ctx context.Context, key *models.APIKey) error {
+	result, err := r.collection.InsertOne(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	key.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByPrefix retrieves an API key by its lookup prefix
+func (r *APIKeyRepository) FindByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := r.collection.FindOne(ctx, bson.M{"prefix": prefix}).Decode(&key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// FindByUser lists a user's API keys that are not revoked, newest first
+func (r *APIKeyRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]models.APIKey, error) {
+	filter := bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []models.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// FindAllByUser lists all of a user's keys, including revoked ones, newest first
+func (r *APIKeyRepository) FindAllByUser(ctx context.Context, userID primitive.ObjectID) ([]models.APIKey, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+
+	cursor, err := r.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []models.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Touch records the use of a key
+func (r *APIKeyRepository) Touch(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	update := bson.M{"$set": bson.M{"last_used_at": usedAt}}
+
+	_, err := r.collection.UpdateByID(ctx, id, update)
+	return err
+}
+
+// Revoke revokes one of a user's keys and reports whether it was active
+func (r *APIKeyRepository) Revoke(ctx context.Context, userID, keyID primitive.ObjectID) (bool, error) {
+	filter := bson.M{"_id": keyID, "user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now()}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// RevokeAllByUser revokes every active key of a user and returns how many were revoked
+func (r *APIKeyRepository) RevokeAllByUser(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now()}}
+
+	result, err := r.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteByUser removes every key of a user
+func (r *APIKeyRepository) DeleteByUser(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := r.collection.DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AttributeSchemaRepository handles database operations for tenants' custom attribute schemas
+type AttributeSchemaRepository struct {
+	collection *mongo.Collection
+}
+
+// NewAttributeSchemaRepository creates a new instance of AttributeSchemaRepository
+func NewAttributeSchemaRepository(db *database.Database) *AttributeSchemaRepository {
+	return &AttributeSchemaRepository{
+		collection: db.Database.Collection("attribute_schemas"),
+	}
+}
+
+// EnsureIndexes creates the unique index that keeps one schema per tenant
+func (r *AttributeSchemaRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenant", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	return err
+}
+
+// FindByTenant retrieves a tenant's schema; a tenant without one gets an empty schema
+func (r *AttributeSchemaRepository) FindByTenant(ctx context.Context, tenant string) (*models.AttributeSchema, error) {
+	var schema models.AttributeSchema
+	err := r.collection.FindOne(ctx, bson.M{"tenant": tenant}).Decode(&schema)
+	if err == mongo.ErrNoDocuments {
+		return &models.AttributeSchema{Tenant: tenant, Attributes: []models.AttributeDefinition{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
+
+// FindAll retrieves the schemas of every tenant
+func (r *AttributeSchemaRepository) FindAll(ctx context.Context) ([]models.AttributeSchema, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := []models.AttributeSchema{}
+	err = cursor.All(ctx, &schemas)
+	return schemas, err
+}
+
+// Save creates or replaces a tenant's schema
+func (r *AttributeSchemaRepository) Save(ctx context.Context, schema *models.AttributeSchema) error {
+	_, err := r.collection.ReplaceOne(ctx, bson.M{"tenant": schema.Tenant}, bson.M{
+		"tenant":     schema.Tenant,
+		"attributes": schema.Attributes,
+		"updated_at": schema.UpdatedAt,
+	}, options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditCheckpointRepository stores signed checkpoints of the audit chains
+type AuditCheckpointRepository struct {
+	collection *mongo.Collection
+}
+
+// NewAuditCheckpointRepository creates a new instance of AuditCheckpointRepository
+func NewAuditCheckpointRepository(db *database.Database) *AuditCheckpointRepository {
+	return &AuditCheckpointRepository{
+		collection: db.Database.Collection("audit_checkpoints"),
+	}
+}
+
+// EnsureIndexes creates the index used to look up checkpoints by tenant
+func (r *AuditCheckpointRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "sequence", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Insert stores a checkpoint
+func (r *AuditCheckpointRepository) Insert(ctx context.Context, checkpoint *models.AuditCheckpoint) error {
+	result, err := r.collection.InsertOne(ctx, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	checkpoint.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// Latest returns the most recent checkpoint of the tenant's chain, or nil if there is none
+func (r *AuditCheckpointRepository) Latest(ctx context.Context, tenant string) (*models.AuditCheckpoint, error) {
+	opts := options.FindOne().SetSort(bson.M{"sequence": -1})
+
+	var checkpoint models.AuditCheckpoint
+	err := r.collection.FindOne(ctx, bson.M{"tenant": tenant}, opts).Decode(&checkpoint)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// FindByTenant returns the tenant's checkpoints in sequence order
+func (r *AuditCheckpointRepository) FindByTenant(ctx context.Context, tenant string) ([]models.AuditCheckpoint, error) {
+	opts := options.Find().SetSort(bson.M{"sequence": 1})
+
+	cursor, err := r.collection.Find(ctx, bson.M{"tenant": tenant}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints := []models.AuditCheckpoint{}
+	if err := cursor.All(ctx, &checkpoints); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
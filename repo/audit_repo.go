@@ -0,0 +1,291 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"iam_backend/auditchain"
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditFilter narrows an audit event query; zero values match everything
+type AuditFilter struct {
+	Action   string
+	ActorID  string
+	TargetID string
+	Outcome  string
+	From     time.Time
+	To       time.Time
+	// Before returns only events older than the event with this ID, for pagination
+	Before primitive.ObjectID
+	// After returns only events newer than the event with this ID, for resuming exports
+	After primitive.ObjectID
+}
+
+// maxAppendAttempts bounds retries when concurrent writers race for the same chain position
+const maxAppendAttempts = 10
+
+// AuditRepository stores audit events as a hash chain per tenant.
+// It deliberately has no delete operations, and its only update is redacting personal data.
+type AuditRepository struct {
+	collection *mongo.Collection
+	// mu serializes appends from this process; other replicas are kept in order by the unique sequence index
+	mu sync.Mutex
+}
+
+// NewAuditRepository creates a new instance of AuditRepository
+func NewAuditRepository(db *database.Database) *AuditRepository {
+	return &AuditRepository{
+		collection: db.Database.Collection("audit_events"),
+	}
+}
+
+// EnsureIndexes creates the indexes used by audit queries
+func (r *AuditRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "target_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.M{"occurred_at": -1}},
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "sequence", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"sequence": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+// Insert appends an audit event to the end of its tenant's chain, setting its ID, sequence and hashes
+func (r *AuditRepository) Insert(ctx context.Context, event *models.AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if event.Tenant == "" {
+		event.Tenant = models.DefaultTenant
+	}
+
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		head, err := r.Head(ctx, event.Tenant)
+		if err != nil {
+			return err
+		}
+		event.ID = primitive.NewObjectID()
+		event.Sequence = 1
+		event.PrevHash = ""
+		event.Hash = ""
+		event.HashVersion = auditchain.Version
+		if event.Salt, err = auditchain.NewSalt(); err != nil {
+			return err
+		}
+		if head != nil {
+			event.Sequence = head.Sequence + 1
+			event.PrevHash = head.Hash
+		}
+
+		data, err := bson.Marshal(event)
+		if err != nil {
+			return err
+		}
+		doc, hash, err := auditchain.Seal(data)
+		if err != nil {
+			return err
+		}
+
+		_, err = r.collection.InsertOne(ctx, doc)
+		if mongo.IsDuplicateKeyError(err) {
+			// Another replica appended first; retry after the new head
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		event.Hash = hash
+		return nil
+	}
+
+	return errors.New("audit chain is busy, too many concurrent appends")
+}
+
+// Head returns the last event in the tenant's chain, or nil if the chain is empty
+func (r *AuditRepository) Head(ctx context.Context, tenant string) (*models.AuditEvent, error) {
+	opts := options.FindOne().SetSort(bson.M{"sequence": -1})
+
+	var event models.AuditEvent
+	err := r.collection.FindOne(ctx, bson.M{"tenant": tenant, "sequence": bson.M{"$exists": true}}, opts).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// Tenants returns the tenants that have an audit chain
+func (r *AuditRepository) Tenants(ctx context.Context) ([]string, error) {
+	values, err := r.collection.Distinct(ctx, "tenant", bson.M{"sequence": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]string, 0, len(values))
+	for _, value := range values {
+		if tenant, ok := value.(string); ok {
+			tenants = append(tenants, tenant)
+		}
+	}
+	return tenants, nil
+}
+
+// Walk passes the stored documents of the tenant's chain to fn in sequence order until fn returns false
+func (r *AuditRepository) Walk(ctx context.Context, tenant string, fn func(doc bson.Raw) bool) error {
+	opts := options.Find().SetSort(bson.M{"sequence": 1})
+
+	cursor, err := r.collection.Find(ctx, bson.M{"tenant": tenant, "sequence": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		if !fn(cursor.Current) {
+			return nil
+		}
+	}
+	return cursor.Err()
+}
+
+// RedactUser redacts the personal data of a user from the events about them and the events they
+// performed, see auditchain.Redact: the values beneath targetKeys of the events whose target is the
+// user, and those beneath actorKeys of the events whose actor is the user. The chain still verifies
+// afterwards. It returns the IDs of the events holding values that could not be redacted irreversibly,
+// which are redacted as far as possible.
+func (r *AuditRepository) RedactUser(ctx context.Context, userID string, targetKeys, actorKeys map[string][]string) ([]primitive.ObjectID, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"$or": bson.A{bson.M{"target_id": userID}, bson.M{"actor_id": userID}}})
+	if err != nil {
+		return nil, err
+	}
+	docs := []bson.Raw{}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	kept := []primitive.ObjectID{}
+	for _, doc := range docs {
+		keys := map[string][]string{}
+		if target, _ := doc.Lookup("target_id").StringValueOK(); target == userID {
+			mergeKeys(keys, targetKeys)
+		}
+		if actor, _ := doc.Lookup("actor_id").StringValueOK(); actor == userID {
+			mergeKeys(keys, actorKeys)
+		}
+
+		redacted, changed, err := auditchain.Redact(doc, keys)
+		if errors.Is(err, auditchain.ErrNotRedactable) {
+			kept = append(kept, doc.Lookup("_id").ObjectID())
+		} else if err != nil {
+			return nil, err
+		}
+		if !changed {
+			continue
+		}
+		if _, err := r.collection.ReplaceOne(ctx, bson.M{"_id": doc.Lookup("_id")}, redacted); err != nil {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+// mergeKeys adds the keys of each field in src to those of dst
+func mergeKeys(dst, src map[string][]string) {
+	for field, names := range src {
+		dst[field] = append(dst[field], names...)
+	}
+}
+
+// Find returns up to limit events matching the filter, newest first
+func (r *AuditRepository) Find(ctx context.Context, filter AuditFilter, limit int64) ([]models.AuditEvent, error) {
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit)
+
+	cursor, err := r.collection.Find(ctx, auditQuery(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []models.AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Stream passes the events matching the filter to fn oldest first, reading them from a cursor
+// rather than loading them all. It stops at the first error returned by fn.
+func (r *AuditRepository) Stream(ctx context.Context, filter AuditFilter, fn func(event *models.AuditEvent) error) error {
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+
+	cursor, err := r.collection.Find(ctx, auditQuery(filter), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var event models.AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return err
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func auditQuery(filter AuditFilter) bson.M {
+	query := bson.M{}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.ActorID != "" {
+		query["actor_id"] = filter.ActorID
+	}
+	if filter.TargetID != "" {
+		query["target_id"] = filter.TargetID
+	}
+	if filter.Outcome != "" {
+		query["outcome"] = filter.Outcome
+	}
+
+	occurred := bson.M{}
+	if !filter.From.IsZero() {
+		occurred["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		occurred["$lt"] = filter.To
+	}
+	if len(occurred) > 0 {
+		query["occurred_at"] = occurred
+	}
+
+	id := bson.M{}
+	if !filter.Before.IsZero() {
+		id["$lt"] = filter.Before
+	}
+	if !filter.After.IsZero() {
+		id["$gt"] = filter.After
+	}
+	if len(id) > 0 {
+		query["_id"] = id
+	}
+	return query
+}
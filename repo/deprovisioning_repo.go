@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrJobNotHeld is returned when a job is changed by a worker that no longer holds it, because it finished,
+// was cancelled or its lease ran out and another worker claimed it
+var ErrJobNotHeld = errors.New("deprovisioning job is no longer held by this worker")
+
+// DeprovisioningRepository handles database operations for deprovisioning jobs
+type DeprovisioningRepository struct {
+	collection *mongo.Collection
+}
+
+// NewDeprovisioningRepository creates a new instance of DeprovisioningRepository
+func NewDeprovisioningRepository(db *database.Database) *DeprovisioningRepository {
+	return &DeprovisioningRepository{
+		collection: db.Database.Collection("deprovisioning_jobs"),
+	}
+}
+
+// EnsureIndexes creates the indexes used to find due jobs and a user's jobs
+func (r *DeprovisioningRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+// Create inserts a job. Pass a transaction's context to commit it with the change that triggered it.
+func (r *DeprovisioningRepository) Create(ctx context.Context, job *models.DeprovisioningJob) error {
+	result, err := r.collection.InsertOne(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	job.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByID retrieves a job by its ID
+func (r *DeprovisioningRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*models.DeprovisioningJob, error) {
+	var job models.DeprovisioningJob
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FindByUser lists a user's jobs, newest first
+func (r *DeprovisioningRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]models.DeprovisioningJob, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+
+	cursor, err := r.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []models.DeprovisioningJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// FindDue returns up to limit pending jobs whose next attempt is due and that no worker holds, oldest first
+func (r *DeprovisioningRepository) FindDue(ctx context.Context, now time.Time, limit int64) ([]models.DeprovisioningJob, error) {
+	filter := bson.M{
+		"status":          models.JobPending,
+		"next_attempt_at": bson.M{"$lte": now},
+		"locked_until":    bson.M{"$lte": now},
+	}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit)
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []models.DeprovisioningJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Claim locks a pending job until lockedUntil, reporting false if another worker holds it or it is no longer
+// pending. A successful claim sets the job's ClaimID, which the worker's later changes to the job must present.
+func (r *DeprovisioningRepository) Claim(ctx context.Context, job *models.DeprovisioningJob, now, lockedUntil time.Time) (bool, error) {
+	filter := bson.M{
+		"_id":          job.ID,
+		"status":       models.JobPending,
+		"locked_until": bson.M{"$lte": now},
+	}
+	claimID := primitive.NewObjectID()
+	update := bson.M{"$set": bson.M{"locked_until": lockedUntil, "claim_id": claimID}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil || result.ModifiedCount == 0 {
+		return false, err
+	}
+	job.ClaimID = claimID
+	job.LockedUntil = lockedUntil
+	return true, nil
+}
+
+// updateHeld applies update to a job if it is still pending and held under the job's claim,
+// returning ErrJobNotHeld otherwise
+func (r *DeprovisioningRepository) updateHeld(ctx context.Context, job *models.DeprovisioningJob, update bson.M) error {
+	filter := bson.M{"_id": job.ID, "status": models.JobPending, "claim_id": job.ClaimID}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrJobNotHeld
+	}
+	return nil
+}
+
+// CompleteStep records that a step finished and what it changed. It returns ErrJobNotHeld unless the job
+// is pending and held under its claim.
+func (r *DeprovisioningRepository) CompleteStep(ctx context.Context, job *models.DeprovisioningJob, step string, changed int64) error {
+	update := bson.M{
+		"$addToSet": bson.M{"completed_steps": step},
+		"$set":      bson.M{"results." + step: changed},
+	}
+
+	err := r.updateHeld(ctx, job, update)
+	if err != nil {
+		return err
+	}
+	if job.Results == nil {
+		job.Results = map[string]int64{}
+	}
+	job.CompletedSteps = append(job.CompletedSteps, step)
+	job.Results[step] = changed
+	return nil
+}
+
+// SetNewOwner records who takes over the service accounts owned by the job's user, so a resumed job
+// transfers the remaining accounts to the same owner. It returns ErrJobNotHeld unless the job is pending
+// and held under its claim.
+func (r *DeprovisioningRepository) SetNewOwner(ctx context.Context, job *models.DeprovisioningJob, ownerID string) error {
+	return r.updateHeld(ctx, job, bson.M{"$set": bson.M{"new_owner_id": ownerID}})
+}
+
+// Renew extends the worker's hold on a job until lockedUntil. It returns ErrJobNotHeld unless the job
+// is pending and held under its claim.
+func (r *DeprovisioningRepository) Renew(ctx context.Context, job *models.DeprovisioningJob, lockedUntil time.Time) error {
+	err := r.updateHeld(ctx, job, bson.M{"$set": bson.M{"locked_until": lockedUntil}})
+	if err != nil {
+		return err
+	}
+	job.LockedUntil = lockedUntil
+	return nil
+}
+
+// MarkCompleted records that every step of a job finished. It returns ErrJobNotHeld unless the job
+// is pending and held under its claim.
+func (r *DeprovisioningRepository) MarkCompleted(ctx context.Context, job *models.DeprovisioningJob, at time.Time) error {
+	update := bson.M{"$set": bson.M{
+		"status":       models.JobCompleted,
+		"completed_at": at,
+		"locked_until": time.Time{},
+	}}
+
+	return r.updateHeld(ctx, job, update)
+}
+
+// MarkFailed records a failed attempt and when to retry the job. It returns ErrJobNotHeld unless the job
+// is pending and held under its claim.
+func (r *DeprovisioningRepository) MarkFailed(ctx context.Context, job *models.DeprovisioningJob, failures int, lastError string, nextAttemptAt time.Time) error {
+	update := bson.M{"$set": bson.M{
+		"failures":        failures,
+		"last_error":      lastError,
+		"next_attempt_at": nextAttemptAt,
+		"locked_until":    time.Time{},
+	}}
+
+	return r.updateHeld(ctx, job, update)
+}
+
+// MarkCancelled records that a job was abandoned before finishing. It returns ErrJobNotHeld unless the job
+// is pending and held under its claim.
+func (r *DeprovisioningRepository) MarkCancelled(ctx context.Context, job *models.DeprovisioningJob, at time.Time) error {
+	update := bson.M{"$set": bson.M{
+		"status":       models.JobCancelled,
+		"completed_at": at,
+		"locked_until": time.Time{},
+	}}
+
+	return r.updateHeld(ctx, job, update)
+}
+
+// CancelDeactivations cancels a user's pending jobs triggered by deactivation, e.g. when the user is reactivated
+func (r *DeprovisioningRepository) CancelDeactivations(ctx context.Context, userID primitive.ObjectID) error {
+	filter := bson.M{"user_id": userID, "trigger": models.DeprovisionDeactivated, "status": models.JobPending}
+	update := bson.M{"$set": bson.M{"status": models.JobCancelled, "completed_at": time.Now()}}
+
+	_, err := r.collection.UpdateMany(ctx, filter, update)
+	return err
+}
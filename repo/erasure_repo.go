@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrAlreadyErased is returned when recording the erasure of a user that already has a tombstone
+var ErrAlreadyErased = errors.New("user has already been erased")
+
+// ErasureRepository handles database operations for the tombstones left by erased users
+type ErasureRepository struct {
+	collection *mongo.Collection
+}
+
+// NewErasureRepository creates a new instance of ErasureRepository
+func NewErasureRepository(db *database.Database) *ErasureRepository {
+	return &ErasureRepository{
+		collection: db.Database.Collection("erasure_tombstones"),
+	}
+}
+
+// EnsureIndexes creates the unique index that keeps one tombstone per user
+func (r *ErasureRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	return err
+}
+
+// Create inserts a tombstone. Pass a transaction's context to commit it with the erasure.
+func (r *ErasureRepository) Create(ctx context.Context, tombstone *models.ErasureTombstone) error {
+	result, err := r.collection.InsertOne(ctx, tombstone)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyErased
+	}
+	if err != nil {
+		return err
+	}
+
+	tombstone.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByUser retrieves the tombstone of an erased user
+func (r *ErasureRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) (*models.ErasureTombstone, error) {
+	var tombstone models.ErasureTombstone
+	err := r.collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&tombstone)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tombstone, nil
+}
@@ -0,0 +1,186 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+	"iam_backend/scim"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrGroupExists is returned when a group's display name is already taken
+var ErrGroupExists = errors.New("a group with this name already exists")
+
+// GroupRepository handles database operations for groups
+type GroupRepository struct {
+	collection *mongo.Collection
+}
+
+// NewGroupRepository creates a new instance of GroupRepository
+func NewGroupRepository(db *database.Database) *GroupRepository {
+	return &GroupRepository{
+		collection: db.Database.Collection("groups"),
+	}
+}
+
+// EnsureIndexes creates the unique index on group names and the index used to find a user's groups
+func (r *GroupRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "display_name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "members", Value: 1}}},
+	})
+	return err
+}
+
+// Create inserts a new group
+func (r *GroupRepository) Create(ctx context.Context, group *models.Group) error {
+	result, err := r.collection.InsertOne(ctx, group)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrGroupExists
+	}
+	if err != nil {
+		return err
+	}
+
+	group.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByID retrieves a group by its ID
+func (r *GroupRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*models.Group, error) {
+	var group models.Group
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&group)
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// FindByMember retrieves the groups a user belongs to
+func (r *GroupRepository) FindByMember(ctx context.Context, userID primitive.ObjectID) ([]models.Group, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"members": userID}, options.Find().SetSort(bson.M{"display_name": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []models.Group{}
+	err = cursor.All(ctx, &groups)
+	return groups, err
+}
+
+// FindByScimFilter returns a page of the groups matching a SCIM filter in ID order, and the number of matching groups
+func (r *GroupRepository) FindByScimFilter(ctx context.Context, filter scim.Expr, skip, limit int64) ([]models.Group, int64, error) {
+	query, err := scimQuery(filter, groupScimFields)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	groups := []models.Group{}
+	if limit == 0 {
+		return groups, total, nil
+	}
+
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetSkip(skip).SetLimit(limit)
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = cursor.All(ctx, &groups)
+	return groups, total, err
+}
+
+// Replace overwrites a group's name, external ID, members and suspended members
+func (r *GroupRepository) Replace(ctx context.Context, group *models.Group) error {
+	group.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"display_name":      group.DisplayName,
+		"external_id":       group.ExternalID,
+		"members":           group.Members,
+		"suspended_members": group.SuspendedMembers,
+		"updated_at":        group.UpdatedAt,
+	}}
+
+	result, err := r.collection.UpdateByID(ctx, group.ID, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrGroupExists
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Delete removes a group, reporting whether it existed
+func (r *GroupRepository) Delete(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// RemoveMember removes a user from every group, including groups where their membership is suspended,
+// and returns how many groups they were removed from
+func (r *GroupRepository) RemoveMember(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"$or": []bson.M{{"members": userID}, {"suspended_members": userID}}}
+	update := bson.M{
+		"$pull": bson.M{"members": userID, "suspended_members": userID},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+
+	result, err := r.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// SuspendMember moves a user from the members of every group to its suspended members, so the memberships
+// stop counting but can be restored. It returns how many memberships were suspended.
+func (r *GroupRepository) SuspendMember(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	update := bson.M{
+		"$pull":     bson.M{"members": userID},
+		"$addToSet": bson.M{"suspended_members": userID},
+		"$set":      bson.M{"updated_at": time.Now()},
+	}
+
+	result, err := r.collection.UpdateMany(ctx, bson.M{"members": userID}, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// RestoreMember makes a user's suspended memberships count again and returns how many were restored
+func (r *GroupRepository) RestoreMember(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	update := bson.M{
+		"$pull":     bson.M{"suspended_members": userID},
+		"$addToSet": bson.M{"members": userID},
+		"$set":      bson.M{"updated_at": time.Now()},
+	}
+
+	result, err := r.collection.UpdateMany(ctx, bson.M{"suspended_members": userID}, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
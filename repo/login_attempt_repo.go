@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginAttemptRepository handles database operations for failed login counters
+type LoginAttemptRepository struct {
+	collection *mongo.Collection
+}
+
+// NewLoginAttemptRepository creates a new instance of LoginAttemptRepository
+func NewLoginAttemptRepository(db *database.Database) *LoginAttemptRepository {
+	return &LoginAttemptRepository{
+		collection: db.Database.Collection("login_attempts"),
+	}
+}
+
+// FindByUserID retrieves the failed login counter for a user, or nil if there is none
+func (r *LoginAttemptRepository) FindByUserID(ctx context.Context, userID primitive.ObjectID) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	err := r.collection.FindOne(ctx, bson.M{"_id": userID}).Decode(&attempt)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// RecordAttempt atomically counts a login attempt for a user, starting a new window when the previous one
+// has expired. The attempt is counted as failed until Reset clears it after a successful login. It is only
+// counted if the user may attempt to log in: not locked, not throttled and, when maxAttempts is positive,
+// with fewer than maxAttempts attempts in the window. Otherwise it returns the current counter and false,
+// so concurrent guesses cannot get past the limit between checking and counting.
+func (r *LoginAttemptRepository) RecordAttempt(ctx context.Context, userID primitive.ObjectID, window time.Duration, maxAttempts int) (*models.LoginAttempt, bool, error) {
+	now := time.Now()
+	blocked := []bson.M{
+		{"locked_until": bson.M{"$gt": now}},
+		{"next_attempt_at": bson.M{"$gt": now}},
+	}
+	if maxAttempts > 0 {
+		blocked = append(blocked, bson.M{"failed_count": bson.M{"$gte": maxAttempts}, "window_start": bson.M{"$gte": now.Add(-window)}})
+	}
+	filter := bson.M{"_id": userID, "$nor": blocked}
+
+	inWindow := bson.M{"$gte": bson.A{"$window_start", now.Add(-window)}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failed_count":   bson.M{"$cond": bson.A{inWindow, bson.M{"$add": bson.A{"$failed_count", 1}}, 1}},
+			"window_start":   bson.M{"$cond": bson.A{inWindow, "$window_start", now}},
+			"last_failed_at": now,
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var attempt models.LoginAttempt
+	err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&attempt)
+	if mongo.IsDuplicateKeyError(err) {
+		// A counter exists but blocks the attempt, so the upsert tried to insert a second one
+		blocking, err := r.FindByUserID(ctx, userID)
+		if err != nil || blocking == nil {
+			return nil, false, err
+		}
+		return blocking, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &attempt, true, nil
+}
+
+// SetNextAttemptAt records the earliest time the next login attempt is allowed
+func (r *LoginAttemptRepository) SetNextAttemptAt(ctx context.Context, userID primitive.ObjectID, next time.Time) error {
+	update := bson.M{"$set": bson.M{"next_attempt_at": next}}
+
+	_, err := r.collection.UpdateByID(ctx, userID, update)
+	return err
+}
+
+// Lock locks the account until the given time and resets the failure counter.
+// It reports whether the lock was newly applied, so callers can emit a single event per lockout.
+func (r *LoginAttemptRepository) Lock(ctx context.Context, userID primitive.ObjectID, until time.Time) (bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id": userID,
+		"$or": []bson.M{
+			{"locked_until": bson.M{"$exists": false}},
+			{"locked_until": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{
+		"$set":   bson.M{"locked_until": until, "failed_count": 0, "window_start": now},
+		"$unset": bson.M{"next_attempt_at": ""},
+	}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// Reset clears all failed login state for a user
+func (r *LoginAttemptRepository) Reset(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": userID})
+	return err
+}
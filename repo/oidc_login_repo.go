@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OIDCLoginRepository handles database operations for sign-ins pending at upstream providers
+type OIDCLoginRepository struct {
+	collection *mongo.Collection
+}
+
+// NewOIDCLoginRepository creates a new instance of OIDCLoginRepository
+func NewOIDCLoginRepository(db *database.Database) *OIDCLoginRepository {
+	return &OIDCLoginRepository{
+		collection: db.Database.Collection("oidc_logins"),
+	}
+}
+
+// EnsureIndexes creates the lookup index by state and the TTL index that removes abandoned sign-ins
+func (r *OIDCLoginRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"state": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// Create inserts a new pending sign-in
+func (r *OIDCLoginRepository) Create(ctx context.Context, login *models.OIDCLogin) error {
+	result, err := r.collection.InsertOne(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	login.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// Consume removes and returns the pending sign-in with the given state, so that each callback is only accepted once
+func (r *OIDCLoginRepository) Consume(ctx context.Context, state string) (*models.OIDCLogin, error) {
+	var login models.OIDCLogin
+	err := r.collection.FindOneAndDelete(ctx, bson.M{"state": state}).Decode(&login)
+	if err != nil {
+		return nil, err
+	}
+
+	return &login, nil
+}
@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OutboxRepository handles database operations for the event outbox
+type OutboxRepository struct {
+	collection *mongo.Collection
+}
+
+// NewOutboxRepository creates a new instance of OutboxRepository
+func NewOutboxRepository(db *database.Database) *OutboxRepository {
+	return &OutboxRepository{
+		collection: db.Database.Collection("outbox"),
+	}
+}
+
+// EnsureIndexes creates the indexes used to find pending messages and the TTL index that
+// removes published messages after retention
+func (r *OutboxRepository) EnsureIndexes(ctx context.Context, retention time.Duration) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "key", Value: 1}}},
+		{Keys: bson.M{"published_at": 1}, Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds()))},
+	})
+	return err
+}
+
+// Insert adds a message to the outbox. Pass a transaction's context to commit it with the transaction.
+func (r *OutboxRepository) Insert(ctx context.Context, message *models.OutboxMessage) error {
+	result, err := r.collection.InsertOne(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	message.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindPending returns up to limit unpublished messages that are due and that no relay holds, oldest first.
+// Messages waiting for a retry are left out so that they cannot fill the batch and hold back newer ones.
+func (r *OutboxRepository) FindPending(ctx context.Context, now time.Time, limit int64) ([]models.OutboxMessage, error) {
+	filter := bson.M{
+		"status":          models.OutboxPending,
+		"next_attempt_at": bson.M{"$lte": now},
+		"locked_until":    bson.M{"$lte": now},
+	}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(limit)
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.OutboxMessage{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// BlockedKeys returns those of keys that have an unpublished message waiting for a retry or held by a relay.
+// Only the oldest message of a key is ever attempted, so such a message is older than the key's due ones.
+func (r *OutboxRepository) BlockedKeys(ctx context.Context, keys []string, now time.Time) (map[string]bool, error) {
+	blocked := map[string]bool{}
+	if len(keys) == 0 {
+		return blocked, nil
+	}
+
+	filter := bson.M{
+		"status": models.OutboxPending,
+		"key":    bson.M{"$in": keys},
+		"$or": []bson.M{
+			{"next_attempt_at": bson.M{"$gt": now}},
+			{"locked_until": bson.M{"$gt": now}},
+		},
+	}
+	values, err := r.collection.Distinct(ctx, "key", filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if key, ok := value.(string); ok {
+			blocked[key] = true
+		}
+	}
+	return blocked, nil
+}
+
+// Claim locks a pending message until lockedUntil, reporting false if another relay holds it
+func (r *OutboxRepository) Claim(ctx context.Context, id primitive.ObjectID, now, lockedUntil time.Time) (bool, error) {
+	filter := bson.M{
+		"_id":          id,
+		"status":       models.OutboxPending,
+		"locked_until": bson.M{"$lte": now},
+	}
+	update := bson.M{"$set": bson.M{"locked_until": lockedUntil}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// MarkPublished records that a message was published
+func (r *OutboxRepository) MarkPublished(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	update := bson.M{"$set": bson.M{
+		"status":       models.OutboxPublished,
+		"published_at": at,
+		"locked_until": time.Time{},
+	}}
+
+	_, err := r.collection.UpdateByID(ctx, id, update)
+	return err
+}
+
+// MarkFailed records a failed publish and when to retry it
+func (r *OutboxRepository) MarkFailed(ctx context.Context, id primitive.ObjectID, failures int, lastError string, nextAttemptAt time.Time) error {
+	update := bson.M{"$set": bson.M{
+		"failures":        failures,
+		"last_error":      lastError,
+		"next_attempt_at": nextAttemptAt,
+		"locked_until":    time.Time{},
+	}}
+
+	_, err := r.collection.UpdateByID(ctx, id, update)
+	return err
+}
+
+// DeletePublishedByUser removes the published messages about a user ahead of the retention period.
+// Pending messages are kept so that they are still delivered.
+func (r *OutboxRepository) DeletePublishedByUser(ctx context.Context, userID string) error {
+	_, err := r.collection.DeleteMany(ctx, bson.M{"event.user_id": userID, "status": models.OutboxPublished})
+	return err
+}
+
+// RedactPendingByUser replaces the named fields of the data of pending messages about a user with
+// value, so that events still to be published carry no personal data
+func (r *OutboxRepository) RedactPendingByUser(ctx context.Context, userID string, fields []string, value string) error {
+	for _, field := range fields {
+		filter := bson.M{"event.user_id": userID, "status": models.OutboxPending, "event.data." + field: bson.M{"$exists": true}}
+		_, err := r.collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"event.data." + field: value}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	database "iam_backend/db"
+	"iam_backend/ratelimit"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RateLimitRepository keeps token buckets in MongoDB so limits are shared across replicas
+type RateLimitRepository struct {
+	collection *mongo.Collection
+}
+
+// NewRateLimitRepository creates a new instance of RateLimitRepository
+func NewRateLimitRepository(db *database.Database) *RateLimitRepository {
+	return &RateLimitRepository{
+		collection: db.Database.Collection("rate_limits"),
+	}
+}
+
+// EnsureIndexes creates the TTL index that expires idle buckets
+func (r *RateLimitRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Take atomically refills the bucket for key and removes a token if one is available
+func (r *RateLimitRepository) Take(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	now := time.Now()
+	burst := float64(limit.Burst)
+	refillTime := time.Duration(burst / limit.Rate * float64(time.Second))
+
+	elapsedSeconds := bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}},
+		1000,
+	}}
+	hasToken := bson.M{"$gte": bson.A{"$tokens", 1}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tokens": bson.M{"$min": bson.A{
+				burst,
+				bson.M{"$add": bson.A{
+					bson.M{"$ifNull": bson.A{"$tokens", burst}},
+					bson.M{"$multiply": bson.A{elapsedSeconds, limit.Rate}},
+				}},
+			}},
+			"updated_at": now,
+			"expires_at": now.Add(refillTime),
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"allowed": hasToken,
+			"tokens":  bson.M{"$cond": bson.A{hasToken, bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}},
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var bucket struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&bucket)
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+
+	return limit.ResultFor(bucket.Tokens, bucket.Allowed), nil
+}
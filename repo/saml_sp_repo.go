@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrServiceProviderExists is returned when a service provider's entity ID is already registered
+var ErrServiceProviderExists = errors.New("a service provider with this entity ID is already registered")
+
+// SAMLServiceProviderRepository handles database operations for registered SAML service providers
+type SAMLServiceProviderRepository struct {
+	collection *mongo.Collection
+}
+
+// NewSAMLServiceProviderRepository creates a new instance of SAMLServiceProviderRepository
+func NewSAMLServiceProviderRepository(db *database.Database) *SAMLServiceProviderRepository {
+	return &SAMLServiceProviderRepository{
+		collection: db.Database.Collection("saml_service_providers"),
+	}
+}
+
+// EnsureIndexes creates the unique index on entity IDs
+func (r *SAMLServiceProviderRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "entity_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	return err
+}
+
+// Create inserts a new service provider
+func (r *SAMLServiceProviderRepository) Create(ctx context.Context, sp *models.SAMLServiceProvider) error {
+	result, err := r.collection.InsertOne(ctx, sp)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrServiceProviderExists
+	}
+	if err != nil {
+		return err
+	}
+
+	sp.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByEntityID retrieves a service provider by its entity ID
+func (r *SAMLServiceProviderRepository) FindByEntityID(ctx context.Context, entityID string) (*models.SAMLServiceProvider, error) {
+	var sp models.SAMLServiceProvider
+	err := r.collection.FindOne(ctx, bson.M{"entity_id": entityID}).Decode(&sp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sp, nil
+}
+
+// FindAll returns all service providers ordered by entity ID
+func (r *SAMLServiceProviderRepository) FindAll(ctx context.Context) ([]models.SAMLServiceProvider, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"entity_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	sps := []models.SAMLServiceProvider{}
+	if err := cursor.All(ctx, &sps); err != nil {
+		return nil, err
+	}
+	return sps, nil
+}
+
+// Delete removes a service provider, reporting whether it existed
+func (r *SAMLServiceProviderRepository) Delete(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	models "iam_backend/models"
+	"iam_backend/scim"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrUnsupportedFilter is returned for SCIM filters that cannot be translated into a query
+var ErrUnsupportedFilter = errors.New("unsupported filter")
+
+// scimFieldKind determines how filter values are compared with a stored field
+type scimFieldKind int
+
+const (
+	scimString scimFieldKind = iota
+	scimCaseInsensitive
+	scimBool
+	scimTime
+	scimObjectID
+	scimActive // the boolean "active" attribute, stored as the lifecycle state
+)
+
+// scimField maps a SCIM attribute onto a stored field
+type scimField struct {
+	name string
+	kind scimFieldKind
+}
+
+// userScimFields are the user attributes that can be filtered on
+var userScimFields = map[string]scimField{
+	"id":                {"_id", scimObjectID},
+	"username":          {"username", scimCaseInsensitive},
+	"externalid":        {"external_id", scimString},
+	"emails":            {"email", scimCaseInsensitive},
+	"emails.value":      {"email", scimCaseInsensitive},
+	"active":            {"state", scimActive},
+	"roles":             {"roles", scimString},
+	"roles.value":       {"roles", scimString},
+	"meta.created":      {"created_at", scimTime},
+	"meta.lastmodified": {"updated_at", scimTime},
+}
+
+// groupScimFields are the group attributes that can be filtered on
+var groupScimFields = map[string]scimField{
+	"id":                {"_id", scimObjectID},
+	"displayname":       {"display_name", scimCaseInsensitive},
+	"externalid":        {"external_id", scimString},
+	"members":           {"members", scimObjectID},
+	"members.value":     {"members", scimObjectID},
+	"meta.created":      {"created_at", scimTime},
+	"meta.lastmodified": {"updated_at", scimTime},
+}
+
+// scimQuery translates a parsed SCIM filter into a query over the given fields; a nil filter matches everything
+func scimQuery(expr scim.Expr, fields map[string]scimField) (bson.M, error) {
+	if expr == nil {
+		return bson.M{}, nil
+	}
+	return scimQueryIn(expr, fields, "")
+}
+
+func scimQueryIn(expr scim.Expr, fields map[string]scimField, prefix string) (bson.M, error) {
+	switch e := expr.(type) {
+	case *scim.Logical:
+		left, err := scimQueryIn(e.Left, fields, prefix)
+		if err != nil {
+			return nil, err
+		}
+		right, err := scimQueryIn(e.Right, fields, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$" + e.Op: bson.A{left, right}}, nil
+	case *scim.Not:
+		inner, err := scimQueryIn(e.Expr, fields, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": bson.A{inner}}, nil
+	case *scim.ValuePath:
+		// Values of the multi-valued attributes stored here are plain values, so the
+		// filter can only test their "value" sub-attribute
+		return scimQueryIn(e.Filter, fields, e.Attr+".")
+	case *scim.Compare:
+		field, ok := fields[prefix+e.Attr]
+		if !ok {
+			return nil, fmt.Errorf("%w: attribute %q cannot be filtered on", ErrUnsupportedFilter, prefix+e.Attr)
+		}
+		condition, err := scimCondition(field, e)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{field.name: condition}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown expression", ErrUnsupportedFilter)
+}
+
+func scimCondition(field scimField, compare *scim.Compare) (interface{}, error) {
+	if compare.Op == scim.OpPresent {
+		return bson.M{"$nin": bson.A{nil, "", bson.A{}}}, nil
+	}
+	if compare.Value == nil {
+		switch compare.Op {
+		case scim.OpEq:
+			return nil, nil
+		case scim.OpNe:
+			return bson.M{"$ne": nil}, nil
+		}
+		return nil, fmt.Errorf("%w: %s cannot compare with null", ErrUnsupportedFilter, compare.Op)
+	}
+
+	var value interface{}
+	switch field.kind {
+	case scimActive:
+		active, ok := compare.Value.(bool)
+		if !ok || (compare.Op != scim.OpEq && compare.Op != scim.OpNe) {
+			return nil, fmt.Errorf("%w: %s requires eq or ne with a boolean", ErrUnsupportedFilter, compare.Attr)
+		}
+		if active == (compare.Op == scim.OpEq) {
+			return models.StateActive, nil
+		}
+		return bson.M{"$ne": models.StateActive}, nil
+	case scimBool:
+		b, ok := compare.Value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s requires a boolean", ErrUnsupportedFilter, compare.Attr)
+		}
+		value = b
+	case scimObjectID:
+		s, ok := compare.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s requires a string", ErrUnsupportedFilter, compare.Attr)
+		}
+		// An ID that is not an ObjectID matches no resource, which the nil ID never is
+		id, _ := primitive.ObjectIDFromHex(s)
+		value = id
+	case scimTime:
+		s, ok := compare.Value.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%w: %s requires an RFC 3339 date", ErrUnsupportedFilter, compare.Attr)
+		}
+		value = t
+	default:
+		s, ok := compare.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s requires a string", ErrUnsupportedFilter, compare.Attr)
+		}
+		return scimStringCondition(field, compare.Op, s)
+	}
+
+	switch compare.Op {
+	case scim.OpEq:
+		return value, nil
+	case scim.OpNe:
+		return bson.M{"$ne": value}, nil
+	case scim.OpGt, scim.OpGe, scim.OpLt, scim.OpLe:
+		if field.kind == scimTime {
+			return bson.M{"$" + compare.Op: value}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s does not support %s", ErrUnsupportedFilter, compare.Attr, compare.Op)
+}
+
+func scimStringCondition(field scimField, op, value string) (interface{}, error) {
+	options := ""
+	if field.kind == scimCaseInsensitive {
+		options = "i"
+	}
+	quoted := regexp.QuoteMeta(value)
+
+	switch op {
+	case scim.OpEq:
+		if options == "" {
+			return value, nil
+		}
+		return primitive.Regex{Pattern: "^" + quoted + "$", Options: options}, nil
+	case scim.OpNe:
+		if options == "" {
+			return bson.M{"$ne": value}, nil
+		}
+		return bson.M{"$not": primitive.Regex{Pattern: "^" + quoted + "$", Options: options}}, nil
+	case scim.OpCo:
+		return primitive.Regex{Pattern: quoted, Options: options}, nil
+	case scim.OpSw:
+		return primitive.Regex{Pattern: "^" + quoted, Options: options}, nil
+	case scim.OpEw:
+		return primitive.Regex{Pattern: quoted + "$", Options: options}, nil
+	}
+	return bson.M{"$" + op: value}, nil
+}
@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	database "iam_backend/db"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SessionRepository handles database operations for sessions
+type SessionRepository struct {
+	collection *mongo.Collection
+}
+
+// NewSessionRepository creates a new instance of SessionRepository
+func NewSessionRepository(db *database.Database) *SessionRepository {
+	return &SessionRepository{
+		collection: db.Database.Collection("sessions"),
+	}
+}
+
+// EnsureIndexes creates the lookup index by user and the TTL index that removes ended sessions
+func (r *SessionRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_seen_at", Value: -1}}},
+		{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// Create inserts a new session into the database
+func (r *SessionRepository) Create(ctx context.Context, session *models.Session) error {
+	result, err := r.collection.InsertOne(ctx, session)
+	if err != nil {
+		return err
+	}
+
+	session.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByID retrieves a session by its ID
+func (r *SessionRepository) FindByID(ctx context.Context, id string) (*models.Session, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var session models.Session
+	err = r.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// FindActiveByUser lists a user's sessions that are not revoked, expired or idle since idleCutoff
+func (r *SessionRepository) FindActiveByUser(ctx context.Context, userID primitive.ObjectID, idleCutoff time.Time) ([]models.Session, error) {
+	filter := bson.M{
+		"user_id":      userID,
+		"revoked_at":   bson.M{"$exists": false},
+		"expires_at":   bson.M{"$gt": time.Now()},
+		"last_seen_at": bson.M{"$gt": idleCutoff},
+	}
+	opts := options.Find().SetSort(bson.M{"last_seen_at": -1})
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []models.Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// FindByUser lists all of a user's stored sessions, including ended ones, newest first
+func (r *SessionRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]models.Session, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+
+	cursor, err := r.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []models.Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Touch records activity on a session
+func (r *SessionRepository) Touch(ctx context.Context, id primitive.ObjectID, seenAt time.Time) error {
+	update := bson.M{"$set": bson.M{"last_seen_at": seenAt}}
+
+	_, err := r.collection.UpdateByID(ctx, id, update)
+	return err
+}
+
+// Revoke revokes one of a user's sessions and reports whether it was active
+func (r *SessionRepository) Revoke(ctx context.Context, userID, sessionID primitive.ObjectID) (bool, error) {
+	filter := bson.M{"_id": sessionID, "user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now()}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// RevokeAllByUser revokes every session of a user except the one with exceptID, if set
+func (r *SessionRepository) RevokeAllByUser(ctx context.Context, userID primitive.ObjectID, exceptID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	if !exceptID.IsZero() {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now()}}
+
+	result, err := r.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteByUser removes every session of a user
+func (r *SessionRepository) DeleteByUser(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := r.collection.DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidCursor is returned for page cursors that are malformed or were issued for another sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// userSortFields are the fields users can be listed by, and whether they hold times rather than strings
+var userSortFields = map[string]bool{
+	"username":   false,
+	"email":      false,
+	"created_at": true,
+	"last_login": true,
+}
+
+// UserSort orders a user listing by a field; ties are broken by ID in the same direction
+type UserSort struct {
+	Field      string
+	Descending bool
+}
+
+// DefaultUserSort lists the newest users first
+var DefaultUserSort = UserSort{Field: "created_at", Descending: true}
+
+// ParseUserSort parses a sort field such as "username", prefixed with "-" for descending order
+func ParseUserSort(value string) (UserSort, error) {
+	sort := UserSort{Field: strings.TrimPrefix(value, "-"), Descending: strings.HasPrefix(value, "-")}
+	if _, ok := userSortFields[sort.Field]; !ok {
+		return UserSort{}, fmt.Errorf("cannot sort by %q", value)
+	}
+	return sort, nil
+}
+
+// String returns the sort in the form ParseUserSort accepts
+func (s UserSort) String() string {
+	if s.Descending {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// userCursor is the position after the last user of a page; cursors are only valid for the sort they were issued for
+type userCursor struct {
+	Sort  string  `json:"s"`
+	Value *string `json:"v"` // sort field of the last user, nil when it was unset
+	ID    string  `json:"id"`
+}
+
+// List returns up to limit users matching the filter in the sort order, starting after cursor,
+// and the cursor of the next page, which is empty on the last page
+func (r *UserRepository) List(ctx context.Context, filter UserFilter, sort UserSort, cursor string, limit int64) ([]models.User, string, error) {
+	query := userQuery(filter)
+	if cursor != "" {
+		after, err := userCursorQuery(sort, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = bson.M{"$and": []bson.M{query, after}}
+	}
+
+	direction := 1
+	if sort.Descending {
+		direction = -1
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: sort.Field, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(limit + 1)
+
+	found, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	users := []models.User{}
+	if err := found.All(ctx, &users); err != nil {
+		return nil, "", err
+	}
+	if int64(len(users)) <= limit {
+		return users, "", nil
+	}
+
+	users = users[:limit]
+	return users, encodeUserCursor(sort, &users[limit-1]), nil
+}
+
+// encodeUserCursor returns the cursor of the page following user in the sort order
+func encodeUserCursor(sort UserSort, user *models.User) string {
+	cursor := userCursor{Sort: sort.String(), ID: user.ID.Hex()}
+
+	var value string
+	switch sort.Field {
+	case "username":
+		value = user.Username
+	case "email":
+		value = user.Email
+	case "created_at":
+		value = user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "last_login":
+		if user.LastLogin != nil {
+			value = user.LastLogin.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	if value != "" || sort.Field != "last_login" {
+		cursor.Value = &value
+	}
+
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// userCursorQuery matches the users after a cursor in the sort order. Unset values sort before all
+// others, so they come first in ascending order and last in descending order.
+func userCursorQuery(sort UserSort, encoded string) (bson.M, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor userCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Sort != sort.String() {
+		return nil, ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(cursor.ID)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	beyond, idBeyond := "$gt", bson.M{"$gt": id}
+	if sort.Descending {
+		beyond, idBeyond = "$lt", bson.M{"$lt": id}
+	}
+
+	if cursor.Value == nil {
+		after := []bson.M{{sort.Field: nil, "_id": idBeyond}}
+		if !sort.Descending {
+			after = append(after, bson.M{sort.Field: bson.M{"$ne": nil}})
+		}
+		return bson.M{"$or": after}, nil
+	}
+
+	var value interface{} = *cursor.Value
+	if userSortFields[sort.Field] {
+		value, err = time.Parse(time.RFC3339Nano, *cursor.Value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	after := []bson.M{
+		{sort.Field: bson.M{beyond: value}},
+		{sort.Field: value, "_id": idBeyond},
+	}
+	if sort.Descending {
+		after = append(after, bson.M{sort.Field: nil})
+	}
+	return bson.M{"$or": after}, nil
+}
@@ -3,16 +3,65 @@ package repository
 import (
 	"context"
 	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	database "iam_backend/db"
 	models "iam_backend/models"
+	"iam_backend/scim"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// User errors
+var (
+	ErrUserExists     = errors.New("username or email already exists")
+	ErrAttributeTaken = errors.New("another user already has this value of the unique attribute")
+)
+
+// Names of the unique indexes on custom attributes. Each tenant declaring an attribute unique gets its own
+// index, named attributeIndexPrefix + tenant + ":" + attribute. legacyAttributeIndexPrefix starts the names
+// of the indexes shared by all tenants that earlier versions created.
+const (
+	attributeIndexPrefix       = "unique_attribute:"
+	legacyAttributeIndexPrefix = "tenant_1_attributes."
+)
+
+// attributeIndexError finds the attribute whose unique index a duplicate key error names
+var attributeIndexError = regexp.MustCompile(`index: ` + regexp.QuoteMeta(attributeIndexPrefix) + `\S*:(\w+)`)
+
+// writeError maps a duplicate value of a unique custom attribute to ErrAttributeTaken
+func writeError(err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	if match := attributeIndexError.FindStringSubmatch(err.Error()); match != nil {
+		return fmt.Errorf("%w: %s", ErrAttributeTaken, match[1])
+	}
+	return err
+}
+
+// UserFilter narrows a user query; zero values match everything
+type UserFilter struct {
+	Roles         []string // users with any of the roles
+	Active        *bool    // users in, or not in, the active state
+	States        []string // users in any of the lifecycle states
+	Search        string   // prefix of the username or email
+	Tenant        string
+	CreatedFrom   time.Time
+	CreatedTo     time.Time
+	LastLoginFrom time.Time
+	LastLoginTo   time.Time
+	// After returns only users created after the user with this ID, for resuming
+	After primitive.ObjectID
+}
+
 // UserRepository handles database operations for users
 type UserRepository struct {
 	collection *mongo.Collection
@@ -25,17 +74,46 @@ func NewUserRepository(db *database.Database) *UserRepository {
 	}
 }
 
+// EnsureIndexes creates the index that finds a user by a linked upstream identity and keeps
+// an identity from being linked to two users, the index listing service accounts by owner,
+// and the indexes behind user listings
+func (r *UserRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "service_account.owner_id", Value: 1}, {Key: "username", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"service_account": bson.M{"$exists": true}}),
+		},
+		// Listing: each sort order, prefix search and the most selective filters
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "last_login", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "roles", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "state", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	return err
+}
+
 // Create inserts a new user into the database
 func (r *UserRepository) Create(ctx context.Context, user *models.User) error {
 	// Check if username or email already exists
-	existingUser, _ := r.FindByUsernameOrEmail(ctx, user.Username, user.Email)
-	if existingUser != nil {
-		return errors.New("username or email already exists")
+	taken, err := r.IsTaken(ctx, user.Username, user.Email, primitive.NilObjectID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUserExists
 	}
 
 	result, err := r.collection.InsertOne(ctx, user)
 	if err != nil {
-		return err
+		return writeError(err)
 	}
 
 	user.ID = result.InsertedID.(primitive.ObjectID)
@@ -60,14 +138,33 @@ func (r *UserRepository) FindByID(ctx context.Context, id string) (*models.User,
 
 // FindByUsernameOrEmail finds a user by username or email
 func (r *UserRepository) FindByUsernameOrEmail(ctx context.Context, username, email string) (*models.User, error) {
+	var user models.User
+	err := r.collection.FindOne(ctx, bson.M{"$or": usernameOrEmail(username, email)}).Decode(&user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// FindByEmail finds a user by email
+func (r *UserRepository) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	err := r.collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// FindByIdentity finds the user an upstream provider account is linked to
+func (r *UserRepository) FindByIdentity(ctx context.Context, provider, subject string) (*models.User, error) {
 	var user models.User
 	err := r.collection.FindOne(ctx, bson.M{
-		"$or": []bson.M{
-			{"username": username},
-			{"email": email},
-		},
+		"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}},
 	}).Decode(&user)
-
 	if err != nil {
 		return nil, err
 	}
@@ -75,12 +172,223 @@ func (r *UserRepository) FindByUsernameOrEmail(ctx context.Context, username, em
 	return &user, nil
 }
 
+// IsTaken reports whether a user other than exclude has the username or email as their username or email,
+// ignoring case, so that no login can name two users
+func (r *UserRepository) IsTaken(ctx context.Context, username, email string, exclude primitive.ObjectID) (bool, error) {
+	clauses := []bson.M{}
+	for _, login := range []string{username, email} {
+		if login == "" {
+			continue
+		}
+		pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(login) + "$", Options: "i"}
+		clauses = append(clauses, bson.M{"username": pattern}, bson.M{"email": pattern})
+	}
+	if len(clauses) == 0 {
+		return false, nil
+	}
+
+	count, err := r.collection.CountDocuments(ctx, bson.M{
+		"_id": bson.M{"$ne": exclude},
+		"$or": clauses,
+	})
+	return count > 0, err
+}
+
+// usernameOrEmail matches a username or email. Service accounts have no email, so an empty
+// email matches nothing rather than every service account.
+func usernameOrEmail(username, email string) []bson.M {
+	clauses := []bson.M{{"username": username}}
+	if email != "" {
+		clauses = append(clauses, bson.M{"email": email})
+	}
+	return clauses
+}
+
+// AttributeTaken reports whether a user of the tenant other than exclude has the attribute value
+func (r *UserRepository) AttributeTaken(ctx context.Context, tenant, name string, value interface{}, exclude primitive.ObjectID) (bool, error) {
+	query := userQuery(UserFilter{Tenant: tenant})
+	query["_id"] = bson.M{"$ne": exclude}
+	query["attributes."+name] = value
+
+	count, err := r.collection.CountDocuments(ctx, query)
+	return count > 0, err
+}
+
+// EnsureAttributeIndex creates the unique index that keeps two users of a tenant from sharing a value of
+// a custom attribute. It covers only the tenant's users, so other tenants may use the same attribute freely.
+// An index with other options is replaced; if users already share a value, ErrAttributeTaken is returned.
+func (r *UserRepository) EnsureAttributeIndex(ctx context.Context, tenant, name string) error {
+	index := attributeIndex(tenant, name)
+	_, err := r.collection.Indexes().CreateOne(ctx, index)
+	if indexConflict(err) {
+		_, err = r.collection.Indexes().DropOne(ctx, *index.Options.Name)
+		if err != nil {
+			return err
+		}
+		_, err = r.collection.Indexes().CreateOne(ctx, index)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s", ErrAttributeTaken, name)
+	}
+	return err
+}
+
+// DropAttributeIndexes drops the tenant's unique attribute indexes other than those of the attributes in keep,
+// so that attributes no longer unique in the tenant's schema stop being enforced
+func (r *UserRepository) DropAttributeIndexes(ctx context.Context, tenant string, keep []string) error {
+	prefix := attributeIndexPrefix + tenant + ":"
+	return r.dropIndexes(ctx, func(name string) bool {
+		attribute, ok := strings.CutPrefix(name, prefix)
+		return ok && !slices.Contains(keep, attribute)
+	})
+}
+
+// DropLegacyAttributeIndexes drops the unique attribute indexes shared by all tenants that earlier versions
+// created, which enforced one tenant's unique attributes on every tenant
+func (r *UserRepository) DropLegacyAttributeIndexes(ctx context.Context) error {
+	return r.dropIndexes(ctx, func(name string) bool {
+		return strings.HasPrefix(name, legacyAttributeIndexPrefix)
+	})
+}
+
+// dropIndexes drops the indexes whose names match
+func (r *UserRepository) dropIndexes(ctx context.Context, match func(name string) bool) error {
+	specs, err := r.collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if !match(spec.Name) {
+			continue
+		}
+		if _, err := r.collection.Indexes().DropOne(ctx, spec.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attributeIndex returns the unique index on a custom attribute of the tenant's users
+func attributeIndex(tenant, name string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "attributes." + name, Value: 1}},
+		Options: options.Index().
+			SetName(attributeIndexPrefix + tenant + ":" + name).
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{
+				{Key: "tenant", Value: tenantCondition(tenant)},
+				{Key: "attributes." + name, Value: bson.M{"$exists": true}},
+			}),
+	}
+}
+
+// indexConflict reports whether an index could not be created because one exists with other options
+func indexConflict(err error) bool {
+	var commandErr mongo.CommandError
+	if !errors.As(err, &commandErr) {
+		return false
+	}
+	return commandErr.Code == 85 || commandErr.Code == 86 // IndexOptionsConflict, IndexKeySpecsConflict
+}
+
+// FindServiceAccounts lists service accounts by name, limited to those owned by one of owners unless owners is nil
+func (r *UserRepository) FindServiceAccounts(ctx context.Context, owners []primitive.ObjectID) ([]models.User, error) {
+	filter := bson.M{"service_account": bson.M{"$exists": true}}
+	if owners != nil {
+		filter["service_account.owner_id"] = bson.M{"$in": owners}
+	}
+
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []models.User{}
+	err = cursor.All(ctx, &accounts)
+	return accounts, err
+}
+
+// FindByIDs retrieves the users with the given IDs; missing users are skipped
+func (r *UserRepository) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]models.User, error) {
+	users := []models.User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	cursor, err := r.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+// FindByScimFilter returns a page of the users matching a SCIM filter in ID order, and the number of matching users
+func (r *UserRepository) FindByScimFilter(ctx context.Context, filter scim.Expr, skip, limit int64) ([]models.User, int64, error) {
+	query, err := scimQuery(filter, userScimFields)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users := []models.User{}
+	if limit == 0 {
+		return users, total, nil
+	}
+
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetSkip(skip).SetLimit(limit)
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = cursor.All(ctx, &users)
+	return users, total, err
+}
+
 // Update updates an existing user
 func (r *UserRepository) Update(ctx context.Context, user *models.User) error {
 	user.UpdatedAt = time.Now()
 	update := bson.M{"$set": user}
 
 	_, err := r.collection.UpdateByID(ctx, user.ID, update)
+	return writeError(err)
+}
+
+// Replace overwrites a user's stored document, dropping any field the user no longer has
+func (r *UserRepository) Replace(ctx context.Context, user *models.User) error {
+	user.UpdatedAt = time.Now()
+
+	_, err := r.collection.ReplaceOne(ctx, bson.M{"_id": user.ID}, user)
+	return writeError(err)
+}
+
+// MigrateLifecycleStates gives users stored before lifecycle states were introduced the state matching
+// their active flag, and drops the flag. Users that already have a state are left alone.
+func (r *UserRepository) MigrateLifecycleStates(ctx context.Context) error {
+	for active, state := range map[bool]string{true: models.StateActive, false: models.StateDeactivated} {
+		filter := bson.M{"state": bson.M{"$exists": false}, "active": active}
+		update := bson.M{"$set": bson.M{"state": state}, "$unset": bson.M{"active": ""}}
+		if _, err := r.collection.UpdateMany(ctx, filter, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateServiceAccountUsernames prefixes the usernames of service accounts created before their names were
+// reserved with prefix
+func (r *UserRepository) MigrateServiceAccountUsernames(ctx context.Context, prefix string) error {
+	filter := bson.M{
+		"service_account": bson.M{"$exists": true},
+		"username":        bson.M{"$not": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix), Options: "i"}},
+	}
+	update := bson.A{bson.M{"$set": bson.M{"username": bson.M{"$concat": bson.A{prefix, "$username"}}}}}
+
+	_, err := r.collection.UpdateMany(ctx, filter, update)
 	return err
 }
 
@@ -95,11 +403,147 @@ func (r *UserRepository) Delete(ctx context.Context, id string) error {
 	return err
 }
 
-// UpdateLastLogin updates the last login time for a user
-func (r *UserRepository) UpdateLastLogin(ctx context.Context, userID primitive.ObjectID) error {
-	now := time.Now()
-	update := bson.M{"$set": bson.M{"last_login": now}}
+// UpdateLastLogin sets the last login time of a user, leaving the rest of the user as stored
+func (r *UserRepository) UpdateLastLogin(ctx context.Context, userID primitive.ObjectID, at time.Time) error {
+	update := bson.M{"$set": bson.M{"last_login": at}}
 
 	_, err := r.collection.UpdateByID(ctx, userID, update)
 	return err
 }
+
+// UpgradePasswordHash replaces a user's password hash with newHash, the same password hashed under the
+// current policy, unless the password was changed since oldHash was read
+func (r *UserRepository) UpgradePasswordHash(ctx context.Context, userID primitive.ObjectID, oldHash, newHash string) error {
+	filter := bson.M{"_id": userID, "password_hash": oldHash}
+	update := bson.M{"$set": bson.M{"password_hash": newHash}}
+
+	_, err := r.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// TransferServiceAccount hands a service account owned by the user from over to the user to, leaving the
+// rest of the account as it is. It reports false if the account no longer belongs to from.
+func (r *UserRepository) TransferServiceAccount(ctx context.Context, accountID, from, to primitive.ObjectID, at time.Time) (bool, error) {
+	filter := bson.M{"_id": accountID, "service_account.owner_type": models.OwnerTypeUser, "service_account.owner_id": from}
+	update := bson.M{"$set": bson.M{"service_account.owner_id": to, "updated_at": at}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// UpdateServiceAccountState writes the lifecycle state of a service account owned by the user owner, leaving
+// the rest of the account as it is. It reports false if the account is no longer in the state from or no
+// longer belongs to owner.
+func (r *UserRepository) UpdateServiceAccountState(ctx context.Context, account *models.User, owner primitive.ObjectID, from string) (bool, error) {
+	filter := bson.M{"_id": account.ID, "service_account.owner_type": models.OwnerTypeUser, "service_account.owner_id": owner, "state": from}
+	update := bson.M{"$set": bson.M{
+		"state":            account.State,
+		"state_reason":     account.StateReason,
+		"state_changed_at": account.StateChangedAt,
+		"updated_at":       account.UpdatedAt,
+	}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// Count returns the total number of users
+func (r *UserRepository) Count(ctx context.Context) (int64, error) {
+	return r.collection.CountDocuments(ctx, bson.M{})
+}
+
+// CountByPasswordHashPrefix returns the number of users whose password hash starts with prefix
+func (r *UserRepository) CountByPasswordHashPrefix(ctx context.Context, prefix string) (int64, error) {
+	filter := bson.M{"password_hash": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}}
+	return r.collection.CountDocuments(ctx, filter)
+}
+
+// Stream passes the users matching the filter to fn in ID order, reading them from a cursor
+// rather than loading them all. It stops at the first error returned by fn.
+func (r *UserRepository) Stream(ctx context.Context, filter UserFilter, fn func(user *models.User) error) error {
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+
+	cursor, err := r.collection.Find(ctx, userQuery(filter), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func userQuery(filter UserFilter) bson.M {
+	query := bson.M{}
+	if len(filter.Roles) > 0 {
+		query["roles"] = bson.M{"$in": filter.Roles}
+	}
+	if filter.Active != nil {
+		if *filter.Active {
+			query["state"] = models.StateActive
+		} else {
+			query["state"] = bson.M{"$ne": models.StateActive}
+		}
+	}
+	if len(filter.States) > 0 {
+		query["$and"] = []bson.M{{"state": bson.M{"$in": filter.States}}}
+	}
+	if filter.Search != "" {
+		// Anchored, case-sensitive patterns can use the username and email indexes
+		prefix := bson.M{"$regex": "^" + regexp.QuoteMeta(filter.Search)}
+		query["$or"] = []bson.M{{"username": prefix}, {"email": prefix}}
+	}
+	switch filter.Tenant {
+	case "":
+	default:
+		query["tenant"] = tenantCondition(filter.Tenant)
+	}
+	if created := timeRange(filter.CreatedFrom, filter.CreatedTo); created != nil {
+		query["created_at"] = created
+	}
+	if lastLogin := timeRange(filter.LastLoginFrom, filter.LastLoginTo); lastLogin != nil {
+		query["last_login"] = lastLogin
+	}
+
+	if !filter.After.IsZero() {
+		query["_id"] = bson.M{"$gt": filter.After}
+	}
+	return query
+}
+
+// timeRange matches times from from, inclusive, to to, exclusive; zero bounds are open
+func timeRange(from, to time.Time) bson.M {
+	bounds := bson.M{}
+	if !from.IsZero() {
+		bounds["$gte"] = from
+	}
+	if !to.IsZero() {
+		bounds["$lt"] = to
+	}
+	if len(bounds) == 0 {
+		return nil
+	}
+	return bounds
+}
+
+// tenantCondition matches the users of a tenant; users without a tenant belong to the default tenant
+func tenantCondition(tenant string) interface{} {
+	if tenant == models.DefaultTenant {
+		return bson.M{"$in": bson.A{nil, models.DefaultTenant}}
+	}
+	return tenant
+}
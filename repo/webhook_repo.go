@@ -0,0 +1,282 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	database "iam_backend/db"
+	"iam_backend/events"
+	models "iam_backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WebhookRepository handles database operations for webhook subscriptions and their deliveries
+type WebhookRepository struct {
+	subscriptions *mongo.Collection
+	deliveries    *mongo.Collection
+}
+
+// DeliveryFilter narrows a delivery query; zero values match everything
+type DeliveryFilter struct {
+	SubscriptionID primitive.ObjectID
+	Status         string
+	// Before returns only deliveries older than the delivery with this ID, for pagination
+	Before primitive.ObjectID
+}
+
+// NewWebhookRepository creates a new instance of WebhookRepository
+func NewWebhookRepository(db *database.Database) *WebhookRepository {
+	return &WebhookRepository{
+		subscriptions: db.Database.Collection("webhook_subscriptions"),
+		deliveries:    db.Database.Collection("webhook_deliveries"),
+	}
+}
+
+// EnsureIndexes creates the indexes used to find due, listed and per-user deliveries, and the one
+// that keeps an event from being queued twice for a subscription
+func (r *WebhookRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.M{"user_id": 1}},
+		{
+			Keys:    bson.D{{Key: "subscription_id", Value: 1}, {Key: "event_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	return err
+}
+
+// CreateSubscription inserts a new subscription
+func (r *WebhookRepository) CreateSubscription(ctx context.Context, subscription *models.WebhookSubscription) error {
+	result, err := r.subscriptions.InsertOne(ctx, subscription)
+	if err != nil {
+		return err
+	}
+
+	subscription.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindSubscription retrieves a subscription by its ID
+func (r *WebhookRepository) FindSubscription(ctx context.Context, id primitive.ObjectID) (*models.WebhookSubscription, error) {
+	var subscription models.WebhookSubscription
+	err := r.subscriptions.FindOne(ctx, bson.M{"_id": id}).Decode(&subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+// FindSubscriptions returns all subscriptions
+func (r *WebhookRepository) FindSubscriptions(ctx context.Context) ([]models.WebhookSubscription, error) {
+	return r.findSubscriptions(ctx, bson.M{})
+}
+
+// FindSubscriptionsForEvent returns the active subscriptions to an event type
+func (r *WebhookRepository) FindSubscriptionsForEvent(ctx context.Context, eventType string) ([]models.WebhookSubscription, error) {
+	eventTypes := []string{eventType}
+	if !events.Confidential(eventType) {
+		eventTypes = append(eventTypes, "*")
+	}
+	return r.findSubscriptions(ctx, bson.M{
+		"active":      true,
+		"event_types": bson.M{"$in": eventTypes},
+	})
+}
+
+func (r *WebhookRepository) findSubscriptions(ctx context.Context, filter bson.M) ([]models.WebhookSubscription, error) {
+	cursor, err := r.subscriptions.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []models.WebhookSubscription{}
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// DeleteSubscription removes a subscription, reporting whether it existed
+func (r *WebhookRepository) DeleteSubscription(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := r.subscriptions.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+// CreateDelivery queues a delivery
+func (r *WebhookRepository) CreateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	result, err := r.deliveries.InsertOne(ctx, delivery)
+	if err != nil {
+		return err
+	}
+
+	delivery.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindDelivery retrieves a delivery by its ID
+func (r *WebhookRepository) FindDelivery(ctx context.Context, id primitive.ObjectID) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := r.deliveries.FindOne(ctx, bson.M{"_id": id}).Decode(&delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// FindDeliveries returns up to limit deliveries matching the filter, newest first
+func (r *WebhookRepository) FindDeliveries(ctx context.Context, filter DeliveryFilter, limit int64) ([]models.WebhookDelivery, error) {
+	query := bson.M{}
+	if !filter.SubscriptionID.IsZero() {
+		query["subscription_id"] = filter.SubscriptionID
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if !filter.Before.IsZero() {
+		query["_id"] = bson.M{"$lt": filter.Before}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit)
+
+	cursor, err := r.deliveries.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// ClaimDueDelivery picks a pending delivery whose attempt is due and pushes its next attempt
+// out to leaseUntil, so other workers leave it alone while it is being sent.
+// It returns nil when nothing is due.
+func (r *WebhookRepository) ClaimDueDelivery(ctx context.Context, now, leaseUntil time.Time) (*models.WebhookDelivery, error) {
+	filter := bson.M{
+		"status":          models.DeliveryPending,
+		"next_attempt_at": bson.M{"$lte": now},
+	}
+	update := bson.M{"$set": bson.M{"next_attempt_at": leaseUntil}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"next_attempt_at": 1}).SetReturnDocument(options.After)
+
+	var delivery models.WebhookDelivery
+	err := r.deliveries.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// RecordAttempt appends an attempt to a delivery and stores its resulting status
+func (r *WebhookRepository) RecordAttempt(ctx context.Context, delivery *models.WebhookDelivery, attempt models.WebhookAttempt) error {
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	update := bson.M{
+		"$push": bson.M{"attempts": attempt},
+		"$set": bson.M{
+			"status":          delivery.Status,
+			"failures":        delivery.Failures,
+			"next_attempt_at": delivery.NextAttemptAt,
+			"delivered_at":    delivery.DeliveredAt,
+		},
+	}
+
+	_, err := r.deliveries.UpdateByID(ctx, delivery.ID, update)
+	return err
+}
+
+// Requeue makes a delivery due immediately with a fresh retry budget, reporting whether it exists
+func (r *WebhookRepository) Requeue(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	update := bson.M{"$set": bson.M{
+		"status":          models.DeliveryPending,
+		"failures":        0,
+		"next_attempt_at": time.Now(),
+	}}
+
+	result, err := r.deliveries.UpdateByID(ctx, id, update)
+	if err != nil {
+		return false, err
+	}
+
+	return result.MatchedCount > 0, nil
+}
+
+// MigrateDeliveryUsers records the user of deliveries queued before deliveries were indexed by user,
+// taking it from their payload
+func (r *WebhookRepository) MigrateDeliveryUsers(ctx context.Context) error {
+	cursor, err := r.deliveries.Find(ctx, bson.M{"user_id": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	deliveries := []models.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		var event events.Event
+		if err := json.Unmarshal([]byte(delivery.Payload), &event); err != nil || event.UserID == "" {
+			continue
+		}
+		if _, err := r.deliveries.UpdateByID(ctx, delivery.ID, bson.M{"$set": bson.M{"user_id": event.UserID}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RedactByUser replaces the named fields of the event data in the payloads of deliveries about a user
+// with value. Deliveries still to be sent are sent without them.
+func (r *WebhookRepository) RedactByUser(ctx context.Context, userID string, fields []string, value string) error {
+	cursor, err := r.deliveries.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return err
+	}
+	deliveries := []models.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		var event events.Event
+		if err := json.Unmarshal([]byte(delivery.Payload), &event); err != nil {
+			return err
+		}
+		changed := false
+		for _, field := range fields {
+			if current, ok := event.Data[field]; ok && current != value {
+				event.Data[field] = value
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := r.deliveries.UpdateByID(ctx, delivery.ID, bson.M{"$set": bson.M{"payload": string(payload)}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
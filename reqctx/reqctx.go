@@ -0,0 +1,31 @@
+package reqctx
+
+import "context"
+
+// Info describes the request an operation is performed for
+type Info struct {
+	RequestID string
+	IP        string
+	UserAgent string
+	ActorID   string // authenticated caller, empty for anonymous requests
+}
+
+type infoKey struct{}
+
+// With returns a context carrying the request info
+func With(ctx context.Context, info Info) context.Context {
+	return context.WithValue(ctx, infoKey{}, info)
+}
+
+// From returns the request info carried by the context, if any
+func From(ctx context.Context) Info {
+	info, _ := ctx.Value(infoKey{}).(Info)
+	return info
+}
+
+// WithActor returns a context whose request info names the authenticated caller
+func WithActor(ctx context.Context, actorID string) context.Context {
+	info := From(ctx)
+	info.ActorID = actorID
+	return With(ctx, info)
+}
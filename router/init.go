@@ -1,32 +1,193 @@
 package router
 
 import (
+	"iam_backend/auth"
 	"iam_backend/handlers"
 	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Dependencies holds the controllers and services the routes are built from
+type Dependencies struct {
+	Users         *controllers.UserController
+	Sessions      *controllers.SessionController
+	Tokens        *auth.TokenService
+	APIKeys       *controllers.APIKeyController
+	Services      *controllers.ServiceAccountController
+	Attributes    *controllers.AttributeController
+	Privacy       *controllers.PrivacyController
+	Deprovisioner *controllers.Deprovisioner
+	Authenticator *middleware.Authenticator
+	Limiter       *middleware.RateLimiter
+	Audit         *controllers.AuditLogger
+	AuditChain    *controllers.AuditChain
+	Webhooks      *controllers.WebhookDispatcher
+	Scim          *controllers.ScimController
+	Federation    *controllers.FederationController
+	SAML          *controllers.SAMLController
+	ScimAuth      *middleware.ScimAuthenticator
+}
+
 // SetupRouter configures the routes for the application
-func SetupRouter(userController *controllers.UserController) *gin.Engine {
+func SetupRouter(deps Dependencies) *gin.Engine {
 	// Create a new Gin router
 	r := gin.Default()
 
 	// Add middleware
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
+	r.Use(middleware.RequestInfo())
 
 	// Public routes
 	public := r.Group("/api/v1")
 	{
-		public.POST("/register", handlers.RegisterHandler(userController))
-		public.POST("/login", handlers.LoginHandler(userController))
+		public.POST("/register", deps.Limiter.Limit("register"), handlers.RegisterHandler(deps.Users))
+		public.POST("/login", deps.Limiter.Limit("login"), handlers.LoginHandler(deps.Users, deps.Sessions, deps.Tokens))
+		public.POST("/oauth/token", deps.Limiter.Limit("login"), handlers.ClientCredentialsTokenHandler(deps.Services, deps.Sessions, deps.Tokens))
+	}
+
+	// Sign-in through upstream OpenID Connect providers
+	federation := r.Group("/api/v1/oidc")
+	{
+		federation.GET("", handlers.ListIdentityProvidersHandler(deps.Federation))
+		federation.GET("/:provider/login", deps.Limiter.Limit("login"), handlers.OIDCLoginHandler(deps.Federation))
+		federation.GET("/:provider/callback", deps.Limiter.Limit("login"), handlers.OIDCCallbackHandler(deps.Federation, deps.Sessions, deps.Tokens))
+	}
+
+	// SAML identity provider endpoints for service providers
+	samlRoutes := r.Group("/saml")
+	{
+		samlRoutes.GET("/metadata", handlers.SAMLMetadataHandler(deps.SAML))
+		samlRoutes.GET("/sso", handlers.SAMLSSOHandler(deps.SAML))
+		samlRoutes.POST("/sso", handlers.SAMLSSOHandler(deps.SAML))
+	}
+
+	// Password change, also reachable with a token restricted to changing the password
+	account := r.Group("/api/v1", deps.Authenticator.RequireAuth(auth.ScopePasswordChange))
+	{
+		account.POST("/change-password", handlers.ChangePasswordHandler(deps.Users))
+		account.POST("/me/password", handlers.ChangePasswordHandler(deps.Users))
+	}
+
+	// Routes acting on the authenticated user, also reachable with an API key granted account scopes
+	me := r.Group("/api/v1/me", deps.Authenticator.RequireAuth(auth.ScopeAPIKey), middleware.RequireAPIKeyScope("account"))
+	{
+		me.GET("", handlers.GetMyProfileHandler(deps.Users))
+		me.PATCH("", handlers.UpdateMyProfileHandler(deps.Users))
+		me.GET("/roles", handlers.ListMyRolesHandler(deps.Users))
+		me.GET("/data-export", handlers.ExportMyDataHandler(deps.Privacy))
+		me.GET("/sessions", handlers.ListMySessionsHandler(deps.Sessions))
+		me.DELETE("/sessions", handlers.RevokeMyOtherSessionsHandler(deps.Sessions))
+		me.DELETE("/sessions/:session_id", handlers.RevokeMySessionHandler(deps.Sessions))
+	}
+
+	// Deactivating the account, verifying an email and linking provider accounts need a signed-in session
+	meSession := r.Group("/api/v1/me", deps.Authenticator.RequireAuth())
+	{
+		meSession.POST("/deactivate", handlers.DeactivateMyAccountHandler(deps.Users, deps.Sessions))
+		meSession.POST("/email/verify", handlers.VerifyMyEmailHandler(deps.Users))
+		meSession.POST("/identities/:provider", handlers.LinkIdentityHandler(deps.Federation))
+	}
+
+	// API key management needs a signed-in session, so a key cannot be used to create further keys
+	apiKeys := r.Group("/api/v1/me/api-keys", deps.Authenticator.RequireAuth())
+	{
+		apiKeys.POST("", handlers.CreateAPIKeyHandler(deps.APIKeys))
+		apiKeys.GET("", handlers.ListAPIKeysHandler(deps.APIKeys))
+		apiKeys.DELETE("/:key_id", handlers.RevokeAPIKeyHandler(deps.APIKeys))
+	}
+
+	// Service accounts, managed by their owners and administrators
+	serviceAccounts := r.Group("/api/v1/service-accounts", deps.Authenticator.RequireAuth())
+	{
+		serviceAccounts.POST("", handlers.CreateServiceAccountHandler(deps.Services))
+		serviceAccounts.GET("", handlers.ListServiceAccountsHandler(deps.Services))
+		serviceAccounts.GET("/:id", handlers.GetServiceAccountHandler(deps.Services))
+		serviceAccounts.DELETE("/:id", handlers.DeleteServiceAccountHandler(deps.Services))
+		serviceAccounts.POST("/:id/client-secret", handlers.RotateClientSecretHandler(deps.Services))
+		serviceAccounts.POST("/:id/api-keys", handlers.CreateServiceAccountKeyHandler(deps.Services))
+		serviceAccounts.GET("/:id/api-keys", handlers.ListServiceAccountKeysHandler(deps.Services))
+		serviceAccounts.DELETE("/:id/api-keys/:key_id", handlers.RevokeServiceAccountKeyHandler(deps.Services))
+	}
+
+	// SAML sign-ins of the authenticated user, completed by the sign-in page
+	samlSignIn := r.Group("/api/v1/saml", deps.Authenticator.RequireAuth())
+	{
+		samlSignIn.POST("/sso", handlers.CompleteSAMLRequestHandler(deps.SAML))
+		samlSignIn.POST("/idp-initiated", handlers.SAMLIdPInitiatedHandler(deps.SAML))
+	}
+
+	// Admin routes, also reachable with an admin's API key granted admin scopes
+	admin := r.Group("/api/v1/admin", deps.Authenticator.RequireAuth(auth.ScopeAPIKey), middleware.RequireRole("admin"), middleware.RequireAPIKeyScope("admin"))
+	{
+		admin.POST("/user-imports", handlers.ImportUsersHandler(deps.Users))
+		admin.GET("/pepper-keys", handlers.PepperKeyUsageHandler(deps.Users))
+		admin.GET("/audit-events", handlers.ListAuditEventsHandler(deps.Audit))
+		admin.GET("/audit-events/verify", handlers.VerifyAuditChainHandler(deps.AuditChain))
+		admin.GET("/exports/users", handlers.ExportUsersHandler(deps.Users))
+		admin.GET("/exports/audit-events", handlers.ExportAuditEventsHandler(deps.Audit))
+		admin.POST("/webhooks", handlers.CreateWebhookHandler(deps.Webhooks))
+		admin.GET("/webhooks", handlers.ListWebhooksHandler(deps.Webhooks))
+		admin.DELETE("/webhooks/:id", handlers.DeleteWebhookHandler(deps.Webhooks))
+		admin.GET("/webhook-deliveries", handlers.ListWebhookDeliveriesHandler(deps.Webhooks))
+		admin.GET("/webhook-deliveries/:id", handlers.GetWebhookDeliveryHandler(deps.Webhooks))
+		admin.POST("/webhook-deliveries/:id/redeliver", handlers.RedeliverWebhookHandler(deps.Webhooks))
+		admin.POST("/users/:id/unlock", handlers.UnlockUserHandler(deps.Users))
+		admin.POST("/users/:id/deactivate", handlers.DeactivateUserHandler(deps.Users))
+		admin.POST("/users/:id/reactivate", handlers.ReactivateUserHandler(deps.Users))
+		admin.PUT("/users/:id/state", handlers.ChangeUserStateHandler(deps.Users))
+		admin.GET("/users/:id/deprovisioning", handlers.ListDeprovisioningJobsHandler(deps.Deprovisioner))
+		admin.POST("/users/:id/temporary-password", handlers.SetTemporaryPasswordHandler(deps.Users, deps.Sessions))
+		admin.PUT("/users/:id/auth-source", handlers.SetAuthSourceHandler(deps.Users))
+		admin.PUT("/service-accounts/:id/roles", handlers.BindServiceAccountRolesHandler(deps.Services))
+		admin.PUT("/users/:id/attributes", handlers.SetUserAttributesHandler(deps.Users))
+		admin.GET("/users/:id/data-export", handlers.ExportUserDataHandler(deps.Privacy))
+		admin.POST("/users/:id/erasure", handlers.EraseUserHandler(deps.Privacy))
+		admin.GET("/users/:id/erasure", handlers.GetErasureHandler(deps.Privacy))
+		admin.GET("/attribute-schemas/:tenant", handlers.GetAttributeSchemaHandler(deps.Attributes))
+		admin.PUT("/attribute-schemas/:tenant", handlers.SaveAttributeSchemaHandler(deps.Attributes))
+		admin.POST("/saml/service-providers", handlers.RegisterSAMLServiceProviderHandler(deps.SAML))
+		admin.GET("/saml/service-providers", handlers.ListSAMLServiceProvidersHandler(deps.SAML))
+		admin.DELETE("/saml/service-providers/:id", handlers.DeleteSAMLServiceProviderHandler(deps.SAML))
+		admin.GET("/users/:id/sessions", handlers.ListUserSessionsHandler(deps.Sessions))
+		admin.DELETE("/users/:id/sessions", handlers.RevokeUserSessionsHandler(deps.Sessions))
+		admin.DELETE("/users/:id/sessions/:session_id", handlers.RevokeUserSessionHandler(deps.Sessions))
+	}
+
+	// User directory, also reachable with an admin's API key granted admin scopes
+	users := r.Group("/api/v1/users", deps.Authenticator.RequireAuth(auth.ScopeAPIKey), middleware.RequireRole("admin"), middleware.RequireAPIKeyScope("admin"))
+	{
+		users.GET("", handlers.ListUsersHandler(deps.Users))
+	}
+
+	// SCIM 2.0 provisioning
+	scimRoutes := r.Group("/scim/v2", deps.ScimAuth.RequireToken())
+	{
+		scimRoutes.GET("/ServiceProviderConfig", handlers.ScimServiceProviderConfigHandler())
+		scimRoutes.GET("/Schemas", handlers.ScimSchemasHandler())
+		scimRoutes.GET("/Schemas/:id", handlers.ScimSchemaHandler())
+		scimRoutes.GET("/ResourceTypes", handlers.ScimResourceTypesHandler())
+		scimRoutes.GET("/ResourceTypes/:id", handlers.ScimResourceTypeHandler())
+		scimRoutes.GET("/Users", handlers.ListScimUsersHandler(deps.Scim))
+		scimRoutes.POST("/Users", handlers.CreateScimUserHandler(deps.Scim))
+		scimRoutes.GET("/Users/:id", handlers.GetScimUserHandler(deps.Scim))
+		scimRoutes.PUT("/Users/:id", handlers.ReplaceScimUserHandler(deps.Scim))
+		scimRoutes.PATCH("/Users/:id", handlers.PatchScimUserHandler(deps.Scim))
+		scimRoutes.DELETE("/Users/:id", handlers.DeleteScimUserHandler(deps.Scim))
+		scimRoutes.GET("/Groups", handlers.ListScimGroupsHandler(deps.Scim))
+		scimRoutes.POST("/Groups", handlers.CreateScimGroupHandler(deps.Scim))
+		scimRoutes.GET("/Groups/:id", handlers.GetScimGroupHandler(deps.Scim))
+		scimRoutes.PUT("/Groups/:id", handlers.ReplaceScimGroupHandler(deps.Scim))
+		scimRoutes.PATCH("/Groups/:id", handlers.PatchScimGroupHandler(deps.Scim))
+		scimRoutes.DELETE("/Groups/:id", handlers.DeleteScimGroupHandler(deps.Scim))
 	}
 
 	// // Protected routes (would require authentication middleware)
 	// protected := r.Group("/api/v1/protected")
 	// {
-	// 	protected.PUT("/user/roles", handlers.UpdateUserRolesHandler(userController))
+	// 	protected.PUT("/user/roles", handlers.UpdateUserRolesHandler(deps.Users))
 	// }
 
 	return r
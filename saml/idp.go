@@ -0,0 +1,227 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Status codes and classes used in responses
+const (
+	StatusSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bearerMethod      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	passwordProtected = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	samlTimeFormat    = "2006-01-02T15:04:05.000Z"
+)
+
+// clockSkew is subtracted from NotBefore to tolerate service providers with slow clocks
+const clockSkew = 90 * time.Second
+
+// IdentityProvider issues signed assertions about users to registered service providers
+type IdentityProvider struct {
+	EntityID     string
+	SSOURL       string // where service providers send authentication requests
+	Certificate  *x509.Certificate
+	Key          *rsa.PrivateKey
+	AssertionTTL time.Duration
+}
+
+// NewIdentityProvider creates an IdentityProvider signing with the PEM-encoded certificate and RSA key
+func NewIdentityProvider(entityID, ssoURL string, certPEM, keyPEM []byte, assertionTTL time.Duration) (*IdentityProvider, error) {
+	if entityID == "" || ssoURL == "" {
+		return nil, errors.New("an entity ID and single sign-on URL are required")
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the signing key must be an RSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if assertionTTL <= 0 {
+		assertionTTL = 5 * time.Minute
+	}
+
+	return &IdentityProvider{
+		EntityID:     entityID,
+		SSOURL:       ssoURL,
+		Certificate:  cert,
+		Key:          key,
+		AssertionTTL: assertionTTL,
+	}, nil
+}
+
+// Metadata returns the identity provider's metadata document
+func (idp *IdentityProvider) Metadata() ([]byte, error) {
+	descriptor := EntityDescriptor{
+		EntityID: idp.EntityID,
+		IDPSSODescriptor: &IDPSSODescriptor{
+			ProtocolSupportEnumeration: ProtocolNamespace,
+			KeyDescriptors: []KeyDescriptor{{
+				Use:         "signing",
+				Certificate: base64.StdEncoding.EncodeToString(idp.Certificate.Raw),
+			}},
+			NameIDFormats: []string{NameIDFormatEmail, NameIDFormatPersistent, NameIDFormatUnspecified},
+			SingleSignOnServices: []Endpoint{
+				{Binding: HTTPRedirectBinding, Location: idp.SSOURL},
+				{Binding: HTTPPostBinding, Location: idp.SSOURL},
+			},
+		},
+	}
+
+	out, err := xml.MarshalIndent(descriptor, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// Attribute is an attribute statement about the subject
+type Attribute struct {
+	Name       string
+	NameFormat string
+	Values     []string
+}
+
+// Assertion describes the assertion to issue in a response
+type Assertion struct {
+	Destination  string // assertion consumer service the response is posted to
+	Audience     string // entity ID of the service provider
+	InResponseTo string // ID of the authentication request; empty for IdP-initiated sign-ins
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	AuthnInstant time.Time
+	Attributes   []Attribute
+}
+
+// NewResponse returns a Response document carrying the assertion, signed with the identity provider's key
+func (idp *IdentityProvider) NewResponse(a Assertion) ([]byte, error) {
+	now := time.Now().UTC()
+	if a.NameIDFormat == "" {
+		a.NameIDFormat = NameIDFormatUnspecified
+	}
+	if a.AuthnInstant.IsZero() {
+		a.AuthnInstant = now
+	}
+
+	assertion, err := idp.signedAssertion(a, now)
+	if err != nil {
+		return nil, err
+	}
+
+	response := etree.NewElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", ProtocolNamespace)
+	response.CreateAttr("xmlns:saml", AssertionNamespace)
+	response.CreateAttr("ID", newID())
+	response.CreateAttr("Version", "2.0")
+	response.CreateAttr("IssueInstant", now.Format(samlTimeFormat))
+	response.CreateAttr("Destination", a.Destination)
+	if a.InResponseTo != "" {
+		response.CreateAttr("InResponseTo", a.InResponseTo)
+	}
+	response.CreateElement("saml:Issuer").SetText(idp.EntityID)
+	response.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", StatusSuccess)
+	response.AddChild(assertion)
+
+	doc := etree.NewDocument()
+	doc.SetRoot(response)
+	return doc.WriteToBytes()
+}
+
+// signedAssertion builds the assertion and signs it. The assertion declares its own namespace so
+// that its canonical form, and therefore its signature, does not depend on the enclosing response.
+func (idp *IdentityProvider) signedAssertion(a Assertion, now time.Time) (*etree.Element, error) {
+	notOnOrAfter := now.Add(idp.AssertionTTL).Format(samlTimeFormat)
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", AssertionNamespace)
+	assertion.CreateAttr("ID", newID())
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", now.Format(samlTimeFormat))
+	assertion.CreateElement("saml:Issuer").SetText(idp.EntityID)
+
+	subject := assertion.CreateElement("saml:Subject")
+	nameID := subject.CreateElement("saml:NameID")
+	nameID.CreateAttr("Format", a.NameIDFormat)
+	nameID.SetText(a.NameID)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", bearerMethod)
+	confirmationData := confirmation.CreateElement("saml:SubjectConfirmationData")
+	if a.InResponseTo != "" {
+		confirmationData.CreateAttr("InResponseTo", a.InResponseTo)
+	}
+	confirmationData.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	confirmationData.CreateAttr("Recipient", a.Destination)
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", now.Add(-clockSkew).Format(samlTimeFormat))
+	conditions.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(a.Audience)
+
+	authnStatement := assertion.CreateElement("saml:AuthnStatement")
+	authnStatement.CreateAttr("AuthnInstant", a.AuthnInstant.UTC().Format(samlTimeFormat))
+	if a.SessionIndex != "" {
+		authnStatement.CreateAttr("SessionIndex", a.SessionIndex)
+	}
+	authnStatement.CreateElement("saml:AuthnContext").CreateElement("saml:AuthnContextClassRef").SetText(passwordProtected)
+
+	if len(a.Attributes) > 0 {
+		statement := assertion.CreateElement("saml:AttributeStatement")
+		for _, attribute := range a.Attributes {
+			el := statement.CreateElement("saml:Attribute")
+			el.CreateAttr("Name", attribute.Name)
+			format := attribute.NameFormat
+			if format == "" {
+				format = AttributeNameFormatBasic
+			}
+			el.CreateAttr("NameFormat", format)
+			for _, value := range attribute.Values {
+				el.CreateElement("saml:AttributeValue").SetText(value)
+			}
+		}
+	}
+
+	signer, err := dsig.NewSigningContext(idp.Key, [][]byte{idp.Certificate.Raw})
+	if err != nil {
+		return nil, err
+	}
+	signer.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := signer.SetSignatureMethod(dsig.RSASHA256SignatureMethod); err != nil {
+		return nil, err
+	}
+	signed, err := signer.SignEnveloped(assertion)
+	if err != nil {
+		return nil, fmt.Errorf("signing the assertion: %w", err)
+	}
+
+	// The schema requires the signature right after the issuer. The enveloped-signature transform
+	// removes it before digesting, so moving it does not invalidate it. The signature is appended
+	// without its index being set, so it is removed by position.
+	signature := signed.RemoveChildAt(len(signed.Child) - 1)
+	signed.InsertChildAt(signed.SelectElement("Issuer").Index()+1, signature)
+
+	return signed, nil
+}
+
+// newID returns a random identifier; XML IDs must not start with a digit
+func newID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return "_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,160 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SAML namespaces, bindings and formats
+const (
+	MetadataNamespace  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	AssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	ProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	SignatureNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+	HTTPPostBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	HTTPRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+	NameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	NameIDFormatEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+
+	AttributeNameFormatBasic       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	AttributeNameFormatURI         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	AttributeNameFormatUnspecified = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+)
+
+// EntityDescriptor is a SAML metadata document describing one entity
+type EntityDescriptor struct {
+	XMLName          xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID         string            `xml:"entityID,attr"`
+	IDPSSODescriptor *IDPSSODescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor,omitempty"`
+	SPSSODescriptor  *SPSSODescriptor  `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor,omitempty"`
+}
+
+// IDPSSODescriptor describes an identity provider's single sign-on endpoints
+type IDPSSODescriptor struct {
+	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr"`
+	WantAuthnRequestsSigned    bool            `xml:"WantAuthnRequestsSigned,attr"`
+	KeyDescriptors             []KeyDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+	NameIDFormats              []string        `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+	SingleSignOnServices       []Endpoint      `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+}
+
+// SPSSODescriptor describes a service provider's assertion consumer endpoints
+type SPSSODescriptor struct {
+	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr"`
+	AuthnRequestsSigned        bool            `xml:"AuthnRequestsSigned,attr"`
+	WantAssertionsSigned       bool            `xml:"WantAssertionsSigned,attr"`
+	KeyDescriptors             []KeyDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+	NameIDFormats              []string        `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+	AssertionConsumerServices  []Endpoint      `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+}
+
+// KeyDescriptor holds a certificate of an entity
+type KeyDescriptor struct {
+	Use         string `xml:"use,attr,omitempty"` // "signing", "encryption" or empty for both
+	Certificate string `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo>X509Data>X509Certificate"`
+}
+
+// Endpoint is a protocol endpoint of an entity
+type Endpoint struct {
+	Binding   string `xml:"Binding,attr"`
+	Location  string `xml:"Location,attr"`
+	Index     *int   `xml:"index,attr,omitempty"`
+	IsDefault *bool  `xml:"isDefault,attr,omitempty"`
+}
+
+// ServiceProvider is a service provider as described by its metadata
+type ServiceProvider struct {
+	EntityID                  string
+	AuthnRequestsSigned       bool
+	AssertionConsumerServices []Endpoint // HTTP-POST endpoints only, as assertions are always posted
+	Certificates              []*x509.Certificate
+}
+
+// ParseServiceProviderMetadata reads the entity ID, HTTP-POST assertion consumer services and
+// signing certificates from a service provider's metadata
+func ParseServiceProviderMetadata(data []byte) (*ServiceProvider, error) {
+	var descriptor EntityDescriptor
+	if err := xml.Unmarshal(data, &descriptor); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	if descriptor.EntityID == "" || descriptor.SPSSODescriptor == nil {
+		return nil, errors.New("the metadata does not describe a service provider")
+	}
+
+	sp := &ServiceProvider{
+		EntityID:            descriptor.EntityID,
+		AuthnRequestsSigned: descriptor.SPSSODescriptor.AuthnRequestsSigned,
+	}
+	for _, endpoint := range descriptor.SPSSODescriptor.AssertionConsumerServices {
+		if endpoint.Binding == HTTPPostBinding && endpoint.Location != "" {
+			sp.AssertionConsumerServices = append(sp.AssertionConsumerServices, endpoint)
+		}
+	}
+	if len(sp.AssertionConsumerServices) == 0 {
+		return nil, errors.New("the service provider has no HTTP-POST assertion consumer service")
+	}
+
+	for _, key := range descriptor.SPSSODescriptor.KeyDescriptors {
+		if key.Use == "encryption" {
+			continue
+		}
+		cert, err := parseCertificate(key.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		sp.Certificates = append(sp.Certificates, cert)
+	}
+	if sp.AuthnRequestsSigned && len(sp.Certificates) == 0 {
+		return nil, errors.New("the service provider signs its requests but has no signing certificate")
+	}
+
+	return sp, nil
+}
+
+// AssertionConsumerService picks the endpoint to post a response to: the URL or index named in the
+// request if the metadata lists it, otherwise the default endpoint
+func (sp *ServiceProvider) AssertionConsumerService(requestedURL string, requestedIndex *int) (string, error) {
+	if requestedURL != "" {
+		for _, endpoint := range sp.AssertionConsumerServices {
+			if endpoint.Location == requestedURL {
+				return endpoint.Location, nil
+			}
+		}
+		return "", fmt.Errorf("assertion consumer service %q is not registered", requestedURL)
+	}
+
+	if requestedIndex != nil {
+		for _, endpoint := range sp.AssertionConsumerServices {
+			if endpoint.Index != nil && *endpoint.Index == *requestedIndex {
+				return endpoint.Location, nil
+			}
+		}
+		return "", fmt.Errorf("assertion consumer service %d is not registered", *requestedIndex)
+	}
+
+	for _, endpoint := range sp.AssertionConsumerServices {
+		if endpoint.IsDefault != nil && *endpoint.IsDefault {
+			return endpoint.Location, nil
+		}
+	}
+	return sp.AssertionConsumerServices[0].Location, nil
+}
+
+func parseCertificate(encoded string) (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,225 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// maxRequestSize bounds an inflated authentication request, so a small deflated payload cannot exhaust memory
+const maxRequestSize = 64 << 10
+
+// rsaSHA256 is the only signature algorithm accepted on redirect-bound requests
+const rsaSHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+
+// ErrInvalidSignature is returned when a request's signature is missing, uses an unsupported algorithm or does not verify
+var ErrInvalidSignature = errors.New("invalid request signature")
+
+// AuthnRequest is an authentication request sent by a service provider
+type AuthnRequest struct {
+	XMLName                       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                            string   `xml:"ID,attr"`
+	Version                       string   `xml:"Version,attr"`
+	IssueInstant                  string   `xml:"IssueInstant,attr"`
+	Destination                   string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL   string   `xml:"AssertionConsumerServiceURL,attr"`
+	AssertionConsumerServiceIndex *int     `xml:"AssertionConsumerServiceIndex,attr"`
+	ProtocolBinding               string   `xml:"ProtocolBinding,attr"`
+	Issuer                        string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameIDPolicy                  *struct {
+		Format string `xml:"Format,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+}
+
+// NameIDFormat returns the name ID format the service provider asked for, if any
+func (r *AuthnRequest) NameIDFormat() string {
+	if r.NameIDPolicy == nil {
+		return ""
+	}
+	return r.NameIDPolicy.Format
+}
+
+// ReceivedRequest is an authentication request together with what is needed to check its signature
+type ReceivedRequest struct {
+	Request    *AuthnRequest
+	RelayState string
+
+	document   []byte // the decoded request
+	postBound  bool   // received through the HTTP-POST binding; the signature is embedded in the document
+	enveloped  bool   // the document has a Signature element
+	signedPart string // for the redirect binding, the query octets covered by the signature
+	sigAlg     string
+	signature  []byte
+}
+
+// ParseRequestQuery decodes an authentication request from a query string. Requests received through
+// the HTTP-Redirect binding are deflated; SAMLBinding=post marks a request forwarded from the HTTP-POST
+// binding, which is only base64-encoded and carries an enveloped signature.
+func ParseRequestQuery(rawQuery string) (*ReceivedRequest, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	encoded := values.Get("SAMLRequest")
+	if encoded == "" {
+		return nil, errors.New("the query has no SAMLRequest")
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAMLRequest encoding: %w", err)
+	}
+
+	received := &ReceivedRequest{RelayState: values.Get("RelayState")}
+	if values.Get("SAMLBinding") == "post" {
+		received.postBound = true
+		received.document = raw
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(raw); err != nil {
+			return nil, fmt.Errorf("invalid AuthnRequest: %w", err)
+		}
+		received.enveloped = doc.Root() != nil && doc.Root().SelectElement("Signature") != nil
+	} else {
+		received.document, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(raw)), maxRequestSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAMLRequest compression: %w", err)
+		}
+		received.signedPart = signedQueryPart(rawQuery)
+		received.sigAlg = values.Get("SigAlg")
+		if signature := values.Get("Signature"); signature != "" {
+			received.signature, err = base64.StdEncoding.DecodeString(signature)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Signature encoding: %w", err)
+			}
+		}
+	}
+	if len(received.document) > maxRequestSize {
+		return nil, errors.New("the SAMLRequest is too large")
+	}
+
+	received.Request = &AuthnRequest{}
+	if err := xml.Unmarshal(received.document, received.Request); err != nil {
+		return nil, fmt.Errorf("invalid AuthnRequest: %w", err)
+	}
+	if received.Request.ID == "" || received.Request.Version != "2.0" {
+		return nil, errors.New("invalid AuthnRequest: an ID and version 2.0 are required")
+	}
+
+	return received, nil
+}
+
+// Signed reports whether the request carries a signature
+func (r *ReceivedRequest) Signed() bool {
+	if r.postBound {
+		return r.enveloped
+	}
+	return r.signature != nil
+}
+
+// VerifySignature checks the request's signature against the service provider's certificates
+func (r *ReceivedRequest) VerifySignature(certs []*x509.Certificate) error {
+	if !r.Signed() {
+		return ErrInvalidSignature
+	}
+	if r.postBound {
+		return r.verifyEnveloped(certs)
+	}
+
+	if r.sigAlg != rsaSHA256 {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidSignature, r.sigAlg)
+	}
+	digest := sha256.Sum256([]byte(r.signedPart))
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], r.signature) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func (r *ReceivedRequest) verifyEnveloped(certs []*x509.Certificate) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(r.document); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	validated, err := validator.Validate(doc.Root())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	// Only the signed element may be trusted, so the request is read again from it
+	signed := etree.NewDocument()
+	signed.SetRoot(validated)
+	data, err := signed.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	request := &AuthnRequest{}
+	if err := xml.Unmarshal(data, request); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	r.Request = request
+	return nil
+}
+
+// signedQueryPart returns the SAMLRequest, RelayState and SigAlg parameters exactly as they were
+// encoded by the sender, which is what the redirect binding's signature covers
+func signedQueryPart(rawQuery string) string {
+	parts := map[string]string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if name == "SAMLRequest" || name == "RelayState" || name == "SigAlg" {
+			parts[name] = param
+		}
+	}
+
+	var signed []string
+	for _, name := range []string{"SAMLRequest", "RelayState", "SigAlg"} {
+		if part, ok := parts[name]; ok {
+			signed = append(signed, part)
+		}
+	}
+	return strings.Join(signed, "&")
+}
+
+// EncodeRedirectRequest deflates and encodes a request for the HTTP-Redirect binding and, with a key,
+// signs it. It returns the query string to append to the identity provider's SSO URL.
+func EncodeRedirectRequest(request []byte, relayState string, key *rsa.PrivateKey) (string, error) {
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	writer.Write(request)
+	writer.Close()
+
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	if key == nil {
+		return query, nil
+	}
+
+	query += "&SigAlg=" + url.QueryEscape(rsaSHA256)
+	digest := sha256.Sum256([]byte(query))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature)), nil
+}
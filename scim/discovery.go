@@ -0,0 +1,214 @@
+package scim
+
+// MaxResults is the largest page the service returns, advertised in the ServiceProviderConfig
+const MaxResults = 200
+
+// Attribute describes an attribute in a schema definition
+type Attribute struct {
+	Name          string      `json:"name"`
+	Type          string      `json:"type"`
+	MultiValued   bool        `json:"multiValued"`
+	Description   string      `json:"description,omitempty"`
+	Required      bool        `json:"required"`
+	CaseExact     bool        `json:"caseExact"`
+	Mutability    string      `json:"mutability"`
+	Returned      string      `json:"returned"`
+	Uniqueness    string      `json:"uniqueness"`
+	SubAttributes []Attribute `json:"subAttributes,omitempty"`
+}
+
+// Schema is a schema definition returned by the /Schemas endpoint
+type Schema struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Attributes  []Attribute `json:"attributes"`
+	Meta        *Meta       `json:"meta,omitempty"`
+}
+
+// ResourceType is a resource type definition returned by the /ResourceTypes endpoint
+type ResourceType struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Endpoint    string   `json:"endpoint"`
+	Description string   `json:"description"`
+	Schema      string   `json:"schema"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// Supported reports whether an optional feature is available
+type Supported struct {
+	Supported bool `json:"supported"`
+}
+
+// FilterSupport describes filtering support
+type FilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+// BulkSupport describes bulk operation support
+type BulkSupport struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+// AuthenticationScheme describes how clients authenticate
+type AuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary"`
+}
+
+// ServiceProviderConfig describes the features the service supports
+type ServiceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	Patch                 Supported              `json:"patch"`
+	Bulk                  BulkSupport            `json:"bulk"`
+	Filter                FilterSupport          `json:"filter"`
+	ChangePassword        Supported              `json:"changePassword"`
+	Sort                  Supported              `json:"sort"`
+	ETag                  Supported              `json:"etag"`
+	AuthenticationSchemes []AuthenticationScheme `json:"authenticationSchemes"`
+	Meta                  *Meta                  `json:"meta,omitempty"`
+}
+
+// NewServiceProviderConfig returns the service's configuration
+func NewServiceProviderConfig() *ServiceProviderConfig {
+	return &ServiceProviderConfig{
+		Schemas:        []string{ServiceProviderConfigSchema},
+		Patch:          Supported{Supported: true},
+		Bulk:           BulkSupport{},
+		Filter:         FilterSupport{Supported: true, MaxResults: MaxResults},
+		ChangePassword: Supported{Supported: true},
+		Sort:           Supported{},
+		ETag:           Supported{},
+		AuthenticationSchemes: []AuthenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "OAuth Bearer Token",
+			Description: "Authentication with a bearer token issued by the service operator",
+			Primary:     true,
+		}},
+		Meta: &Meta{ResourceType: "ServiceProviderConfig"},
+	}
+}
+
+// ResourceTypes returns the resource types the service supports
+func ResourceTypes() []ResourceType {
+	return []ResourceType{
+		{
+			Schemas:     []string{ResourceTypeSchema},
+			ID:          "User",
+			Name:        "User",
+			Endpoint:    "/Users",
+			Description: "User Account",
+			Schema:      UserSchema,
+			Meta:        &Meta{ResourceType: "ResourceType"},
+		},
+		{
+			Schemas:     []string{ResourceTypeSchema},
+			ID:          "Group",
+			Name:        "Group",
+			Endpoint:    "/Groups",
+			Description: "Group",
+			Schema:      GroupSchema,
+			Meta:        &Meta{ResourceType: "ResourceType"},
+		},
+	}
+}
+
+// Schemas returns the definitions of the schemas the service supports
+func Schemas() []Schema {
+	return []Schema{
+		{
+			Schemas:     []string{SchemaSchema},
+			ID:          UserSchema,
+			Name:        "User",
+			Description: "User Account",
+			Attributes: []Attribute{
+				stringAttr("userName", "Unique identifier for the user, used to log in", true, "readWrite", "server"),
+				stringAttr("externalId", "Identifier of the user in the provisioning client", false, "readWrite", "none"),
+				{
+					Name: "emails", Type: "complex", MultiValued: true, Required: true,
+					Description: "Email addresses of the user; only the primary address is stored",
+					Mutability:  "readWrite", Returned: "default", Uniqueness: "none",
+					SubAttributes: []Attribute{
+						stringAttr("value", "Email address", true, "readWrite", "server"),
+						stringAttr("type", "Label of the address, e.g. work", false, "readWrite", "none"),
+						booleanAttr("primary", "Whether this is the primary address", "readWrite"),
+					},
+				},
+				booleanAttr("active", "Whether the user can log in", "readWrite"),
+				{
+					Name: "password", Type: "string", Description: "Initial or new password of the user",
+					Mutability: "writeOnly", Returned: "never", Uniqueness: "none",
+				},
+				{
+					Name: "roles", Type: "complex", MultiValued: true,
+					Description: "Roles granted to the user",
+					Mutability:  "readWrite", Returned: "default", Uniqueness: "none",
+					SubAttributes: []Attribute{
+						stringAttr("value", "Role name", true, "readWrite", "none"),
+					},
+				},
+				{
+					Name: "groups", Type: "complex", MultiValued: true,
+					Description: "Groups the user belongs to",
+					Mutability:  "readOnly", Returned: "default", Uniqueness: "none",
+					SubAttributes: []Attribute{
+						stringAttr("value", "Identifier of the group", false, "readOnly", "none"),
+						stringAttr("display", "Name of the group", false, "readOnly", "none"),
+					},
+				},
+			},
+			Meta: &Meta{ResourceType: "Schema"},
+		},
+		{
+			Schemas:     []string{SchemaSchema},
+			ID:          GroupSchema,
+			Name:        "Group",
+			Description: "Group",
+			Attributes: []Attribute{
+				stringAttr("displayName", "Name of the group", true, "readWrite", "server"),
+				stringAttr("externalId", "Identifier of the group in the provisioning client", false, "readWrite", "none"),
+				{
+					Name: "members", Type: "complex", MultiValued: true,
+					Description: "Users in the group",
+					Mutability:  "readWrite", Returned: "default", Uniqueness: "none",
+					SubAttributes: []Attribute{
+						stringAttr("value", "Identifier of the user", false, "immutable", "none"),
+						stringAttr("display", "User name of the user", false, "readOnly", "none"),
+					},
+				},
+			},
+			Meta: &Meta{ResourceType: "Schema"},
+		},
+	}
+}
+
+func stringAttr(name, description string, required bool, mutability, uniqueness string) Attribute {
+	return Attribute{
+		Name:        name,
+		Type:        "string",
+		Description: description,
+		Required:    required,
+		Mutability:  mutability,
+		Returned:    "default",
+		Uniqueness:  uniqueness,
+	}
+}
+
+func booleanAttr(name, description, mutability string) Attribute {
+	return Attribute{
+		Name:        name,
+		Type:        "boolean",
+		Description: description,
+		Mutability:  mutability,
+		Returned:    "default",
+		Uniqueness:  "none",
+	}
+}
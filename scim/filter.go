@@ -0,0 +1,431 @@
+package scim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter operators (RFC 7644 section 3.4.2.2)
+const (
+	OpEq      = "eq"
+	OpNe      = "ne"
+	OpCo      = "co"
+	OpSw      = "sw"
+	OpEw      = "ew"
+	OpGt      = "gt"
+	OpGe      = "ge"
+	OpLt      = "lt"
+	OpLe      = "le"
+	OpPresent = "pr"
+)
+
+// Expr is a parsed filter expression: a *Compare, *Logical, *Not or *ValuePath
+type Expr interface{}
+
+// Compare tests an attribute against a value; Value is a string, bool, float64 or nil
+type Compare struct {
+	Attr  string // lowercased attribute path without schema prefix, e.g. "emails.value"
+	Op    string
+	Value interface{}
+}
+
+// Logical combines two expressions with "and" or "or"
+type Logical struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// Not negates an expression
+type Not struct {
+	Expr Expr
+}
+
+// ValuePath filters the values of a multi-valued attribute, e.g. emails[type eq "work"]
+type ValuePath struct {
+	Attr   string
+	Filter Expr
+}
+
+// ParseFilter parses a SCIM filter such as `userName eq "alice" and active eq true`
+func ParseFilter(filter string) (Expr, error) {
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+// NormalizeAttr lowercases an attribute path and removes a schema URN prefix
+func NormalizeAttr(attr string) string {
+	if strings.HasPrefix(strings.ToLower(attr), "urn:") {
+		if i := strings.LastIndex(attr, ":"); i >= 0 {
+			attr = attr[i+1:]
+		}
+	}
+	return strings.ToLower(attr)
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		ch := rune(input[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case strings.ContainsRune("()[]", ch):
+			tokens = append(tokens, token{text: string(ch)})
+			i++
+		case ch == '"':
+			end := i + 1
+			for end < len(input) && input[end] != '"' {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			value, err := strconv.Unquote(input[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s in filter", input[i:end+1])
+			}
+			tokens = append(tokens, token{text: value, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(input) && !unicode.IsSpace(rune(input[end])) && !strings.ContainsRune("()[]\"", rune(input[end])) {
+				end++
+			}
+			tokens = append(tokens, token{text: input[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) next() (token, error) {
+	t, ok := p.peek()
+	if !ok {
+		return token{}, fmt.Errorf("unexpected end of filter")
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *parser) keyword(word string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.quoted || t.text != text {
+		return fmt.Errorf("expected %q in filter, found %q", text, t.text)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.keyword("not") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &Not{Expr: expr}, nil
+	}
+
+	if t, ok := p.peek(); ok && !t.quoted && t.text == "(" {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	return p.parseAttrExpr()
+}
+
+func (p *parser) parseAttrExpr() (Expr, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.quoted || strings.ContainsAny(t.text, "()[]") {
+		return nil, fmt.Errorf("expected an attribute in filter, found %q", t.text)
+	}
+	attr := NormalizeAttr(t.text)
+
+	if next, ok := p.peek(); ok && !next.quoted && next.text == "[" {
+		p.pos++
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &ValuePath{Attr: attr, Filter: filter}, nil
+	}
+
+	opToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(opToken.text)
+	switch op {
+	case OpPresent:
+		return &Compare{Attr: attr, Op: op}, nil
+	case OpEq, OpNe, OpCo, OpSw, OpEw, OpGt, OpGe, OpLt, OpLe:
+	default:
+		return nil, fmt.Errorf("unknown operator %q in filter", opToken.text)
+	}
+
+	valueToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := parseValue(valueToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Compare{Attr: attr, Op: op, Value: value}, nil
+}
+
+func parseValue(t token) (interface{}, error) {
+	if t.quoted {
+		return t.text, nil
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q in filter", t.text)
+	}
+	return number, nil
+}
+
+// Matches evaluates a filter against a resource decoded from JSON, comparing strings case-insensitively
+func Matches(expr Expr, resource map[string]interface{}) bool {
+	switch e := expr.(type) {
+	case *Logical:
+		if e.Op == "and" {
+			return Matches(e.Left, resource) && Matches(e.Right, resource)
+		}
+		return Matches(e.Left, resource) || Matches(e.Right, resource)
+	case *Not:
+		return !Matches(e.Expr, resource)
+	case *ValuePath:
+		for _, value := range asSlice(lookup(resource, e.Attr)) {
+			if element, ok := value.(map[string]interface{}); ok && Matches(e.Filter, element) {
+				return true
+			}
+		}
+		return false
+	case *Compare:
+		values := asSlice(lookup(resource, e.Attr))
+		if e.Op == OpPresent {
+			for _, v := range values {
+				if v != nil && v != "" {
+					return true
+				}
+			}
+			return false
+		}
+		if e.Op == OpNe {
+			return !Matches(&Compare{Attr: e.Attr, Op: OpEq, Value: e.Value}, resource)
+		}
+		for _, v := range values {
+			// Multi-valued complex attributes compare their "value" sub-attribute
+			if element, ok := v.(map[string]interface{}); ok {
+				v = lookup(element, "value")
+			}
+			if compareValue(v, e.Op, e.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookup finds a dotted attribute path in a resource, ignoring case. Paths into
+// multi-valued attributes return the sub-attribute of every element.
+func lookup(resource map[string]interface{}, path string) interface{} {
+	name, rest, nested := strings.Cut(path, ".")
+	var value interface{}
+	for key, v := range resource {
+		if strings.EqualFold(key, name) {
+			value = v
+			break
+		}
+	}
+	if !nested || value == nil {
+		return value
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return lookup(v, rest)
+	case []interface{}:
+		var values []interface{}
+		for _, element := range v {
+			if m, ok := element.(map[string]interface{}); ok {
+				values = append(values, asSlice(lookup(m, rest))...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func asSlice(value interface{}) []interface{} {
+	if values, ok := value.([]interface{}); ok {
+		return values
+	}
+	if value == nil {
+		return nil
+	}
+	return []interface{}{value}
+}
+
+func compareValue(actual interface{}, op string, expected interface{}) bool {
+	switch a := actual.(type) {
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return false
+		}
+		if at, err := time.Parse(time.RFC3339, a); err == nil {
+			if et, err := time.Parse(time.RFC3339, e); err == nil {
+				return compareOrdered(at.Compare(et), op)
+			}
+		}
+		a, e = strings.ToLower(a), strings.ToLower(e)
+		switch op {
+		case OpCo:
+			return strings.Contains(a, e)
+		case OpSw:
+			return strings.HasPrefix(a, e)
+		case OpEw:
+			return strings.HasSuffix(a, e)
+		}
+		return compareOrdered(strings.Compare(a, e), op)
+	case bool:
+		e, ok := expected.(bool)
+		return ok && op == OpEq && a == e
+	case float64:
+		e, ok := expected.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case a < e:
+			return compareOrdered(-1, op)
+		case a > e:
+			return compareOrdered(1, op)
+		}
+		return compareOrdered(0, op)
+	case nil:
+		return expected == nil && op == OpEq
+	}
+	return false
+}
+
+func compareOrdered(cmp int, op string) bool {
+	switch op {
+	case OpEq:
+		return cmp == 0
+	case OpGt:
+		return cmp > 0
+	case OpGe:
+		return cmp >= 0
+	case OpLt:
+		return cmp < 0
+	case OpLe:
+		return cmp <= 0
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package scim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PatchRequest is the body of a PATCH request
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation is a single add, remove or replace operation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Path is a parsed attribute path such as emails[type eq "work"].value
+type Path struct {
+	Attr   string // top-level attribute, lowercased
+	Filter Expr   // selects values of a multi-valued attribute, if set
+	Sub    string // sub-attribute, lowercased, if set
+}
+
+// booleanAttrs are coerced from the strings "True" and "False", which some clients send
+var booleanAttrs = map[string]bool{"active": true, "primary": true}
+
+// ParsePath parses a PATCH operation path
+func ParsePath(path string) (Path, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return Path{}, fmt.Errorf("path is empty")
+	}
+
+	var p Path
+	open := strings.Index(path, "[")
+	if open < 0 {
+		p.Attr, p.Sub, _ = strings.Cut(NormalizeAttr(path), ".")
+		return p, nil
+	}
+
+	close := strings.LastIndex(path, "]")
+	if close < open {
+		return Path{}, fmt.Errorf("unbalanced brackets in path %q", path)
+	}
+	filter, err := ParseFilter(path[open+1 : close])
+	if err != nil {
+		return Path{}, err
+	}
+	p.Attr = NormalizeAttr(path[:open])
+	p.Filter = filter
+
+	rest := path[close+1:]
+	if rest != "" {
+		if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+			return Path{}, fmt.Errorf("invalid sub-attribute in path %q", path)
+		}
+		p.Sub = strings.ToLower(rest[1:])
+	}
+	return p, nil
+}
+
+// ApplyPatch applies the operations, in order, to a resource decoded from JSON.
+// Errors are returned as *Error.
+func ApplyPatch(resource map[string]interface{}, operations []PatchOperation) error {
+	for _, operation := range operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "remove" && op != "replace" {
+			return BadRequest(ErrInvalidSyntax, fmt.Sprintf("unknown patch operation %q", operation.Op))
+		}
+
+		// Without a path the value is an object of attributes to add or replace
+		if operation.Path == "" {
+			if op == "remove" {
+				return BadRequest(ErrNoTarget, "remove operations require a path")
+			}
+			values, ok := operation.Value.(map[string]interface{})
+			if !ok {
+				return BadRequest(ErrInvalidValue, "operations without a path require an object value")
+			}
+			for attr, value := range values {
+				if err := applyOperation(resource, op, attr, value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := applyOperation(resource, op, operation.Path, operation.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyOperation(resource map[string]interface{}, op, rawPath string, value interface{}) error {
+	path, err := ParsePath(rawPath)
+	if err != nil {
+		return BadRequest(ErrInvalidPath, err.Error())
+	}
+	if op != "remove" && value == nil {
+		return BadRequest(ErrInvalidValue, fmt.Sprintf("%s operation on %q requires a value", op, rawPath))
+	}
+	value = coerce(path, value)
+	key := findKey(resource, path.Attr)
+
+	if path.Filter != nil {
+		return applyToMatches(resource, op, key, path, value)
+	}
+
+	if path.Sub != "" {
+		parent, _ := resource[key].(map[string]interface{})
+		if op == "remove" {
+			if parent != nil {
+				delete(parent, findKey(parent, path.Sub))
+			}
+			return nil
+		}
+		if parent == nil {
+			parent = map[string]interface{}{}
+			resource[key] = parent
+		}
+		parent[findKey(parent, path.Sub)] = value
+		return nil
+	}
+
+	switch op {
+	case "remove":
+		// A value on a remove selects the elements to remove, e.g. group members
+		if elements, ok := value.([]interface{}); ok {
+			resource[key] = removeValues(asSlice(resource[key]), elements)
+		} else {
+			delete(resource, key)
+		}
+	case "add":
+		if existing, ok := resource[key].([]interface{}); ok {
+			resource[key] = appendValues(existing, asSlice(value))
+		} else {
+			resource[key] = value
+		}
+	default:
+		resource[key] = value
+	}
+	return nil
+}
+
+// applyToMatches applies an operation to the elements of a multi-valued attribute matched by the path's filter
+func applyToMatches(resource map[string]interface{}, op, key string, path Path, value interface{}) error {
+	elements := asSlice(resource[key])
+	var kept []interface{}
+	matched := false
+	for _, element := range elements {
+		m, ok := element.(map[string]interface{})
+		if !ok || !Matches(path.Filter, m) {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+
+		switch {
+		case op == "remove" && path.Sub == "":
+			continue
+		case op == "remove":
+			delete(m, findKey(m, path.Sub))
+		case path.Sub != "":
+			m[findKey(m, path.Sub)] = value
+		default:
+			replacement, ok := value.(map[string]interface{})
+			if !ok {
+				return BadRequest(ErrInvalidValue, "the value must be an object")
+			}
+			for k, v := range replacement {
+				m[findKey(m, k)] = v
+			}
+		}
+		kept = append(kept, m)
+	}
+
+	if !matched && op != "remove" {
+		return BadRequest(ErrNoTarget, fmt.Sprintf("no values of %q match the filter", path.Attr))
+	}
+	if kept == nil {
+		kept = []interface{}{}
+	}
+	resource[key] = kept
+	return nil
+}
+
+// appendValues adds values to a multi-valued attribute, skipping values that are already present
+func appendValues(existing, values []interface{}) []interface{} {
+	for _, value := range values {
+		if !containsValue(existing, value) {
+			existing = append(existing, value)
+		}
+	}
+	return existing
+}
+
+// removeValues removes the elements whose "value" matches one of values
+func removeValues(existing, values []interface{}) []interface{} {
+	kept := []interface{}{}
+	for _, element := range existing {
+		if !containsValue(values, element) {
+			kept = append(kept, element)
+		}
+	}
+	return kept
+}
+
+func containsValue(elements []interface{}, value interface{}) bool {
+	for _, element := range elements {
+		if sameValue(element, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameValue compares elements of multi-valued attributes by their "value" sub-attribute
+func sameValue(a, b interface{}) bool {
+	if m, ok := a.(map[string]interface{}); ok {
+		a = lookup(m, "value")
+	}
+	if m, ok := b.(map[string]interface{}); ok {
+		b = lookup(m, "value")
+	}
+	return a != nil && a == b
+}
+
+// findKey returns the key of attr in m, ignoring case, or attr itself if it is not present
+func findKey(m map[string]interface{}, attr string) string {
+	for key := range m {
+		if strings.EqualFold(key, attr) {
+			return key
+		}
+	}
+	return attr
+}
+
+func coerce(path Path, value interface{}) interface{} {
+	attr := path.Attr
+	if path.Sub != "" {
+		attr = path.Sub
+	}
+	if s, ok := value.(string); ok && booleanAttrs[attr] {
+		switch strings.ToLower(s) {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+	}
+	return value
+}
@@ -0,0 +1,160 @@
+package scim
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Schema URNs (RFC 7643 and RFC 7644)
+const (
+	UserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	ListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// ContentType is the media type of SCIM requests and responses
+const ContentType = "application/scim+json"
+
+// Meta holds the resource metadata common to all resources
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+	Version      string    `json:"version,omitempty"`
+}
+
+// MultiValued is an element of a multi-valued attribute such as emails or roles
+type MultiValued struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Reference points to another resource, e.g. a group member or a user's group
+type Reference struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// User is the SCIM representation of a user. Attributes the service does not store, such as name,
+// are accepted and ignored.
+type User struct {
+	Schemas    []string      `json:"schemas"`
+	ID         string        `json:"id,omitempty"`
+	ExternalID string        `json:"externalId,omitempty"`
+	UserName   string        `json:"userName"`
+	Emails     []MultiValued `json:"emails,omitempty"`
+	Active     *bool         `json:"active,omitempty"`
+	Password   string        `json:"password,omitempty"` // write-only, never returned
+	Roles      []MultiValued `json:"roles,omitempty"`
+	Groups     []Reference   `json:"groups,omitempty"` // read-only
+	Meta       *Meta         `json:"meta,omitempty"`
+}
+
+// PrimaryEmail returns the primary email, or the first one if none is marked primary
+func (u *User) PrimaryEmail() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+// Group is the SCIM representation of a group
+type Group struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []Reference `json:"members"`
+	Meta        *Meta       `json:"meta,omitempty"`
+}
+
+// ListResponse is a page of query results
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int64         `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// NewListResponse creates a list response for a page of resources
+func NewListResponse(resources []interface{}, total int64, startIndex int) *ListResponse {
+	if resources == nil {
+		resources = []interface{}{}
+	}
+	return &ListResponse{
+		Schemas:      []string{ListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// scimType values of error responses (RFC 7644 section 3.12)
+const (
+	ErrInvalidFilter = "invalidFilter"
+	ErrInvalidSyntax = "invalidSyntax"
+	ErrInvalidPath   = "invalidPath"
+	ErrInvalidValue  = "invalidValue"
+	ErrNoTarget      = "noTarget"
+	ErrUniqueness    = "uniqueness"
+	ErrMutability    = "mutability"
+)
+
+// Error is a SCIM error response
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+// NewError creates an error response
+func NewError(status int, scimType, detail string) *Error {
+	return &Error{Status: status, ScimType: scimType, Detail: detail}
+}
+
+// NotFound creates a 404 error for a missing resource
+func NotFound(detail string) *Error {
+	return &Error{Status: 404, Detail: detail}
+}
+
+// BadRequest creates a 400 error of the given scimType
+func BadRequest(scimType, detail string) *Error {
+	return &Error{Status: 400, ScimType: scimType, Detail: detail}
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+// MarshalJSON encodes the error with the status as a string, as RFC 7644 requires
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail,omitempty"`
+	}{
+		Schemas:  []string{ErrorSchema},
+		Status:   strconv.Itoa(e.Status),
+		ScimType: e.ScimType,
+		Detail:   e.Detail,
+	})
+}
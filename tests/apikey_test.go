@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fixedAPIKeys is an API key validator backed by a fixed set of keys and their scopes
+type fixedAPIKeys map[string][]string
+
+func (k fixedAPIKeys) ValidateAPIKey(ctx context.Context, key string) (*auth.Claims, error) {
+	scopes, ok := k[key]
+	if !ok {
+		return nil, controllers.ErrInvalidAPIKey
+	}
+	claims := &auth.Claims{Username: "alice", Roles: []string{"user"}, Scope: auth.ScopeAPIKey, KeyScopes: scopes}
+	claims.Subject = "user-1"
+	return claims, nil
+}
+
+func TestAPIKeyFormat(t *testing.T) {
+	key, prefix, err := auth.NewAPIKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(key, "iam_"+prefix+"_"))
+	assert.True(t, auth.IsAPIKey(key))
+
+	parsed, ok := auth.APIKeyPrefix(key)
+	assert.True(t, ok)
+	assert.Equal(t, prefix, parsed)
+
+	hash := auth.HashAPIKey(key)
+	assert.NotContains(t, hash, key)
+	assert.True(t, auth.APIKeyMatches(key, hash))
+	assert.False(t, auth.APIKeyMatches(key+"x", hash))
+
+	other, otherPrefix, _ := auth.NewAPIKey()
+	assert.NotEqual(t, key, other)
+	assert.NotEqual(t, prefix, otherPrefix)
+
+	for _, invalid := range []string{"", "eyJhbGciOiJIUzI1NiJ9.e30.sig", "iam_", "iam_short_secret", "iam_" + prefix} {
+		_, ok := auth.APIKeyPrefix(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	now := time.Now()
+	key := &models.APIKey{}
+	assert.True(t, key.IsActive(now))
+
+	expiresAt := now.Add(time.Hour)
+	key.ExpiresAt = &expiresAt
+	assert.True(t, key.IsActive(now))
+	assert.False(t, key.IsActive(now.Add(2*time.Hour)))
+
+	key.ExpiresAt = nil
+	key.RevokedAt = &now
+	assert.False(t, key.IsActive(now))
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := auth.NewTokenService([]byte("secret"), "test", time.Minute)
+	authenticator := middleware.NewAuthenticator(tokens, activeSessions{"session-1": true}, fixedAPIKeys{
+		"iam_reader": {auth.APIKeyScopeAccountRead},
+		"iam_writer": {auth.APIKeyScopeAccountRead, auth.APIKeyScopeAccountWrite},
+	}, nil)
+
+	r := gin.New()
+	ok := func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"subject": middleware.CurrentClaims(c).Subject}) }
+	account := r.Group("/me", authenticator.RequireAuth(auth.ScopeAPIKey), middleware.RequireAPIKeyScope("account"))
+	account.GET("/sessions", ok)
+	account.DELETE("/sessions", ok)
+	r.POST("/me/api-keys", authenticator.RequireAuth(), ok)
+
+	send := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodGet, "/me/sessions", "iam_reader")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"subject": "user-1"}`, w.Body.String())
+
+	// Writes need the write scope
+	assert.Equal(t, http.StatusForbidden, send(http.MethodDelete, "/me/sessions", "iam_reader").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/me/sessions", "iam_writer").Code)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/me/sessions", "iam_unknown").Code)
+
+	// Keys cannot be used where only sessions are accepted, such as to create more keys
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/me/api-keys", "iam_writer").Code)
+
+	// Session tokens are not limited by key scopes
+	user := &models.User{ID: primitive.NewObjectID(), Username: "alice", Roles: []string{"user"}}
+	token, _, err := tokens.Issue(user, "session-1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/me/sessions", token).Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/me/api-keys", token).Code)
+}
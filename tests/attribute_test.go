@@ -0,0 +1,296 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func testAttributeSchema() *models.AttributeSchema {
+	return &models.AttributeSchema{
+		Tenant: models.DefaultTenant,
+		Attributes: []models.AttributeDefinition{
+			{Name: "department", Type: models.AttributeString, Required: true, Enum: []string{"sales", "engineering"}, InToken: true},
+			{Name: "employee_id", Type: models.AttributeString, Pattern: `^E[0-9]{5}$`, Unique: true},
+			{Name: "cost_center", Type: models.AttributeInteger},
+			{Name: "remote", Type: models.AttributeBoolean, UserEditable: true},
+			{Name: "hired_on", Type: models.AttributeDate},
+		},
+	}
+}
+
+func TestAttributeSchemaCheck(t *testing.T) {
+	assert.NoError(t, testAttributeSchema().Check())
+
+	for _, def := range []models.AttributeDefinition{
+		{Name: "1st", Type: models.AttributeString},
+		{Name: "a.b", Type: models.AttributeString},
+		{Name: "level", Type: "enum"},
+		{Name: "level", Type: models.AttributeNumber, Enum: []string{"1"}},
+		{Name: "code", Type: models.AttributeString, Pattern: "("},
+	} {
+		schema := &models.AttributeSchema{Attributes: []models.AttributeDefinition{def}}
+		assert.ErrorIs(t, schema.Check(), models.ErrInvalidAttribute, def.Name)
+	}
+
+	duplicate := &models.AttributeSchema{Attributes: []models.AttributeDefinition{
+		{Name: "team", Type: models.AttributeString},
+		{Name: "team", Type: models.AttributeString},
+	}}
+	assert.ErrorIs(t, duplicate.Check(), models.ErrInvalidAttribute)
+}
+
+func TestAttributeValidation(t *testing.T) {
+	schema := testAttributeSchema()
+
+	values, err := schema.Validate(map[string]interface{}{
+		"department":  "sales",
+		"employee_id": "E01234",
+		"cost_center": float64(4100), // numbers decode from JSON as float64
+		"remote":      true,
+		"hired_on":    "2021-03-01",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(4100), values["cost_center"])
+		assert.Equal(t, "sales", values["department"])
+	}
+
+	// Empty values count as unset
+	values, err = schema.Validate(map[string]interface{}{"department": "sales", "employee_id": ""})
+	assert.NoError(t, err)
+	assert.NotContains(t, values, "employee_id")
+
+	for name, invalid := range map[string]map[string]interface{}{
+		"missing required": {"remote": true},
+		"unknown":          {"department": "sales", "shoe_size": 44},
+		"not in enum":      {"department": "legal"},
+		"pattern":          {"department": "sales", "employee_id": "12345"},
+		"fraction":         {"department": "sales", "cost_center": 41.5},
+		"wrong type":       {"department": "sales", "remote": "yes"},
+		"date":             {"department": "sales", "hired_on": "03/01/2021"},
+	} {
+		_, err := schema.Validate(invalid)
+		assert.ErrorIs(t, err, models.ErrInvalidAttribute, name)
+	}
+}
+
+func TestAttributeClaims(t *testing.T) {
+	schema := testAttributeSchema()
+	claims := schema.ClaimAttributes(map[string]interface{}{"department": "sales", "employee_id": "E01234"})
+	assert.Equal(t, map[string]interface{}{"department": "sales"}, claims)
+	assert.Nil(t, schema.ClaimAttributes(map[string]interface{}{"employee_id": "E01234"}))
+
+	tokens := auth.NewTokenService([]byte("secret"), "test", time.Minute)
+	user := &models.User{ID: primitive.NewObjectID(), Username: "alice", Roles: []string{"user"}}
+	token, _, err := tokens.Issue(user, "session-1", claims)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	parsed, err := tokens.Parse(token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "sales", parsed.Attributes["department"])
+	}
+}
+
+// attributeIndexSpec returns the stored index with the given name, or nil if there is none
+func attributeIndexSpec(t *testing.T, env *testEnv, name string) *mongo.IndexSpecification {
+	t.Helper()
+	specs, err := env.db.Database.Collection("users").Indexes().ListSpecifications(context.Background())
+	require.NoError(t, err)
+	for _, spec := range specs {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// setEmployeeID stores a user's employee ID without validating it
+func setEmployeeID(t *testing.T, env *testEnv, user *models.User, id string) error {
+	t.Helper()
+	user.Attributes = map[string]interface{}{"employee_id": id}
+	return env.users.Replace(context.Background(), user)
+}
+
+// createTenantUser creates a user of a tenant with an employee ID
+func createTenantUser(t *testing.T, env *testEnv, tenant, username, employeeID string) (*models.User, error) {
+	t.Helper()
+	user := &models.User{Username: username, Email: username + "@example.com", Tenant: tenant, State: models.StateActive, Attributes: map[string]interface{}{"employee_id": employeeID}}
+	return user, env.users.Create(context.Background(), user)
+}
+
+func TestUniqueAttributeIndexReplacesOlderIndex(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	const index = "unique_attribute:default:employee_id"
+
+	// An index of the same name created with other options
+	_, err := env.db.Database.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "attributes.employee_id", Value: 1}},
+		Options: options.Index().SetName(index).SetPartialFilterExpression(bson.M{"attributes.employee_id": bson.M{"$exists": true}}),
+	})
+	require.NoError(t, err)
+
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	bob := env.createUser(t, "bob", "Correct-Horse-42")
+	require.NoError(t, setEmployeeID(t, env, alice, "E00001"))
+	require.NoError(t, setEmployeeID(t, env, bob, "E00001"))
+
+	// Shared values are reported without creating the index
+	err = env.users.EnsureAttributeIndex(ctx, models.DefaultTenant, "employee_id")
+	assert.ErrorIs(t, err, repository.ErrAttributeTaken)
+	assert.Nil(t, attributeIndexSpec(t, env, index))
+
+	require.NoError(t, setEmployeeID(t, env, bob, "E00002"))
+	require.NoError(t, env.users.EnsureAttributeIndex(ctx, models.DefaultTenant, "employee_id"))
+	if spec := attributeIndexSpec(t, env, index); assert.NotNil(t, spec) && assert.NotNil(t, spec.Unique) {
+		assert.True(t, *spec.Unique)
+	}
+	require.NoError(t, env.users.EnsureAttributeIndex(ctx, models.DefaultTenant, "employee_id"))
+
+	// Writes that get past the uniqueness query are rejected by the index
+	err = setEmployeeID(t, env, bob, "E00001")
+	assert.ErrorIs(t, err, controllers.ErrAttributeTaken)
+	assert.ErrorContains(t, err, "employee_id")
+
+	carol := &models.User{Username: "carol", Email: "carol@example.com", State: models.StateActive, Attributes: map[string]interface{}{"employee_id": "E00001"}}
+	assert.ErrorIs(t, env.users.Create(ctx, carol), controllers.ErrAttributeTaken)
+}
+
+func TestUniqueAttributesAreScopedToTheirTenant(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	attributes := controllers.NewAttributeController(env.attributes, env.users, env.auditLog)
+	ctx := context.Background()
+	unique := []models.AttributeDefinition{{Name: "employee_id", Type: models.AttributeString, Unique: true}}
+
+	_, err := attributes.SaveSchema(ctx, "acme", unique)
+	require.NoError(t, err)
+	_, err = createTenantUser(t, env, "acme", "alice", "E00001")
+	require.NoError(t, err)
+
+	// Another tenant that never declared the attribute unique may share values, with acme and itself
+	_, err = createTenantUser(t, env, "globex", "bob", "E00001")
+	assert.NoError(t, err)
+	_, err = createTenantUser(t, env, "globex", "carol", "E00001")
+	assert.NoError(t, err)
+	_, err = createTenantUser(t, env, "acme", "dave", "E00001")
+	assert.ErrorIs(t, err, controllers.ErrAttributeTaken)
+
+	// Declaring it unique in the default tenant does not affect acme's index
+	_, err = attributes.SaveSchema(ctx, models.DefaultTenant, unique)
+	require.NoError(t, err)
+	_, err = createTenantUser(t, env, "", "erin", "E00001")
+	assert.NoError(t, err)
+	_, err = createTenantUser(t, env, "", "frank", "E00001")
+	assert.ErrorIs(t, err, controllers.ErrAttributeTaken)
+	assert.NotNil(t, attributeIndexSpec(t, env, "unique_attribute:acme:employee_id"))
+
+	// Clearing unique drops acme's index and leaves the default tenant's
+	_, err = attributes.SaveSchema(ctx, "acme", []models.AttributeDefinition{{Name: "employee_id", Type: models.AttributeString}})
+	require.NoError(t, err)
+	assert.Nil(t, attributeIndexSpec(t, env, "unique_attribute:acme:employee_id"))
+	assert.NotNil(t, attributeIndexSpec(t, env, "unique_attribute:default:employee_id"))
+	_, err = createTenantUser(t, env, "acme", "dave", "E00001")
+	assert.NoError(t, err)
+
+	// Removing the attribute drops the default tenant's index
+	_, err = attributes.SaveSchema(ctx, models.DefaultTenant, nil)
+	require.NoError(t, err)
+	assert.Nil(t, attributeIndexSpec(t, env, "unique_attribute:default:employee_id"))
+}
+
+func TestEnsureIndexesDropsSharedAttributeIndexes(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	attributes := controllers.NewAttributeController(env.attributes, env.users, env.auditLog)
+	ctx := context.Background()
+
+	// The index earlier versions shared between all tenants
+	_, err := env.db.Database.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "attributes.employee_id", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"attributes.employee_id": bson.M{"$exists": true}}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, env.attributes.Save(ctx, &models.AttributeSchema{Tenant: "acme", Attributes: []models.AttributeDefinition{{Name: "employee_id", Type: models.AttributeString, Unique: true}}}))
+
+	require.NoError(t, attributes.EnsureIndexes(ctx))
+	assert.Nil(t, attributeIndexSpec(t, env, "tenant_1_attributes.employee_id_1"))
+	assert.NotNil(t, attributeIndexSpec(t, env, "unique_attribute:acme:employee_id"))
+}
+
+func TestSaveSchemaRejectsSharedUniqueValues(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	attributes := controllers.NewAttributeController(env.attributes, env.users, env.auditLog)
+	ctx := context.Background()
+
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	bob := env.createUser(t, "bob", "Correct-Horse-42")
+	require.NoError(t, setEmployeeID(t, env, alice, "E00001"))
+	require.NoError(t, setEmployeeID(t, env, bob, "E00001"))
+
+	definitions := []models.AttributeDefinition{{Name: "employee_id", Type: models.AttributeString, Unique: true}}
+	_, err := attributes.SaveSchema(ctx, models.DefaultTenant, definitions)
+	assert.ErrorIs(t, err, controllers.ErrAttributeTaken)
+
+	require.NoError(t, setEmployeeID(t, env, bob, "E00002"))
+	_, err = attributes.SaveSchema(ctx, models.DefaultTenant, definitions)
+	require.NoError(t, err)
+	assert.NoError(t, attributes.EnsureIndexes(ctx))
+}
+
+func TestCreatingUsersChecksAttributes(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	attributes := controllers.NewAttributeController(env.attributes, env.users, env.auditLog)
+	ctx := context.Background()
+
+	_, err := attributes.SaveSchema(ctx, models.DefaultTenant, testAttributeSchema().Attributes)
+	require.NoError(t, err)
+
+	// Registration carries no attributes, so it cannot set the required department
+	_, err = env.userController.RegisterUser(ctx, "alice", "alice@example.com", "Correct-Horse-42")
+	assert.ErrorIs(t, err, models.ErrInvalidAttribute)
+	_, err = env.users.FindByUsernameOrEmail(ctx, "alice", "")
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+
+	definitions := testAttributeSchema().Attributes
+	definitions[0].Required = false
+	_, err = attributes.SaveSchema(ctx, models.DefaultTenant, definitions)
+	require.NoError(t, err)
+	_, err = env.userController.RegisterUser(ctx, "alice", "alice@example.com", "Correct-Horse-42")
+	assert.NoError(t, err)
+}
+
+func TestSetUserAttributesHandlerErrors(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	r := gin.New()
+	r.PUT("/users/:id/attributes", handlers.SetUserAttributesHandler(env.userController))
+
+	w := sendJSON(r, http.MethodPut, "/users/not-an-id/attributes", `{"attributes": {}}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON(r, http.MethodPut, "/users/"+primitive.NewObjectID().Hex()+"/attributes", `{"attributes": {}}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendJSON(r, http.MethodPut, "/users/"+alice.ID.Hex()+"/attributes", `{"attributes": {"shoe_size": 44}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A schema that cannot be read is a server error, not a missing user
+	_, err := env.db.Database.Collection("attribute_schemas").InsertOne(context.Background(), bson.M{"tenant": models.DefaultTenant, "attributes": "corrupt"})
+	require.NoError(t, err)
+	w = sendJSON(r, http.MethodPut, "/users/"+alice.ID.Hex()+"/attributes", `{"attributes": {}}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
@@ -0,0 +1,212 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"iam_backend/auditchain"
+	models "iam_backend/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// buildChain seals n events the way the audit repository stores them
+func buildChain(t *testing.T, n int) ([]bson.Raw, []string) {
+	docs := make([]bson.Raw, n)
+	hashes := make([]string, n)
+	prev := ""
+	for i := 0; i < n; i++ {
+		event := &models.AuditEvent{
+			ID:         primitive.NewObjectID(),
+			Tenant:     models.DefaultTenant,
+			Sequence:   int64(i + 1),
+			PrevHash:   prev,
+			Action:     "user.roles_updated",
+			Outcome:    models.AuditSuccess,
+			Details:    map[string]interface{}{"a": 1, "b": "two", "c": true},
+			OccurredAt: time.Now(),
+		}
+		data, err := bson.Marshal(event)
+		assert.NoError(t, err)
+		docs[i], hashes[i], err = auditchain.Seal(data)
+		assert.NoError(t, err)
+		prev = hashes[i]
+	}
+	return docs, hashes
+}
+
+func verifyChain(keys auditchain.KeySet, checkpoints []models.AuditCheckpoint, docs []bson.Raw) *auditchain.Report {
+	verifier := auditchain.NewVerifier(models.DefaultTenant, keys, checkpoints)
+	for _, doc := range docs {
+		if !verifier.Next(doc) {
+			break
+		}
+	}
+	return verifier.Finish()
+}
+
+func TestAuditChainDetectsTampering(t *testing.T) {
+	docs, hashes := buildChain(t, 5)
+
+	report := verifyChain(nil, nil, docs)
+	assert.True(t, report.Valid)
+	assert.Equal(t, int64(5), report.Events)
+	assert.Equal(t, hashes[4], report.Head)
+
+	// Edit an event in place, keeping its stored hash
+	var event models.AuditEvent
+	assert.NoError(t, bson.Unmarshal(docs[2], &event))
+	event.Action = "user.reactivated"
+	edited, err := bson.Marshal(event)
+	assert.NoError(t, err)
+	tampered := append(append([]bson.Raw{}, docs[:2]...), edited)
+	tampered = append(tampered, docs[3:]...)
+
+	report = verifyChain(nil, nil, tampered)
+	assert.False(t, report.Valid)
+	assert.Equal(t, int64(3), report.Break.Sequence)
+	assert.Equal(t, int64(2), report.Events)
+
+	// Remove an event from the middle
+	report = verifyChain(nil, nil, append(append([]bson.Raw{}, docs[:1]...), docs[2:]...))
+	assert.False(t, report.Valid)
+	assert.Equal(t, int64(2), report.Break.Sequence)
+}
+
+func TestAuditCheckpoints(t *testing.T) {
+	docs, hashes := buildChain(t, 4)
+
+	signer, err := auditchain.NewSigner(make([]byte, 32))
+	assert.NoError(t, err)
+	keys := auditchain.NewKeySet(signer.PublicKey())
+
+	checkpoint := models.AuditCheckpoint{Tenant: models.DefaultTenant, Sequence: 4, Hash: hashes[3], SignedAt: time.Now()}
+	signer.Sign(&checkpoint)
+
+	report := verifyChain(keys, []models.AuditCheckpoint{checkpoint}, docs)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 1, report.Checkpoints)
+
+	// Dropping the newest events is caught by the checkpoint beyond the end of the chain
+	report = verifyChain(keys, []models.AuditCheckpoint{checkpoint}, docs[:3])
+	assert.False(t, report.Valid)
+	assert.Equal(t, int64(4), report.Break.Sequence)
+
+	// A forged checkpoint does not verify
+	forged := checkpoint
+	forged.Sequence = 3
+	forged.Hash = hashes[2]
+	report = verifyChain(keys, []models.AuditCheckpoint{forged}, docs)
+	assert.False(t, report.Valid)
+	assert.Contains(t, report.Break.Reason, "invalid signature")
+
+	report = verifyChain(auditchain.KeySet{}, []models.AuditCheckpoint{checkpoint}, docs)
+	assert.False(t, report.Valid)
+	assert.Contains(t, report.Break.Reason, "unknown key")
+}
+
+func TestAuditRedactionKeepsHash(t *testing.T) {
+	event := &models.AuditEvent{
+		ID:          primitive.NewObjectID(),
+		Tenant:      models.DefaultTenant,
+		Sequence:    1,
+		Action:      "user.updated",
+		Outcome:     models.AuditSuccess,
+		Changes:     map[string]models.AuditChange{"email": {Before: "alice@example.com", After: "alicia@example.com"}, "roles": {Before: []string{"user"}, After: []string{"admin"}}},
+		Details:     map[string]interface{}{"username": "alice", "source": "ldap"},
+		IP:          "203.0.113.7",
+		UserAgent:   "curl/8.0",
+		OccurredAt:  time.Now(),
+		HashVersion: auditchain.Version,
+	}
+	var err error
+	event.Salt, err = auditchain.NewSalt()
+	assert.NoError(t, err)
+	data, err := bson.Marshal(event)
+	assert.NoError(t, err)
+	doc, hash, err := auditchain.Seal(data)
+	assert.NoError(t, err)
+
+	keys := map[string][]string{"changes": {"email"}, "details": {"username"}, "ip": nil}
+	redacted, changed, err := auditchain.Redact(doc, keys)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NotContains(t, redacted.String(), "alice")
+	assert.NotContains(t, redacted.String(), "203.0.113.7")
+	assert.Contains(t, redacted.String(), "curl/8.0")
+	assert.Contains(t, redacted.String(), "ldap")
+	assert.Contains(t, redacted.String(), "admin")
+	assert.True(t, verifyChain(nil, nil, []bson.Raw{redacted}).Valid)
+
+	again, changed, err := auditchain.Redact(redacted, keys)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, redacted, again)
+
+	// Values that are not redacted are still covered by the hash
+	var stored models.AuditEvent
+	assert.NoError(t, bson.Unmarshal(redacted, &stored))
+	stored.Changes["roles"] = models.AuditChange{Before: []string{"user"}, After: []string{"user"}}
+	stored.Hash = hash
+	edited, err := bson.Marshal(stored)
+	assert.NoError(t, err)
+	assert.False(t, verifyChain(nil, nil, []bson.Raw{edited}).Valid)
+
+	// Events sealed before redaction was supported cannot be redacted
+	legacy, _ := buildChain(t, 1)
+	_, changed, err = auditchain.Redact(legacy[0], map[string][]string{"details": {"b"}})
+	assert.ErrorIs(t, err, auditchain.ErrNotRedactable)
+	assert.False(t, changed)
+	_, _, err = auditchain.Redact(legacy[0], keys)
+	assert.NoError(t, err, "nothing to redact")
+}
+
+func TestAuditRedactionIsSalted(t *testing.T) {
+	seal := func(salt []byte, version int32) bson.Raw {
+		event := &models.AuditEvent{
+			ID:          primitive.NewObjectID(),
+			Tenant:      models.DefaultTenant,
+			Sequence:    1,
+			Action:      "user.updated",
+			Outcome:     models.AuditSuccess,
+			Details:     map[string]interface{}{"email": "alice@example.com"},
+			OccurredAt:  time.Now(),
+			Salt:        salt,
+			HashVersion: version,
+		}
+		data, err := bson.Marshal(event)
+		require.NoError(t, err)
+		doc, _, err := auditchain.Seal(data)
+		require.NoError(t, err)
+		return doc
+	}
+	keys := map[string][]string{"details": {"email"}}
+	digestOf := func(doc bson.Raw) string {
+		redacted, _, _ := auditchain.Redact(doc, keys)
+		return redacted.Lookup("details", "email").StringValue()
+	}
+
+	first, err := auditchain.NewSalt()
+	require.NoError(t, err)
+	second, err := auditchain.NewSalt()
+	require.NoError(t, err)
+
+	// The same value leaves a different digest in every event, so a digest cannot be matched to a guess
+	// without the event's salt, which responses leave out
+	assert.NotEqual(t, digestOf(seal(first, auditchain.Version)), digestOf(seal(second, auditchain.Version)))
+	body, err := json.Marshal(models.AuditEvent{Salt: first})
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "salt")
+
+	// Events sealed without a salt are redacted, but reported as recoverable
+	unsalted := seal(nil, 2)
+	redacted, changed, err := auditchain.Redact(unsalted, keys)
+	assert.ErrorIs(t, err, auditchain.ErrNotRedactable)
+	assert.True(t, changed)
+	assert.NotContains(t, redacted.String(), "alice")
+	assert.True(t, verifyChain(nil, nil, []bson.Raw{redacted}).Valid)
+}
@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"iam_backend/middleware"
+	"iam_backend/reqctx"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestInfo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var info reqctx.Info
+	r := gin.New()
+	r.Use(middleware.RequestInfo())
+	r.GET("/", func(c *gin.Context) {
+		info = reqctx.From(reqctx.WithActor(c.Request.Context(), "admin-1"))
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set(middleware.RequestIDHeader, "req-42")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "req-42", w.Header().Get(middleware.RequestIDHeader))
+	assert.Equal(t, "req-42", info.RequestID)
+	assert.Equal(t, "curl/8.0", info.UserAgent)
+	assert.Equal(t, "admin-1", info.ActorID)
+	assert.NotEmpty(t, info.IP)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Len(t, w.Header().Get(middleware.RequestIDHeader), 32)
+}
@@ -0,0 +1,316 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"iam_backend/events"
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewDeprovisioningJob(t *testing.T) {
+	userID := primitive.NewObjectID()
+	job := models.NewDeprovisioningJob(userID, models.DeprovisionDeactivated, "admin-1")
+
+	assert.Equal(t, userID, job.UserID)
+	assert.Equal(t, models.JobPending, job.Status)
+	assert.Equal(t, job.CreatedAt, job.NextAttemptAt)
+	assert.True(t, job.LockedUntil.IsZero())
+
+	for _, step := range models.DeprovisioningSteps {
+		assert.False(t, job.StepDone(step), step)
+	}
+	job.CompletedSteps = append(job.CompletedSteps, models.StepRevokeSessions)
+	assert.True(t, job.StepDone(models.StepRevokeSessions))
+	assert.False(t, job.StepDone(models.StepRevokeAPIKeys))
+
+	// The event announcing the result is emitted last
+	assert.Equal(t, models.StepEmitEvent, models.DeprovisioningSteps[len(models.DeprovisioningSteps)-1])
+}
+
+func TestDeprovisioningJobJSONOmitsLease(t *testing.T) {
+	job := models.NewDeprovisioningJob(primitive.NewObjectID(), models.DeprovisionDeleted, "")
+
+	body, err := json.Marshal(job)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, string(body), "locked_until")
+		assert.Contains(t, string(body), `"trigger":"deleted"`)
+	}
+}
+
+func TestListDeprovisioningJobsRejectsInvalidIDs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/users/:id/deprovisioning", handlers.ListDeprovisioningJobsHandler(nil))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/users/not-an-id/deprovisioning", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// enqueueDeactivation deactivates a user and enqueues their deprovisioning without running it
+func enqueueDeactivation(t *testing.T, env *testEnv, user *models.User, actorID string) *models.DeprovisioningJob {
+	t.Helper()
+	ctx := context.Background()
+	user.State = models.StateDeactivated
+	require.NoError(t, env.users.Replace(ctx, user))
+	job, err := env.deprovisioner.Enqueue(ctx, user.ID, models.DeprovisionDeactivated, actorID)
+	require.NoError(t, err)
+	return job
+}
+
+// storedJob reads a deprovisioning job back from the database
+func storedJob(t *testing.T, env *testEnv, job *models.DeprovisioningJob) *models.DeprovisioningJob {
+	t.Helper()
+	stored, err := env.deprovisioning.FindByID(context.Background(), job.ID)
+	require.NoError(t, err)
+	return stored
+}
+
+// deprovisionedEvents counts the user.deprovisioned events staged for a user
+func deprovisionedEvents(t *testing.T, env *testEnv, user *models.User) int64 {
+	t.Helper()
+	count, err := env.db.Database.Collection("outbox").CountDocuments(context.Background(), bson.M{"event.type": events.UserDeprovisioned, "event.user_id": user.ID.Hex()})
+	require.NoError(t, err)
+	return count
+}
+
+func TestDeprovisioningRunsOnce(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	session := models.NewSession(alice.ID, "", "", "127.0.0.1", time.Hour)
+	require.NoError(t, env.sessions.Create(ctx, session))
+	group := &models.Group{DisplayName: "Sales", Members: []primitive.ObjectID{alice.ID}}
+	require.NoError(t, env.groups.Create(ctx, group))
+
+	require.NoError(t, env.userController.DeactivateUser(ctx, alice.ID.Hex(), "left"))
+	jobs, err := env.deprovisioner.ListJobs(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	job := &jobs[0]
+	assert.Equal(t, models.JobCompleted, job.Status)
+	assert.ElementsMatch(t, models.DeprovisioningSteps, job.CompletedSteps)
+	assert.Equal(t, int64(1), job.Results[models.StepRevokeSessions])
+	assert.Equal(t, int64(1), job.Results[models.StepGroupMemberships])
+
+	stored, err := env.sessions.FindByID(ctx, session.ID.Hex())
+	require.NoError(t, err)
+	assert.NotNil(t, stored.RevokedAt)
+	suspended, err := env.groups.FindByID(ctx, group.ID)
+	require.NoError(t, err)
+	assert.Empty(t, suspended.Members)
+	assert.Equal(t, []primitive.ObjectID{alice.ID}, suspended.SuspendedMembers)
+
+	// Running a finished job again, directly or by the worker, changes nothing
+	require.NoError(t, env.deprovisioner.Process(ctx, job))
+	processed, err := env.deprovisioner.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, processed)
+	assert.Equal(t, int64(1), deprovisionedEvents(t, env, alice))
+	assert.Equal(t, models.JobCompleted, storedJob(t, env, job).Status)
+}
+
+func TestDeprovisioningResumesAfterFailedStep(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	group := &models.Group{DisplayName: "Sales", Members: []primitive.ObjectID{alice.ID}}
+	require.NoError(t, env.groups.Create(ctx, group))
+	job := enqueueDeactivation(t, env, alice, "")
+
+	env.mongo.failNext("update", "groups", 1)
+	err := env.deprovisioner.Process(ctx, job)
+	assert.ErrorContains(t, err, models.StepGroupMemberships)
+
+	failed := storedJob(t, env, job)
+	assert.Equal(t, models.JobPending, failed.Status)
+	assert.Equal(t, 1, failed.Failures)
+	assert.Equal(t, []string{models.StepRevokeSessions, models.StepRevokeAPIKeys}, failed.CompletedSteps)
+	assert.True(t, failed.NextAttemptAt.After(time.Now()))
+	assert.Zero(t, deprovisionedEvents(t, env, alice))
+
+	// The retry runs only the steps that did not complete
+	require.NoError(t, env.deprovisioner.Process(ctx, failed))
+	done := storedJob(t, env, job)
+	assert.Equal(t, models.JobCompleted, done.Status)
+	assert.Equal(t, models.DeprovisioningSteps, done.CompletedSteps)
+	assert.Equal(t, int64(1), done.Results[models.StepGroupMemberships])
+	assert.Equal(t, int64(1), deprovisionedEvents(t, env, alice))
+}
+
+func TestDeprovisioningIsCancelledByReactivation(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	group := &models.Group{DisplayName: "Sales", Members: []primitive.ObjectID{alice.ID}}
+	require.NoError(t, env.groups.Create(ctx, group))
+	job := enqueueDeactivation(t, env, alice, "")
+
+	env.mongo.failNext("update", "groups", 1)
+	require.Error(t, env.deprovisioner.Process(ctx, job))
+
+	// The user is reactivated while the job waits for its retry; the job stops before its next step
+	alice.State = models.StateActive
+	require.NoError(t, env.users.Replace(ctx, alice))
+	require.NoError(t, env.deprovisioner.Process(ctx, storedJob(t, env, job)))
+
+	cancelled := storedJob(t, env, job)
+	assert.Equal(t, models.JobCancelled, cancelled.Status)
+	assert.False(t, cancelled.StepDone(models.StepGroupMemberships))
+	stored, err := env.groups.FindByID(ctx, group.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []primitive.ObjectID{alice.ID}, stored.Members)
+	assert.Zero(t, deprovisionedEvents(t, env, alice))
+}
+
+func TestDeprovisioningTransfersOrSuspendsServiceAccounts(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	admin := env.createUser(t, "admin", "Correct-Horse-42")
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	bob := env.createUser(t, "bob", "Correct-Horse-42")
+	aliceAccount, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(alice), "alice-sync", "", "", "")
+	require.NoError(t, err)
+	bobAccount, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(bob), "bob-sync", "", "", "")
+	require.NoError(t, err)
+
+	// An administrator deactivating a user takes over their accounts
+	job := enqueueDeactivation(t, env, alice, admin.ID.Hex())
+	require.NoError(t, env.deprovisioner.Process(ctx, job))
+	transferred, err := env.users.FindByID(ctx, aliceAccount.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, admin.ID, transferred.ServiceAccount.OwnerID)
+	assert.True(t, transferred.IsActive())
+	assert.Equal(t, admin.ID.Hex(), storedJob(t, env, job).NewOwnerID)
+	assert.Equal(t, int64(1), storedJob(t, env, job).Results[models.StepServiceAccounts])
+
+	// Without an actor or fallback owner the accounts are suspended
+	job = enqueueDeactivation(t, env, bob, "")
+	require.NoError(t, env.deprovisioner.Process(ctx, job))
+	suspended, err := env.users.FindByID(ctx, bobAccount.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, bob.ID, suspended.ServiceAccount.OwnerID)
+	assert.Equal(t, models.StateSuspended, suspended.State)
+	assert.Zero(t, storedJob(t, env, job).Results[models.StepServiceAccounts])
+}
+
+func TestDeprovisioningWorkerWithoutClaimCannotFinishJob(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	job := enqueueDeactivation(t, env, alice, "")
+
+	// A worker whose lease ran out, and another that claimed the job after it
+	stale := *job
+	now := time.Now()
+	claimed, err := env.deprovisioning.Claim(ctx, &stale, now, now)
+	require.NoError(t, err)
+	require.True(t, claimed)
+	require.NoError(t, env.deprovisioner.Process(ctx, job))
+
+	assert.ErrorIs(t, env.deprovisioning.CompleteStep(ctx, &stale, models.StepEmitEvent, 1), repository.ErrJobNotHeld)
+	assert.ErrorIs(t, env.deprovisioning.MarkCompleted(ctx, &stale, time.Now()), repository.ErrJobNotHeld)
+	assert.ErrorIs(t, env.deprovisioning.MarkCancelled(ctx, &stale, time.Now()), repository.ErrJobNotHeld)
+	assert.Equal(t, models.JobCompleted, storedJob(t, env, job).Status)
+	assert.Equal(t, int64(1), deprovisionedEvents(t, env, alice))
+}
+
+// hookTransactor runs before ahead of its first transaction, standing in for a request made concurrently
+type hookTransactor struct {
+	controllers.Transactor
+	before func()
+}
+
+func (tx *hookTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if before := tx.before; before != nil {
+		tx.before = nil
+		before()
+	}
+	return tx.Transactor.WithTransaction(ctx, fn)
+}
+
+// hookedDeprovisioner returns a deprovisioner whose first transaction runs before ahead of it
+func hookedDeprovisioner(env *testEnv, before func()) *controllers.Deprovisioner {
+	tx := &hookTransactor{Transactor: controllers.NoTransactor{}, before: before}
+	return controllers.NewDeprovisioner(env.deprovisioning, env.users, env.sessions, env.apiKeys, env.groups, controllers.NewOutbox(env.outbox), tx, env.auditLog, controllers.DefaultDeprovisionPolicy())
+}
+
+func TestDeprovisioningKeepsConcurrentServiceAccountChanges(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	admin := env.createUser(t, "admin", "Correct-Horse-42")
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	bob := env.createUser(t, "bob", "Correct-Horse-42")
+	sync, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(alice), "alice-sync", "", "", "")
+	require.NoError(t, err)
+	report, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(alice), "alice-report", "", "", "")
+	require.NoError(t, err)
+	job := enqueueDeactivation(t, env, alice, admin.ID.Hex())
+
+	// While the accounts are handed over, one is described and the other given to bob
+	deprovisioner := hookedDeprovisioner(env, func() {
+		described, err := env.users.FindByID(ctx, sync.ID.Hex())
+		require.NoError(t, err)
+		described.ServiceAccount.Description = "Nightly sync"
+		require.NoError(t, env.users.Replace(ctx, described))
+		given, err := env.users.FindByID(ctx, report.ID.Hex())
+		require.NoError(t, err)
+		given.ServiceAccount.OwnerID = bob.ID
+		require.NoError(t, env.users.Replace(ctx, given))
+	})
+	require.NoError(t, deprovisioner.Process(ctx, job))
+
+	stored, err := env.users.FindByID(ctx, sync.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, admin.ID, stored.ServiceAccount.OwnerID)
+	assert.Equal(t, "Nightly sync", stored.ServiceAccount.Description)
+	stored, err = env.users.FindByID(ctx, report.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, bob.ID, stored.ServiceAccount.OwnerID)
+	assert.Equal(t, int64(1), storedJob(t, env, job).Results[models.StepServiceAccounts])
+}
+
+func TestDeprovisioningStopsWhenOwnerIsReactivatedDuringServiceAccounts(t *testing.T) {
+	for _, newOwner := range []bool{true, false} {
+		env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+		ctx := context.Background()
+		admin := env.createUser(t, "admin", "Correct-Horse-42")
+		alice := env.createUser(t, "alice", "Correct-Horse-42")
+		account, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(alice), "alice-sync", "", "", "")
+		require.NoError(t, err)
+		actorID := ""
+		if newOwner {
+			actorID = admin.ID.Hex()
+		}
+		job := enqueueDeactivation(t, env, alice, actorID)
+
+		deprovisioner := hookedDeprovisioner(env, func() {
+			require.NoError(t, env.userController.ReactivateUser(ctx, alice.ID.Hex(), "returned"))
+		})
+		require.NoError(t, deprovisioner.Process(ctx, job))
+
+		// The account is neither transferred nor suspended
+		stored, err := env.users.FindByID(ctx, account.ID.Hex())
+		require.NoError(t, err)
+		assert.Equal(t, alice.ID, stored.ServiceAccount.OwnerID)
+		assert.True(t, stored.IsActive())
+		assert.Equal(t, models.JobCancelled, storedJob(t, env, job).Status)
+		assert.Zero(t, deprovisionedEvents(t, env, alice))
+	}
+}
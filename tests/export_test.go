@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"iam_backend/handlers"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportRejectsInvalidParameters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/exports/users", handlers.ExportUsersHandler(nil))
+	r.GET("/exports/audit-events", handlers.ExportAuditEventsHandler(nil))
+
+	for _, path := range []string{
+		"/exports/users?format=xml",
+		"/exports/users?cursor=not-an-id",
+		"/exports/users?active=maybe",
+		"/exports/audit-events?from=yesterday",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
+
+func TestListUsersRejectsInvalidParameters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/users", handlers.ListUsersHandler(nil))
+
+	for _, path := range []string{
+		"/users?sort=password_hash",
+		"/users?sort=-",
+		"/users?active=maybe",
+		"/users?limit=0",
+		"/users?limit=100000",
+		"/users?created_from=yesterday",
+		"/users?last_login_to=2024-01-01",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
+
+func TestParseUserSort(t *testing.T) {
+	sort, err := repository.ParseUserSort("-last_login")
+	assert.NoError(t, err)
+	assert.Equal(t, repository.UserSort{Field: "last_login", Descending: true}, sort)
+	assert.Equal(t, "-last_login", sort.String())
+
+	sort, err = repository.ParseUserSort("username")
+	assert.NoError(t, err)
+	assert.False(t, sort.Descending)
+
+	_, err = repository.ParseUserSort("roles")
+	assert.Error(t, err)
+}
@@ -0,0 +1,1715 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	database "iam_backend/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Wire protocol opcodes
+const (
+	fakeOpReply = 1
+	fakeOpQuery = 2004
+	fakeOpMsg   = 2013
+)
+
+// fakeMongo is an in-memory MongoDB server speaking the wire protocol, so tests can run the repositories
+// without a database. It supports the commands, query and update operators and pipeline expressions the
+// repositories use. It runs as a standalone server, so tests pass controllers.NoTransactor, or a
+// fakeTransactor to run the transactional paths.
+type fakeMongo struct {
+	mu          sync.Mutex
+	collections map[string]*fakeCollection // by namespace
+	failures    []*fakeFailure
+}
+
+type fakeCollection struct {
+	docs    []bson.D
+	indexes []fakeIndex
+}
+
+type fakeIndex struct {
+	name    string
+	keys    bson.D
+	unique  bool
+	sparse  bool
+	partial bson.D
+}
+
+// fakeFailure makes commands on a collection fail
+type fakeFailure struct {
+	command    string
+	collection string
+	remaining  int
+}
+
+// testDatabase starts a fake MongoDB server for the test and returns a connection to it
+func testDatabase(t *testing.T) (*database.Database, *fakeMongo) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeMongo{collections: map[string]*fakeCollection{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+
+	db, err := database.NewMongoConnection("mongodb://"+listener.Addr().String()+"/?directConnection=true", "iam_test")
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Disconnect()
+		listener.Close()
+	})
+	return db, fake
+}
+
+// failNext makes the next times commands named command on collection fail
+func (f *fakeMongo) failNext(command, collection string, times int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, &fakeFailure{command: command, collection: collection, remaining: times})
+}
+
+// docs returns copies of the documents of a collection of the test database, in insertion order
+func (f *fakeMongo) docs(collection string) []bson.D {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var docs []bson.D
+	if c, ok := f.collections["iam_test."+collection]; ok {
+		for _, doc := range c.docs {
+			docs = append(docs, fakeClone(doc))
+		}
+	}
+	return docs
+}
+
+// fakeTransactor runs functions as transactions on the fake server: when fn fails, every write made
+// since it started is undone, as aborting a MongoDB transaction would. Writes made outside fn while it
+// runs are undone too, so tests run one transaction at a time.
+type fakeTransactor struct {
+	mongo *fakeMongo
+}
+
+func (tx fakeTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	snapshot := tx.mongo.snapshot()
+	if err := fn(ctx); err != nil {
+		tx.mongo.restore(snapshot)
+		return err
+	}
+	return nil
+}
+
+// snapshot returns copies of the collections
+func (f *fakeMongo) snapshot() map[string]*fakeCollection {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	collections := make(map[string]*fakeCollection, len(f.collections))
+	for ns, c := range f.collections {
+		copied := &fakeCollection{indexes: append([]fakeIndex(nil), c.indexes...)}
+		for _, doc := range c.docs {
+			copied.docs = append(copied.docs, fakeClone(doc))
+		}
+		collections[ns] = copied
+	}
+	return collections
+}
+
+// restore replaces the collections with a snapshot
+func (f *fakeMongo) restore(collections map[string]*fakeCollection) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.collections = collections
+}
+
+func (f *fakeMongo) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int(binary.LittleEndian.Uint32(header[0:4]))
+		requestID := binary.LittleEndian.Uint32(header[4:8])
+		opCode := binary.LittleEndian.Uint32(header[12:16])
+		body := make([]byte, length-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		var reply []byte
+		switch opCode {
+		case fakeOpMsg:
+			reply = f.handleMsg(body, requestID)
+		case fakeOpQuery:
+			reply = f.handleQuery(body, requestID)
+		default:
+			return
+		}
+		if reply == nil {
+			continue
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeMongo) handleMsg(body []byte, requestID uint32) []byte {
+	flags := binary.LittleEndian.Uint32(body[0:4])
+	sections := body[4:]
+	if flags&1 != 0 {
+		sections = sections[:len(sections)-4]
+	}
+
+	var cmd bson.D
+	for len(sections) > 0 {
+		kind := sections[0]
+		size := int(binary.LittleEndian.Uint32(sections[1:5]))
+		switch kind {
+		case 0:
+			var doc bson.D
+			if err := bson.Unmarshal(sections[1:1+size], &doc); err != nil {
+				return nil
+			}
+			cmd = append(doc, cmd...)
+		case 1:
+			section := sections[5 : 1+size]
+			end := bytes.IndexByte(section, 0)
+			identifier := string(section[:end])
+			section = section[end+1:]
+			docs := bson.A{}
+			for len(section) > 0 {
+				docSize := int(binary.LittleEndian.Uint32(section[0:4]))
+				var doc bson.D
+				if err := bson.Unmarshal(section[:docSize], &doc); err != nil {
+					return nil
+				}
+				docs = append(docs, doc)
+				section = section[docSize:]
+			}
+			cmd = append(cmd, bson.E{Key: identifier, Value: docs})
+		}
+		sections = sections[1+size:]
+	}
+	if flags&2 != 0 {
+		// moreToCome: the client expects no reply
+		f.run(cmd)
+		return nil
+	}
+
+	doc, _ := bson.Marshal(f.run(cmd))
+	reply := make([]byte, 16+4+1, 16+4+1+len(doc))
+	reply = append(reply, doc...)
+	fakeHeader(reply, requestID, fakeOpMsg)
+	return reply
+}
+
+func (f *fakeMongo) handleQuery(body []byte, requestID uint32) []byte {
+	rest := body[4:]
+	end := bytes.IndexByte(rest, 0)
+	rest = rest[end+1+8:]
+
+	var cmd bson.D
+	size := int(binary.LittleEndian.Uint32(rest[0:4]))
+	if err := bson.Unmarshal(rest[:size], &cmd); err != nil {
+		return nil
+	}
+	if len(cmd) > 0 && cmd[0].Key == "$query" {
+		cmd = cmd[0].Value.(bson.D)
+	}
+
+	doc, _ := bson.Marshal(f.run(cmd))
+	reply := make([]byte, 16+20, 16+20+len(doc))
+	binary.LittleEndian.PutUint32(reply[32:36], 1)
+	reply = append(reply, doc...)
+	fakeHeader(reply, requestID, fakeOpReply)
+	return reply
+}
+
+func fakeHeader(message []byte, responseTo uint32, opCode uint32) {
+	binary.LittleEndian.PutUint32(message[0:4], uint32(len(message)))
+	binary.LittleEndian.PutUint32(message[8:12], responseTo)
+	binary.LittleEndian.PutUint32(message[12:16], opCode)
+}
+
+func fakeError(code int32, message string) bson.D {
+	return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: message}, {Key: "code", Value: code}}
+}
+
+// run executes a command and returns the reply
+func (f *fakeMongo) run(cmd bson.D) (reply bson.D) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			reply = fakeError(2, fmt.Sprintf("fake server: %v", r))
+		}
+	}()
+	if len(cmd) == 0 {
+		return fakeError(59, "empty command")
+	}
+
+	name := cmd[0].Key
+	collection, _ := cmd[0].Value.(string)
+	dbName, _ := fakeGet(cmd, "$db")
+	ns := fmt.Sprintf("%v.%s", dbName, collection)
+
+	for _, failure := range f.failures {
+		if failure.remaining > 0 && failure.command == name && failure.collection == collection {
+			failure.remaining--
+			return fakeError(8, "injected failure")
+		}
+	}
+
+	ok := bson.E{Key: "ok", Value: 1.0}
+	switch name {
+	case "hello", "isMaster", "ismaster":
+		return bson.D{
+			{Key: "ismaster", Value: true},
+			{Key: "isWritablePrimary", Value: true},
+			{Key: "helloOk", Value: true},
+			{Key: "maxBsonObjectSize", Value: int32(16 * 1024 * 1024)},
+			{Key: "maxMessageSizeBytes", Value: int32(48000000)},
+			{Key: "maxWriteBatchSize", Value: int32(100000)},
+			{Key: "localTime", Value: primitive.NewDateTimeFromTime(time.Now())},
+			{Key: "logicalSessionTimeoutMinutes", Value: int32(30)},
+			{Key: "connectionId", Value: int32(1)},
+			{Key: "minWireVersion", Value: int32(0)},
+			{Key: "maxWireVersion", Value: int32(17)},
+			{Key: "readOnly", Value: false},
+			ok,
+		}
+	case "ping", "endSessions", "drop", "dropDatabase":
+		if name == "drop" {
+			delete(f.collections, ns)
+		}
+		return bson.D{ok}
+	case "buildInfo", "buildinfo":
+		return bson.D{{Key: "version", Value: "6.0.0"}, ok}
+	case "killCursors":
+		return bson.D{{Key: "cursorsKilled", Value: bson.A{}}, ok}
+	}
+
+	c := f.collections[ns]
+	if c == nil {
+		c = &fakeCollection{}
+		f.collections[ns] = c
+	}
+
+	switch name {
+	case "insert":
+		return c.insert(ns, cmd)
+	case "find":
+		docs := c.find(fakeDoc(cmd, "filter"))
+		if spec := fakeDoc(cmd, "sort"); len(spec) > 0 {
+			fakeSort(docs, spec)
+		}
+		docs = fakePage(docs, fakeInt(cmd, "skip"), fakeInt(cmd, "limit"))
+		return fakeCursor(ns, docs)
+	case "count":
+		return bson.D{{Key: "n", Value: int32(len(c.find(fakeDoc(cmd, "query"))))}, ok}
+	case "aggregate":
+		pipeline, _ := fakeGet(cmd, "pipeline")
+		docs, err := c.aggregate(pipeline.(bson.A))
+		if err != nil {
+			return fakeError(2, err.Error())
+		}
+		return fakeCursor(ns, docs)
+	case "distinct":
+		key, _ := fakeGet(cmd, "key")
+		values := bson.A{}
+		for _, doc := range c.find(fakeDoc(cmd, "query")) {
+			for _, value := range fakeFlatten(fakeLookup(doc, key.(string))) {
+				if !fakeContains(values, value) {
+					values = append(values, value)
+				}
+			}
+		}
+		return bson.D{{Key: "values", Value: values}, ok}
+	case "update":
+		return c.update(ns, cmd)
+	case "delete":
+		return c.delete(cmd)
+	case "findAndModify", "findandmodify":
+		return c.findAndModify(ns, cmd)
+	case "createIndexes":
+		return c.createIndexes(ns, cmd)
+	case "dropIndexes":
+		index, _ := fakeGet(cmd, "index")
+		kept := c.indexes[:0]
+		for _, idx := range c.indexes {
+			if index != "*" && idx.name != index {
+				kept = append(kept, idx)
+			}
+		}
+		c.indexes = kept
+		return bson.D{ok}
+	case "listIndexes":
+		specs := []bson.D{{{Key: "v", Value: int32(2)}, {Key: "key", Value: bson.D{{Key: "_id", Value: int32(1)}}}, {Key: "name", Value: "_id_"}}}
+		for _, idx := range c.indexes {
+			spec := bson.D{{Key: "v", Value: int32(2)}, {Key: "key", Value: idx.keys}, {Key: "name", Value: idx.name}}
+			if idx.unique {
+				spec = append(spec, bson.E{Key: "unique", Value: true})
+			}
+			if idx.partial != nil {
+				spec = append(spec, bson.E{Key: "partialFilterExpression", Value: idx.partial})
+			}
+			specs = append(specs, spec)
+		}
+		return fakeCursor(ns, specs)
+	}
+	return fakeError(59, "no such command: "+name)
+}
+
+func fakeCursor(ns string, docs []bson.D) bson.D {
+	batch := bson.A{}
+	for _, doc := range docs {
+		batch = append(batch, doc)
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{{Key: "firstBatch", Value: batch}, {Key: "id", Value: int64(0)}, {Key: "ns", Value: ns}}},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func fakePage(docs []bson.D, skip, limit int64) []bson.D {
+	if skip > 0 {
+		if skip >= int64(len(docs)) {
+			return nil
+		}
+		docs = docs[skip:]
+	}
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < int64(len(docs)) {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+// find returns copies of the documents matching filter
+func (c *fakeCollection) find(filter bson.D) []bson.D {
+	var docs []bson.D
+	for _, doc := range c.docs {
+		if fakeMatch(doc, filter) {
+			docs = append(docs, fakeClone(doc))
+		}
+	}
+	return docs
+}
+
+// matching returns the positions of the documents matching filter, ordered by sort if set
+func (c *fakeCollection) matching(filter, sortSpec bson.D) []int {
+	var positions []int
+	for i, doc := range c.docs {
+		if fakeMatch(doc, filter) {
+			positions = append(positions, i)
+		}
+	}
+	if len(sortSpec) > 0 {
+		sort.SliceStable(positions, func(i, j int) bool {
+			return fakeLess(c.docs[positions[i]], c.docs[positions[j]], sortSpec)
+		})
+	}
+	return positions
+}
+
+func (c *fakeCollection) insert(ns string, cmd bson.D) bson.D {
+	documents, _ := fakeGet(cmd, "documents")
+	ordered := true
+	if value, ok := fakeGet(cmd, "ordered"); ok {
+		ordered = value.(bool)
+	}
+
+	n := 0
+	writeErrors := bson.A{}
+	for i, value := range documents.(bson.A) {
+		doc := fakeWithID(fakeClone(value.(bson.D)))
+		if err := c.checkUnique(ns, doc, -1); err != nil {
+			writeErrors = append(writeErrors, bson.D{{Key: "index", Value: int32(i)}, {Key: "code", Value: int32(11000)}, {Key: "errmsg", Value: err.Error()}})
+			if ordered {
+				break
+			}
+			continue
+		}
+		c.docs = append(c.docs, doc)
+		n++
+	}
+
+	reply := bson.D{{Key: "n", Value: int32(n)}}
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+	}
+	return append(reply, bson.E{Key: "ok", Value: 1.0})
+}
+
+func (c *fakeCollection) update(ns string, cmd bson.D) bson.D {
+	updates, _ := fakeGet(cmd, "updates")
+
+	n, modified := 0, 0
+	upserted := bson.A{}
+	writeErrors := bson.A{}
+	writeError := func(i int, code int32, err error) {
+		writeErrors = append(writeErrors, bson.D{{Key: "index", Value: int32(i)}, {Key: "code", Value: code}, {Key: "errmsg", Value: err.Error()}})
+	}
+
+	for i, value := range updates.(bson.A) {
+		spec := value.(bson.D)
+		query := fakeDoc(spec, "q")
+		change, _ := fakeGet(spec, "u")
+		multi, _ := fakeGet(spec, "multi")
+		upsert, _ := fakeGet(spec, "upsert")
+
+		positions := c.matching(query, nil)
+		if multi != true && len(positions) > 1 {
+			positions = positions[:1]
+		}
+		if len(positions) == 0 && upsert == true {
+			doc, err := fakeUpsert(query, change)
+			if err == nil {
+				err = c.checkUnique(ns, doc, -1)
+			}
+			if err != nil {
+				writeError(i, 11000, err)
+				break
+			}
+			c.docs = append(c.docs, doc)
+			id, _ := fakeGet(doc, "_id")
+			upserted = append(upserted, bson.D{{Key: "index", Value: int32(i)}, {Key: "_id", Value: id}})
+			n++
+			continue
+		}
+
+		for _, position := range positions {
+			doc, err := fakeApplyUpdate(c.docs[position], change, false)
+			if err != nil {
+				writeError(i, 9, err)
+				break
+			}
+			if err := c.checkUnique(ns, doc, position); err != nil {
+				writeError(i, 11000, err)
+				break
+			}
+			n++
+			if !fakeSame(doc, c.docs[position]) {
+				modified++
+				c.docs[position] = doc
+			}
+		}
+	}
+
+	reply := bson.D{{Key: "n", Value: int32(n)}, {Key: "nModified", Value: int32(modified)}}
+	if len(upserted) > 0 {
+		reply = append(reply, bson.E{Key: "upserted", Value: upserted})
+	}
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+	}
+	return append(reply, bson.E{Key: "ok", Value: 1.0})
+}
+
+func (c *fakeCollection) delete(cmd bson.D) bson.D {
+	deletes, _ := fakeGet(cmd, "deletes")
+
+	n := 0
+	for _, value := range deletes.(bson.A) {
+		spec := value.(bson.D)
+		positions := c.matching(fakeDoc(spec, "q"), nil)
+		if fakeInt(spec, "limit") == 1 && len(positions) > 1 {
+			positions = positions[:1]
+		}
+		removed := map[int]bool{}
+		for _, position := range positions {
+			removed[position] = true
+		}
+		kept := c.docs[:0]
+		for i, doc := range c.docs {
+			if !removed[i] {
+				kept = append(kept, doc)
+			}
+		}
+		c.docs = kept
+		n += len(positions)
+	}
+	return bson.D{{Key: "n", Value: int32(n)}, {Key: "ok", Value: 1.0}}
+}
+
+func (c *fakeCollection) findAndModify(ns string, cmd bson.D) bson.D {
+	query := fakeDoc(cmd, "query")
+	change, hasChange := fakeGet(cmd, "update")
+	remove, _ := fakeGet(cmd, "remove")
+	returnNew, _ := fakeGet(cmd, "new")
+	upsert, _ := fakeGet(cmd, "upsert")
+
+	var value interface{}
+	lastError := bson.D{{Key: "n", Value: int32(0)}, {Key: "updatedExisting", Value: false}}
+	positions := c.matching(query, fakeDoc(cmd, "sort"))
+	switch {
+	case len(positions) > 0 && remove == true:
+		position := positions[0]
+		value = c.docs[position]
+		c.docs = append(c.docs[:position:position], c.docs[position+1:]...)
+		lastError[0].Value = int32(1)
+	case len(positions) > 0 && hasChange:
+		position := positions[0]
+		doc, err := fakeApplyUpdate(c.docs[position], change, false)
+		if err != nil {
+			return fakeError(9, err.Error())
+		}
+		if err := c.checkUnique(ns, doc, position); err != nil {
+			return fakeError(11000, err.Error())
+		}
+		value = c.docs[position]
+		if returnNew == true {
+			value = doc
+		}
+		c.docs[position] = doc
+		lastError = bson.D{{Key: "n", Value: int32(1)}, {Key: "updatedExisting", Value: true}}
+	case upsert == true && hasChange:
+		doc, err := fakeUpsert(query, change)
+		if err == nil {
+			err = c.checkUnique(ns, doc, -1)
+		}
+		if err != nil {
+			return fakeError(11000, err.Error())
+		}
+		c.docs = append(c.docs, doc)
+		if returnNew == true {
+			value = doc
+		}
+		id, _ := fakeGet(doc, "_id")
+		lastError = bson.D{{Key: "n", Value: int32(1)}, {Key: "updatedExisting", Value: false}, {Key: "upserted", Value: id}}
+	}
+
+	return bson.D{{Key: "lastErrorObject", Value: lastError}, {Key: "value", Value: value}, {Key: "ok", Value: 1.0}}
+}
+
+func (c *fakeCollection) createIndexes(ns string, cmd bson.D) bson.D {
+	specs, _ := fakeGet(cmd, "indexes")
+	before := len(c.indexes) + 1
+
+	for _, value := range specs.(bson.A) {
+		spec := value.(bson.D)
+		name, _ := fakeGet(spec, "name")
+		unique, _ := fakeGet(spec, "unique")
+		sparse, _ := fakeGet(spec, "sparse")
+		idx := fakeIndex{name: name.(string), keys: fakeDoc(spec, "key"), unique: unique == true, sparse: sparse == true, partial: fakeDoc(spec, "partialFilterExpression")}
+
+		exists := false
+		for _, other := range c.indexes {
+			// Indexes on the same keys may coexist when they cover different documents
+			if other.name != idx.name && (!fakeSame(other.keys, idx.keys) || !fakeSame(other.partial, idx.partial)) {
+				continue
+			}
+			if other.name == idx.name && fakeSame(other.keys, idx.keys) && other.unique == idx.unique && other.sparse == idx.sparse && fakeSame(other.partial, idx.partial) {
+				exists = true
+				break
+			}
+			return fakeError(85, "index already exists with different options: "+other.name)
+		}
+		if exists {
+			continue
+		}
+
+		if idx.unique {
+			seen := map[string]bool{}
+			for _, doc := range c.docs {
+				for key := range idx.keysOf(doc) {
+					if seen[key] {
+						return fakeError(11000, fmt.Sprintf("E11000 duplicate key error collection: %s index: %s", ns, idx.name))
+					}
+					seen[key] = true
+				}
+			}
+		}
+		c.indexes = append(c.indexes, idx)
+	}
+
+	return bson.D{{Key: "numIndexesBefore", Value: int32(before)}, {Key: "numIndexesAfter", Value: int32(len(c.indexes) + 1)}, {Key: "ok", Value: 1.0}}
+}
+
+// checkUnique returns an error if doc, stored at position skip or new, would break a unique index
+func (c *fakeCollection) checkUnique(ns string, doc bson.D, skip int) error {
+	id, _ := fakeGet(doc, "_id")
+	for i, other := range c.docs {
+		otherID, _ := fakeGet(other, "_id")
+		if i != skip && fakeEqual(id, otherID) {
+			return fmt.Errorf("E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", ns, id)
+		}
+	}
+
+	for _, idx := range c.indexes {
+		if !idx.unique {
+			continue
+		}
+		keys := idx.keysOf(doc)
+		for i, other := range c.docs {
+			if i == skip {
+				continue
+			}
+			for key := range idx.keysOf(other) {
+				if keys[key] {
+					return fmt.Errorf("E11000 duplicate key error collection: %s index: %s", ns, idx.name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// keysOf returns the index keys of doc, one per combination of array elements, or nil if doc is not indexed
+func (idx fakeIndex) keysOf(doc bson.D) map[string]bool {
+	if idx.partial != nil && !fakeMatch(doc, idx.partial) {
+		return nil
+	}
+
+	present := false
+	combinations := [][]interface{}{{}}
+	for _, key := range idx.keys {
+		values := fakeLookup(doc, key.Key)
+		if len(values) > 0 {
+			present = true
+		}
+		values = fakeFlatten(values)
+		if len(values) == 0 {
+			values = []interface{}{nil}
+		}
+
+		var next [][]interface{}
+		for _, combination := range combinations {
+			for _, value := range values {
+				next = append(next, append(append([]interface{}{}, combination...), fakeNormalize(value)))
+			}
+		}
+		combinations = next
+	}
+	if idx.sparse && !present {
+		return nil
+	}
+
+	keys := map[string]bool{}
+	for _, combination := range combinations {
+		data, _ := bson.Marshal(bson.D{{Key: "k", Value: bson.A(combination)}})
+		keys[string(data)] = true
+	}
+	return keys
+}
+
+func (c *fakeCollection) aggregate(pipeline bson.A) ([]bson.D, error) {
+	docs := c.find(nil)
+	for _, value := range pipeline {
+		stage := value.(bson.D)[0]
+		switch stage.Key {
+		case "$match":
+			var matched []bson.D
+			for _, doc := range docs {
+				if fakeMatch(doc, stage.Value.(bson.D)) {
+					matched = append(matched, doc)
+				}
+			}
+			docs = matched
+		case "$sort":
+			fakeSort(docs, stage.Value.(bson.D))
+		case "$skip":
+			docs = fakePage(docs, fakeNumber(stage.Value), 0)
+		case "$limit":
+			docs = fakePage(docs, 0, fakeNumber(stage.Value))
+		case "$count":
+			docs = []bson.D{{{Key: stage.Value.(string), Value: int32(len(docs))}}}
+		case "$group":
+			docs = fakeGroup(docs, stage.Value.(bson.D))
+		default:
+			return nil, fmt.Errorf("unsupported stage %s", stage.Key)
+		}
+	}
+	return docs, nil
+}
+
+func fakeGroup(docs []bson.D, spec bson.D) []bson.D {
+	idExpr, _ := fakeGet(spec, "_id")
+	var groups []bson.D
+	positions := map[string]int{}
+	for _, doc := range docs {
+		id := fakeEval(doc, idExpr)
+		data, _ := bson.Marshal(bson.D{{Key: "k", Value: fakeNormalize(id)}})
+		position, ok := positions[string(data)]
+		if !ok {
+			position = len(groups)
+			positions[string(data)] = position
+			group := bson.D{{Key: "_id", Value: id}}
+			for _, field := range spec {
+				if field.Key != "_id" {
+					group = append(group, bson.E{Key: field.Key, Value: nil})
+				}
+			}
+			groups = append(groups, group)
+		}
+
+		group := groups[position]
+		for i := 1; i < len(group); i++ {
+			accumulator := fakeDoc(spec, group[i].Key)[0]
+			value := fakeEval(doc, accumulator.Value)
+			switch accumulator.Key {
+			case "$sum":
+				if group[i].Value == nil {
+					group[i].Value = int32(0)
+				}
+				if _, ok := fakeFloat(value); ok {
+					group[i].Value = fakeArithmetic("$add", group[i].Value, value)
+				}
+			case "$first":
+				if !ok {
+					group[i].Value = value
+				}
+			case "$last":
+				group[i].Value = value
+			case "$max":
+				if group[i].Value == nil || fakeCompare(value, group[i].Value) > 0 {
+					group[i].Value = value
+				}
+			case "$min":
+				if group[i].Value == nil || fakeCompare(value, group[i].Value) < 0 {
+					group[i].Value = value
+				}
+			default:
+				panic("unsupported accumulator " + accumulator.Key)
+			}
+		}
+	}
+	return groups
+}
+
+// fakeMatch reports whether doc matches a query filter
+func fakeMatch(doc bson.D, filter bson.D) bool {
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			matched := 0
+			for _, clause := range e.Value.(bson.A) {
+				if fakeMatch(doc, clause.(bson.D)) {
+					matched++
+				}
+			}
+			clauses := len(e.Value.(bson.A))
+			if (e.Key == "$and" && matched != clauses) || (e.Key == "$or" && matched == 0) || (e.Key == "$nor" && matched > 0) {
+				return false
+			}
+		case "$comment":
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				panic("unsupported query operator " + e.Key)
+			}
+			if !fakeMatchValue(fakeLookup(doc, e.Key), e.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fakeMatchValue reports whether the values found at a path match a condition
+func fakeMatchValue(values []interface{}, condition interface{}) bool {
+	if ops, ok := condition.(bson.D); ok && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+		return fakeMatchOps(values, ops)
+	}
+	if re, ok := condition.(primitive.Regex); ok {
+		return fakeRegexMatch(values, re.Pattern, re.Options)
+	}
+	return fakeEq(values, condition)
+}
+
+func fakeMatchOps(values []interface{}, ops bson.D) bool {
+	for _, op := range ops {
+		var matched bool
+		switch op.Key {
+		case "$eq":
+			matched = fakeEq(values, op.Value)
+		case "$ne":
+			matched = !fakeEq(values, op.Value)
+		case "$gt", "$gte", "$lt", "$lte":
+			matched = fakeCmp(values, op.Key, op.Value)
+		case "$in", "$nin":
+			for _, candidate := range op.Value.(bson.A) {
+				if re, ok := candidate.(primitive.Regex); ok {
+					matched = fakeRegexMatch(values, re.Pattern, re.Options)
+				} else {
+					matched = fakeEq(values, candidate)
+				}
+				if matched {
+					break
+				}
+			}
+			if op.Key == "$nin" {
+				matched = !matched
+			}
+		case "$exists":
+			matched = (len(values) > 0) == fakeTruthy(op.Value)
+		case "$regex":
+			pattern, options := "", ""
+			switch re := op.Value.(type) {
+			case string:
+				pattern = re
+			case primitive.Regex:
+				pattern, options = re.Pattern, re.Options
+			}
+			if extra, ok := fakeGet(ops, "$options"); ok {
+				options += extra.(string)
+			}
+			matched = fakeRegexMatch(values, pattern, options)
+		case "$options":
+			matched = true
+		case "$not":
+			switch not := op.Value.(type) {
+			case primitive.Regex:
+				matched = !fakeRegexMatch(values, not.Pattern, not.Options)
+			case bson.D:
+				matched = !fakeMatchOps(values, not)
+			}
+		case "$elemMatch":
+			query := op.Value.(bson.D)
+			operators := len(query) > 0 && strings.HasPrefix(query[0].Key, "$") && query[0].Key != "$and" && query[0].Key != "$or" && query[0].Key != "$nor"
+			for _, value := range values {
+				array, ok := value.(bson.A)
+				if !ok {
+					continue
+				}
+				for _, element := range array {
+					if operators && fakeMatchOps([]interface{}{element}, query) {
+						matched = true
+					}
+					if doc, ok := element.(bson.D); ok && !operators && fakeMatch(doc, query) {
+						matched = true
+					}
+				}
+			}
+		case "$size":
+			for _, value := range values {
+				if array, ok := value.(bson.A); ok && int64(len(array)) == fakeNumber(op.Value) {
+					matched = true
+				}
+			}
+		case "$all":
+			matched = true
+			for _, candidate := range op.Value.(bson.A) {
+				if !fakeEq(values, candidate) {
+					matched = false
+				}
+			}
+		default:
+			panic("unsupported query operator " + op.Key)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeEq reports whether any value, or any element of an array value, equals want; null matches missing fields
+func fakeEq(values []interface{}, want interface{}) bool {
+	if want == nil && len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if fakeEqual(value, want) {
+			return true
+		}
+		if array, ok := value.(bson.A); ok {
+			for _, element := range array {
+				if fakeEqual(element, want) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// fakeCmp applies a comparison operator, which only matches values of the same type as bound
+func fakeCmp(values []interface{}, op string, bound interface{}) bool {
+	if bound == nil {
+		return (op == "$gte" || op == "$lte") && fakeEq(values, nil)
+	}
+	check := func(value interface{}) bool {
+		if fakeClass(value) != fakeClass(bound) {
+			return false
+		}
+		c := fakeCompare(value, bound)
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		}
+		return c <= 0
+	}
+	for _, value := range values {
+		if check(value) {
+			return true
+		}
+		if array, ok := value.(bson.A); ok {
+			for _, element := range array {
+				if check(element) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func fakeRegexMatch(values []interface{}, pattern, options string) bool {
+	flags := ""
+	for _, option := range options {
+		if strings.ContainsRune("ims", option) {
+			flags += string(option)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re := regexp.MustCompile(pattern)
+	for _, value := range fakeFlatten(values) {
+		if s, ok := value.(string); ok && re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeLookup returns the values at a dotted path, descending into the elements of arrays; missing fields yield none
+func fakeLookup(value interface{}, path string) []interface{} {
+	return fakeLookupParts(value, strings.Split(path, "."))
+}
+
+func fakeLookupParts(value interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case bson.D:
+		child, ok := fakeGet(v, parts[0])
+		if !ok {
+			return nil
+		}
+		return fakeLookupParts(child, parts[1:])
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i < len(v) {
+				return fakeLookupParts(v[i], parts[1:])
+			}
+			return nil
+		}
+		var values []interface{}
+		for _, element := range v {
+			if doc, ok := element.(bson.D); ok {
+				values = append(values, fakeLookupParts(doc, parts)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// fakeFlatten replaces array values by their elements
+func fakeFlatten(values []interface{}) []interface{} {
+	var flat []interface{}
+	for _, value := range values {
+		if array, ok := value.(bson.A); ok {
+			flat = append(flat, array...)
+			continue
+		}
+		flat = append(flat, value)
+	}
+	return flat
+}
+
+func fakeSort(docs []bson.D, spec bson.D) {
+	sort.SliceStable(docs, func(i, j int) bool { return fakeLess(docs[i], docs[j], spec) })
+}
+
+func fakeLess(a, b bson.D, spec bson.D) bool {
+	for _, key := range spec {
+		direction := int(fakeNumber(key.Value))
+		if c := fakeCompare(fakeSortValue(a, key.Key, direction), fakeSortValue(b, key.Key, direction)); c != 0 {
+			return c*direction < 0
+		}
+	}
+	return false
+}
+
+// fakeSortValue is the value a document sorts by: the smallest array element ascending, the largest descending
+func fakeSortValue(doc bson.D, path string, direction int) interface{} {
+	values := fakeFlatten(fakeLookup(doc, path))
+	if len(values) == 0 {
+		return nil
+	}
+	best := values[0]
+	for _, value := range values[1:] {
+		if fakeCompare(value, best)*direction < 0 {
+			best = value
+		}
+	}
+	return best
+}
+
+// fakeClass returns the position of a value's type in MongoDB's comparison order
+func fakeClass(value interface{}) int {
+	switch value.(type) {
+	case primitive.MinKey:
+		return 0
+	case nil, primitive.Undefined, primitive.Null:
+		return 1
+	case int32, int64, float64, int:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.MaxKey:
+		return 13
+	}
+	panic(fmt.Sprintf("unsupported value type %T", value))
+}
+
+// fakeCompare orders two values the way MongoDB does
+func fakeCompare(a, b interface{}) int {
+	ca, cb := fakeClass(a), fakeClass(b)
+	if ca != cb {
+		return fakeSign(float64(ca - cb))
+	}
+
+	switch x := a.(type) {
+	case int32, int64, float64, int:
+		fa, _ := fakeFloat(a)
+		fb, _ := fakeFloat(b)
+		return fakeSign(fa - fb)
+	case string:
+		return strings.Compare(x, b.(string))
+	case bson.D:
+		y := b.(bson.D)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := strings.Compare(x[i].Key, y[i].Key); c != 0 {
+				return c
+			}
+			if c := fakeCompare(x[i].Value, y[i].Value); c != 0 {
+				return c
+			}
+		}
+		return fakeSign(float64(len(x) - len(y)))
+	case bson.A:
+		y := b.(bson.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := fakeCompare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return fakeSign(float64(len(x) - len(y)))
+	case primitive.Binary:
+		return bytes.Compare(x.Data, b.(primitive.Binary).Data)
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case bool:
+		if x == b.(bool) {
+			return 0
+		}
+		if x {
+			return 1
+		}
+		return -1
+	case primitive.DateTime:
+		return fakeSign(float64(x - b.(primitive.DateTime)))
+	case primitive.Timestamp:
+		y := b.(primitive.Timestamp)
+		if x.T != y.T {
+			return fakeSign(float64(x.T) - float64(y.T))
+		}
+		return fakeSign(float64(x.I) - float64(y.I))
+	}
+	return 0
+}
+
+func fakeEqual(a, b interface{}) bool {
+	return fakeClass(a) == fakeClass(b) && fakeCompare(a, b) == 0
+}
+
+func fakeContains(array bson.A, value interface{}) bool {
+	for _, element := range array {
+		if fakeEqual(element, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func fakeSign(x float64) int {
+	switch {
+	case x < 0:
+		return -1
+	case x > 0:
+		return 1
+	}
+	return 0
+}
+
+// fakeApplyUpdate returns a copy of doc changed by an update document, a replacement or a pipeline
+func fakeApplyUpdate(doc bson.D, change interface{}, inserting bool) (bson.D, error) {
+	doc = fakeClone(doc)
+	id, _ := fakeGet(doc, "_id")
+
+	switch u := change.(type) {
+	case bson.A:
+		for _, value := range u {
+			stage := value.(bson.D)[0]
+			switch stage.Key {
+			case "$set", "$addFields":
+				// Every expression of the stage sees the document as it was before the stage
+				before := fakeClone(doc)
+				for _, field := range stage.Value.(bson.D) {
+					doc = fakeSet(doc, fakeParts(field.Key), fakeEval(before, field.Value)).(bson.D)
+				}
+			case "$unset":
+				names := bson.A{stage.Value}
+				if array, ok := stage.Value.(bson.A); ok {
+					names = array
+				}
+				for _, name := range names {
+					doc = fakeUnset(doc, fakeParts(name.(string))).(bson.D)
+				}
+			default:
+				return nil, fmt.Errorf("unsupported update stage %s", stage.Key)
+			}
+		}
+		return doc, nil
+
+	case bson.D:
+		if len(u) == 0 || !strings.HasPrefix(u[0].Key, "$") {
+			replacement := bson.D{{Key: "_id", Value: id}}
+			for _, e := range fakeClone(u) {
+				if e.Key != "_id" {
+					replacement = append(replacement, e)
+				}
+			}
+			return replacement, nil
+		}
+
+		for _, op := range u {
+			for _, field := range op.Value.(bson.D) {
+				parts := fakeParts(field.Key)
+				current, exists := fakeGetPath(doc, parts)
+				switch op.Key {
+				case "$set":
+					doc = fakeSet(doc, parts, field.Value).(bson.D)
+				case "$setOnInsert":
+					if inserting {
+						doc = fakeSet(doc, parts, field.Value).(bson.D)
+					}
+				case "$unset":
+					doc = fakeUnset(doc, parts).(bson.D)
+				case "$inc":
+					if !exists {
+						current = int32(0)
+					}
+					doc = fakeSet(doc, parts, fakeArithmetic("$add", current, field.Value)).(bson.D)
+				case "$min", "$max":
+					c := fakeCompare(field.Value, current)
+					if !exists || (op.Key == "$min" && c < 0) || (op.Key == "$max" && c > 0) {
+						doc = fakeSet(doc, parts, field.Value).(bson.D)
+					}
+				case "$currentDate":
+					doc = fakeSet(doc, parts, primitive.NewDateTimeFromTime(time.Now())).(bson.D)
+				case "$push", "$addToSet":
+					array, _ := current.(bson.A)
+					array = append(bson.A{}, array...)
+					values := bson.A{field.Value}
+					if each, ok := field.Value.(bson.D); ok && len(each) > 0 && each[0].Key == "$each" {
+						values = each[0].Value.(bson.A)
+					}
+					for _, value := range values {
+						if op.Key == "$push" || !fakeContains(array, value) {
+							array = append(array, value)
+						}
+					}
+					doc = fakeSet(doc, parts, array).(bson.D)
+				case "$pull":
+					array, ok := current.(bson.A)
+					if !ok {
+						continue
+					}
+					kept := bson.A{}
+					for _, element := range array {
+						if !fakePullMatch(element, field.Value) {
+							kept = append(kept, element)
+						}
+					}
+					doc = fakeSet(doc, parts, kept).(bson.D)
+				default:
+					return nil, fmt.Errorf("unsupported update operator %s", op.Key)
+				}
+			}
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unsupported update %T", change)
+}
+
+func fakePullMatch(element, condition interface{}) bool {
+	if query, ok := condition.(bson.D); ok && len(query) > 0 {
+		if strings.HasPrefix(query[0].Key, "$") {
+			return fakeMatchOps([]interface{}{element}, query)
+		}
+		doc, ok := element.(bson.D)
+		return ok && fakeMatch(doc, query)
+	}
+	return fakeEqual(element, condition)
+}
+
+// fakeUpsert builds the document inserted by an upsert from the equality conditions of the query
+func fakeUpsert(query bson.D, change interface{}) (bson.D, error) {
+	doc := bson.D{}
+	var add func(query bson.D)
+	add = func(query bson.D) {
+		for _, e := range query {
+			if e.Key == "$and" {
+				for _, clause := range e.Value.(bson.A) {
+					add(clause.(bson.D))
+				}
+				continue
+			}
+			if strings.HasPrefix(e.Key, "$") {
+				continue
+			}
+			value := e.Value
+			if ops, ok := value.(bson.D); ok && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+				eq, ok := fakeGet(ops, "$eq")
+				if !ok {
+					continue
+				}
+				value = eq
+			}
+			doc = fakeSet(doc, fakeParts(e.Key), value).(bson.D)
+		}
+	}
+	add(query)
+
+	id, hasID := fakeGet(doc, "_id")
+	updated, err := fakeApplyUpdate(doc, change, true)
+	if err != nil {
+		return nil, err
+	}
+	if hasID {
+		updated = fakeSet(updated, []string{"_id"}, id).(bson.D)
+	}
+	if current, _ := fakeGet(updated, "_id"); current == nil {
+		updated = fakeUnset(updated, []string{"_id"}).(bson.D)
+	}
+	return fakeWithID(updated), nil
+}
+
+// fakeEval evaluates an aggregation expression against doc
+func fakeEval(doc bson.D, expr interface{}) interface{} {
+	switch e := expr.(type) {
+	case string:
+		if e == "$$NOW" {
+			return primitive.NewDateTimeFromTime(time.Now())
+		}
+		if strings.HasPrefix(e, "$") {
+			value, _ := fakeGetPath(doc, fakeParts(e[1:]))
+			return value
+		}
+		return e
+	case bson.A:
+		values := bson.A{}
+		for _, element := range e {
+			values = append(values, fakeEval(doc, element))
+		}
+		return values
+	case bson.D:
+		if len(e) == 1 && strings.HasPrefix(e[0].Key, "$") {
+			return fakeOperator(doc, e[0].Key, e[0].Value)
+		}
+		out := bson.D{}
+		for _, field := range e {
+			out = append(out, bson.E{Key: field.Key, Value: fakeEval(doc, field.Value)})
+		}
+		return out
+	}
+	return expr
+}
+
+func fakeOperator(doc bson.D, op string, arg interface{}) interface{} {
+	if op == "$literal" {
+		return arg
+	}
+	if op == "$cond" {
+		var condition, then, otherwise interface{}
+		switch a := arg.(type) {
+		case bson.A:
+			condition, then, otherwise = a[0], a[1], a[2]
+		case bson.D:
+			condition, _ = fakeGet(a, "if")
+			then, _ = fakeGet(a, "then")
+			otherwise, _ = fakeGet(a, "else")
+		}
+		if fakeTruthy(fakeEval(doc, condition)) {
+			return fakeEval(doc, then)
+		}
+		return fakeEval(doc, otherwise)
+	}
+
+	args, ok := fakeEval(doc, arg).(bson.A)
+	if !ok {
+		args = bson.A{fakeEval(doc, arg)}
+	}
+	switch op {
+	case "$ifNull":
+		for _, value := range args[:len(args)-1] {
+			if value != nil {
+				return value
+			}
+		}
+		return args[len(args)-1]
+	case "$add", "$subtract", "$multiply", "$divide":
+		result := args[0]
+		for _, value := range args[1:] {
+			result = fakeArithmetic(op, result, value)
+		}
+		return result
+	case "$min", "$max":
+		if len(args) == 1 {
+			if array, ok := args[0].(bson.A); ok {
+				args = array
+			}
+		}
+		var best interface{}
+		for _, value := range args {
+			if value == nil {
+				continue
+			}
+			if best == nil || (op == "$min" && fakeCompare(value, best) < 0) || (op == "$max" && fakeCompare(value, best) > 0) {
+				best = value
+			}
+		}
+		return best
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		c := fakeCompare(args[0], args[1])
+		switch op {
+		case "$eq":
+			return c == 0
+		case "$ne":
+			return c != 0
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		}
+		return c <= 0
+	case "$and", "$or":
+		for _, value := range args {
+			if fakeTruthy(value) != (op == "$and") {
+				return op == "$or"
+			}
+		}
+		return op == "$and"
+	case "$not":
+		return !fakeTruthy(args[0])
+	case "$concat":
+		var result strings.Builder
+		for _, value := range args {
+			part, ok := value.(string)
+			if !ok {
+				return nil
+			}
+			result.WriteString(part)
+		}
+		return result.String()
+	}
+	panic("unsupported expression operator " + op)
+}
+
+// fakeArithmetic applies an arithmetic operator to two numbers, or to dates and milliseconds.
+// Integers stay integers except when divided.
+func fakeArithmetic(op string, a, b interface{}) interface{} {
+	if a == nil || b == nil {
+		return nil
+	}
+	da, aDate := a.(primitive.DateTime)
+	db, bDate := b.(primitive.DateTime)
+	switch {
+	case aDate && bDate && op == "$subtract":
+		return int64(da - db)
+	case aDate:
+		ms, _ := fakeFloat(b)
+		if op == "$subtract" {
+			ms = -ms
+		}
+		return da + primitive.DateTime(ms)
+	case bDate && op == "$add":
+		ms, _ := fakeFloat(a)
+		return db + primitive.DateTime(ms)
+	}
+
+	fa, _ := fakeFloat(a)
+	fb, _ := fakeFloat(b)
+	var result float64
+	switch op {
+	case "$add":
+		result = fa + fb
+	case "$subtract":
+		result = fa - fb
+	case "$multiply":
+		result = fa * fb
+	case "$divide":
+		return fa / fb
+	}
+
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	if aFloat || bFloat {
+		return result
+	}
+	_, a32 := a.(int32)
+	_, b32 := b.(int32)
+	if a32 && b32 && result >= math.MinInt32 && result <= math.MaxInt32 {
+		return int32(result)
+	}
+	return int64(result)
+}
+
+func fakeFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func fakeNumber(value interface{}) int64 {
+	f, _ := fakeFloat(value)
+	return int64(f)
+}
+
+func fakeTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int32, int64, float64, int:
+		f, _ := fakeFloat(v)
+		return f != 0
+	}
+	return true
+}
+
+// fakeNormalize makes numbers of different types that are equal compare equal as index keys
+func fakeNormalize(value interface{}) interface{} {
+	if f, ok := fakeFloat(value); ok {
+		return f
+	}
+	return value
+}
+
+func fakeParts(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// fakeGetPath returns the value at a dotted path without descending into arrays other than by index
+func fakeGetPath(value interface{}, parts []string) (interface{}, bool) {
+	for _, part := range parts {
+		switch v := value.(type) {
+		case bson.D:
+			child, ok := fakeGet(v, part)
+			if !ok {
+				return nil, false
+			}
+			value = child
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// fakeSet returns container with the value at a dotted path set, creating documents along the way
+func fakeSet(container interface{}, parts []string, value interface{}) interface{} {
+	switch c := container.(type) {
+	case bson.A:
+		i, _ := strconv.Atoi(parts[0])
+		for len(c) <= i {
+			c = append(c, nil)
+		}
+		if len(parts) == 1 {
+			c[i] = value
+		} else {
+			c[i] = fakeSet(c[i], parts[1:], value)
+		}
+		return c
+	case bson.D:
+		for i := range c {
+			if c[i].Key == parts[0] {
+				if len(parts) == 1 {
+					c[i].Value = value
+				} else {
+					c[i].Value = fakeSet(c[i].Value, parts[1:], value)
+				}
+				return c
+			}
+		}
+		if len(parts) == 1 {
+			return append(c, bson.E{Key: parts[0], Value: value})
+		}
+		return append(c, bson.E{Key: parts[0], Value: fakeSet(bson.D{}, parts[1:], value)})
+	}
+	return fakeSet(bson.D{}, parts, value)
+}
+
+// fakeUnset returns container without the value at a dotted path
+func fakeUnset(container interface{}, parts []string) interface{} {
+	switch c := container.(type) {
+	case bson.A:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i >= len(c) {
+			return c
+		}
+		if len(parts) == 1 {
+			c[i] = nil
+		} else {
+			c[i] = fakeUnset(c[i], parts[1:])
+		}
+		return c
+	case bson.D:
+		for i := range c {
+			if c[i].Key != parts[0] {
+				continue
+			}
+			if len(parts) == 1 {
+				return append(c[:i:i], c[i+1:]...)
+			}
+			c[i].Value = fakeUnset(c[i].Value, parts[1:])
+			return c
+		}
+	}
+	return container
+}
+
+// fakeWithID returns doc with an _id, generated if missing, as its first field
+func fakeWithID(doc bson.D) bson.D {
+	id, ok := fakeGet(doc, "_id")
+	if !ok {
+		id = primitive.NewObjectID()
+	}
+	out := bson.D{{Key: "_id", Value: id}}
+	for _, e := range doc {
+		if e.Key != "_id" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func fakeGet(doc bson.D, key string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+func fakeDoc(doc bson.D, key string) bson.D {
+	value, _ := fakeGet(doc, key)
+	d, _ := value.(bson.D)
+	return d
+}
+
+func fakeInt(doc bson.D, key string) int64 {
+	value, _ := fakeGet(doc, key)
+	return fakeNumber(value)
+}
+
+func fakeClone(doc bson.D) bson.D {
+	if doc == nil {
+		return nil
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	var clone bson.D
+	if err := bson.Unmarshal(data, &clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
+// fakeSame reports whether two documents are identical, field order and types included
+func fakeSame(a, b bson.D) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	da, _ := bson.Marshal(a)
+	db, _ := bson.Marshal(b)
+	return bytes.Equal(da, db)
+}
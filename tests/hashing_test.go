@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"iam_backend/hashing"
+	models "iam_backend/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fastArgon2id keeps tests quick while exercising the real algorithm
+func fastArgon2id() hashing.Argon2id {
+	return hashing.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+}
+
+// usePasswordHasher makes hasher the password hasher for the rest of the test
+func usePasswordHasher(t *testing.T, hasher *hashing.Hasher) {
+	previous := models.PasswordHasher()
+	models.SetPasswordHasher(hasher)
+	t.Cleanup(func() { models.SetPasswordHasher(previous) })
+}
+
+func TestArgon2idHash(t *testing.T) {
+	scheme := fastArgon2id()
+
+	encoded, err := scheme.Hash("s3cret-pass")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.True(t, scheme.Verify("s3cret-pass", encoded))
+	assert.False(t, scheme.Verify("wrong", encoded))
+	assert.False(t, scheme.NeedsRehash(encoded))
+
+	stronger := scheme
+	stronger.Iterations = 2
+	assert.True(t, stronger.Verify("s3cret-pass", encoded))
+	assert.True(t, stronger.NeedsRehash(encoded))
+}
+
+func TestArgon2idRejectsUnsafeParameters(t *testing.T) {
+	scheme := fastArgon2id()
+	hasher := hashing.NewHasher(scheme)
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	valid := "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + key
+	assert.True(t, hasher.Recognizes(valid))
+
+	for name, params := range map[string]string{
+		"no iterations":   "m=1024,t=0,p=1",
+		"no parallelism":  "m=1024,t=1,p=0",
+		"huge memory":     "m=4294967295,t=1,p=1",
+		"huge iterations": "m=1024,t=4294967295,p=1",
+		"wide":            "m=1024,t=1,p=255",
+		"too little mem":  "m=7,t=1,p=1",
+		"overflow":        "m=1024,t=1,p=256",
+	} {
+		encoded := "$argon2id$v=19$" + params + "$" + salt + "$" + key
+		assert.False(t, hasher.Recognizes(encoded), name)
+		assert.False(t, scheme.Verify("password", encoded), name)
+		assert.True(t, hasher.NeedsRehash(encoded), name)
+
+		_, err := models.NewImportedUser("alice", "alice@example.com", encoded, nil)
+		assert.Error(t, err, name)
+	}
+
+	assert.Error(t, hashing.Argon2id{Memory: 1024, Iterations: 0, Parallelism: 1, SaltLength: 16, KeyLength: 32}.Validate())
+	assert.NoError(t, hashing.DefaultArgon2id().Validate())
+	assert.NoError(t, scheme.Validate())
+}
+
+func TestDjangoPBKDF2RejectsUnboundedIterations(t *testing.T) {
+	scheme := hashing.DjangoPBKDF2{Iterations: 1000}
+	usePasswordHasher(t, hashing.NewHasher(fastArgon2id(), scheme))
+	key := "YIWkt6M1JFXrHg5s0jZjBSc7C2Cz6QvchSJ0h8Y+i7c="
+
+	assert.True(t, scheme.Matches("pbkdf2_sha256$1000$seasalt$"+key))
+	for name, encoded := range map[string]string{
+		"huge":      "pbkdf2_sha256$2147483647$seasalt$" + key,
+		"zero":      "pbkdf2_sha256$0$seasalt$" + key,
+		"negative":  "pbkdf2_sha256$-5$seasalt$" + key,
+		"no salt":   "pbkdf2_sha256$1000$$" + key,
+		"short key": "pbkdf2_sha256$1000$seasalt$c2hvcnQ=",
+		"parts":     "pbkdf2_sha256$1000$seasalt",
+	} {
+		assert.False(t, scheme.Matches(encoded), name)
+		assert.False(t, scheme.Verify("password", encoded), name)
+
+		_, err := models.NewImportedUser("alice", "alice@example.com", encoded, nil)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestHasherUpgradesLegacyHashes(t *testing.T) {
+	bcryptScheme := hashing.Bcrypt{Cost: 4}
+	legacy, err := bcryptScheme.Hash("s3cret-pass")
+	assert.NoError(t, err)
+
+	hasher := hashing.NewHasher(fastArgon2id(), bcryptScheme)
+	assert.True(t, hasher.Verify("s3cret-pass", legacy))
+	assert.True(t, hasher.NeedsRehash(legacy))
+
+	usePasswordHasher(t, hasher)
+	user := &models.User{PasswordHash: legacy}
+	assert.True(t, user.CheckPasswordHash("s3cret-pass"))
+	assert.True(t, user.PasswordNeedsRehash())
+
+	assert.NoError(t, user.HashPassword("s3cret-pass"))
+	assert.True(t, user.CheckPasswordHash("s3cret-pass"))
+	assert.False(t, user.PasswordNeedsRehash())
+}
+
+func TestImportedHashFormats(t *testing.T) {
+	usePasswordHasher(t, hashing.NewHasher(fastArgon2id(), append([]hashing.Scheme{hashing.Bcrypt{Cost: 4}}, hashing.LegacySchemes()...)...))
+
+	auth0, err := hashing.Bcrypt{Cost: 10}.Hash("password")
+	assert.NoError(t, err)
+
+	for name, hash := range map[string]string{
+		"django":   "pbkdf2_sha256$1000$seasalt$YIWkt6M1JFXrHg5s0jZjBSc7C2Cz6QvchSJ0h8Y+i7c=",
+		"sha1":     "sha1$Ab12$A7D99EED60A816344D6B9B617CAE6467E04BD60B",
+		"md5crypt": "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/",
+		"auth0":    auth0,
+	} {
+		user, err := models.NewImportedUser("alice", "alice@example.com", hash, nil)
+		assert.NoError(t, err, name)
+		assert.True(t, user.CheckPasswordHash("password"), name)
+		assert.False(t, user.CheckPasswordHash("Password"), name)
+		assert.True(t, user.PasswordNeedsRehash(), name)
+	}
+
+	_, err = models.NewImportedUser("alice", "alice@example.com", "plaintext", nil)
+	assert.Error(t, err)
+}
+
+func TestPepperRotation(t *testing.T) {
+	oldPepper, err := hashing.NewPepper("k1", map[string][]byte{"k1": []byte("first-secret")})
+	assert.NoError(t, err)
+	hasher := hashing.NewHasher(fastArgon2id())
+	hasher.UsePepper(oldPepper)
+
+	encoded, err := hasher.Hash("s3cret-pass")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$pepper$k1$argon2id$"))
+	assert.True(t, hasher.Verify("s3cret-pass", encoded))
+	assert.False(t, hasher.NeedsRehash(encoded))
+
+	// Without the pepper key the hash alone cannot be verified
+	assert.False(t, hashing.NewHasher(fastArgon2id()).Verify("s3cret-pass", encoded))
+
+	rotated, err := hashing.NewPepper("k2", map[string][]byte{
+		"k1": []byte("first-secret"),
+		"k2": []byte("second-secret"),
+	})
+	assert.NoError(t, err)
+	hasher.UsePepper(rotated)
+	assert.True(t, hasher.Verify("s3cret-pass", encoded))
+	assert.True(t, hasher.NeedsRehash(encoded))
+
+	rehashed, err := hasher.Hash("s3cret-pass")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rehashed, "$pepper$k2$"))
+	assert.False(t, hasher.NeedsRehash(rehashed))
+
+	_, err = hashing.NewPepper("missing", map[string][]byte{"k1": []byte("x")})
+	assert.Error(t, err)
+}
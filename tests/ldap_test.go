@@ -0,0 +1,378 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+
+	"github.com/gin-gonic/gin"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDirectory is an in-process LDAP server that understands simple binds and the search
+// filters the LDAP authenticator sends
+type fakeDirectory struct {
+	listener net.Listener
+	entries  []fakeEntry
+}
+
+type fakeEntry struct {
+	dn         string
+	password   string
+	attributes map[string]string
+}
+
+func newFakeDirectory(t *testing.T, entries ...fakeEntry) *fakeDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{listener: listener, entries: entries}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *fakeDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case 0: // BindRequest
+			name := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := 49 // invalidCredentials
+			if name == "" && password == "" {
+				code = 0
+			}
+			for _, entry := range d.entries {
+				if strings.EqualFold(entry.dn, name) && entry.password == password && password != "" {
+					code = 0
+				}
+			}
+			d.reply(conn, messageID, ldapResult(1, code))
+		case 3: // SearchRequest
+			base := strings.ToLower(op.Children[0].Data.String())
+			scope := op.Children[1].Value.(int64)
+			for _, entry := range d.entries {
+				dn := strings.ToLower(entry.dn)
+				inScope := dn == base
+				if scope != 0 {
+					inScope = inScope || strings.HasSuffix(dn, ","+base)
+				}
+				if inScope && matchesFilter(op.Children[6], entry) {
+					d.reply(conn, messageID, searchEntry(entry))
+				}
+			}
+			d.reply(conn, messageID, ldapResult(5, 0))
+		case 2: // UnbindRequest
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) reply(conn net.Conn, messageID int64, op *ber.Packet) {
+	packet := ber.NewSequence("LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return result
+}
+
+func searchEntry(entry fakeEntry) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "SearchResultEntry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "objectName"))
+	attributes := ber.NewSequence("attributes")
+	for name, value := range entry.attributes {
+		attribute := ber.NewSequence("attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	result.AppendChild(attributes)
+	return result
+}
+
+// matchesFilter evaluates and, or, not, equality and presence filters
+func matchesFilter(filter *ber.Packet, entry fakeEntry) bool {
+	switch filter.Tag {
+	case 0:
+		for _, child := range filter.Children {
+			if !matchesFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		for _, child := range filter.Children {
+			if matchesFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case 2:
+		return !matchesFilter(filter.Children[0], entry)
+	case 3:
+		value, ok := entry.attributes[filter.Children[0].Data.String()]
+		return ok && strings.EqualFold(value, filter.Children[1].Data.String())
+	case 7:
+		attribute := strings.ToLower(filter.Data.String())
+		_, ok := entry.attributes[attribute]
+		return ok || attribute == "objectclass"
+	}
+	return false
+}
+
+var aliceEntry = fakeEntry{
+	dn:         "uid=alice,ou=people,dc=corp,dc=example",
+	password:   "directory-secret",
+	attributes: map[string]string{"uid": "alice", "mail": "alice@corp.example"},
+}
+
+func TestLDAPAuthenticatorWithDNTemplate(t *testing.T) {
+	directory := newFakeDirectory(t, aliceEntry)
+	ldap, err := auth.NewLDAPAuthenticator(auth.LDAPConfig{
+		URL:            directory.URL(),
+		UserDNTemplate: "uid=%s,ou=people,dc=corp,dc=example",
+	})
+	assert.NoError(t, err)
+
+	identity, err := ldap.Authenticate(context.Background(), "alice", nil, "directory-secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &auth.Identity{Username: "alice", Email: "alice@corp.example"}, identity)
+	}
+
+	for _, attempt := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"bob", "directory-secret"}, {"", ""}} {
+		_, err := ldap.Authenticate(context.Background(), attempt[0], nil, attempt[1])
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials, attempt[0])
+	}
+}
+
+func TestLDAPAuthenticatorWithSearch(t *testing.T) {
+	directory := newFakeDirectory(t, aliceEntry, fakeEntry{
+		dn:         "cn=iam,ou=services,dc=corp,dc=example",
+		password:   "service-secret",
+		attributes: map[string]string{"cn": "iam"},
+	})
+	ldap, err := auth.NewLDAPAuthenticator(auth.LDAPConfig{
+		URL:          directory.URL(),
+		BindDN:       "cn=iam,ou=services,dc=corp,dc=example",
+		BindPassword: "service-secret",
+		BaseDN:       "ou=people,dc=corp,dc=example",
+		UserFilter:   "(|(uid=%s)(mail=%s))",
+	})
+	assert.NoError(t, err)
+
+	identity, err := ldap.Authenticate(context.Background(), "alice@corp.example", nil, "directory-secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", identity.Username)
+	}
+
+	_, err = ldap.Authenticate(context.Background(), "alice@corp.example", nil, "wrong")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	// Filter metacharacters in the login are escaped rather than matching every entry
+	_, err = ldap.Authenticate(context.Background(), "*", nil, "directory-secret")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	_, err = auth.NewLDAPAuthenticator(auth.LDAPConfig{URL: directory.URL(), BaseDN: "dc=corp,dc=example"})
+	assert.Error(t, err)
+}
+
+type stubAuthenticator struct{ name string }
+
+func (s stubAuthenticator) Name() string { return s.name }
+
+func (s stubAuthenticator) Authenticate(ctx context.Context, login string, user *models.User, password string) (*auth.Identity, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestAuthenticatorRouter(t *testing.T) {
+	router := auth.NewAuthenticatorRouter(stubAuthenticator{name: auth.SourceLDAP})
+	assert.NoError(t, router.RouteDomain("Corp.Example", auth.SourceLDAP))
+	assert.Error(t, router.RouteDomain("other.example", "radius"))
+	assert.Error(t, router.SetDefault("radius"))
+
+	route := func(login string, user *models.User) string {
+		authenticator, err := router.Route(login, user)
+		if !assert.NoError(t, err, login) {
+			return ""
+		}
+		return authenticator.Name()
+	}
+
+	assert.Equal(t, auth.SourceLDAP, route("alice@CORP.example", nil))
+	assert.Equal(t, auth.SourceLocal, route("bob@example.com", nil))
+	assert.Equal(t, auth.SourceLocal, route("bob", nil))
+
+	// An existing account logs in through its own source, local unless recorded otherwise
+	assert.Equal(t, auth.SourceLocal, route("alice", &models.User{Email: "alice@corp.example"}))
+	assert.Equal(t, auth.SourceLocal, route("alice@corp.example", &models.User{Email: "alice@corp.example"}))
+	assert.Equal(t, auth.SourceLDAP, route("carol", &models.User{Email: "carol@example.com", AuthSource: auth.SourceLDAP}))
+
+	_, err := router.Route("dave", &models.User{AuthSource: "radius"})
+	assert.Error(t, err)
+
+	routes, err := auth.ParseDomainRoutes(" corp.example:ldap, Example.com:local ,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"corp.example": "ldap", "example.com": "local"}, routes)
+	_, err = auth.ParseDomainRoutes("corp.example")
+	assert.Error(t, err)
+}
+
+// directoryStub accepts the password "secret" for any login and reports the fixed identity
+type directoryStub struct{ identity auth.Identity }
+
+func (directoryStub) Name() string { return auth.SourceLDAP }
+
+func (d directoryStub) Authenticate(ctx context.Context, login string, user *models.User, password string) (*auth.Identity, error) {
+	if password != "secret" {
+		return nil, auth.ErrInvalidCredentials
+	}
+	identity := d.identity
+	return &identity, nil
+}
+
+func TestAuthenticateUserRejectsAnotherDirectoryIdentity(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy(), directoryStub{identity: auth.Identity{Username: "mallory", Email: "mallory@corp.example"}})
+	ctx := context.Background()
+	user := env.createUser(t, "alice", "Correct-Horse-42")
+	user.AuthSource = auth.SourceLDAP
+	require.NoError(t, env.users.Update(ctx, user))
+
+	_, err := env.userController.AuthenticateUser(ctx, "alice", "secret")
+	assert.ErrorIs(t, err, controllers.ErrInvalidCredentials)
+
+	env = newTestEnv(t, controllers.DefaultLockoutPolicy(), directoryStub{identity: auth.Identity{Username: "ALICE", Email: "alice@corp.example"}})
+	user = env.createUser(t, "alice", "Correct-Horse-42")
+	user.AuthSource = auth.SourceLDAP
+	require.NoError(t, env.users.Update(ctx, user))
+
+	result, err := env.userController.AuthenticateUser(ctx, "alice", "secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, user.ID, result.User.ID)
+	}
+}
+
+func TestAuthenticateUserThrottlesLoginsWithoutAccount(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	env := newTestEnv(t, policy, directoryStub{identity: auth.Identity{Username: "bob", Email: "bob@corp.example"}})
+	require.NoError(t, env.authRouter.RouteDomain("corp.example", auth.SourceLDAP))
+	ctx := context.Background()
+
+	for i := 0; i < policy.MaxFailedAttempts; i++ {
+		_, err := env.userController.AuthenticateUser(ctx, "bob@corp.example", "guess")
+		assert.ErrorIs(t, err, controllers.ErrInvalidCredentials, "attempt %d", i+1)
+	}
+
+	// The right password is refused too until the lockout of the login name ends
+	var blocked *controllers.LoginBlockedError
+	_, err := env.userController.AuthenticateUser(ctx, "BOB@corp.example", "secret")
+	if assert.ErrorAs(t, err, &blocked) {
+		assert.True(t, blocked.Locked)
+	}
+	count, err := env.users.Count(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestAuthenticateUserReportsLookupFailures(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy(), directoryStub{identity: auth.Identity{Username: "bob", Email: "bob@corp.example"}})
+	require.NoError(t, env.authRouter.RouteDomain("corp.example", auth.SourceLDAP))
+	ctx := context.Background()
+	env.createUser(t, "alice", "Correct-Horse-42")
+
+	// A failed lookup is neither a wrong password nor a login without an account
+	env.mongo.failNext("find", "users", 1)
+	_, err := env.userController.AuthenticateUser(ctx, "alice", "Correct-Horse-42")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, controllers.ErrInvalidCredentials)
+
+	env.mongo.failNext("find", "users", 1)
+	_, err = env.userController.AuthenticateUser(ctx, "bob@corp.example", "secret")
+	assert.Error(t, err)
+	count, err := env.users.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	tokens := auth.NewTokenService([]byte("secret"), "test", time.Minute)
+	r := gin.New()
+	r.POST("/login", handlers.LoginHandler(env.userController, env.sessionCtrl, tokens))
+	env.mongo.failNext("find", "users", 1)
+	w := sendJSON(r, http.MethodPost, "/login", `{"username": "alice", "password": "Correct-Horse-42"}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	w = sendJSON(r, http.MethodPost, "/login", `{"username": "alice", "password": "wrong"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// racingDirectory is a directoryStub that runs during while it checks the password, as a concurrent change would
+type racingDirectory struct {
+	directoryStub
+	during func()
+}
+
+func (d racingDirectory) Authenticate(ctx context.Context, login string, user *models.User, password string) (*auth.Identity, error) {
+	d.during()
+	return d.directoryStub.Authenticate(ctx, login, user, password)
+}
+
+func TestLoginKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	var env *testEnv
+	var alice *models.User
+	directory := racingDirectory{directoryStub: directoryStub{identity: auth.Identity{Username: "alice", Email: "alice@example.com"}}, during: func() {
+		require.NoError(t, env.userController.DeactivateUser(ctx, alice.ID.Hex(), "left"))
+	}}
+	env = newTestEnv(t, controllers.DefaultLockoutPolicy(), directory)
+	alice = env.createUser(t, "alice", "Correct-Horse-42")
+	alice.AuthSource = auth.SourceLDAP
+	require.NoError(t, env.users.Update(ctx, alice))
+
+	// The login read the user before the deactivation; recording it must not make the user active again
+	_, err := env.userController.AuthenticateUser(ctx, "alice", "secret")
+	require.NoError(t, err)
+	stored, err := env.users.FindByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, models.StateDeactivated, stored.State)
+	assert.NotNil(t, stored.LastLogin)
+}
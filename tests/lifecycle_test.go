@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/handlers"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLifecycleTransitions(t *testing.T) {
+	user, err := models.NewUser("alice", "alice@example.com", "Str0ng!Passw0rd")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, user.IsActive())
+	assert.NoError(t, user.CheckActive())
+
+	at := time.Now()
+	assert.NoError(t, user.Transition(models.StateSuspended, "under investigation", at))
+	assert.Equal(t, models.StateSuspended, user.State)
+	assert.Equal(t, "under investigation", user.StateReason)
+	assert.Equal(t, at, *user.StateChangedAt)
+	assert.False(t, user.IsActive())
+
+	err = user.CheckActive()
+	assert.ErrorIs(t, err, models.ErrUserInactive)
+	assert.Contains(t, err.Error(), "suspended")
+
+	// Moving to the current state changes nothing
+	assert.NoError(t, user.Transition(models.StateSuspended, "again", time.Now()))
+	assert.Equal(t, "under investigation", user.StateReason)
+
+	assert.NoError(t, user.Transition(models.StateDeactivated, "left", time.Now()))
+	assert.ErrorIs(t, user.Transition(models.StateLocked, "", time.Now()), models.ErrInvalidTransition)
+	assert.ErrorIs(t, user.Transition(models.StatePendingVerification, "", time.Now()), models.ErrInvalidTransition)
+	assert.ErrorIs(t, user.Transition("archived", "", time.Now()), models.ErrInvalidTransition)
+	assert.Equal(t, models.StateDeactivated, user.State)
+
+	assert.NoError(t, user.Transition(models.StateActive, "rehired", time.Now()))
+	assert.True(t, user.IsActive())
+}
+
+type inactiveUsers map[string]bool
+
+func (u inactiveUsers) ValidateUser(ctx context.Context, userID string) error {
+	if u[userID] {
+		return models.ErrUserInactive
+	}
+	return nil
+}
+
+func TestTokensOfInactiveUsersAreRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := auth.NewTokenService([]byte("secret"), "test", time.Minute)
+	active := &models.User{ID: primitive.NewObjectID(), Username: "alice", Roles: []string{"user"}}
+	suspended := &models.User{ID: primitive.NewObjectID(), Username: "bob", Roles: []string{"user"}}
+
+	authenticator := middleware.NewAuthenticator(tokens, activeSessions{"session-1": true}, nil, inactiveUsers{suspended.ID.Hex(): true})
+	r := gin.New()
+	r.GET("/profile", authenticator.RequireAuth(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	send := func(user *models.User) int {
+		token, _, err := tokens.Issue(user, "session-1", nil)
+		assert.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send(active))
+	assert.Equal(t, http.StatusUnauthorized, send(suspended))
+}
+
+func TestChangeUserStateRejectsUnknownStates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PUT("/users/:id/state", handlers.ChangeUserStateHandler(nil))
+
+	for body, status := range map[string]int{
+		`{"state": "archived", "reason": "cleanup"}`: http.StatusBadRequest,
+		`{"state": "suspended"}`:                     http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/users/64b7f0c2e4b0a1a2b3c4d5e6/state", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Code, body)
+	}
+}
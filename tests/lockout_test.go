@@ -0,0 +1,387 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/events"
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = time.Second
+	policy.MaxDelay = 5 * time.Second
+
+	assert.Equal(t, time.Duration(0), policy.DelayAfter(0))
+	assert.Equal(t, time.Second, policy.DelayAfter(1))
+	assert.Equal(t, 2*time.Second, policy.DelayAfter(2))
+	assert.Equal(t, 4*time.Second, policy.DelayAfter(3))
+	assert.Equal(t, 5*time.Second, policy.DelayAfter(4))
+	assert.Equal(t, 5*time.Second, policy.DelayAfter(50))
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	tokens := auth.NewTokenService([]byte("secret"), "test", time.Minute)
+	user := &models.User{ID: primitive.NewObjectID(), Username: "alice", Roles: []string{"user", "admin"}}
+
+	token, _, err := tokens.Issue(user, "session-1", nil)
+	assert.NoError(t, err)
+
+	claims, err := tokens.Parse(token)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID.Hex(), claims.Subject)
+	assert.Equal(t, "session-1", claims.SessionID())
+	assert.True(t, claims.HasRole("admin"))
+
+	other := auth.NewTokenService([]byte("other"), "test", time.Minute)
+	_, err = other.Parse(token)
+	assert.Error(t, err)
+}
+
+func TestPasswordChangeTokenIsRestricted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := auth.NewTokenService([]byte("secret"), "test", time.Minute)
+	user := &models.User{ID: primitive.NewObjectID(), Username: "alice", Roles: []string{"user"}}
+
+	authenticator := middleware.NewAuthenticator(tokens, activeSessions{"session-1": true}, nil, nil)
+
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/profile", authenticator.RequireAuth(), ok)
+	r.POST("/change-password", authenticator.RequireAuth(auth.ScopePasswordChange), ok)
+
+	send := func(method, path, token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	restricted, _, err := tokens.IssuePasswordChange(user)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "/profile", restricted))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/change-password", restricted))
+
+	full, _, err := tokens.Issue(user, "session-1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/profile", full))
+
+	revoked, _, err := tokens.Issue(user, "session-2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/profile", revoked))
+}
+
+// activeSessions is a session validator backed by a fixed set of active session IDs
+type activeSessions map[string]bool
+
+func (s activeSessions) ValidateSession(ctx context.Context, sessionID, userID string) error {
+	if !s[sessionID] {
+		return controllers.ErrSessionExpired
+	}
+	return nil
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	session := models.NewSession(primitive.NewObjectID(), "curl/8.0", "curl", "127.0.0.1", time.Hour)
+	now := time.Now()
+
+	assert.True(t, session.IsActive(now, 10*time.Minute))
+	assert.False(t, session.IsActive(now.Add(11*time.Minute), 10*time.Minute))
+	assert.False(t, session.IsActive(now.Add(2*time.Hour), 0))
+
+	revokedAt := now
+	session.RevokedAt = &revokedAt
+	assert.False(t, session.IsActive(now, 0))
+}
+
+// newTestLoginGuard returns a login guard backed by a fake database, and the events it publishes
+func newTestLoginGuard(t *testing.T, policy controllers.LockoutPolicy) (*controllers.LoginGuard, *[]events.Event) {
+	db, _ := testDatabase(t)
+	bus := events.NewBus()
+	var mu sync.Mutex
+	published := &[]events.Event{}
+	bus.Subscribe("*", func(ctx context.Context, event events.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		*published = append(*published, event)
+	})
+	return controllers.NewLoginGuard(repository.NewLoginAttemptRepository(db), policy, bus), published
+}
+
+func TestLoginGuardLocksAfterMaxFailures(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	guard, published := newTestLoginGuard(t, policy)
+	ctx := context.Background()
+	user := &models.User{ID: primitive.NewObjectID()}
+
+	for i := 0; i < policy.MaxFailedAttempts; i++ {
+		assert.NoError(t, guard.Begin(ctx, user), "attempt %d", i+1)
+		assert.NoError(t, guard.RecordFailure(ctx, user))
+	}
+
+	var blocked *controllers.LoginBlockedError
+	if assert.ErrorAs(t, guard.Begin(ctx, user), &blocked) {
+		assert.True(t, blocked.Locked)
+		assert.InDelta(t, policy.LockoutDuration.Seconds(), blocked.RetryAfter.Seconds(), 5)
+	}
+	if assert.Len(t, *published, 1) {
+		assert.Equal(t, events.UserLocked, (*published)[0].Type)
+	}
+
+	assert.NoError(t, guard.Unlock(ctx, user.ID, "admin-1"))
+	assert.NoError(t, guard.Begin(ctx, user))
+	assert.Equal(t, events.UserUnlocked, (*published)[len(*published)-1].Type)
+}
+
+func TestLoginGuardThrottlesAfterFailure(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = time.Minute
+	policy.MaxDelay = time.Hour
+	guard, _ := newTestLoginGuard(t, policy)
+	ctx := context.Background()
+	user := &models.User{ID: primitive.NewObjectID()}
+
+	assert.NoError(t, guard.Begin(ctx, user))
+	assert.NoError(t, guard.RecordFailure(ctx, user))
+
+	var blocked *controllers.LoginBlockedError
+	if assert.ErrorAs(t, guard.Begin(ctx, user), &blocked) {
+		assert.False(t, blocked.Locked)
+		assert.InDelta(t, time.Minute.Seconds(), blocked.RetryAfter.Seconds(), 5)
+	}
+}
+
+func TestLoginGuardSuccessClearsAttempts(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	guard, _ := newTestLoginGuard(t, policy)
+	ctx := context.Background()
+	user := &models.User{ID: primitive.NewObjectID()}
+
+	// Each success forgets the failures before it, so alternating never locks the account
+	for i := 0; i < 2*policy.MaxFailedAttempts; i++ {
+		assert.NoError(t, guard.Begin(ctx, user))
+		if i%2 == 0 {
+			assert.NoError(t, guard.RecordFailure(ctx, user))
+		} else {
+			assert.NoError(t, guard.RecordSuccess(ctx, user))
+		}
+	}
+	assert.NoError(t, guard.Begin(ctx, user))
+}
+
+func TestLoginGuardAdmitsAtMostMaxConcurrentAttempts(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	guard, _ := newTestLoginGuard(t, policy)
+	ctx := context.Background()
+	user := &models.User{ID: primitive.NewObjectID()}
+
+	var wg sync.WaitGroup
+	var admitted, blocked int32
+	for i := 0; i < 4*policy.MaxFailedAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := guard.Begin(ctx, user)
+			var blockedErr *controllers.LoginBlockedError
+			switch {
+			case err == nil:
+				atomic.AddInt32(&admitted, 1)
+			case errors.As(err, &blockedErr):
+				atomic.AddInt32(&blocked, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(policy.MaxFailedAttempts), admitted)
+	assert.Equal(t, int32(3*policy.MaxFailedAttempts), blocked)
+
+	// The failures of the admitted attempts lock the account
+	for i := 0; i < policy.MaxFailedAttempts; i++ {
+		assert.NoError(t, guard.RecordFailure(ctx, user))
+	}
+	var blockedErr *controllers.LoginBlockedError
+	if assert.ErrorAs(t, guard.Begin(ctx, user), &blockedErr) {
+		assert.True(t, blockedErr.Locked)
+	}
+}
+
+func TestUnlockUserHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	user := env.createUser(t, "alice", "Correct-horse-1")
+
+	r := gin.New()
+	r.POST("/users/:id/unlock", asUser("admin-1", "admin"), handlers.UnlockUserHandler(env.userController))
+	send := func(id string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/"+id+"/unlock", nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, send("not-an-id"))
+	assert.Equal(t, http.StatusNotFound, send(primitive.NewObjectID().Hex()))
+
+	env.mongo.failNext("find", "users", 1)
+	assert.Equal(t, http.StatusInternalServerError, send(user.ID.Hex()))
+
+	assert.Equal(t, http.StatusOK, send(user.ID.Hex()))
+}
+
+// lockOut fails the user's logins until the lockout policy locks them out
+func lockOut(t *testing.T, env *testEnv, policy controllers.LockoutPolicy, user *models.User) {
+	t.Helper()
+	for i := 0; i < policy.MaxFailedAttempts; i++ {
+		_, err := env.userController.AuthenticateUser(context.Background(), user.Username, "wrong")
+		require.ErrorIs(t, err, controllers.ErrInvalidCredentials)
+	}
+}
+
+// storedState returns the user's stored lifecycle state and its reason
+func storedState(t *testing.T, env *testEnv, user *models.User) (string, string) {
+	t.Helper()
+	stored, err := env.users.FindByID(context.Background(), user.ID.Hex())
+	require.NoError(t, err)
+	return stored.State, stored.StateReason
+}
+
+func TestLockoutOnlyBlocksLogins(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	policy.LockoutDuration = 100 * time.Millisecond
+	env := newTestEnv(t, policy)
+	alice := env.createUser(t, "alice", "Correct-horse-1")
+	ctx := context.Background()
+	_, key, err := env.apiKeyCtrl.CreateKey(ctx, alice.ID.Hex(), "ci", []string{auth.APIKeyScopeAccountRead}, nil)
+	require.NoError(t, err)
+
+	// Failed logins by someone else do not end the sessions and keys the user already has
+	lockOut(t, env, policy, alice)
+	state, _ := storedState(t, env, alice)
+	assert.Equal(t, models.StateActive, state)
+	assert.NoError(t, env.userController.ValidateUser(ctx, alice.ID.Hex()))
+	_, err = env.apiKeyCtrl.ValidateAPIKey(ctx, key)
+	assert.NoError(t, err)
+
+	var blocked *controllers.LoginBlockedError
+	_, err = env.userController.AuthenticateUser(ctx, "alice", "Correct-horse-1")
+	if assert.ErrorAs(t, err, &blocked) {
+		assert.True(t, blocked.Locked)
+	}
+
+	time.Sleep(policy.LockoutDuration)
+	_, err = env.userController.AuthenticateUser(ctx, "alice", "Correct-horse-1")
+	assert.NoError(t, err)
+}
+
+func TestLockoutLeavesOtherStatesAlone(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	env := newTestEnv(t, policy)
+	alice := env.createUser(t, "alice", "Correct-horse-1")
+	ctx := context.Background()
+	require.NoError(t, env.userController.ChangeState(ctx, alice.ID.Hex(), models.StateSuspended, "under investigation"))
+
+	lockOut(t, env, policy, alice)
+	state, reason := storedState(t, env, alice)
+	assert.Equal(t, models.StateSuspended, state)
+	assert.Equal(t, "under investigation", reason)
+
+	// A lock set by an admin does not run out
+	bob := env.createUser(t, "bob", "Correct-horse-1")
+	require.NoError(t, env.userController.ChangeState(ctx, bob.ID.Hex(), models.StateLocked, "compromised"))
+	assert.ErrorIs(t, env.userController.ValidateUser(ctx, bob.ID.Hex()), models.ErrUserInactive)
+}
+
+func TestUnlockingClearsLockout(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	env := newTestEnv(t, policy)
+	alice := env.createUser(t, "alice", "Correct-horse-1")
+	ctx := context.Background()
+
+	lockOut(t, env, policy, alice)
+	require.NoError(t, env.userController.UnlockUser(ctx, alice.ID.Hex(), "admin-1"))
+	_, err := env.userController.AuthenticateUser(ctx, "alice", "Correct-horse-1")
+	assert.NoError(t, err)
+
+	// Reactivating a user an admin locked also clears the lockout of their failed logins
+	lockOut(t, env, policy, alice)
+	require.NoError(t, env.userController.ChangeState(ctx, alice.ID.Hex(), models.StateLocked, "compromised"))
+	require.NoError(t, env.userController.ReactivateUser(ctx, alice.ID.Hex(), "confirmed by phone"))
+	_, err = env.userController.AuthenticateUser(ctx, "alice", "Correct-horse-1")
+	assert.NoError(t, err)
+}
+
+func TestChangingToCurrentStateIsNotRecorded(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	alice := env.createUser(t, "alice", "Correct-horse-1")
+	ctx := context.Background()
+
+	recorded := func() (int, int) {
+		audited, err := env.audit.Find(ctx, repository.AuditFilter{TargetID: alice.ID.Hex()}, 100)
+		require.NoError(t, err)
+		pending, err := env.outbox.FindPending(ctx, time.Now(), 100)
+		require.NoError(t, err)
+		return len(audited), len(pending)
+	}
+
+	require.NoError(t, env.userController.ReactivateUser(ctx, alice.ID.Hex(), "again"))
+	audited, staged := recorded()
+	assert.Zero(t, audited)
+	assert.Zero(t, staged)
+
+	require.NoError(t, env.userController.ChangeState(ctx, alice.ID.Hex(), models.StateSuspended, "under investigation"))
+	require.NoError(t, env.userController.ChangeState(ctx, alice.ID.Hex(), models.StateSuspended, "still"))
+	audited, staged = recorded()
+	assert.Equal(t, 1, audited)
+	assert.Equal(t, 1, staged)
+	_, reason := storedState(t, env, alice)
+	assert.Equal(t, "under investigation", reason)
+}
+
+func TestUnverifiedUsersStayPendingAndCannotSignIn(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-horse-1")
+	alice.State = models.StatePendingVerification
+	require.NoError(t, env.users.Replace(ctx, alice))
+
+	require.NoError(t, env.users.MigrateLifecycleStates(ctx))
+	state, _ := storedState(t, env, alice)
+	assert.Equal(t, models.StatePendingVerification, state)
+
+	_, err := env.userController.AuthenticateUser(ctx, "alice", "Correct-horse-1")
+	assert.ErrorIs(t, err, models.ErrUserInactive)
+	assert.ErrorContains(t, err, "pending verification")
+	assert.ErrorIs(t, env.userController.ValidateUser(ctx, alice.ID.Hex()), models.ErrUserInactive)
+
+	// Verification makes the user active
+	assert.ErrorIs(t, env.userController.ChangeState(ctx, alice.ID.Hex(), models.StateLocked, ""), models.ErrInvalidTransition)
+	require.NoError(t, env.userController.ChangeState(ctx, alice.ID.Hex(), models.StateActive, "verified"))
+	_, err = env.userController.AuthenticateUser(ctx, "alice", "Correct-horse-1")
+	assert.NoError(t, err)
+}
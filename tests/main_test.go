@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -81,3 +82,11 @@ func TestEnvironmentVariables(t *testing.T) {
 		})
 	}
 }
+
+func TestStandaloneServerDoesNotSupportTransactions(t *testing.T) {
+	db, _ := testDatabase(t)
+
+	supported, err := db.SupportsTransactions(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, supported)
+}
@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/events"
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateMyProfileValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PATCH("/me", handlers.UpdateMyProfileHandler(nil))
+
+	for _, body := range []string{
+		`{"email": "not-an-email"}`,
+		`{"username": "ab"}`,
+		`{"username": "` + strings.Repeat("a", 51) + `"}`,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/me", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
+
+// meRouter serves the account routes of the test environment to a user authenticated as claims would be
+func meRouter(env *testEnv, user *models.User, scope string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		claims := &auth.Claims{Roles: user.Roles, Scope: scope}
+		claims.Subject = user.ID.Hex()
+		c.Set(middleware.ClaimsKey, claims)
+	})
+	r.PATCH("/me", handlers.UpdateMyProfileHandler(env.userController))
+	r.POST("/me/email/verify", handlers.VerifyMyEmailHandler(env.userController))
+	return r
+}
+
+// sendJSON sends a JSON request to the router
+func sendJSON(r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUpdateMyProfileNeedsCurrentPassword(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	env := newTestEnv(t, policy)
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	r := meRouter(env, alice, "")
+
+	w := sendJSON(r, http.MethodPatch, "/me", `{"username": "alicia"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = sendJSON(r, http.MethodPatch, "/me", `{"username": "alicia", "password": "wrong"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = sendJSON(r, http.MethodPatch, "/me", `{"username": "alicia", "password": "Correct-Horse-42"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	stored, err := env.users.FindByID(context.Background(), alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alicia", stored.Username)
+}
+
+func TestPasswordConfirmationsAreThrottledLikeLogins(t *testing.T) {
+	policy := controllers.DefaultLockoutPolicy()
+	policy.BaseDelay = 0
+	env := newTestEnv(t, policy)
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	r := meRouter(env, alice, auth.ScopeAPIKey)
+
+	// A stolen key cannot be used to guess the password without limit
+	for i := 0; i < policy.MaxFailedAttempts; i++ {
+		w := sendJSON(r, http.MethodPatch, "/me", `{"username": "alicia", "password": "guess"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "attempt %d", i+1)
+	}
+	w := sendJSON(r, http.MethodPatch, "/me", `{"username": "alicia", "password": "Correct-Horse-42"}`)
+	assert.Equal(t, http.StatusLocked, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// The lockout is the one logins use
+	var blocked *controllers.LoginBlockedError
+	_, err := env.userController.AuthenticateUser(ctx, "alice", "Correct-Horse-42")
+	assert.ErrorAs(t, err, &blocked)
+	err = env.userController.ChangePassword(ctx, alice.ID.Hex(), "Correct-Horse-42", "Another-Horse-43")
+	assert.ErrorAs(t, err, &blocked)
+	err = env.userController.DeactivateOwnAccount(ctx, alice.ID.Hex(), "Correct-Horse-42")
+	assert.ErrorAs(t, err, &blocked)
+	state, _ := storedState(t, env, alice)
+	assert.Equal(t, models.StateActive, state)
+
+	require.NoError(t, env.userController.UnlockUser(ctx, alice.ID.Hex(), "admin-1"))
+	assert.NoError(t, env.userController.ChangePassword(ctx, alice.ID.Hex(), "Correct-Horse-42", "Another-Horse-43"))
+}
+
+func TestUpdateMyProfileKeepsNewEmailPendingUntilVerified(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+
+	// A key cannot change the email, even with the password
+	w := sendJSON(meRouter(env, alice, auth.ScopeAPIKey), http.MethodPatch, "/me", `{"email": "mallory@example.com", "password": "Correct-Horse-42"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	r := meRouter(env, alice, "")
+	w = sendJSON(r, http.MethodPatch, "/me", `{"email": "alice@new.example", "password": "Correct-Horse-42"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	stored, err := env.users.FindByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", stored.Email)
+	if assert.NotNil(t, stored.PendingEmail) {
+		assert.Equal(t, "alice@new.example", stored.PendingEmail.Email)
+	}
+
+	// The token goes out in an event for delivery to the new address
+	messages, err := env.outbox.FindPending(ctx, time.Now(), 100)
+	require.NoError(t, err)
+	var token string
+	for _, message := range messages {
+		if message.Event.Type == events.UserEmailRequested {
+			assert.Equal(t, "alice@new.example", message.Event.Data["email"])
+			token, _ = message.Event.Data["token"].(string)
+		}
+	}
+	require.NotEmpty(t, token)
+	assert.NotContains(t, w.Body.String(), token)
+
+	w = sendJSON(r, http.MethodPost, "/me/email/verify", `{"token": "wrong"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = sendJSON(r, http.MethodPost, "/me/email/verify", `{"token": "`+token+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	stored, err = env.users.FindByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alice@new.example", stored.Email)
+	assert.Nil(t, stored.PendingEmail)
+
+	// Tokens are single use
+	w = sendJSON(r, http.MethodPost, "/me/email/verify", `{"token": "`+token+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUsernamesAndEmailsAreUniqueIgnoringCase(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	env.createUser(t, "bob", "Correct-Horse-42")
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	r := meRouter(env, alice, "")
+
+	for _, body := range []string{
+		`{"username": "BOB", "password": "Correct-Horse-42"}`,
+		`{"username": "Bob@Example.com", "password": "Correct-Horse-42"}`,
+		`{"email": "BOB@example.com", "password": "Correct-Horse-42"}`,
+	} {
+		w := sendJSON(r, http.MethodPatch, "/me", body)
+		assert.Equal(t, http.StatusConflict, w.Code, body)
+	}
+
+	_, err := env.userController.RegisterUser(context.Background(), "carol", "ALICE@example.com", "Correct-Horse-42")
+	assert.ErrorIs(t, err, repository.ErrUserExists)
+}
+
+func TestEmailVerificationEventsOnlyReachNamedSubscribers(t *testing.T) {
+	bus := events.NewBus()
+	var all, named []string
+	bus.Subscribe("*", func(ctx context.Context, event events.Event) { all = append(all, event.Type) })
+	bus.Subscribe(events.UserEmailRequested, func(ctx context.Context, event events.Event) { named = append(named, event.Type) })
+
+	bus.Publish(context.Background(), events.New(events.UserEmailRequested, "user-1", map[string]interface{}{"token": "secret"}))
+	bus.Publish(context.Background(), events.New(events.UserUpdated, "user-1", nil))
+	assert.Equal(t, []string{events.UserUpdated}, all)
+	assert.Equal(t, []string{events.UserEmailRequested}, named)
+}
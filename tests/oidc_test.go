@@ -0,0 +1,352 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	"iam_backend/ratelimit"
+	repository "iam_backend/repo"
+	"iam_backend/router"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockIdP is a minimal OpenID Connect provider issuing codes for a single configured user
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims // extra claims put in every ID token
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	nonce     string
+	challenge string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, codes: map[string]mockAuthorization{}, claims: jwt.MapClaims{
+		"sub":            "user-1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "client" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code := "code-" + query.Get("state")
+		idp.mu.Lock()
+		idp.codes[code] = mockAuthorization{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+		idp.mu.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		idp.mu.Lock()
+		authorization, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if clientID != "client" || secret != "secret" || !ok ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "upstream-access-token",
+			"token_type":   "Bearer",
+			"id_token":     idp.idToken(t, jwt.MapClaims{"nonce": authorization.nonce}),
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// idToken signs an ID token with the IdP's key; overrides replace the default claims
+func (idp *mockIdP) idToken(t *testing.T, overrides jwt.MapClaims) string {
+	return idp.sign(t, idp.key, "k1", overrides)
+}
+
+func (idp *mockIdP) sign(t *testing.T, key *rsa.PrivateKey, kid string, overrides jwt.MapClaims) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": idp.server.URL,
+		"aud": "client",
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+	for name, value := range overrides {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func newTestOIDCProvider(t *testing.T, idp *mockIdP, trustEmail bool) *auth.OIDCProvider {
+	provider, err := auth.NewOIDCProvider(auth.OIDCProviderConfig{
+		Name:         "mock",
+		Issuer:       idp.server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://iam.example.com/api/v1/oidc/mock/callback",
+		TrustEmail:   trustEmail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// authorize follows the redirect to the IdP and returns the code it sends back
+func authorize(t *testing.T, authURL string) (code, state string) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestOIDCProviderAuthorizationCodeFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := newTestOIDCProvider(t, idp, false)
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", "verifier-1")
+	assert.NoError(t, err)
+	code, state := authorize(t, authURL)
+	assert.Equal(t, "state-1", state)
+
+	// The code is bound to the PKCE verifier
+	_, err = provider.Exchange(ctx, code, "another-verifier", "nonce-1")
+	assert.Error(t, err)
+
+	authURL, _ = provider.AuthCodeURL(ctx, "state-2", "nonce-2", "verifier-2")
+	code, _ = authorize(t, authURL)
+	identity, err := provider.Exchange(ctx, code, "verifier-2", "nonce-2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &auth.OIDCIdentity{
+			Provider:      "mock",
+			Subject:       "user-1",
+			Email:         "alice@example.com",
+			EmailVerified: true,
+		}, identity)
+	}
+
+	// Codes are single use
+	_, err = provider.Exchange(ctx, code, "verifier-2", "nonce-2")
+	assert.Error(t, err)
+
+	// The nonce ties the ID token to the sign-in that requested it
+	authURL, _ = provider.AuthCodeURL(ctx, "state-3", "nonce-3", "verifier-3")
+	code, _ = authorize(t, authURL)
+	_, err = provider.Exchange(ctx, code, "verifier-3", "nonce-other")
+	assert.ErrorIs(t, err, auth.ErrInvalidIDToken)
+}
+
+func TestOIDCProviderVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := newTestOIDCProvider(t, idp, false)
+	ctx := context.Background()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]string{
+		"wrong audience":         idp.idToken(t, jwt.MapClaims{"nonce": "n", "aud": "someone-else"}),
+		"wrong issuer":           idp.idToken(t, jwt.MapClaims{"nonce": "n", "iss": "https://evil.example.com"}),
+		"expired":                idp.idToken(t, jwt.MapClaims{"nonce": "n", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"missing subject":        idp.idToken(t, jwt.MapClaims{"nonce": "n", "sub": ""}),
+		"unknown key":            idp.sign(t, otherKey, "k2", jwt.MapClaims{"nonce": "n"}),
+		"forged with key ID":     idp.sign(t, otherKey, "k1", jwt.MapClaims{"nonce": "n"}),
+		"other authorized party": idp.idToken(t, jwt.MapClaims{"nonce": "n", "aud": []string{"client", "other"}, "azp": "other"}),
+	}
+	for name, token := range invalid {
+		_, err := provider.VerifyIDToken(ctx, token, "n")
+		assert.ErrorIs(t, err, auth.ErrInvalidIDToken, name)
+	}
+
+	// Some providers send email_verified as a string
+	identity, err := provider.VerifyIDToken(ctx, idp.idToken(t, jwt.MapClaims{"nonce": "n", "email_verified": "false"}), "n")
+	if assert.NoError(t, err) {
+		assert.False(t, identity.EmailVerified)
+	}
+
+	// Without email_verified the email is only trusted when the connection is configured to
+	delete(idp.claims, "email_verified")
+	token := idp.idToken(t, jwt.MapClaims{"nonce": "n"})
+	identity, err = provider.VerifyIDToken(ctx, token, "n")
+	if assert.NoError(t, err) {
+		assert.False(t, identity.EmailVerified)
+	}
+	identity, err = newTestOIDCProvider(t, idp, true).VerifyIDToken(ctx, token, "n")
+	if assert.NoError(t, err) {
+		assert.True(t, identity.EmailVerified)
+	}
+}
+
+func TestOIDCRoutes(t *testing.T) {
+	idp := newMockIdP(t)
+	r := router.SetupRouter(router.Dependencies{
+		Authenticator: middleware.NewAuthenticator(nil, nil, nil, nil),
+		Limiter:       middleware.NewRateLimiter(ratelimit.NewMemoryStore(), nil),
+		Federation:    controllers.NewFederationController(nil, nil, newTestOIDCProvider(t, idp, false)),
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/api/v1/oidc")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"providers": ["mock"]}`, w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/oidc/unknown/login").Code)
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/oidc/unknown/callback?state=s&code=c").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/oidc/mock/callback").Code)
+
+	w = get("/api/v1/oidc/mock/callback?error=access_denied&error_description=User+cancelled")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "access_denied: User cancelled")
+}
+
+// newTestFederation returns a federation controller for the mock provider over the test environment
+func newTestFederation(t *testing.T, env *testEnv, idp *mockIdP) *controllers.FederationController {
+	loginRepo := repository.NewOIDCLoginRepository(env.db)
+	require.NoError(t, loginRepo.EnsureIndexes(context.Background()))
+	return controllers.NewFederationController(env.userController, loginRepo, newTestOIDCProvider(t, idp, false))
+}
+
+// signIn goes through a sign-in at the mock provider, presenting binding with the callback
+func signIn(t *testing.T, redirectURL, binding string, federation *controllers.FederationController) (*controllers.AuthResult, error) {
+	code, state := authorize(t, redirectURL)
+	return federation.CompleteLogin(context.Background(), "mock", state, binding, code)
+}
+
+func TestFederationChecksBrowserBinding(t *testing.T) {
+	idp := newMockIdP(t)
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	federation := newTestFederation(t, env, idp)
+	ctx := context.Background()
+
+	// A callback started in another browser, e.g. one an attacker sends the victim, is refused
+	redirectURL, _, err := federation.BeginLogin(ctx, "mock")
+	require.NoError(t, err)
+	_, otherBinding, err := federation.BeginLogin(ctx, "mock")
+	require.NoError(t, err)
+	_, err = signIn(t, redirectURL, otherBinding, federation)
+	assert.ErrorIs(t, err, controllers.ErrInvalidOIDCState)
+	_, err = signIn(t, redirectURL, "", federation)
+	assert.ErrorIs(t, err, controllers.ErrInvalidOIDCState)
+
+	redirectURL, binding, err := federation.BeginLogin(ctx, "mock")
+	require.NoError(t, err)
+	result, err := signIn(t, redirectURL, binding, federation)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice@example.com", result.User.Email)
+	}
+}
+
+func TestFederationLinksExistingUsersOnlyWhenSignedIn(t *testing.T) {
+	idp := newMockIdP(t)
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	federation := newTestFederation(t, env, idp)
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	bob := env.createUser(t, "bob", "Correct-Horse-42")
+
+	// The provider vouches for the email, but not that its owner is the local user
+	redirectURL, binding, err := federation.BeginLogin(ctx, "mock")
+	require.NoError(t, err)
+	_, err = signIn(t, redirectURL, binding, federation)
+	assert.ErrorIs(t, err, controllers.ErrLinkRequired)
+	linked, err := env.users.FindByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Empty(t, linked.Identities)
+
+	redirectURL, binding, err = federation.BeginLink(ctx, "mock", alice.ID.Hex())
+	require.NoError(t, err)
+	result, err := signIn(t, redirectURL, binding, federation)
+	if assert.NoError(t, err) {
+		assert.Equal(t, alice.ID, result.User.ID)
+	}
+
+	// Once linked the provider account signs in as the user, and cannot be linked to another
+	redirectURL, binding, err = federation.BeginLogin(ctx, "mock")
+	require.NoError(t, err)
+	result, err = signIn(t, redirectURL, binding, federation)
+	if assert.NoError(t, err) {
+		assert.Equal(t, alice.ID, result.User.ID)
+	}
+
+	redirectURL, binding, err = federation.BeginLink(ctx, "mock", bob.ID.Hex())
+	require.NoError(t, err)
+	_, err = signIn(t, redirectURL, binding, federation)
+	assert.ErrorIs(t, err, controllers.ErrIdentityLinked)
+}
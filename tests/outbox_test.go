@@ -0,0 +1,245 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/events"
+	controllers "iam_backend/jwork"
+	"iam_backend/outbox"
+	repository "iam_backend/repo"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// natsMessage is a message received by fakeNATS
+type natsMessage struct {
+	Subject string
+	Payload []byte
+}
+
+// fakeNATS accepts NATS client connections and records published messages
+func fakeNATS(t *testing.T) (string, <-chan natsMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan natsMessage, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveNATS(conn, messages)
+		}
+	}()
+
+	return "nats://" + listener.Addr().String(), messages
+}
+
+func serveNATS(conn net.Conn, messages chan<- natsMessage) {
+	defer conn.Close()
+	fmt.Fprint(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			messages <- natsMessage{Subject: fields[1], Payload: payload[:size]}
+		}
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	address, messages := fakeNATS(t)
+
+	sink, err := outbox.NewNATSSink(address, "iam", time.Second)
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	for _, eventType := range []string{events.UserRegistered, events.UserDeactivated} {
+		event := events.New(eventType, "user-1", map[string]interface{}{"username": "alice"})
+		assert.NoError(t, sink.Publish(context.Background(), event))
+
+		message := <-messages
+		assert.Equal(t, "iam."+eventType, message.Subject)
+
+		var received events.Event
+		assert.NoError(t, json.Unmarshal(message.Payload, &received))
+		assert.Equal(t, event.ID, received.ID)
+		assert.Equal(t, "alice", received.Data["username"])
+	}
+
+	_, err = outbox.NewNATSSink("http://localhost:4222", "iam", time.Second)
+	assert.Error(t, err)
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	sink, err := outbox.NewFileSink(path)
+	assert.NoError(t, err)
+
+	first := events.New(events.UserRegistered, "user-1", nil)
+	second := events.New(events.UserRolesUpdated, "user-1", nil)
+	assert.NoError(t, sink.Publish(context.Background(), first))
+	assert.NoError(t, sink.Publish(context.Background(), second))
+	assert.NoError(t, sink.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+
+	var received events.Event
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &received))
+	assert.Equal(t, second.ID, received.ID)
+}
+
+// recordingSink records published events and fails those listed in failing
+type recordingSink struct {
+	published []string
+	failing   map[string]bool
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Publish(ctx context.Context, event events.Event) error {
+	if s.failing[event.ID] {
+		return errors.New("sink unavailable")
+	}
+	s.published = append(s.published, event.ID)
+	return nil
+}
+
+// stageEvents stages one event per user ID, in order, and returns their IDs
+func stageEvents(t *testing.T, stage *controllers.Outbox, userIDs ...string) []string {
+	var ids []string
+	for _, userID := range userIDs {
+		event := events.New(events.UserUpdated, userID, nil)
+		require.NoError(t, stage.Stage(context.Background(), event))
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestOutboxRelayPublishesInOrderPerUser(t *testing.T) {
+	db, _ := testDatabase(t)
+	outboxRepo := repository.NewOutboxRepository(db)
+	sink := &recordingSink{}
+	relay := controllers.NewOutboxRelay(outboxRepo, []outbox.Sink{sink}, controllers.DefaultOutboxPolicy())
+	ids := stageEvents(t, controllers.NewOutbox(outboxRepo), "alice", "alice", "bob", "alice")
+	ctx := context.Background()
+
+	// One message per user and pass, oldest first
+	published, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, published)
+	assert.Equal(t, []string{ids[0], ids[2]}, sink.published)
+
+	for i := 0; i < 2; i++ {
+		_, err = relay.RelayOnce(ctx)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{ids[0], ids[2], ids[1], ids[3]}, sink.published)
+
+	published, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, published)
+}
+
+func TestOutboxRelayRetriesWithBackoff(t *testing.T) {
+	db, fake := testDatabase(t)
+	outboxRepo := repository.NewOutboxRepository(db)
+	policy := controllers.DefaultOutboxPolicy()
+	policy.BaseDelay = 100 * time.Millisecond
+	ids := stageEvents(t, controllers.NewOutbox(outboxRepo), "alice", "alice", "bob")
+	sink := &recordingSink{failing: map[string]bool{ids[0]: true}}
+	relay := controllers.NewOutboxRelay(outboxRepo, []outbox.Sink{sink}, policy)
+	ctx := context.Background()
+
+	// The failing message holds back alice's next one but not bob's
+	_, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ids[2]}, sink.published)
+
+	head := fake.docs("outbox")[0]
+	failures, _ := fakeGet(head, "failures")
+	lastError, _ := fakeGet(head, "last_error")
+	assert.EqualValues(t, 1, failures)
+	assert.Contains(t, lastError, "sink unavailable")
+
+	// Nothing is retried before the backoff expires
+	_, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ids[2]}, sink.published)
+
+	// A second failure doubles the delay
+	time.Sleep(policy.BaseDelay)
+	_, err = relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	head = fake.docs("outbox")[0]
+	failures, _ = fakeGet(head, "failures")
+	next, _ := fakeGet(head, "next_attempt_at")
+	assert.EqualValues(t, 2, failures)
+	assert.InDelta(t, 2*policy.BaseDelay.Milliseconds(), next.(primitive.DateTime).Time().Sub(time.Now()).Milliseconds(), 50)
+
+	delete(sink.failing, ids[0])
+	time.Sleep(2 * policy.BaseDelay)
+	for i := 0; i < 2; i++ {
+		_, err = relay.RelayOnce(ctx)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{ids[2], ids[0], ids[1]}, sink.published)
+}
+
+func TestOutboxRelaySkipsMessagesWaitingForRetry(t *testing.T) {
+	db, _ := testDatabase(t)
+	outboxRepo := repository.NewOutboxRepository(db)
+	policy := controllers.DefaultOutboxPolicy()
+	policy.BatchSize = 2
+	policy.BaseDelay = time.Hour
+	ids := stageEvents(t, controllers.NewOutbox(outboxRepo), "alice", "bob", "carol")
+	sink := &recordingSink{failing: map[string]bool{ids[0]: true, ids[1]: true}}
+	relay := controllers.NewOutboxRelay(outboxRepo, []outbox.Sink{sink}, policy)
+	ctx := context.Background()
+
+	_, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, sink.published)
+
+	// Stalled messages at the head of the outbox do not take up the batch
+	published, err := relay.RelayOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, published)
+	assert.Equal(t, []string{ids[2]}, sink.published)
+}
@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	"iam_backend/password"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func violatedRules(err error) []string {
+	var policyErr *password.PolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+
+	rules := make([]string, len(policyErr.Violations))
+	for i, v := range policyErr.Violations {
+		rules[i] = v.Rule
+	}
+	return rules
+}
+
+func TestPasswordPolicyRules(t *testing.T) {
+	policy := &password.Policy{
+		MinLength:        10,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowUserInfo: true,
+	}
+	user := &models.User{Username: "alice", Email: "alice.smith@example.com"}
+
+	err := policy.Validate("short", user)
+	assert.ElementsMatch(t, []string{
+		password.RuleMinLength,
+		password.RuleUppercase,
+		password.RuleDigit,
+		password.RuleSymbol,
+	}, violatedRules(err))
+
+	err = policy.Validate("Alice.Smith-2024", user)
+	assert.Equal(t, []string{password.RuleUserInfo}, violatedRules(err))
+
+	assert.NoError(t, policy.Validate("Correct-Horse-42", user))
+}
+
+func TestBreachedPasswordList(t *testing.T) {
+	breached := []string{"password", "123456", "letmein", "qwerty", "dragon"}
+	lines := make([]string, len(breached))
+	for i, p := range breached {
+		sum := sha1.Sum([]byte(p))
+		lines[i] = strings.ToUpper(hex.EncodeToString(sum[:])) + ":42"
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600))
+
+	list, err := password.OpenBreachedList(path)
+	assert.NoError(t, err)
+	defer list.Close()
+
+	for _, p := range breached {
+		found, err := list.Contains(p)
+		assert.NoError(t, err)
+		assert.True(t, found, p)
+	}
+
+	found, err := list.Contains("Correct-Horse-42")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	policy := &password.Policy{Breached: list}
+	assert.Equal(t, []string{password.RuleBreached}, violatedRules(policy.Validate("letmein", &models.User{})))
+}
+
+func TestGeneratedPasswordSatisfiesPolicy(t *testing.T) {
+	policy := &password.Policy{
+		MinLength:        16,
+		RequireUppercase: true,
+		RequireLowercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+	}
+
+	generated, err := password.Generate(16)
+	assert.NoError(t, err)
+	assert.Len(t, generated, 16)
+	assert.NoError(t, policy.Validate(generated, &models.User{}))
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	user := &models.User{CreatedAt: time.Now().Add(-48 * time.Hour)}
+	assert.False(t, user.PasswordExpired(0))
+	assert.True(t, user.PasswordExpired(24*time.Hour))
+
+	user.PasswordChangedAt = time.Now().Add(-time.Hour)
+	assert.False(t, user.PasswordExpired(24*time.Hour))
+}
+
+func TestSetTemporaryPasswordHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	user := env.createUser(t, "alice", "Correct-horse-1")
+	ctx := context.Background()
+
+	session, err := env.sessionCtrl.StartSession(ctx, user, "curl/8.0", "127.0.0.1")
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.POST("/users/:id/temporary-password", asUser("admin-1", "admin"), handlers.SetTemporaryPasswordHandler(env.userController, env.sessionCtrl))
+	send := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/"+id+"/temporary-password", nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, send("not-an-id").Code)
+	assert.Equal(t, http.StatusNotFound, send(primitive.NewObjectID().Hex()).Code)
+	env.mongo.failNext("find", "users", 1)
+	assert.Equal(t, http.StatusInternalServerError, send(user.ID.Hex()).Code)
+	assert.NoError(t, env.sessionCtrl.ValidateSession(ctx, session.ID.Hex(), user.ID.Hex()))
+
+	w := send(user.ID.Hex())
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		TemporaryPassword string `json:"temporary_password"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+
+	// The old sessions end and only the temporary password works
+	assert.Error(t, env.sessionCtrl.ValidateSession(ctx, session.ID.Hex(), user.ID.Hex()))
+	stored, err := env.users.FindByID(ctx, user.ID.Hex())
+	require.NoError(t, err)
+	assert.True(t, stored.MustChangePassword)
+	assert.True(t, stored.CheckPasswordHash(body.TemporaryPassword))
+	assert.False(t, stored.CheckPasswordHash("Correct-horse-1"))
+}
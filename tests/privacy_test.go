@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/auditchain"
+	"iam_backend/events"
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+	"iam_backend/reqctx"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPseudonymize(t *testing.T) {
+	user, err := models.NewUser("alice", "alice@example.com", "Str0ng!Passw0rd")
+	if !assert.NoError(t, err) {
+		return
+	}
+	user.ID = primitive.NewObjectID()
+	user.Tenant = "acme"
+	user.ExternalID = "ext-1"
+	user.Attributes = map[string]interface{}{"department": "sales"}
+	user.LinkIdentity("google", "1234", "alice@gmail.com")
+	lastLogin := time.Now()
+	user.LastLogin = &lastLogin
+	id, createdAt := user.ID, user.CreatedAt
+
+	user.Pseudonymize()
+
+	assert.Equal(t, id, user.ID)
+	assert.Equal(t, createdAt, user.CreatedAt)
+	assert.Equal(t, "acme", user.Tenant)
+	assert.Equal(t, "erased-"+id.Hex(), user.Username)
+	assert.Empty(t, user.Email)
+	assert.Empty(t, user.ExternalID)
+	assert.Empty(t, user.PasswordHash)
+	assert.Empty(t, user.Attributes)
+	assert.Empty(t, user.Identities)
+	assert.Empty(t, user.Roles)
+	assert.Nil(t, user.LastLogin)
+	assert.Equal(t, models.StateDeactivated, user.State)
+}
+
+func TestDataExportOmitsSecrets(t *testing.T) {
+	user, err := models.NewUser("alice", "alice@example.com", "Str0ng!Passw0rd")
+	if !assert.NoError(t, err) {
+		return
+	}
+	export := models.DataExport{
+		Profile: user,
+		APIKeys: []models.APIKey{{Name: "deploy", Prefix: "abcd", KeyHash: "secret-hash"}},
+	}
+
+	body, err := json.Marshal(export)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, string(body), user.PasswordHash)
+		assert.NotContains(t, string(body), "secret-hash")
+		assert.Contains(t, string(body), "alice@example.com")
+	}
+}
+
+func TestEraseUserRequiresMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/users/:id/erasure", handlers.EraseUserHandler(nil))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/users/64b7f0c2e4b0a1a2b3c4d5e6/erasure", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestEraseUserRedactsKeptRecords(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	webhooks := repository.NewWebhookRepository(env.db)
+	require.NoError(t, webhooks.EnsureIndexes(context.Background()))
+	dispatcher := controllers.NewWebhookDispatcher(webhooks, controllers.DefaultWebhookPolicy())
+	privacy := controllers.NewPrivacyController(env.userController, env.sessions, env.apiKeys, env.loginAttempts, env.groups, env.outbox, webhooks, repository.NewErasureRepository(env.db))
+	chain := controllers.NewAuditChain(env.audit, repository.NewAuditCheckpointRepository(env.db), nil, nil)
+	ctx := context.Background()
+
+	alice, err := env.userController.RegisterUser(ctx, "alice", "alice@example.com", "Correct-Horse-42")
+	require.NoError(t, err)
+	require.NoError(t, env.userController.UpdateProfile(ctx, alice.ID.Hex(), "alicia", "alicia@example.com", ""))
+	bob, err := env.userController.RegisterUser(ctx, "bob", "bob@example.com", "Correct-Horse-42")
+	require.NoError(t, err)
+	asAlice := reqctx.With(ctx, reqctx.Info{ActorID: alice.ID.Hex(), IP: "203.0.113.7", UserAgent: "alice-laptop"})
+	require.NoError(t, env.userController.UpdateProfile(asAlice, bob.ID.Hex(), "bobby", "bob@example.com", ""))
+	_, err = dispatcher.CreateSubscription(ctx, "https://hooks.example.com/iam", []string{"*"}, "")
+	require.NoError(t, err)
+	require.NoError(t, dispatcher.Publish(ctx, events.New(events.UserUpdated, alice.ID.Hex(), map[string]interface{}{"username": "alicia", "email": "alicia@example.com", "state": models.StateActive})))
+
+	tombstone, err := privacy.EraseUser(ctx, alice.ID.Hex(), models.ErasurePseudonymize)
+	require.NoError(t, err)
+	assert.True(t, tombstone.Complete)
+	assert.Empty(t, tombstone.RetainedAuditEvents)
+
+	personal := []string{"alice", "alicia", "alice@example.com", "alicia@example.com", "203.0.113.7", "alice-laptop"}
+	assertErased := func(record interface{}, what string) {
+		t.Helper()
+		data, err := json.Marshal(record)
+		require.NoError(t, err)
+		for _, value := range personal {
+			assert.NotContains(t, string(data), `"`+value+`"`, what)
+		}
+	}
+
+	// Events still waiting to be published keep their other data
+	pending, err := env.outbox.FindPending(ctx, time.Now(), 100)
+	require.NoError(t, err)
+	redacted := 0
+	for _, message := range pending {
+		assertErased(message.Event, message.Event.Type)
+		if message.Event.Data["username"] == models.ErasedValue {
+			redacted++
+			assert.Equal(t, models.ErasedValue, message.Event.Data["email"])
+			assert.NotNil(t, message.Event.Data["state"])
+		}
+	}
+	assert.Equal(t, 2, redacted)
+
+	deliveries, err := webhooks.FindDeliveries(ctx, repository.DeliveryFilter{}, 100)
+	require.NoError(t, err)
+	require.NotEmpty(t, deliveries)
+	for _, delivery := range deliveries {
+		assert.Equal(t, alice.ID.Hex(), delivery.UserID)
+		for _, value := range personal {
+			assert.NotContains(t, delivery.Payload, `"`+value+`"`)
+		}
+		assert.Contains(t, delivery.Payload, models.ErasedValue)
+	}
+
+	audited, err := env.audit.Find(ctx, repository.AuditFilter{TargetID: alice.ID.Hex()}, 100)
+	require.NoError(t, err)
+	require.Len(t, audited, 4) // registered, updated, deprovisioned and erased
+	for _, event := range audited {
+		assertErased(event, event.Action)
+	}
+
+	// Events the user performed lose the user's IP address and user agent, but keep what they did to others
+	performed, err := env.audit.Find(ctx, repository.AuditFilter{ActorID: alice.ID.Hex()}, 100)
+	require.NoError(t, err)
+	require.Len(t, performed, 1)
+	assertErased(performed[0], performed[0].Action)
+	assert.Equal(t, "bobby", performed[0].Changes["username"].After)
+
+	// Redacted values are replaced by their digests, so the chain still verifies
+	report, err := chain.Verify(ctx, models.DefaultTenant)
+	require.NoError(t, err)
+	assert.True(t, report.Valid, report.Break)
+	assert.Equal(t, int64(6), report.Events)
+}
+
+func TestEraseUserReportsUnredactableAuditEvents(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	privacy := controllers.NewPrivacyController(env.userController, env.sessions, env.apiKeys, env.loginAttempts, env.groups, env.outbox, repository.NewWebhookRepository(env.db), repository.NewErasureRepository(env.db))
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+
+	// An event chained before redaction was supported
+	legacy := &models.AuditEvent{
+		ID:         primitive.NewObjectID(),
+		Tenant:     "legacy",
+		Sequence:   1,
+		Action:     "user.registered",
+		TargetID:   alice.ID.Hex(),
+		Outcome:    models.AuditSuccess,
+		Details:    map[string]interface{}{"username": "alice"},
+		OccurredAt: time.Now(),
+	}
+	data, err := bson.Marshal(legacy)
+	require.NoError(t, err)
+	doc, _, err := auditchain.Seal(data)
+	require.NoError(t, err)
+	_, err = env.db.Database.Collection("audit_events").InsertOne(ctx, doc)
+	require.NoError(t, err)
+
+	tombstone, err := privacy.EraseUser(ctx, alice.ID.Hex(), models.ErasureDelete)
+	require.NoError(t, err)
+	assert.False(t, tombstone.Complete)
+	assert.Equal(t, []primitive.ObjectID{legacy.ID}, tombstone.RetainedAuditEvents)
+
+	stored, err := privacy.GetTombstone(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.False(t, stored.Complete)
+	assert.Equal(t, []primitive.ObjectID{legacy.ID}, stored.RetainedAuditEvents)
+
+	erased, err := env.audit.Find(ctx, repository.AuditFilter{Action: controllers.AuditUserErased}, 1)
+	require.NoError(t, err)
+	require.Len(t, erased, 1)
+	assert.EqualValues(t, 1, erased[0].Details["retained_audit_events"])
+}
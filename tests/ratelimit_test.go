@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/middleware"
+	"iam_backend/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ratelimit.ParseLimit("10/1m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, limit.Burst)
+	assert.InDelta(t, 10.0/60.0, limit.Rate, 1e-9)
+
+	_, err = ratelimit.ParseLimit("ten/1m")
+	assert.Error(t, err)
+
+	limit, err = ratelimit.ParseLimit("")
+	assert.NoError(t, err)
+	assert.False(t, limit.Enabled())
+}
+
+func TestMemoryStoreTokenBucket(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.Limit{Rate: 1, Burst: 2}
+
+	first, _ := store.Take(context.Background(), "k", limit)
+	second, _ := store.Take(context.Background(), "k", limit)
+	third, _ := store.Take(context.Background(), "k", limit)
+
+	assert.True(t, first.Allowed)
+	assert.Equal(t, 1, first.Remaining)
+	assert.True(t, second.Allowed)
+	assert.False(t, third.Allowed)
+	assert.True(t, third.RetryAfter > 0 && third.RetryAfter <= time.Second)
+}
+
+func TestRateLimitMiddlewareByUsername(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := middleware.NewRateLimiter(ratelimit.NewMemoryStore(), map[string]middleware.RouteLimit{
+		"login": {PerUsername: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+	})
+
+	r := gin.New()
+	r.POST("/login", limiter.Limit("login"), func(c *gin.Context) {
+		var body struct {
+			Username string `json:"username"`
+		}
+		assert.NoError(t, c.ShouldBindJSON(&body))
+		c.String(http.StatusOK, body.Username)
+	})
+
+	send := func(username string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"`+username+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	w = send("Alice")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	w = send("bob")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRateLimitMiddlewareByIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newRouter := func(proxies ...string) *gin.Engine {
+		limiter := middleware.NewRateLimiter(ratelimit.NewMemoryStore(), map[string]middleware.RouteLimit{
+			"login": {PerIP: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+		})
+		assert.NoError(t, limiter.TrustProxies(proxies...))
+
+		r := gin.New()
+		r.POST("/login", limiter.Limit("login"), func(c *gin.Context) { c.Status(http.StatusOK) })
+		return r
+	}
+	send := func(r *gin.Engine, remoteAddr, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Without trusted proxies a forged X-Forwarded-For does not get a fresh bucket
+	r := newRouter()
+	assert.Equal(t, http.StatusOK, send(r, "203.0.113.7:1234", "198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "203.0.113.7:1234", "198.51.100.2"))
+	assert.Equal(t, http.StatusOK, send(r, "203.0.113.8:1234", ""))
+
+	// Behind a trusted proxy each client is limited by the address the proxy reports
+	r = newRouter("10.0.0.0/8")
+	assert.Equal(t, http.StatusOK, send(r, "10.0.0.1:1234", "198.51.100.1"))
+	assert.Equal(t, http.StatusOK, send(r, "10.0.0.1:1234", "198.51.100.2"))
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "10.0.0.2:1234", "198.51.100.1, 10.0.0.3"))
+	// Addresses the client prepends before the proxy's are ignored
+	assert.Equal(t, http.StatusTooManyRequests, send(r, "10.0.0.1:1234", "192.0.2.9, 198.51.100.2"))
+
+	limiter := middleware.NewRateLimiter(ratelimit.NewMemoryStore(), nil)
+	assert.Error(t, limiter.TrustProxies("not-an-address"))
+}
+
+func TestRateLimitMiddlewareSkipsLargeBodies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := middleware.NewRateLimiter(ratelimit.NewMemoryStore(), map[string]middleware.RouteLimit{
+		"login": {PerUsername: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+	})
+
+	r := gin.New()
+	r.POST("/login", limiter.Limit("login"), func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		assert.NoError(t, err)
+		c.String(http.StatusOK, strconv.Itoa(len(body)))
+	})
+
+	body := `{"username":"alice","padding":"` + strings.Repeat("x", 1<<20) + `"}`
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body)))
+
+		// The body is too large to search for a username, but reaches the handler intact
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, strconv.Itoa(len(body)), w.Body.String())
+	}
+}
@@ -0,0 +1,23 @@
+package tests
+
+import (
+	"testing"
+
+	"iam_backend/middleware"
+	"iam_backend/ratelimit"
+	"iam_backend/router"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupRouterRegistersRoutes(t *testing.T) {
+	deps := router.Dependencies{
+		Authenticator: middleware.NewAuthenticator(nil, nil, nil, nil),
+		Limiter:       middleware.NewRateLimiter(ratelimit.NewMemoryStore(), nil),
+	}
+
+	// Conflicting route patterns panic when registered
+	assert.NotPanics(t, func() {
+		router.SetupRouter(deps)
+	})
+}
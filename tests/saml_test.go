@@ -0,0 +1,271 @@
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	"iam_backend/ratelimit"
+	"iam_backend/router"
+	"iam_backend/saml"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// selfSigned returns a key and self-signed certificate, PEM encoded as well as parsed
+func selfSigned(t *testing.T, name string) (*rsa.PrivateKey, *x509.Certificate, []byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, cert, certPEM, keyPEM
+}
+
+func newTestIdP(t *testing.T) *saml.IdentityProvider {
+	_, _, certPEM, keyPEM := selfSigned(t, "idp")
+	idp, err := saml.NewIdentityProvider("https://iam.example.com/saml/metadata", "https://iam.example.com/saml/sso", certPEM, keyPEM, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp
+}
+
+func spMetadata(cert *x509.Certificate, signsRequests bool) string {
+	return fmt.Sprintf(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://app.example.com">
+  <md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol" AuthnRequestsSigned="%t">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact" Location="https://app.example.com/saml/artifact" index="0"/>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://app.example.com/saml/acs" index="1"/>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://app.example.com/saml/acs2" index="2" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>`, signsRequests, base64.StdEncoding.EncodeToString(cert.Raw))
+}
+
+func authnRequest(id string) []byte {
+	return []byte(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ` +
+		`ID="` + id + `" Version="2.0" IssueInstant="2024-01-01T00:00:00Z" Destination="https://iam.example.com/saml/sso" ` +
+		`AssertionConsumerServiceURL="https://app.example.com/saml/acs">` +
+		`<saml:Issuer>https://app.example.com</saml:Issuer>` +
+		`<samlp:NameIDPolicy Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"/>` +
+		`</samlp:AuthnRequest>`)
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	idp := newTestIdP(t)
+	metadata, err := idp.Metadata()
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(metadata), `entityID="https://iam.example.com/saml/metadata"`)
+		assert.Contains(t, string(metadata), `Location="https://iam.example.com/saml/sso"`)
+		assert.Contains(t, string(metadata), base64.StdEncoding.EncodeToString(idp.Certificate.Raw))
+	}
+
+	// Identity provider metadata does not describe a service provider
+	_, err = saml.ParseServiceProviderMetadata(metadata)
+	assert.Error(t, err)
+
+	_, cert, _, _ := selfSigned(t, "sp")
+	sp, err := saml.ParseServiceProviderMetadata([]byte(spMetadata(cert, true)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "https://app.example.com", sp.EntityID)
+	assert.True(t, sp.AuthnRequestsSigned)
+	assert.Len(t, sp.AssertionConsumerServices, 2)
+	assert.Equal(t, cert.Raw, sp.Certificates[0].Raw)
+
+	acs, err := sp.AssertionConsumerService("", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://app.example.com/saml/acs2", acs)
+	one := 1
+	acs, err = sp.AssertionConsumerService("", &one)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://app.example.com/saml/acs", acs)
+
+	// Responses are only sent to registered endpoints
+	_, err = sp.AssertionConsumerService("https://evil.example.com/acs", nil)
+	assert.Error(t, err)
+	zero := 0
+	_, err = sp.AssertionConsumerService("", &zero)
+	assert.Error(t, err)
+}
+
+func TestSAMLRedirectRequestSignature(t *testing.T) {
+	spKey, spCert, _, _ := selfSigned(t, "sp")
+	_, otherCert, _, _ := selfSigned(t, "other")
+
+	query, err := saml.EncodeRedirectRequest(authnRequest("_req1"), "https://app.example.com/dashboard", spKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	received, err := saml.ParseRequestQuery(query)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "_req1", received.Request.ID)
+	assert.Equal(t, "https://app.example.com", received.Request.Issuer)
+	assert.Equal(t, "https://app.example.com/saml/acs", received.Request.AssertionConsumerServiceURL)
+	assert.Equal(t, saml.NameIDFormatPersistent, received.Request.NameIDFormat())
+	assert.Equal(t, "https://app.example.com/dashboard", received.RelayState)
+	assert.True(t, received.Signed())
+	assert.NoError(t, received.VerifySignature([]*x509.Certificate{otherCert, spCert}))
+	assert.ErrorIs(t, received.VerifySignature([]*x509.Certificate{otherCert}), saml.ErrInvalidSignature)
+
+	// The relay state is covered by the signature
+	tampered, _ := saml.ParseRequestQuery(strings.Replace(query, "dashboard", "admin", 1))
+	assert.ErrorIs(t, tampered.VerifySignature([]*x509.Certificate{spCert}), saml.ErrInvalidSignature)
+
+	unsignedQuery, _ := saml.EncodeRedirectRequest(authnRequest("_req2"), "", nil)
+	unsigned, err := saml.ParseRequestQuery(unsignedQuery)
+	if assert.NoError(t, err) {
+		assert.False(t, unsigned.Signed())
+		assert.ErrorIs(t, unsigned.VerifySignature([]*x509.Certificate{spCert}), saml.ErrInvalidSignature)
+	}
+
+	_, err = saml.ParseRequestQuery("SAMLRequest=" + base64.StdEncoding.EncodeToString([]byte("not deflated")))
+	assert.Error(t, err)
+}
+
+func TestSAMLResponseSignature(t *testing.T) {
+	idp := newTestIdP(t)
+	response, err := idp.NewResponse(saml.Assertion{
+		Destination:  "https://app.example.com/saml/acs",
+		Audience:     "https://app.example.com",
+		InResponseTo: "_req1",
+		NameID:       "alice@example.com",
+		NameIDFormat: saml.NameIDFormatEmail,
+		SessionIndex: "session-1",
+		Attributes:   []saml.Attribute{{Name: "roles", Values: []string{"admin", "user"}}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc := etree.NewDocument()
+	if !assert.NoError(t, doc.ReadFromBytes(response)) {
+		return
+	}
+	assert.Equal(t, "_req1", doc.Root().SelectAttrValue("InResponseTo", ""))
+	assert.Equal(t, saml.StatusSuccess, doc.FindElement("//StatusCode").SelectAttrValue("Value", ""))
+	assertion := doc.FindElement("//Assertion")
+	if !assert.NotNil(t, assertion) {
+		return
+	}
+
+	// The signature follows the issuer, as the schema requires
+	children := assertion.ChildElements()
+	assert.Equal(t, "Issuer", children[0].Tag)
+	assert.Equal(t, "Signature", children[1].Tag)
+	assert.Equal(t, "https://app.example.com", assertion.FindElement(".//Audience").Text())
+	assert.Equal(t, "_req1", assertion.FindElement(".//SubjectConfirmationData").SelectAttrValue("InResponseTo", ""))
+	assert.Len(t, assertion.FindElements(".//AttributeValue"), 2)
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{idp.Certificate}})
+	_, err = validator.Validate(assertion.Copy())
+	assert.NoError(t, err)
+
+	// Changing the subject breaks the signature
+	tampered := assertion.Copy()
+	tampered.FindElement(".//NameID").SetText("mallory@example.com")
+	_, err = validator.Validate(tampered)
+	assert.Error(t, err)
+
+	// So does a different signing key
+	other := newTestIdP(t)
+	otherValidator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{other.Certificate}})
+	_, err = otherValidator.Validate(assertion.Copy())
+	assert.Error(t, err)
+}
+
+func TestSAMLAttributeMapping(t *testing.T) {
+	user := &models.User{
+		ID:       primitive.NewObjectID(),
+		Username: "alice",
+		Email:    "alice@example.com",
+		Roles:    []string{"user", "admin", "auditor"},
+	}
+	sp := &models.SAMLServiceProvider{
+		Attributes: []models.SAMLAttribute{
+			{Name: "uid", Field: models.SAMLFieldID},
+			{Name: "urn:oid:0.9.2342.19200300.100.1.3", NameFormat: saml.AttributeNameFormatURI, Field: models.SAMLFieldEmail},
+			{Name: "externalId", Field: models.SAMLFieldExternalID},
+			{Name: "memberOf", Field: models.SAMLFieldRoles},
+			{Name: "groups", Field: models.SAMLFieldGroups},
+		},
+		RoleValues: map[string]string{"admin": "Administrators", "auditor": ""},
+	}
+
+	attributes := controllers.SAMLAttributes(sp, user, []models.Group{{DisplayName: "Engineering"}})
+	assert.Equal(t, []saml.Attribute{
+		{Name: "uid", Values: []string{user.ID.Hex()}},
+		{Name: "urn:oid:0.9.2342.19200300.100.1.3", NameFormat: saml.AttributeNameFormatURI, Values: []string{"alice@example.com"}},
+		{Name: "memberOf", Values: []string{"Administrators", "user"}},
+		{Name: "groups", Values: []string{"Engineering"}},
+	}, attributes)
+}
+
+func TestSAMLRoutes(t *testing.T) {
+	deps := router.Dependencies{
+		Authenticator: middleware.NewAuthenticator(nil, nil, nil, nil),
+		Limiter:       middleware.NewRateLimiter(ratelimit.NewMemoryStore(), nil),
+		SAML:          controllers.NewSAMLController(nil, nil, nil, nil, ""),
+	}
+	request := func(r http.Handler, method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// Without a signing key SAML is disabled
+	assert.Equal(t, http.StatusNotFound, request(router.SetupRouter(deps), http.MethodGet, "/saml/metadata").Code)
+
+	deps.SAML = controllers.NewSAMLController(nil, nil, nil, newTestIdP(t), "https://iam.example.com/login")
+	r := router.SetupRouter(deps)
+
+	w := request(r, http.MethodGet, "/saml/metadata")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/samlmetadata+xml")
+
+	// The query is forwarded byte for byte so its signature still verifies
+	query := "SAMLRequest=abc%2Bdef%3D&RelayState=x&SigAlg=alg&Signature=sig"
+	w = request(r, http.MethodGet, "/saml/sso?"+query)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://iam.example.com/login?"+query, w.Header().Get("Location"))
+
+	assert.Equal(t, http.StatusBadRequest, request(r, http.MethodGet, "/saml/sso").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(r, http.MethodPost, "/api/v1/saml/idp-initiated").Code)
+}
@@ -0,0 +1,326 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"iam_backend/events"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	"iam_backend/ratelimit"
+	"iam_backend/router"
+	"iam_backend/scim"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func scimResource(t *testing.T, raw string) map[string]interface{} {
+	var resource map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(raw), &resource))
+	return resource
+}
+
+func TestScimFilter(t *testing.T) {
+	user := scimResource(t, `{
+		"userName": "Alice",
+		"externalId": "00u1",
+		"active": true,
+		"emails": [{"value": "alice@example.com", "type": "work", "primary": true}],
+		"meta": {"created": "2024-05-01T10:00:00Z"}
+	}`)
+
+	matches := map[string]bool{
+		`userName eq "alice"`: true,
+		`USERNAME Eq "ALICE"`: true,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "al"`: true,
+		`userName eq "bob"`:                                  false,
+		`userName ne "bob" and active eq true`:               true,
+		`userName eq "bob" or externalId eq "00u1"`:          true,
+		`not (active eq true)`:                               false,
+		`emails[type eq "work" and value co "@example.com"]`: true,
+		`emails[type eq "home"]`:                             false,
+		`emails.value ew ".com"`:                             true,
+		`meta.created gt "2024-01-01T00:00:00Z"`:             true,
+		`title pr`:                                           false,
+		`externalId pr`:                                      true,
+	}
+	for filter, expected := range matches {
+		expr, err := scim.ParseFilter(filter)
+		if assert.NoError(t, err, filter) {
+			assert.Equal(t, expected, scim.Matches(expr, user), filter)
+		}
+	}
+
+	for _, filter := range []string{``, `userName`, `userName eq`, `userName xx "a"`, `(userName eq "a"`, `userName eq "a" and`, `emails[type eq "work"`} {
+		_, err := scim.ParseFilter(filter)
+		assert.Error(t, err, filter)
+	}
+}
+
+func TestScimPatch(t *testing.T) {
+	user := scimResource(t, `{
+		"userName": "alice",
+		"active": true,
+		"emails": [{"value": "alice@example.com", "type": "work", "primary": true}],
+		"roles": [{"value": "user"}]
+	}`)
+
+	err := scim.ApplyPatch(user, []scim.PatchOperation{
+		// Azure AD sends booleans as strings and capitalizes operations
+		{Op: "Replace", Path: "active", Value: "False"},
+		{Op: "replace", Path: `emails[type eq "work"].value`, Value: "alice@corp.example"},
+		{Op: "add", Path: "roles", Value: []interface{}{map[string]interface{}{"value": "admin"}, map[string]interface{}{"value": "user"}}},
+		{Op: "add", Value: map[string]interface{}{"externalId": "00u1"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, false, user["active"])
+	assert.Equal(t, "alice@corp.example", user["emails"].([]interface{})[0].(map[string]interface{})["value"])
+	assert.Len(t, user["roles"], 2)
+	assert.Equal(t, "00u1", user["externalid"])
+
+	group := scimResource(t, `{"displayName": "Engineering", "members": [{"value": "a"}, {"value": "b"}, {"value": "c"}]}`)
+	err = scim.ApplyPatch(group, []scim.PatchOperation{
+		{Op: "remove", Path: `members[value eq "a"]`},
+		{Op: "remove", Path: "members", Value: []interface{}{map[string]interface{}{"value": "b"}}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{map[string]interface{}{"value": "c"}}, group["members"])
+
+	err = scim.ApplyPatch(group, []scim.PatchOperation{{Op: "replace", Path: `members[value eq "x"].display`, Value: "X"}})
+	var scimErr *scim.Error
+	if assert.ErrorAs(t, err, &scimErr) {
+		assert.Equal(t, scim.ErrNoTarget, scimErr.ScimType)
+	}
+	assert.Error(t, scim.ApplyPatch(group, []scim.PatchOperation{{Op: "move", Path: "members"}}))
+	assert.Error(t, scim.ApplyPatch(group, []scim.PatchOperation{{Op: "remove"}}))
+}
+
+func TestScimDiscoveryRequiresToken(t *testing.T) {
+	r := router.SetupRouter(router.Dependencies{
+		Authenticator: middleware.NewAuthenticator(nil, nil, nil, nil),
+		Limiter:       middleware.NewRateLimiter(ratelimit.NewMemoryStore(), nil),
+		ScimAuth:      middleware.NewScimAuthenticator([]string{"scim-token"}),
+	})
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/scim/v2/ServiceProviderConfig", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, scim.ContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), scim.ErrorSchema)
+
+	w = get("/scim/v2/ServiceProviderConfig", "scim-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"patch":{"supported":true}`)
+
+	w = get("/scim/v2/ResourceTypes", "scim-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list scim.ListResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.EqualValues(t, 2, list.TotalResults)
+
+	w = get("/scim/v2/Schemas/"+scim.GroupSchema, "scim-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusNotFound, get("/scim/v2/Schemas/unknown", "scim-token").Code)
+}
+
+func TestScimReplaceUserRoles(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+
+	created, err := env.scim.CreateUser(ctx, &scim.User{
+		UserName: "alice",
+		Emails:   []scim.MultiValued{{Value: "alice@example.com", Primary: true}},
+		Roles:    []scim.MultiValued{{Value: "user"}, {Value: "admin"}},
+	})
+	require.NoError(t, err)
+	roles := func() []string {
+		user, err := env.users.FindByID(ctx, created.ID)
+		require.NoError(t, err)
+		return user.Roles
+	}
+
+	// Without the roles attribute the roles are kept
+	replacement := *created
+	replacement.Roles = nil
+	_, err = env.scim.ReplaceUser(ctx, created.ID, &replacement)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user", "admin"}, roles())
+
+	// An empty list removes them all
+	replacement.Roles = []scim.MultiValued{}
+	_, err = env.scim.ReplaceUser(ctx, created.ID, &replacement)
+	assert.NoError(t, err)
+	assert.Empty(t, roles())
+
+	replacement.Roles = []scim.MultiValued{{Value: "user"}}
+	_, err = env.scim.ReplaceUser(ctx, created.ID, &replacement)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user"}, roles())
+
+	// So does a patch removing every role
+	_, err = env.scim.PatchUser(ctx, created.ID, []scim.PatchOperation{{Op: "remove", Path: "roles"}})
+	assert.NoError(t, err)
+	assert.Empty(t, roles())
+
+	_, err = env.scim.PatchUser(ctx, created.ID, []scim.PatchOperation{{Op: "add", Path: "roles", Value: []interface{}{map[string]interface{}{"value": "auditor"}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"auditor"}, roles())
+	_, err = env.scim.PatchUser(ctx, created.ID, []scim.PatchOperation{{Op: "remove", Path: `roles[value eq "auditor"]`}})
+	assert.NoError(t, err)
+	assert.Empty(t, roles())
+}
+
+func TestScimReplaceUserAppliesAllOrNothing(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+
+	created, err := env.scim.CreateUser(ctx, &scim.User{
+		UserName: "alice",
+		Emails:   []scim.MultiValued{{Value: "alice@example.com", Primary: true}},
+		Roles:    []scim.MultiValued{{Value: "user"}},
+	})
+	require.NoError(t, err)
+	staged := len(env.mongo.docs("outbox"))
+
+	// The password is rejected after the profile, roles and status were changed in memory
+	replacement := *created
+	replacement.UserName = "alicia"
+	replacement.Roles = []scim.MultiValued{{Value: "admin"}}
+	replacement.Active = boolPtr(false)
+	replacement.Password = "short"
+	_, err = env.scim.ReplaceUser(ctx, created.ID, &replacement)
+	var scimErr *scim.Error
+	require.ErrorAs(t, err, &scimErr)
+	assert.Equal(t, http.StatusBadRequest, scimErr.Status)
+
+	stored, err := env.users.FindByID(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", stored.Username)
+	assert.Equal(t, []string{"user"}, stored.Roles)
+	assert.True(t, stored.IsActive())
+	assert.Len(t, env.mongo.docs("outbox"), staged)
+
+	// A valid replacement is saved with an event for each part that changed
+	replacement.Password = "Correct-Horse-43"
+	_, err = env.scim.ReplaceUser(ctx, created.ID, &replacement)
+	require.NoError(t, err)
+	stored, err = env.users.FindByID(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "alicia", stored.Username)
+	assert.Equal(t, []string{"admin"}, stored.Roles)
+	assert.Equal(t, models.StateDeactivated, stored.State)
+	var types []string
+	for _, doc := range env.mongo.docs("outbox")[staged:] {
+		types = append(types, doc.Map()["event"].(bson.D).Map()["type"].(string))
+	}
+	// followed by the deprovisioning of the deactivated user
+	assert.Equal(t, []string{events.UserUpdated, events.UserPasswordChanged, events.UserRolesUpdated, events.UserDeactivated, events.UserDeprovisioned}, types)
+}
+
+func TestScimActiveOnlyTogglesDeactivation(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+
+	created, err := env.scim.CreateUser(ctx, &scim.User{
+		UserName: "alice",
+		Emails:   []scim.MultiValued{{Value: "alice@example.com", Primary: true}},
+	})
+	require.NoError(t, err)
+	state := func() string {
+		user, err := env.users.FindByID(ctx, created.ID)
+		require.NoError(t, err)
+		return user.State
+	}
+	replace := func(active bool) error {
+		replacement := *created
+		replacement.Active = boolPtr(active)
+		_, err := env.scim.ReplaceUser(ctx, created.ID, &replacement)
+		return err
+	}
+
+	require.NoError(t, replace(false))
+	assert.Equal(t, models.StateDeactivated, state())
+	require.NoError(t, replace(true))
+	assert.Equal(t, models.StateActive, state())
+
+	// Users an administrator blocked stay blocked: marking them inactive changes nothing, and
+	// marking them active is refused
+	for _, blocked := range []string{models.StateSuspended, models.StateLocked} {
+		require.NoError(t, env.userController.ChangeState(ctx, created.ID, blocked, "blocked by an administrator"))
+
+		require.NoError(t, replace(false))
+		assert.Equal(t, blocked, state())
+
+		err := replace(true)
+		var scimErr *scim.Error
+		require.ErrorAs(t, err, &scimErr, blocked)
+		assert.Equal(t, http.StatusConflict, scimErr.Status)
+		assert.Equal(t, blocked, state())
+
+		require.NoError(t, env.userController.ReactivateUser(ctx, created.ID, "cleared"))
+	}
+}
+
+func TestScimGroupsKeepSuspendedMembers(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	bob := env.createUser(t, "bob", "Correct-Horse-42")
+	carol := env.createUser(t, "carol", "Correct-Horse-42")
+	created, err := env.scim.CreateGroup(ctx, &scim.Group{DisplayName: "Sales", Members: []scim.Reference{{Value: alice.ID.Hex()}, {Value: bob.ID.Hex()}}})
+	require.NoError(t, err)
+	groupID, err := primitive.ObjectIDFromHex(created.ID)
+	require.NoError(t, err)
+	require.NoError(t, env.userController.DeactivateUser(ctx, alice.ID.Hex(), "on leave"))
+
+	// The suspended member is still listed, so a patch built from the group keeps the membership suspended
+	group, err := env.scim.GetGroup(ctx, created.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{alice.ID.Hex(), bob.ID.Hex()}, scimMemberIDs(group))
+	_, err = env.scim.PatchGroup(ctx, created.ID, []scim.PatchOperation{{Op: "add", Path: "members", Value: []interface{}{map[string]interface{}{"value": carol.ID.Hex()}}}})
+	require.NoError(t, err)
+	stored, err := env.groups.FindByID(ctx, groupID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []primitive.ObjectID{bob.ID, carol.ID}, stored.Members)
+	assert.Equal(t, []primitive.ObjectID{alice.ID}, stored.SuspendedMembers)
+
+	// Removing the member drops the suspended membership, so reactivation does not restore it
+	_, err = env.scim.PatchGroup(ctx, created.ID, []scim.PatchOperation{{Op: "remove", Path: `members[value eq "` + alice.ID.Hex() + `"]`}})
+	require.NoError(t, err)
+	require.NoError(t, env.userController.ReactivateUser(ctx, alice.ID.Hex(), "back"))
+	stored, err = env.groups.FindByID(ctx, stored.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []primitive.ObjectID{bob.ID, carol.ID}, stored.Members)
+	assert.Empty(t, stored.SuspendedMembers)
+
+	// Deleting a user removes them from their groups through deprovisioning
+	require.NoError(t, env.scim.DeleteUser(ctx, bob.ID.Hex()))
+	group, err = env.scim.GetGroup(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{carol.ID.Hex()}, scimMemberIDs(group))
+}
+
+// scimMemberIDs returns the IDs of a SCIM group's members
+func scimMemberIDs(group *scim.Group) []string {
+	ids := []string{}
+	for _, member := range group.Members {
+		ids = append(ids, member.Value)
+	}
+	return ids
+}
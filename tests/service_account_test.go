@@ -0,0 +1,253 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"iam_backend/auth"
+	"iam_backend/handlers"
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewServiceAccount(t *testing.T) {
+	owner := primitive.NewObjectID()
+	account := models.NewServiceAccount("billing-sync", "Nightly export", models.OwnerTypeGroup, owner)
+
+	assert.True(t, account.IsServiceAccount())
+	assert.Equal(t, "svc:billing-sync", account.Username)
+	assert.True(t, account.HasValidUsername())
+	assert.True(t, account.IsActive())
+	assert.Empty(t, account.Roles)
+	assert.Empty(t, account.Email)
+	assert.Empty(t, account.PasswordHash)
+	assert.Equal(t, owner, account.ServiceAccount.OwnerID)
+
+	person, err := models.NewUser("alice", "alice@example.com", "Str0ng!Passw0rd")
+	assert.NoError(t, err)
+	assert.False(t, person.IsServiceAccount())
+}
+
+func TestClientSecret(t *testing.T) {
+	secret, err := auth.NewClientSecret()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.GreaterOrEqual(t, len(secret), 43)
+	assert.False(t, auth.IsAPIKey(secret))
+
+	hash := auth.HashAPIKey(secret)
+	assert.True(t, auth.APIKeyMatches(secret, hash))
+	assert.False(t, auth.APIKeyMatches(secret+"x", hash))
+
+	other, _ := auth.NewClientSecret()
+	assert.NotEqual(t, secret, other)
+}
+
+func TestClientCredentialsTokenRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/oauth/token", handlers.ClientCredentialsTokenHandler(nil, nil, nil))
+
+	send := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(url.Values{"grant_type": {"password"}, "client_id": {"id"}, "client_secret": {"secret"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unsupported_grant_type")
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	w = send(url.Values{"grant_type": {"client_credentials"}, "client_id": {"id"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_request")
+}
+
+// stringPtr returns a pointer to s, for optional fields
+func stringPtr(s string) *string { return &s }
+
+// boolPtr returns a pointer to b, for optional fields
+func boolPtr(b bool) *bool { return &b }
+
+// claimsOf returns the claims of a signed-in user with the given roles
+func claimsOf(user *models.User, roles ...string) *auth.Claims {
+	claims := &auth.Claims{Roles: roles}
+	claims.Subject = user.ID.Hex()
+	return claims
+}
+
+func TestServiceAccountAuthorization(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	owner := env.createUser(t, "owner", "Correct-Horse-42")
+	member := env.createUser(t, "member", "Correct-Horse-42")
+	stranger := env.createUser(t, "stranger", "Correct-Horse-42")
+	admin := env.createUser(t, "admin", "Correct-Horse-42")
+	group := &models.Group{DisplayName: "Billing", Members: []primitive.ObjectID{member.ID}}
+	require.NoError(t, env.groups.Create(ctx, group))
+
+	// Only admins can give an account to someone else or to a group they are not in
+	_, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(stranger), "sync", "", models.OwnerTypeUser, owner.ID.Hex())
+	assert.ErrorIs(t, err, controllers.ErrNotServiceAccountOwner)
+	_, err = env.serviceAccts.CreateServiceAccount(ctx, claimsOf(stranger), "sync", "", models.OwnerTypeGroup, group.ID.Hex())
+	assert.ErrorIs(t, err, controllers.ErrNotServiceAccountOwner)
+
+	owned, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(owner), "owned", "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, owner.ID, owned.ServiceAccount.OwnerID)
+	grouped, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(member), "grouped", "", models.OwnerTypeGroup, group.ID.Hex())
+	require.NoError(t, err)
+	assigned, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(admin, "admin"), "assigned", "", models.OwnerTypeUser, owner.ID.Hex())
+	require.NoError(t, err)
+
+	cases := []struct {
+		actor    *auth.Claims
+		account  *models.User
+		allowed  bool
+		describe string
+	}{
+		{claimsOf(owner), owned, true, "owner"},
+		{claimsOf(owner), assigned, true, "owner of an account an admin assigned"},
+		{claimsOf(member), grouped, true, "member of the owning group"},
+		{claimsOf(admin, "admin"), grouped, true, "admin"},
+		{claimsOf(stranger), owned, false, "another user"},
+		{claimsOf(owner), grouped, false, "user outside the owning group"},
+	}
+	for _, tc := range cases {
+		_, err := env.serviceAccts.GetServiceAccount(ctx, tc.actor, tc.account.ID.Hex())
+		_, rotateErr := env.serviceAccts.RotateClientSecret(ctx, tc.actor, tc.account.ID.Hex())
+		if tc.allowed {
+			assert.NoError(t, err, tc.describe)
+			assert.NoError(t, rotateErr, tc.describe)
+		} else {
+			assert.ErrorIs(t, err, controllers.ErrNotServiceAccountOwner, tc.describe)
+			assert.ErrorIs(t, rotateErr, controllers.ErrNotServiceAccountOwner, tc.describe)
+		}
+	}
+
+	// Deleting is refused to others, and people are not service accounts
+	assert.ErrorIs(t, env.serviceAccts.DeleteServiceAccount(ctx, claimsOf(stranger), owned.ID.Hex()), controllers.ErrNotServiceAccountOwner)
+	_, err = env.serviceAccts.GetServiceAccount(ctx, claimsOf(admin, "admin"), owner.ID.Hex())
+	assert.ErrorIs(t, err, controllers.ErrServiceAccountNotFound)
+
+	listed, err := env.serviceAccts.ListServiceAccounts(ctx, claimsOf(member))
+	require.NoError(t, err)
+	if assert.Len(t, listed, 1) {
+		assert.Equal(t, grouped.ID, listed[0].ID)
+	}
+	listed, err = env.serviceAccts.ListServiceAccounts(ctx, claimsOf(admin, "admin"))
+	require.NoError(t, err)
+	assert.Len(t, listed, 3)
+
+	assert.NoError(t, env.serviceAccts.DeleteServiceAccount(ctx, claimsOf(owner), owned.ID.Hex()))
+	_, err = env.serviceAccts.GetServiceAccount(ctx, claimsOf(owner), owned.ID.Hex())
+	assert.ErrorIs(t, err, controllers.ErrServiceAccountNotFound)
+}
+
+func TestServiceAccountClientCredentials(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	owner := env.createUser(t, "owner", "Correct-Horse-42")
+	account, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(owner), "sync", "", "", "")
+	require.NoError(t, err)
+	id := account.ID.Hex()
+
+	// Without a secret the account cannot authenticate at all
+	_, err = env.serviceAccts.AuthenticateClient(ctx, id, "")
+	assert.ErrorIs(t, err, controllers.ErrInvalidClient)
+
+	secret, err := env.serviceAccts.RotateClientSecret(ctx, claimsOf(owner), id)
+	require.NoError(t, err)
+	result, err := env.serviceAccts.AuthenticateClient(ctx, id, secret)
+	if assert.NoError(t, err) {
+		assert.Equal(t, account.ID, result.User.ID)
+	}
+	_, err = env.serviceAccts.AuthenticateClient(ctx, id, secret+"x")
+	assert.ErrorIs(t, err, controllers.ErrInvalidClient)
+	_, err = env.serviceAccts.AuthenticateClient(ctx, owner.ID.Hex(), secret)
+	assert.ErrorIs(t, err, controllers.ErrInvalidClient)
+	_, err = env.serviceAccts.AuthenticateClient(ctx, "not-an-id", secret)
+	assert.ErrorIs(t, err, controllers.ErrInvalidClient)
+
+	// Rotating the secret ends the sessions started with the previous one
+	session := models.NewSession(account.ID, "", "", "127.0.0.1", time.Hour)
+	require.NoError(t, env.sessions.Create(ctx, session))
+	rotated, err := env.serviceAccts.RotateClientSecret(ctx, claimsOf(owner), id)
+	require.NoError(t, err)
+	_, err = env.serviceAccts.AuthenticateClient(ctx, id, secret)
+	assert.ErrorIs(t, err, controllers.ErrInvalidClient)
+	_, err = env.serviceAccts.AuthenticateClient(ctx, id, rotated)
+	assert.NoError(t, err)
+	stored, err := env.sessions.FindByID(ctx, session.ID.Hex())
+	require.NoError(t, err)
+	assert.NotNil(t, stored.RevokedAt)
+
+	// A deactivated account is refused even with the right secret
+	require.NoError(t, env.userController.ChangeState(ctx, id, models.StateDeactivated, "retired"))
+	_, err = env.serviceAccts.AuthenticateClient(ctx, id, rotated)
+	assert.ErrorIs(t, err, controllers.ErrInvalidClient)
+}
+
+func TestServiceAccountBindRoles(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	owner := env.createUser(t, "owner", "Correct-Horse-42")
+	account, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(owner), "sync", "", "", "")
+	require.NoError(t, err)
+	assert.Empty(t, account.Roles)
+
+	require.NoError(t, env.serviceAccts.BindRoles(ctx, account.ID.Hex(), []string{"reader", "exporter"}))
+	stored, err := env.users.FindByID(ctx, account.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reader", "exporter"}, stored.Roles)
+
+	// Roles of people are not changed through service accounts
+	assert.ErrorIs(t, env.serviceAccts.BindRoles(ctx, owner.ID.Hex(), []string{"admin"}), controllers.ErrServiceAccountNotFound)
+	assert.ErrorIs(t, env.serviceAccts.BindRoles(ctx, primitive.NewObjectID().Hex(), []string{"admin"}), controllers.ErrServiceAccountNotFound)
+}
+
+func TestServiceAccountUsernamesAreReserved(t *testing.T) {
+	env := newTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	owner := env.createUser(t, "owner", "Correct-Horse-42")
+
+	account, err := env.serviceAccts.CreateServiceAccount(ctx, claimsOf(owner), "alice", "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, models.ServiceAccountPrefix+"alice", account.Username)
+
+	// The account does not take the name of a person who registers later, and people cannot take its name
+	_, err = env.userController.RegisterUser(ctx, "alice", "alice@example.com", "Correct-Horse-42")
+	assert.NoError(t, err)
+	_, err = env.userController.RegisterUser(ctx, "SVC:bob", "bob@example.com", "Correct-Horse-42")
+	assert.ErrorIs(t, err, controllers.ErrReservedUsername)
+	assert.ErrorIs(t, err, repository.ErrUserExists)
+	assert.ErrorIs(t, env.userController.UpdateOwnProfile(ctx, owner.ID.Hex(), "Correct-Horse-42", stringPtr("svc:owner"), nil, nil), controllers.ErrReservedUsername)
+	assert.ErrorIs(t, env.userController.UpdateProfile(ctx, account.ID.Hex(), "renamed", "", ""), controllers.ErrReservedUsername)
+
+	// Accounts created before names were reserved are renamed once
+	legacy := models.NewServiceAccount("legacy", "", models.OwnerTypeUser, owner.ID)
+	legacy.Username = "legacy"
+	require.NoError(t, env.users.Create(ctx, legacy))
+	require.NoError(t, env.users.MigrateServiceAccountUsernames(ctx, models.ServiceAccountPrefix))
+	require.NoError(t, env.users.MigrateServiceAccountUsernames(ctx, models.ServiceAccountPrefix))
+	for id, username := range map[string]string{legacy.ID.Hex(): "svc:legacy", account.ID.Hex(): "svc:alice", owner.ID.Hex(): "owner"} {
+		stored, err := env.users.FindByID(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, username, stored.Username)
+	}
+}
@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"iam_backend/auth"
+	database "iam_backend/db"
+	"iam_backend/events"
+	"iam_backend/hashing"
+	controllers "iam_backend/jwork"
+	"iam_backend/middleware"
+	models "iam_backend/models"
+	"iam_backend/password"
+	repository "iam_backend/repo"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// testEnv wires the repositories and controllers the way main does, against a fake database
+type testEnv struct {
+	db    *database.Database
+	mongo *fakeMongo
+
+	users          *repository.UserRepository
+	loginAttempts  *repository.LoginAttemptRepository
+	sessions       *repository.SessionRepository
+	audit          *repository.AuditRepository
+	outbox         *repository.OutboxRepository
+	groups         *repository.GroupRepository
+	apiKeys        *repository.APIKeyRepository
+	attributes     *repository.AttributeSchemaRepository
+	deprovisioning *repository.DeprovisioningRepository
+
+	authRouter     *auth.AuthenticatorRouter
+	loginGuard     *controllers.LoginGuard
+	auditLog       *controllers.AuditLogger
+	sessionCtrl    *controllers.SessionController
+	deprovisioner  *controllers.Deprovisioner
+	userController *controllers.UserController
+	scim           *controllers.ScimController
+	apiKeyCtrl     *controllers.APIKeyController
+	serviceAccts   *controllers.ServiceAccountController
+}
+
+// newTestEnv returns a test environment; the login guard uses policy and logins go through authenticators
+func newTestEnv(t *testing.T, policy controllers.LockoutPolicy, authenticators ...auth.Authenticator) *testEnv {
+	t.Helper()
+	return newTestEnvWith(t, policy, func(*fakeMongo) controllers.Transactor { return controllers.NoTransactor{} }, authenticators...)
+}
+
+// newTransactionalTestEnv returns a test environment whose controllers run their transactions with a
+// fakeTransactor, so that a failed transaction leaves no writes behind
+func newTransactionalTestEnv(t *testing.T, policy controllers.LockoutPolicy) *testEnv {
+	t.Helper()
+	return newTestEnvWith(t, policy, func(fake *fakeMongo) controllers.Transactor { return fakeTransactor{mongo: fake} })
+}
+
+// newTestEnvWith returns a test environment whose controllers run their transactions with the transactor
+// returned by transactor for the fake database
+func newTestEnvWith(t *testing.T, policy controllers.LockoutPolicy, transactor func(*fakeMongo) controllers.Transactor, authenticators ...auth.Authenticator) *testEnv {
+	t.Helper()
+	usePasswordHasher(t, hashing.NewHasher(fastArgon2id()))
+	db, fake := testDatabase(t)
+	ctx := context.Background()
+
+	env := &testEnv{
+		db:             db,
+		mongo:          fake,
+		users:          repository.NewUserRepository(db),
+		loginAttempts:  repository.NewLoginAttemptRepository(db),
+		sessions:       repository.NewSessionRepository(db),
+		audit:          repository.NewAuditRepository(db),
+		outbox:         repository.NewOutboxRepository(db),
+		groups:         repository.NewGroupRepository(db),
+		apiKeys:        repository.NewAPIKeyRepository(db),
+		attributes:     repository.NewAttributeSchemaRepository(db),
+		deprovisioning: repository.NewDeprovisioningRepository(db),
+	}
+	require.NoError(t, env.users.EnsureIndexes(ctx))
+	require.NoError(t, env.groups.EnsureIndexes(ctx))
+	require.NoError(t, env.apiKeys.EnsureIndexes(ctx))
+	require.NoError(t, env.attributes.EnsureIndexes(ctx))
+	require.NoError(t, env.deprovisioning.EnsureIndexes(ctx))
+
+	tx := transactor(fake)
+	outbox := controllers.NewOutbox(env.outbox)
+	env.authRouter = auth.NewAuthenticatorRouter(authenticators...)
+	env.loginGuard = controllers.NewLoginGuard(env.loginAttempts, policy, events.NewBus())
+	env.auditLog = controllers.NewAuditLogger(env.audit)
+	env.sessionCtrl = controllers.NewSessionController(env.sessions, controllers.DefaultSessionPolicy())
+	env.deprovisioner = controllers.NewDeprovisioner(env.deprovisioning, env.users, env.sessions, env.apiKeys, env.groups, outbox, tx, env.auditLog, controllers.DefaultDeprovisionPolicy())
+	env.userController = controllers.NewUserController(env.users, env.loginGuard, password.DefaultPolicy(), env.auditLog, outbox, tx, env.authRouter, env.attributes, env.deprovisioner)
+	env.scim = controllers.NewScimController(env.userController, env.users, env.groups, env.auditLog)
+	env.apiKeyCtrl = controllers.NewAPIKeyController(env.apiKeys, env.users, env.auditLog)
+	env.serviceAccts = controllers.NewServiceAccountController(env.userController, env.groups, env.apiKeyCtrl, env.sessionCtrl)
+	return env
+}
+
+// createUser stores an active local user with the given password
+func (env *testEnv) createUser(t *testing.T, username, plain string) *models.User {
+	t.Helper()
+	user := &models.User{Username: username, Email: username + "@example.com", Roles: []string{"user"}, State: models.StateActive}
+	require.NoError(t, user.HashPassword(plain))
+	require.NoError(t, env.users.Create(context.Background(), user))
+	return user
+}
+
+// asUser is middleware authenticating every request as the given user, as RequireAuth would
+func asUser(subject string, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := &auth.Claims{Roles: roles}
+		claims.Subject = subject
+		c.Set(middleware.ClaimsKey, claims)
+		c.Next()
+	}
+}
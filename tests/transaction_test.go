@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"iam_backend/events"
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFailedOutboxWriteRollsBackUserChange(t *testing.T) {
+	env := newTransactionalTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+
+	env.mongo.failNext("insert", "outbox", 1)
+	err := env.userController.UpdateProfile(ctx, alice.ID.Hex(), "alicia", "alicia@example.com", "")
+	require.Error(t, err)
+
+	stored, err := env.users.FindByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alice", stored.Username)
+	assert.Equal(t, "alice@example.com", stored.Email)
+	assert.Empty(t, env.mongo.docs("outbox"))
+
+	// The change and its event commit together once the outbox accepts the write
+	require.NoError(t, env.userController.UpdateProfile(ctx, alice.ID.Hex(), "alicia", "alicia@example.com", ""))
+	stored, err = env.users.FindByID(ctx, alice.ID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, "alicia", stored.Username)
+	staged, err := env.db.Database.Collection("outbox").CountDocuments(ctx, bson.M{"event.type": events.UserUpdated, "event.user_id": alice.ID.Hex()})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), staged)
+}
+
+func TestFailedErasureLeavesNothingErased(t *testing.T) {
+	env := newTransactionalTestEnv(t, controllers.DefaultLockoutPolicy())
+	erasures := repository.NewErasureRepository(env.db)
+	privacy := controllers.NewPrivacyController(env.userController, env.sessions, env.apiKeys, env.loginAttempts, env.groups, env.outbox, repository.NewWebhookRepository(env.db), erasures)
+	ctx := context.Background()
+
+	alice, err := env.userController.RegisterUser(ctx, "alice", "alice@example.com", "Correct-Horse-42")
+	require.NoError(t, err)
+	session := models.NewSession(alice.ID, "", "", "127.0.0.1", time.Hour)
+	require.NoError(t, env.sessions.Create(ctx, session))
+
+	// Deleting the user is the last write before the erasure's event is staged
+	env.mongo.failNext("delete", "users", 1)
+	_, err = privacy.EraseUser(ctx, alice.ID.Hex(), models.ErasureDelete)
+	require.Error(t, err)
+
+	_, err = privacy.GetTombstone(ctx, alice.ID.Hex())
+	assert.ErrorIs(t, err, controllers.ErrNotErased)
+	_, err = env.users.FindByID(ctx, alice.ID.Hex())
+	assert.NoError(t, err)
+	sessions, err := env.sessions.FindByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	registered, err := env.audit.Find(ctx, repository.AuditFilter{Action: controllers.AuditUserRegistered, TargetID: alice.ID.Hex()}, 1)
+	require.NoError(t, err)
+	require.Len(t, registered, 1)
+	assert.Equal(t, "alice", registered[0].Details["username"])
+
+	// A retry erases the user from scratch
+	tombstone, err := privacy.EraseUser(ctx, alice.ID.Hex(), models.ErasureDelete)
+	require.NoError(t, err)
+	assert.True(t, tombstone.Complete)
+	sessions, err = env.sessions.FindByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestFailedDeprovisionedEventLeavesStepToRetry(t *testing.T) {
+	env := newTransactionalTestEnv(t, controllers.DefaultLockoutPolicy())
+	ctx := context.Background()
+	alice := env.createUser(t, "alice", "Correct-Horse-42")
+	job := enqueueDeactivation(t, env, alice, "")
+
+	env.mongo.failNext("insert", "outbox", 1)
+	err := env.deprovisioner.Process(ctx, job)
+	assert.ErrorContains(t, err, models.StepEmitEvent)
+
+	// The step's completion was rolled back with the event, so the retry emits it
+	failed := storedJob(t, env, job)
+	assert.Equal(t, models.JobPending, failed.Status)
+	assert.NotContains(t, failed.CompletedSteps, models.StepEmitEvent)
+	assert.Zero(t, deprovisionedEvents(t, env, alice))
+
+	require.NoError(t, env.deprovisioner.Process(ctx, failed))
+	assert.Equal(t, models.JobCompleted, storedJob(t, env, job).Status)
+	assert.Equal(t, int64(1), deprovisionedEvents(t, env, alice))
+}
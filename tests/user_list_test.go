@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	models "iam_backend/models"
+	repository "iam_backend/repo"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// listedUsers stores users whose creation and last login times tie in groups, some never having logged in
+func listedUsers(t *testing.T, users *repository.UserRepository) []models.User {
+	t.Helper()
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	stored := []models.User{}
+	for i := 0; i < 9; i++ {
+		user := models.User{
+			Username:  fmt.Sprintf("user-%d", (i*4)%9),
+			Email:     fmt.Sprintf("u%d@example.com", (i*7)%9),
+			State:     models.StateActive,
+			Roles:     []string{"user"},
+			CreatedAt: base.Add(time.Duration(i/3) * time.Hour),
+		}
+		if i%3 != 0 {
+			lastLogin := base.Add(time.Duration(i%2) * time.Minute)
+			user.LastLogin = &lastLogin
+		}
+		require.NoError(t, users.Create(context.Background(), &user))
+		stored = append(stored, user)
+	}
+	return stored
+}
+
+// compareSortKeys compares the values two users are sorted by, unset values lowest
+func compareSortKeys(a, b models.User, field string) int {
+	switch field {
+	case "username":
+		return strings.Compare(a.Username, b.Username)
+	case "email":
+		return strings.Compare(a.Email, b.Email)
+	case "created_at":
+		return a.CreatedAt.Compare(b.CreatedAt)
+	}
+	switch {
+	case a.LastLogin == nil && b.LastLogin == nil:
+		return 0
+	case a.LastLogin == nil:
+		return -1
+	case b.LastLogin == nil:
+		return 1
+	}
+	return a.LastLogin.Compare(*b.LastLogin)
+}
+
+// expectedOrder returns the IDs of users in the sort order, ties broken by ID in the same direction
+func expectedOrder(users []models.User, order repository.UserSort) []primitive.ObjectID {
+	sorted := append([]models.User{}, users...)
+	sort.Slice(sorted, func(i, j int) bool {
+		c := compareSortKeys(sorted[i], sorted[j], order.Field)
+		if c == 0 {
+			c = bytes.Compare(sorted[i].ID[:], sorted[j].ID[:])
+		}
+		if order.Descending {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	ids := []primitive.ObjectID{}
+	for _, user := range sorted {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+func TestUserListPagesThroughEverySortOrder(t *testing.T) {
+	db, _ := testDatabase(t)
+	users := repository.NewUserRepository(db)
+	ctx := context.Background()
+	stored := listedUsers(t, users)
+
+	for _, field := range []string{"username", "email", "created_at", "last_login"} {
+		for _, descending := range []bool{false, true} {
+			order := repository.UserSort{Field: field, Descending: descending}
+			for _, limit := range []int64{1, 2, 4, 9, 10} {
+				name := fmt.Sprintf("%s limit %d", order, limit)
+
+				// Every user is listed exactly once, in order, whatever the page size
+				listed := []primitive.ObjectID{}
+				cursor := ""
+				for pages := 0; pages <= len(stored); pages++ {
+					page, next, err := users.List(ctx, repository.UserFilter{}, order, cursor, limit)
+					require.NoError(t, err, name)
+					assert.LessOrEqual(t, int64(len(page)), limit, name)
+					for _, user := range page {
+						listed = append(listed, user.ID)
+					}
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+				assert.Equal(t, expectedOrder(stored, order), listed, name)
+			}
+		}
+	}
+}
+
+func TestUserListRejectsCursorOfAnotherSort(t *testing.T) {
+	db, _ := testDatabase(t)
+	users := repository.NewUserRepository(db)
+	ctx := context.Background()
+	listedUsers(t, users)
+
+	_, cursor, err := users.List(ctx, repository.UserFilter{}, repository.UserSort{Field: "last_login"}, "", 2)
+	require.NoError(t, err)
+	require.NotEmpty(t, cursor)
+
+	for _, order := range []repository.UserSort{{Field: "last_login", Descending: true}, {Field: "username"}} {
+		_, _, err = users.List(ctx, repository.UserFilter{}, order, cursor, 2)
+		assert.ErrorIs(t, err, repository.ErrInvalidCursor, order.String())
+	}
+	for _, cursor := range []string{"not base64!", "e30", "eyJzIjoibGFzdF9sb2dpbiIsImlkIjoieCJ9"} {
+		_, _, err = users.List(ctx, repository.UserFilter{}, repository.UserSort{Field: "last_login"}, cursor, 2)
+		assert.ErrorIs(t, err, repository.ErrInvalidCursor, cursor)
+	}
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	controllers "iam_backend/jwork"
+	models "iam_backend/models"
+	"iam_backend/webhook"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	payload := []byte(`{"type":"user.registered"}`)
+	now := time.Now()
+	header := webhook.Sign("whsec_test", now, payload)
+
+	assert.NoError(t, webhook.Verify("whsec_test", header, payload, 5*time.Minute, now))
+	assert.ErrorIs(t, webhook.Verify("whsec_other", header, payload, 5*time.Minute, now), webhook.ErrInvalidSignature)
+	assert.ErrorIs(t, webhook.Verify("whsec_test", header, []byte(`{}`), 5*time.Minute, now), webhook.ErrInvalidSignature)
+	assert.Error(t, webhook.Verify("whsec_test", header, payload, 5*time.Minute, now.Add(time.Hour)))
+}
+
+func TestWebhookSender(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	subscription := &models.WebhookSubscription{URL: server.URL, Secret: "whsec_test"}
+	delivery := &models.WebhookDelivery{EventID: "evt-1", EventType: "user.deactivated", Payload: `{"id":"evt-1"}`}
+	sender := controllers.NewWebhookSender(time.Second)
+
+	attempt := sender.Send(context.Background(), subscription, delivery)
+	assert.Empty(t, attempt.Error)
+	assert.Equal(t, http.StatusNoContent, attempt.StatusCode)
+	assert.Equal(t, "evt-1", received.Header.Get(webhook.EventIDHeader))
+	assert.Equal(t, "user.deactivated", received.Header.Get(webhook.EventTypeHeader))
+	assert.NoError(t, webhook.Verify("whsec_test", received.Header.Get(webhook.SignatureHeader), body, time.Minute, time.Now()))
+
+	status = http.StatusInternalServerError
+	attempt = sender.Send(context.Background(), subscription, delivery)
+	assert.Equal(t, http.StatusInternalServerError, attempt.StatusCode)
+	assert.NotEmpty(t, attempt.Error)
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	policy := controllers.WebhookPolicy{BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+
+	assert.Equal(t, time.Minute, policy.RetryDelay(1))
+	assert.Equal(t, 2*time.Minute, policy.RetryDelay(2))
+	assert.Equal(t, 8*time.Minute, policy.RetryDelay(4))
+	assert.Equal(t, 10*time.Minute, policy.RetryDelay(5))
+}
@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers sent with every webhook request
+const (
+	SignatureHeader = "Webhook-Signature"
+	EventIDHeader   = "Webhook-Id"
+	EventTypeHeader = "Webhook-Event"
+)
+
+// ErrInvalidSignature is returned when a signature header does not match the payload
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign returns the signature header value for a payload sent at the given time.
+// The signature is an HMAC-SHA256 over "<unix timestamp>.<payload>", so a captured request
+// cannot be replayed later with a different timestamp.
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + unix + ",v1=" + hex.EncodeToString(mac(secret, unix, payload))
+}
+
+// Verify checks a signature header against the payload, rejecting signatures older than tolerance
+func Verify(secret, header string, payload []byte, tolerance time.Duration, now time.Time) error {
+	var unix string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			unix = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && now.Sub(time.Unix(seconds, 0)).Abs() > tolerance {
+		return errors.New("webhook signature timestamp is outside the tolerance")
+	}
+
+	expected := mac(secret, unix, payload)
+	for _, signature := range signatures {
+		decoded, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func mac(secret, unix string, payload []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(unix))
+	h.Write([]byte("."))
+	h.Write(payload)
+	return h.Sum(nil)
+}